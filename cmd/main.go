@@ -5,22 +5,39 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/kostik-b/metrics-store/pkg/cluster"
 	"github.com/kostik-b/metrics-store/pkg/datastore"
 	mhandler "github.com/kostik-b/metrics-store/pkg/handler"
+	"github.com/kostik-b/metrics-store/pkg/machines"
+	"github.com/kostik-b/metrics-store/pkg/metadata"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/remote"
+	"github.com/kostik-b/metrics-store/pkg/shard"
+	"github.com/kostik-b/metrics-store/pkg/tiered"
+	"github.com/kostik-b/metrics-store/pkg/validation"
 )
 
 const (
-	readWriteTimeout          = 10
-	shutdownTimeout           = 10
-	defaultListenPort         = 4000
-	defaultMaxRequestBodySize = 1048576
+	readWriteTimeout           = 10
+	shutdownTimeout            = 10
+	defaultListenPort          = 4000
+	defaultMaxRequestBodySize  = 1048576
+	joinTimeout                = 10
+	shardRequestTimeout        = 10
+	defaultHotThreshold        = time.Hour
+	defaultMigrationInterval   = time.Minute
+	defaultSegmentCacheSize    = 16
+	defaultCompactionThreshold = 4
 )
 
 func main() {
@@ -33,32 +50,292 @@ func main() {
 	flag.BoolVar(&debug, "debug", false, "Set to true to enable debug output")
 
 	var maxRequestBodySize int64 = defaultMaxRequestBodySize
-	flag.Int64Var(&maxRequestBodySize, "max-request-body-size", maxRequestBodySize, "Maximum size of request body")
+	flag.Int64Var(&maxRequestBodySize, "max-request-body-size", maxRequestBodySize, "Maximum size of request body, compressed bodies are limited once decompressed as well")
 
 	var allowUnknownFields bool
 	flag.BoolVar(&allowUnknownFields, "allow-unknown-fields", false, "Set to true to allow unknown fields")
 
+	var nodeID string
+	flag.StringVar(&nodeID, "node-id", "", "Id of this node in a raft cluster, clustering is enabled when set")
+
+	var raftAddr string
+	flag.StringVar(&raftAddr, "raft-addr", "", "Address to listen on for raft traffic, e.g. localhost:5000")
+
+	var advertiseAddr string
+	flag.StringVar(&advertiseAddr, "advertise-addr", "", "Address other cluster nodes use to reach the HTTP API of this node (default localhost:<listen-port>)")
+
+	var bootstrap bool
+	flag.BoolVar(&bootstrap, "bootstrap", false, "Set to true to bootstrap a new cluster with this node as its first member")
+
+	var joinAddr string
+	flag.StringVar(&joinAddr, "join", "", "HTTP address of a member of an existing cluster to join")
+
+	var shards string
+	flag.StringVar(&shards, "shards", "", "Comma separated HTTP addresses of backend nodes, runs this node as a router when set")
+
+	var shardBackend bool
+	flag.BoolVar(&shardBackend, "shard-backend", false, "Set to true to serve as a shard of a router, which stores its reports through /internal/entries")
+
+	var internalSecretFile string
+	flag.StringVar(&internalSecretFile, "internal-secret-file", "", "File with the secret shared by the nodes of a cluster or by a router and its shards, required in either mode")
+
+	var dataDir string
+	flag.StringVar(&dataDir, "data-dir", "", "Directory for the cold tier, entries older than hot-threshold are moved there when set. With node-id, directory for the raft log and snapshots instead")
+
+	var hotThreshold time.Duration
+	flag.DurationVar(&hotThreshold, "hot-threshold", defaultHotThreshold, "Age after which entries are moved from memory to the cold tier")
+
+	var migrationInterval time.Duration
+	flag.DurationVar(&migrationInterval, "migration-interval", defaultMigrationInterval, "How often to move entries to the cold tier")
+
+	var segmentCacheSize int
+	flag.IntVar(&segmentCacheSize, "segment-cache-size", defaultSegmentCacheSize, "Number of cold tier segments kept decompressed in memory")
+
+	var compactionThreshold int
+	flag.IntVar(&compactionThreshold, "compaction-threshold", defaultCompactionThreshold, "Number of cold tier segments of similar size which are merged into one")
+
+	var principalHeader string
+	flag.StringVar(&principalHeader, "principal-header", "", "Request header carrying the authenticated user, e.g. set by a reverse proxy, which is recorded with each report")
+
+	var sysTimeLayouts stringList
+	flag.Var(&sysTimeLayouts, "systime-layout", "Go time layout sysTime is parsed with, can be repeated, replaces the default layouts (RFC3339 and Unix timestamps are always accepted)")
+
+	var lenientSysTime bool
+	flag.BoolVar(&lenientSysTime, "lenient-systime", false, "Set to true to accept a sysTime in an unknown format, it is stored as sent")
+
+	var loginPatterns stringList
+	flag.Var(&loginPatterns, "login-pattern", "Regular expression with groups named role and user lastLoggedIn is parsed with, can be repeated, replaces the default patterns")
+
+	var maxLabels int
+	flag.IntVar(&maxLabels, "max-labels", model.DefaultMaxLabels, "Maximum number of labels of a report")
+
+	var maxLabelValueLength int
+	flag.IntVar(&maxLabelValueLength, "max-label-value-length", model.DefaultMaxLabelValueLength, "Maximum length of a label value in characters")
+
+	var metricsMetadataFile string
+	flag.StringVar(&metricsMetadataFile, "metrics-metadata", "", "JSON file describing metrics in addition to the built-in ones, see README")
+
+	var machinesFile string
+	flag.StringVar(&machinesFile, "machines-file", "", "JSON file the descriptions of machines set with PUT /machines/{id} are kept in, they are only kept in memory if not set")
+
+	var defaultPageSize int
+	flag.IntVar(&defaultPageSize, "default-page-size", mhandler.DefaultPageSize, "Number of reports returned by GET /metrics without a limit")
+
+	var maxPageSize int
+	flag.IntVar(&maxPageSize, "max-page-size", mhandler.DefaultMaxPageSize, "Largest limit GET /metrics can ask for")
+
+	var maxBatchSize int
+	flag.IntVar(&maxBatchSize, "max-batch-size", mhandler.DefaultMaxBatchSize, "Maximum number of reports a POST /metrics request can carry")
+
+	var validationRulesFile string
+	flag.StringVar(&validationRulesFile, "validation-rules", "", "YAML or JSON file with validation rules for reports, reloaded on SIGHUP, see README")
+
 	flag.Parse()
 
+	if len(sysTimeLayouts) > 0 {
+		model.SysTimeLayouts = sysTimeLayouts
+	}
+
+	if len(loginPatterns) > 0 {
+		if err := model.SetLoginPatterns(loginPatterns); err != nil {
+			log.Printf("ERROR: %v\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
 	if listenPortAsInt < 1 || listenPortAsInt > 65535 {
 		log.Printf("ERROR: port specified is out of range: %d\n", listenPortAsInt)
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	if maxLabels < 0 || maxLabelValueLength < 0 {
+		log.Println("ERROR: max-labels and max-label-value-length cannot be negative")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if defaultPageSize < 1 || maxPageSize < defaultPageSize {
+		log.Println("ERROR: default-page-size has to be at least 1 and max-page-size at least default-page-size")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if maxBatchSize < 1 {
+		log.Println("ERROR: max-batch-size has to be at least 1")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
 	log.Printf("Using the listen port %d\n", listenPortAsInt)
 	listenPortAsString := strconv.Itoa(listenPortAsInt)
 
-	// create server
-	metricsDatastore := datastore.GetInstance()
+	if advertiseAddr == "" {
+		advertiseAddr = "localhost:" + listenPortAsString
+	}
 
-	// create handler
-	metricsHandler := mhandler.NewMetricsHandler(metricsDatastore, debug, allowUnknownFields, maxRequestBodySize)
+	var metricsFromFile []metadata.Metric
+	if metricsMetadataFile != "" {
+		var err error
+		if metricsFromFile, err = metadata.LoadFile(metricsMetadataFile); err != nil {
+			log.Fatalf("ERROR: could not load metrics metadata: %v", err)
+		}
+	}
+
+	metricsRegistry, err := metadata.NewRegistry(metricsFromFile...)
+	if err != nil {
+		log.Fatalf("ERROR: could not load metrics metadata from %s: %v", metricsMetadataFile, err)
+	}
+
+	var validationRules *validation.RulesFile
+	if validationRulesFile != "" {
+		if validationRules, err = validation.LoadRulesFile(validationRulesFile); err != nil {
+			log.Fatalf("ERROR: could not load validation rules: %v", err)
+		}
+
+		go reloadOnHangup(validationRules)
+	}
+
+	machineInfos, err := machines.NewInfoStore(machinesFile)
+	if err != nil {
+		log.Fatalf("ERROR: could not load descriptions of machines: %v", err)
+	}
 
-	// create request multiplexer and register handler with it
+	// create request multiplexer
 	serveMux := http.NewServeMux()
-	serveMux.Handle("/metrics", metricsHandler)
 
+	// create datastore, either a local one, a tiered one, a router or a cluster node
+	var metricsDatastore datastore.DatastoreInterface = datastore.GetInstance()
+
+	if shards != "" && nodeID != "" {
+		log.Println("ERROR: shards and node-id cannot be set at the same time")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if dataDir != "" && shards != "" {
+		log.Println("ERROR: data-dir cannot be used together with shards")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if shardBackend && shards != "" {
+		log.Println("ERROR: shard-backend and shards cannot be set at the same time")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// only nodes which talk to each other need the secret, it keeps clients from storing entries under keys they choose
+	var internalSecret string
+	if nodeID != "" || shards != "" || shardBackend {
+		if internalSecretFile == "" {
+			log.Println("ERROR: internal-secret-file has to be specified when node-id, shards or shard-backend is set")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		if internalSecret, err = readSecret(internalSecretFile); err != nil {
+			log.Fatalf("ERROR: could not read internal secret: %v", err)
+		}
+	}
+
+	// a cluster node keeps the raft log in data-dir, its datastore is rebuilt from it
+	var tieredDatastore *tiered.TieredDatastore
+	if dataDir != "" && nodeID == "" {
+		var err error
+		tieredDatastore, err = tiered.Open(tiered.Config{
+			Dir:                 dataDir,
+			HotThreshold:        hotThreshold,
+			MigrationInterval:   migrationInterval,
+			SegmentCacheSize:    segmentCacheSize,
+			CompactionThreshold: compactionThreshold,
+			Debug:               debug,
+		})
+		if err != nil {
+			log.Fatalf("ERROR: could not open tiered datastore in %s: %v", dataDir, err)
+		}
+
+		log.Printf("Using tiered datastore in %s, hot threshold %s\n", dataDir, hotThreshold)
+
+		metricsDatastore = tieredDatastore
+		serveMux.Handle(tiered.StatsPath, tiered.NewStatsHandler(tieredDatastore))
+	}
+
+	if shards != "" {
+		router := shard.NewRouter(strings.Split(shards, ","), shardRequestTimeout*time.Second, debug)
+		router.SetInternalSecret(internalSecret)
+
+		log.Printf("Running as a router for shards %s\n", shards)
+
+		metricsDatastore = router
+		serveMux.Handle(shard.AdminPath, shard.NewAdminHandler(router, debug))
+	}
+
+	var clusterNode *cluster.Node
+	if nodeID != "" {
+		if raftAddr == "" {
+			log.Println("ERROR: raft-addr has to be specified when node-id is set")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		var err error
+		clusterNode, err = cluster.NewNode(cluster.Config{
+			NodeID:         nodeID,
+			RaftAddr:       raftAddr,
+			APIAddr:        advertiseAddr,
+			Bootstrap:      bootstrap,
+			Debug:          debug,
+			InternalSecret: internalSecret,
+			DataDir:        dataDir,
+		})
+		if err != nil {
+			log.Fatalf("ERROR: could not start cluster node: %v", err)
+		}
+
+		if joinAddr != "" {
+			member := cluster.Member{ID: nodeID, RaftAddr: raftAddr, APIAddr: advertiseAddr}
+			if err := cluster.JoinCluster(joinAddr, member, internalSecret, joinTimeout*time.Second); err != nil {
+				log.Fatalf("ERROR: could not join cluster via %s: %v", joinAddr, err)
+			}
+		}
+
+		log.Printf("Running as cluster node %s, raft address %s\n", nodeID, raftAddr)
+
+		metricsDatastore = clusterNode
+		serveMux.Handle(cluster.AdminPath, cluster.NewAdminHandler(clusterNode, debug))
+	}
+
+	// create handlers and register them with the multiplexer
+	metricsHandler := mhandler.NewMetricsHandler(metricsDatastore, debug, allowUnknownFields, maxRequestBodySize)
+	metricsHandler.PrincipalHeader = principalHeader
+	metricsHandler.LenientSysTime = lenientSysTime
+	metricsHandler.MetricsRegistry = metricsRegistry
+	metricsHandler.ValidationRules = validationRules
+	metricsHandler.MachineInfos = machineInfos
+	metricsHandler.LabelLimits = model.LabelLimits{MaxLabels: maxLabels, MaxLabelValueLength: maxLabelValueLength}
+	metricsHandler.DefaultPageSize = defaultPageSize
+	metricsHandler.MaxPageSize = maxPageSize
+	metricsHandler.MaxBatchSize = maxBatchSize
+	metricsHandler.StreamWriteTimeout = readWriteTimeout * time.Second
+
+	serveMux.Handle(mhandler.Path, metricsHandler)
+	serveMux.Handle(mhandler.Path+"/", metricsHandler)
+	serveMux.Handle(metadata.Path, metadata.NewMetadataHandler(metricsRegistry))
+
+	machinesHandler := machines.NewMachinesHandler(metricsDatastore, machineInfos, debug)
+	serveMux.Handle(machines.Path, machinesHandler)
+	serveMux.Handle(machines.Path+"/", machinesHandler)
+
+	// followers forward changes to the leader and routers store reports on their shards through it
+	if nodeID != "" || shardBackend {
+		entriesHandler := remote.NewDatastoreHandler(metricsDatastore, debug)
+		entriesHandler.Secret = internalSecret
+		serveMux.Handle(remote.EntriesPath, entriesHandler)
+	}
+
+	// streamed NDJSON and CSV responses have the write timeout for every 100 reports instead, see StreamWriteTimeout
 	metricsServer := &http.Server{
 		Addr:         ":" + listenPortAsString,
 		Handler:      serveMux,
@@ -84,6 +361,18 @@ func main() {
 			// Error from closing listeners, or context timeout:
 			log.Printf("HTTP server Shutdown: %v", err)
 		}
+
+		if clusterNode != nil {
+			if err := clusterNode.Shutdown(); err != nil {
+				log.Printf("Cluster node Shutdown: %v", err)
+			}
+		}
+
+		if tieredDatastore != nil {
+			if err := tieredDatastore.Close(); err != nil {
+				log.Printf("Tiered datastore Close: %v", err)
+			}
+		}
 		close(idleConnsClosed)
 	}()
 
@@ -97,3 +386,44 @@ func main() {
 	// wait until all open connections are finished (or timeout expires)
 	<-idleConnsClosed
 }
+
+// reloadOnHangup reloads the validation rules every time SIGHUP is received
+func reloadOnHangup(rules *validation.RulesFile) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	for range sighup {
+		if err := rules.Reload(); err != nil {
+			log.Printf("ERROR: could not reload validation rules, keeping the previous ones: %v\n", err)
+		} else {
+			log.Printf("Reloaded validation rules from %s\n", rules.Path())
+		}
+	}
+}
+
+// readSecret returns the secret kept in file, without surrounding whitespace
+func readSecret(file string) (string, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(string(contents))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+
+	return secret, nil
+}
+
+// stringList collects the values of a flag which can be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
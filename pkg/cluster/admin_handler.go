@@ -0,0 +1,197 @@
+// Copyright Konstantin Bakanov 2023
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/remote"
+)
+
+// AdminPath is the prefix of all cluster administration routes:
+//
+//	GET    /cluster/nodes      - list members of the cluster
+//	POST   /cluster/nodes      - add a member, body is a Member with id, raftAddr and apiAddr
+//	DELETE /cluster/nodes/{id} - remove a member
+//
+// Requests have to carry the internal secret of the cluster as a bearer token, as a member which
+// joins gets all entries. Requests which change membership are redirected to the leader
+const AdminPath = "/cluster/"
+
+const nodesPath = AdminPath + "nodes"
+
+// an HTTP handler for cluster administration
+type adminHandler struct {
+	Node   *Node
+	Debug  bool
+	Secret string // internal secret of the cluster, requests have to carry it unless it is empty
+}
+
+func NewAdminHandler(node *Node, debug bool) *adminHandler {
+	return &adminHandler{
+		Node:   node,
+		Debug:  debug,
+		Secret: node.config.InternalSecret,
+	}
+}
+
+// implementing http.Handler interface
+func (a *adminHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if !remote.Authorized(request, a.Secret) {
+		remote.RefuseUnauthorized(responseWriter, request)
+		return
+	}
+
+	if request.URL.Path == nodesPath {
+		if request.Method == "GET" {
+			a.handleGetMembers(responseWriter)
+		} else if request.Method == "POST" {
+			a.handleJoin(responseWriter, request)
+		} else {
+			responseWriter.Header().Set("Allow", "POST, GET")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(request.URL.Path, nodesPath+"/") {
+		if request.Method == "DELETE" {
+			a.handleRemove(responseWriter, request, strings.TrimPrefix(request.URL.Path, nodesPath+"/"))
+		} else {
+			responseWriter.Header().Set("Allow", "DELETE")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	http.NotFound(responseWriter, request)
+}
+
+func (a *adminHandler) handleGetMembers(responseWriter http.ResponseWriter) {
+	members, err := a.Node.Members()
+	if err != nil {
+		log.Printf("ERROR: cluster - could not get members: %s\n", err.Error())
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	membersAsBytes, err := json.MarshalIndent(members, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: cluster - could not marshal members: %s\n", err.Error())
+		http.Error(responseWriter, "Error marshalling members", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	if _, err = responseWriter.Write(membersAsBytes); err != nil {
+		log.Printf("ERROR: cluster - could not write response: %s\n", err.Error())
+	}
+}
+
+func (a *adminHandler) handleJoin(responseWriter http.ResponseWriter, request *http.Request) {
+	if a.redirectToLeader(responseWriter, request) {
+		return
+	}
+
+	var member Member
+	if err := json.NewDecoder(request.Body).Decode(&member); err != nil {
+		http.Error(responseWriter, "Error parsing request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if member.ID == "" || member.RaftAddr == "" || member.APIAddr == "" {
+		http.Error(responseWriter, "id, raftAddr and apiAddr must be specified", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.Node.Join(member.ID, member.RaftAddr, member.APIAddr); err != nil {
+		log.Printf("ERROR: cluster - could not add node %s: %s\n", member.ID, err.Error())
+		http.Error(responseWriter, "Could not add node: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("cluster - added node %s, raft address %s, API address %s\n", member.ID, member.RaftAddr, member.APIAddr)
+	responseWriter.WriteHeader(http.StatusCreated)
+}
+
+func (a *adminHandler) handleRemove(responseWriter http.ResponseWriter, request *http.Request, nodeID string) {
+	if a.redirectToLeader(responseWriter, request) {
+		return
+	}
+
+	if nodeID == "" {
+		http.Error(responseWriter, "Node id must be specified", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.Node.Remove(nodeID); err != nil {
+		log.Printf("ERROR: cluster - could not remove node %s: %s\n", nodeID, err.Error())
+		http.Error(responseWriter, "Could not remove node: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("cluster - removed node %s\n", nodeID)
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+// redirectToLeader responds with a redirect if this node is not the leader,
+// returns true if it did so
+func (a *adminHandler) redirectToLeader(responseWriter http.ResponseWriter, request *http.Request) bool {
+	if a.Node.IsLeader() {
+		return false
+	}
+
+	leaderAPIAddr, err := a.Node.LeaderAPIAddr()
+	if err != nil {
+		http.Error(responseWriter, "Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+
+	if a.Debug {
+		log.Printf("cluster - redirecting %s %s to the leader at %s\n", request.Method, request.URL.Path, leaderAPIAddr)
+	}
+
+	// 307 makes sure that the method and the body are preserved
+	http.Redirect(responseWriter, request, "http://"+leaderAPIAddr+request.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// JoinCluster asks the cluster member reachable at memberAPIAddr
+// to add the node described by member to its cluster, secret is the internal secret of the cluster
+func JoinCluster(memberAPIAddr string, member Member, secret string, timeout time.Duration) error {
+	memberAsBytes, err := json.Marshal(&member)
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(memberAPIAddr, "://") {
+		memberAPIAddr = "http://" + memberAPIAddr
+	}
+
+	request, err := http.NewRequest("POST", memberAPIAddr+nodesPath, bytes.NewReader(memberAsBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	remote.SetSecret(request, secret)
+
+	// a follower redirects to the leader
+	httpClient := &http.Client{Timeout: timeout, CheckRedirect: remote.KeepSecretOnRedirect(secret)}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s responded with %s", memberAPIAddr, response.Status)
+	}
+
+	return nil
+}
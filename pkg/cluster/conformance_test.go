@@ -0,0 +1,30 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/datastore/datastoretest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) ds.DatastoreInterface {
+		_, transport := raft.NewInmemTransport("node0")
+
+		node, err := NewNodeWithTransport(Config{
+			NodeID:     "node0",
+			APIAddr:    "localhost:0",
+			Bootstrap:  true,
+			RaftConfig: fastRaftConfig(),
+		}, transport)
+		require.Nil(t, err, "Problem creating node")
+		t.Cleanup(func() { node.Shutdown() })
+
+		require.Eventually(t, node.IsLeader, waitTimeout, pollInterval, "Node should become the leader")
+
+		return node
+	})
+}
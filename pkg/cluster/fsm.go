@@ -0,0 +1,211 @@
+// Copyright Konstantin Bakanov 2023
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/raft"
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// types of commands which are replicated through the raft log
+type commandType int
+
+const (
+	commandAddEntry commandType = iota
+	commandDeleteEntry
+	commandSetNodeAddr
+	commandRemoveNodeAddr
+	commandAddBatch
+)
+
+// command is an entry of the raft log
+type command struct {
+	Type    commandType             `json:"type"`
+	Key     string                  `json:"key,omitempty"`
+	Entry   *model.MachineMetrics   `json:"entry,omitempty"`
+	Entries []*model.MachineMetrics `json:"entries,omitempty"`
+	NodeID  string                  `json:"nodeId,omitempty"`
+	Addr    string                  `json:"addr,omitempty"`
+	Epoch   string                  `json:"epoch,omitempty"` // epoch of the fsm of the node which committed the command
+}
+
+// fsmSnapshotData is what gets written to the snapshot store
+type fsmSnapshotData struct {
+	Entries   []*model.MachineMetrics `json:"entries"`
+	NodeAddrs map[string]string       `json:"nodeAddrs"`
+	Version   datastore.Version       `json:"version"`
+}
+
+// fsm implements raft.FSM, every committed command is applied
+// to the local datastore as map, which is then used to serve reads
+type fsm struct {
+	mutex sync.RWMutex // protects the fields below, which are replaced on restore
+
+	store     datastore.DatastoreInterface
+	nodeAddrs map[string]string // raft server id -> API address of that node
+
+	// version is named after the log entry which last added or deleted an entry and the epoch it was
+	// committed in, so that every node has the same version once it applied the same entries
+	version datastore.Version
+
+	// epoch is unique to the fsm and stamped on the commands it commits as the leader. A cluster which
+	// starts from scratch goes through the same terms and indexes again, with other entries
+	epoch string
+}
+
+func newFSM() *fsm {
+	return &fsm{
+		store:     datastore.NewDatastoreAsMap(),
+		nodeAddrs: make(map[string]string),
+		version:   datastore.Version{Tag: logVersion(&raft.Log{}, ""), Modified: time.Now()},
+		epoch:     uuid.New().String(),
+	}
+}
+
+func logVersion(log *raft.Log, epoch string) string {
+	if epoch == "" {
+		return fmt.Sprintf("%d.%d", log.Term, log.Index)
+	}
+
+	return fmt.Sprintf("%s-%d.%d", epoch, log.Term, log.Index)
+}
+
+// Apply is called once a log entry is committed by a quorum,
+// the returned value is passed back to the caller of raft.Apply on the leader
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return fmt.Errorf("could not unmarshal command at index %d: %w", log.Index, err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch cmd.Type {
+	case commandAddEntry:
+		return f.changed(log, &cmd, f.store.AddEntry(cmd.Key, cmd.Entry))
+	case commandAddBatch:
+		return f.changed(log, &cmd, f.store.AddBatch(cmd.Entries))
+	case commandDeleteEntry:
+		return f.changed(log, &cmd, f.store.DeleteEntry(cmd.Key))
+	case commandSetNodeAddr:
+		f.nodeAddrs[cmd.NodeID] = cmd.Addr
+	case commandRemoveNodeAddr:
+		delete(f.nodeAddrs, cmd.NodeID)
+	default:
+		return fmt.Errorf("unknown command type %d at index %d", cmd.Type, log.Index)
+	}
+
+	return nil
+}
+
+// changed moves the version on to log if cmd applied at log changed the entries
+func (f *fsm) changed(log *raft.Log, cmd *command, rc datastore.DatastoreReturnCode) datastore.DatastoreReturnCode {
+	if rc == datastore.Success {
+		f.version = datastore.Version{Tag: logVersion(log, cmd.Epoch), Modified: time.Now()}
+	}
+
+	return rc
+}
+
+// Snapshot captures the current state, it is called from the raft goroutine
+// so no Apply can run concurrently, hence a copy of entries and addresses is enough
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	snapshot := &fsmSnapshot{
+		data: fsmSnapshotData{
+			Entries:   f.store.GetAllEntries(),
+			NodeAddrs: make(map[string]string, len(f.nodeAddrs)),
+			Version:   f.version,
+		},
+	}
+	for k, v := range f.nodeAddrs {
+		snapshot.data.NodeAddrs[k] = v
+	}
+
+	return snapshot, nil
+}
+
+// Restore replaces the current state with the one from a snapshot
+func (f *fsm) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	var data fsmSnapshotData
+	if err := json.NewDecoder(snapshot).Decode(&data); err != nil {
+		return err
+	}
+
+	store := datastore.NewDatastoreAsMap()
+	for _, entry := range data.Entries {
+		if rc := store.AddEntry(entry.ID, entry); rc != datastore.Success {
+			return fmt.Errorf("could not restore entry %s: %s", entry.ID, rc.String())
+		}
+	}
+
+	if data.NodeAddrs == nil {
+		data.NodeAddrs = make(map[string]string)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.store = store
+	f.nodeAddrs = data.NodeAddrs
+	f.version = datastore.Version{Tag: data.Version.Tag, Modified: time.Now()}
+
+	return nil
+}
+
+func (f *fsm) getAllEntries() []*model.MachineMetrics {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.store.GetAllEntries()
+}
+
+func (f *fsm) getEntry(key string) (*model.MachineMetrics, datastore.DatastoreReturnCode) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.store.GetEntry(key)
+}
+
+func (f *fsm) getVersion() datastore.Version {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.version
+}
+
+func (f *fsm) nodeAddr(nodeID string) string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.nodeAddrs[nodeID]
+}
+
+// fsmSnapshot implements raft.FSMSnapshot
+type fsmSnapshot struct {
+	data fsmSnapshotData
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(&s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
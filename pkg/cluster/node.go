@@ -0,0 +1,476 @@
+// Copyright Konstantin Bakanov 2023
+
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/remote"
+)
+
+const (
+	defaultApplyTimeout   = 5 * time.Second
+	tcpTransportPoolSize  = 3
+	tcpTransportTimeout   = 10 * time.Second
+	leaderWatchInterval   = 100 * time.Millisecond
+	forwardRequestTimeout = 10 * time.Second
+	retainedSnapshots     = 2
+	raftStoreFileName     = "raft.db"
+)
+
+// ErrNoLeader is returned when an operation requires a leader
+// but the cluster currently does not have one
+var ErrNoLeader = errors.New("cluster has no leader")
+
+// Config holds the settings of one cluster node
+type Config struct {
+	NodeID       string        // unique id of this node within the cluster
+	RaftAddr     string        // address the raft transport listens on, e.g. localhost:5000
+	APIAddr      string        // address other nodes use to reach the HTTP API of this node
+	Bootstrap    bool          // set to true on the first node of a new cluster, ignored once the node has state
+	DataDir      string        // directory for the raft log and snapshots, they are only kept in memory if empty
+	ApplyTimeout time.Duration // how long to wait for an entry to be committed
+	Debug        bool
+
+	// InternalSecret is sent with changes forwarded to the leader, see remote.EntriesPath
+	InternalSecret string
+
+	// RaftConfig can be used to override raft timeouts, defaults are used if nil
+	RaftConfig *raft.Config
+}
+
+// Node is a member of a raft group. It implements DatastoreInterface,
+// so that it can be used by the metrics handler in place of a plain
+// datastore: AddEntry only returns once the entry is committed by a quorum
+// and is forwarded to the leader if this node is a follower
+type Node struct {
+	config Config
+	raft   *raft.Raft
+	fsm    *fsm
+
+	boltStore *raftboltdb.BoltStore // nil if the raft log is kept in memory
+
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewNode creates a node which uses a TCP transport listening on config.RaftAddr
+func NewNode(config Config) (*Node, error) {
+	advertiseAddr, err := net.ResolveTCPAddr("tcp", config.RaftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve raft address %s: %w", config.RaftAddr, err)
+	}
+
+	transport, err := raft.NewTCPTransport(config.RaftAddr, advertiseAddr,
+		tcpTransportPoolSize, tcpTransportTimeout, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("could not create raft transport: %w", err)
+	}
+
+	return NewNodeWithTransport(config, transport)
+}
+
+// NewNodeWithTransport creates a node on top of an existing transport,
+// e.g. raft.InmemTransport when running several nodes in one process
+func NewNodeWithTransport(config Config, transport raft.Transport) (*Node, error) {
+	if config.NodeID == "" {
+		return nil, errors.New("node id is not specified")
+	}
+
+	if config.ApplyTimeout == 0 {
+		config.ApplyTimeout = defaultApplyTimeout
+	}
+
+	raftConfig := raft.DefaultConfig()
+	if config.RaftConfig != nil {
+		copied := *config.RaftConfig
+		raftConfig = &copied
+	}
+	raftConfig.LocalID = raft.ServerID(config.NodeID)
+
+	logLevel := hclog.Warn
+	if config.Debug {
+		logLevel = hclog.Debug
+	}
+	raftConfig.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:  "raft-" + config.NodeID,
+		Level: logLevel,
+	})
+
+	node := &Node{
+		config:     config,
+		fsm:        newFSM(),
+		shutdownCh: make(chan struct{}),
+	}
+
+	// the datastore itself lives in memory, it is rebuilt from the raft log and snapshots on restart
+	var logStore raft.LogStore = raft.NewInmemStore()
+	stableStore := logStore.(raft.StableStore)
+	var snapshotStore raft.SnapshotStore = raft.NewInmemSnapshotStore()
+
+	if config.DataDir != "" {
+		var err error
+		if node.boltStore, snapshotStore, err = openStores(config.DataDir); err != nil {
+			return nil, err
+		}
+		logStore, stableStore = node.boltStore, node.boltStore
+	}
+
+	existingState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		node.closeStores()
+		return nil, fmt.Errorf("could not read raft state: %w", err)
+	}
+
+	node.raft, err = raft.NewRaft(raftConfig, node.fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		node.closeStores()
+		return nil, fmt.Errorf("could not create raft: %w", err)
+	}
+
+	// a restarted node already knows its cluster
+	if config.Bootstrap && !existingState {
+		bootstrapConfig := raft.Configuration{
+			Servers: []raft.Server{
+				{
+					ID:      raftConfig.LocalID,
+					Address: transport.LocalAddr(),
+				},
+			},
+		}
+		if err := node.raft.BootstrapCluster(bootstrapConfig).Error(); err != nil {
+			node.raft.Shutdown()
+			node.closeStores()
+			return nil, fmt.Errorf("could not bootstrap cluster: %w", err)
+		}
+	}
+
+	go node.publishAPIAddr()
+
+	return node, nil
+}
+
+// openStores opens the raft log and snapshots kept in dir, creating dir if needed
+func openStores(dir string) (*raftboltdb.BoltStore, raft.SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	boltStore, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(dir, raftStoreFileName)})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open raft log in %s: %w", dir, err)
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStore(dir, retainedSnapshots, os.Stderr)
+	if err != nil {
+		boltStore.Close()
+		return nil, nil, fmt.Errorf("could not open raft snapshots in %s: %w", dir, err)
+	}
+
+	return boltStore, snapshotStore, nil
+}
+
+func (n *Node) closeStores() error {
+	if n.boltStore == nil {
+		return nil
+	}
+
+	return n.boltStore.Close()
+}
+
+// publishAPIAddr makes sure that whenever this node is the leader,
+// the rest of the cluster knows how to reach its HTTP API
+// so that writes can be forwarded to it
+func (n *Node) publishAPIAddr() {
+	ticker := time.NewTicker(leaderWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.shutdownCh:
+			return
+		case <-ticker.C:
+			if n.raft.State() != raft.Leader || n.fsm.nodeAddr(n.config.NodeID) == n.config.APIAddr {
+				continue
+			}
+
+			err := n.apply(&command{Type: commandSetNodeAddr, NodeID: n.config.NodeID, Addr: n.config.APIAddr})
+			if err != nil {
+				log.Printf("ERROR: cluster - could not publish API address of node %s: %s\n", n.config.NodeID, err.Error())
+			}
+		}
+	}
+}
+
+// apply replicates a command which does not return a value
+func (n *Node) apply(cmd *command) error {
+	response, err := n.applyWithResponse(cmd)
+	if err != nil {
+		return err
+	}
+
+	if responseErr, ok := response.(error); ok {
+		return responseErr
+	}
+
+	return nil
+}
+
+func (n *Node) applyWithResponse(cmd *command) (interface{}, error) {
+	cmdAsBytes, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	future := n.raft.Apply(cmdAsBytes, n.config.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	return future.Response(), nil
+}
+
+// GetAllEntries returns all entries applied on this node. Reads are served
+// locally, hence a follower can lag slightly behind the leader
+func (n *Node) GetAllEntries() []*model.MachineMetrics {
+	return n.fsm.getAllEntries()
+}
+
+// GetEntry returns the entry applied on this node, like GetAllEntries it is served locally
+func (n *Node) GetEntry(key string) (*model.MachineMetrics, datastore.DatastoreReturnCode) {
+	return n.fsm.getEntry(key)
+}
+
+// Version returns the version of the entries applied on this node, which is
+// the same on every node which applied the same log entries
+func (n *Node) Version() datastore.Version {
+	return n.fsm.getVersion()
+}
+
+// AddEntry commits the entry to a quorum of the cluster before returning.
+// If this node is not the leader, the entry is forwarded to the leader
+func (n *Node) AddEntry(key string, entry *model.MachineMetrics) datastore.DatastoreReturnCode {
+	// validate here, so that we don't replicate something that will be rejected anyway
+	if key == "" {
+		return datastore.ErrorKeyNotSpecified
+	}
+
+	if entry == nil {
+		return datastore.ErrorValueNotSpecified
+	}
+
+	if n.raft.State() != raft.Leader {
+		return n.forward(key, func(leader datastore.DatastoreInterface) datastore.DatastoreReturnCode {
+			return leader.AddEntry(key, entry)
+		})
+	}
+
+	return n.commit(&command{Type: commandAddEntry, Key: key, Entry: entry})
+}
+
+// AddBatch commits all entries with a single log entry, so that either all or none of them are added.
+// If this node is not the leader, the batch is forwarded to the leader
+func (n *Node) AddBatch(entries []*model.MachineMetrics) datastore.DatastoreReturnCode {
+	if rc := datastore.CheckBatch(entries); rc != datastore.Success {
+		return rc
+	}
+
+	if n.raft.State() != raft.Leader {
+		return n.forward(entries[0].ID, func(leader datastore.DatastoreInterface) datastore.DatastoreReturnCode {
+			return leader.AddBatch(entries)
+		})
+	}
+
+	// the key only names the batch in logs
+	return n.commit(&command{Type: commandAddBatch, Key: entries[0].ID, Entries: entries})
+}
+
+// DeleteEntry commits deletion of the entry to a quorum of the cluster before returning.
+// If this node is not the leader, the deletion is forwarded to the leader
+func (n *Node) DeleteEntry(key string) datastore.DatastoreReturnCode {
+	if key == "" {
+		return datastore.ErrorKeyNotSpecified
+	}
+
+	if n.raft.State() != raft.Leader {
+		return n.forward(key, func(leader datastore.DatastoreInterface) datastore.DatastoreReturnCode {
+			return leader.DeleteEntry(key)
+		})
+	}
+
+	return n.commit(&command{Type: commandDeleteEntry, Key: key})
+}
+
+// commit replicates a command which returns a DatastoreReturnCode once applied
+func (n *Node) commit(cmd *command) datastore.DatastoreReturnCode {
+	cmd.Epoch = n.fsm.epoch
+
+	response, err := n.applyWithResponse(cmd)
+	if errors.Is(err, raft.ErrNotLeader) {
+		// leadership moved before the command reached the log, so it is safe to forward it
+		return n.forward(cmd.Key, func(leader datastore.DatastoreInterface) datastore.DatastoreReturnCode {
+			switch cmd.Type {
+			case commandDeleteEntry:
+				return leader.DeleteEntry(cmd.Key)
+			case commandAddBatch:
+				return leader.AddBatch(cmd.Entries)
+			}
+			return leader.AddEntry(cmd.Key, cmd.Entry)
+		})
+	} else if err != nil {
+		log.Printf("ERROR: cluster - could not commit command for key %s: %s\n", cmd.Key, err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	rc, ok := response.(datastore.DatastoreReturnCode)
+	if !ok {
+		log.Printf("ERROR: cluster - unexpected response when committing command for key %s: %v\n", cmd.Key, response)
+		return datastore.ErrorNotAvailable
+	}
+
+	return rc
+}
+
+// forward runs operation against the datastore of the leader
+func (n *Node) forward(key string,
+	operation func(leader datastore.DatastoreInterface) datastore.DatastoreReturnCode) datastore.DatastoreReturnCode {
+	leaderAPIAddr, err := n.LeaderAPIAddr()
+	if err != nil {
+		log.Printf("ERROR: cluster - could not forward command for key %s: %s\n", key, err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	if n.config.Debug {
+		log.Printf("cluster - forwarding command for key %s to the leader at %s\n", key, leaderAPIAddr)
+	}
+
+	leader := remote.NewDatastoreClient(leaderAPIAddr, forwardRequestTimeout)
+	leader.Secret = n.config.InternalSecret
+
+	return operation(leader)
+}
+
+// IsLeader returns true if this node is currently the leader
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// LeaderAPIAddr returns the address of the HTTP API of the current leader
+func (n *Node) LeaderAPIAddr() (string, error) {
+	_, leaderID := n.raft.LeaderWithID()
+	if leaderID == "" {
+		return "", ErrNoLeader
+	}
+
+	leaderAPIAddr := n.fsm.nodeAddr(string(leaderID))
+	if leaderAPIAddr == "" {
+		return "", fmt.Errorf("API address of leader %s is not known yet", leaderID)
+	}
+
+	return leaderAPIAddr, nil
+}
+
+// Member describes one server in the cluster configuration
+type Member struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	APIAddr  string `json:"apiAddr"`
+	Voter    bool   `json:"voter"`
+	Leader   bool   `json:"leader"`
+}
+
+// Members returns the current cluster configuration
+func (n *Node) Members() ([]Member, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	_, leaderID := n.raft.LeaderWithID()
+
+	members := []Member{}
+	for _, server := range future.Configuration().Servers {
+		members = append(members, Member{
+			ID:       string(server.ID),
+			RaftAddr: string(server.Address),
+			APIAddr:  n.fsm.nodeAddr(string(server.ID)),
+			Voter:    server.Suffrage == raft.Voter,
+			Leader:   server.ID == leaderID,
+		})
+	}
+
+	return members, nil
+}
+
+// Join adds a new voting member to the cluster, it can only be called on the leader
+func (n *Node) Join(nodeID, raftAddr, apiAddr string) error {
+	if nodeID == "" || raftAddr == "" || apiAddr == "" {
+		return errors.New("node id, raft address and API address must all be specified")
+	}
+
+	future := n.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(raftAddr), 0, n.config.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	return n.apply(&command{Type: commandSetNodeAddr, NodeID: nodeID, Addr: apiAddr})
+}
+
+// Remove removes a member from the cluster, it can only be called on the leader
+func (n *Node) Remove(nodeID string) error {
+	if nodeID == "" {
+		return errors.New("node id must be specified")
+	}
+
+	future := n.raft.RemoveServer(raft.ServerID(nodeID), 0, n.config.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	// when the leader removes itself it can no longer replicate anything
+	if nodeID == n.config.NodeID {
+		return nil
+	}
+
+	return n.apply(&command{Type: commandRemoveNodeAddr, NodeID: nodeID})
+}
+
+// WaitForLeader blocks until the cluster has a leader or timeout expires
+func (n *Node) WaitForLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if _, leaderID := n.raft.LeaderWithID(); leaderID != "" {
+			return nil
+		}
+		time.Sleep(leaderWatchInterval / 10)
+	}
+
+	return ErrNoLeader
+}
+
+// Shutdown stops the node, it cannot be used afterwards
+func (n *Node) Shutdown() error {
+	n.shutdownOnce.Do(func() {
+		close(n.shutdownCh)
+	})
+
+	if err := n.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+
+	return n.closeStores()
+}
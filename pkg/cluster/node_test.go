@@ -0,0 +1,481 @@
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/remote"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	waitTimeout    = 5 * time.Second
+	pollInterval   = 10 * time.Millisecond
+	internalSecret = "cluster-secret" // followers have to send it when forwarding to the leader
+)
+
+var dummyMachineMetrics model.MachineMetrics = model.MachineMetrics{
+	ID:        "test-id",
+	MachineID: 123,
+	Stats: model.MetricsStats{
+		CPUTemp:  456,
+		FanSpeed: 789,
+		HDDSpace: 987,
+	},
+	LastLoggedIn: "userA",
+	SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+}
+
+// testNode is a node together with the HTTP server exposing its API
+type testNode struct {
+	node      *Node
+	server    *httptest.Server
+	transport *raft.InmemTransport
+}
+
+type ClusterTestSuite struct {
+	suite.Suite
+	nodes []*testNode
+}
+
+func fastRaftConfig() *raft.Config {
+	raftConfig := raft.DefaultConfig()
+	raftConfig.HeartbeatTimeout = 50 * time.Millisecond
+	raftConfig.ElectionTimeout = 50 * time.Millisecond
+	raftConfig.LeaderLeaseTimeout = 50 * time.Millisecond
+	raftConfig.CommitTimeout = 5 * time.Millisecond
+
+	return raftConfig
+}
+
+// startNode creates a node with an in-memory transport connected to all existing nodes
+func (s *ClusterTestSuite) startNode(nodeID string, bootstrap bool) *testNode {
+	return s.startNodeInDir(nodeID, bootstrap, "")
+}
+
+// startNodeInDir creates a node like startNode which keeps its raft log and snapshots in dataDir
+func (s *ClusterTestSuite) startNodeInDir(nodeID string, bootstrap bool, dataDir string) *testNode {
+	server := httptest.NewUnstartedServer(nil)
+
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(nodeID))
+
+	node, err := NewNodeWithTransport(Config{
+		NodeID:         nodeID,
+		APIAddr:        server.Listener.Addr().String(),
+		Bootstrap:      bootstrap,
+		RaftConfig:     fastRaftConfig(),
+		InternalSecret: internalSecret,
+		DataDir:        dataDir,
+	}, transport)
+	require.Nil(s.T(), err, "Problem creating node")
+
+	entriesHandler := remote.NewDatastoreHandler(node, false)
+	entriesHandler.Secret = internalSecret
+
+	serveMux := http.NewServeMux()
+	serveMux.Handle(AdminPath, NewAdminHandler(node, false))
+	serveMux.Handle(remote.EntriesPath, entriesHandler)
+	server.Config.Handler = serveMux
+	server.Start()
+
+	for _, other := range s.nodes {
+		transport.Connect(other.transport.LocalAddr(), other.transport)
+		other.transport.Connect(transport.LocalAddr(), transport)
+	}
+
+	started := &testNode{node: node, server: server, transport: transport}
+	s.nodes = append(s.nodes, started)
+
+	return started
+}
+
+// startCluster starts a cluster of count nodes, joined through the admin API of the first one
+func (s *ClusterTestSuite) startCluster(count int) {
+	first := s.startNode("node0", true)
+	s.waitForLeader(first)
+
+	for i := 1; i < count; i++ {
+		joining := s.startNode(fmt.Sprintf("node%d", i), false)
+
+		member := Member{
+			ID:       joining.node.config.NodeID,
+			RaftAddr: string(joining.transport.LocalAddr()),
+			APIAddr:  joining.node.config.APIAddr,
+		}
+		require.Nil(s.T(), JoinCluster(first.server.URL, member, internalSecret, waitTimeout), "Problem joining cluster")
+	}
+
+	for _, n := range s.nodes {
+		s.waitForLeader(n)
+	}
+}
+
+// waitForLeader waits until the node knows the leader and how to reach it
+func (s *ClusterTestSuite) waitForLeader(n *testNode) {
+	require.Eventually(s.T(), func() bool {
+		_, err := n.node.LeaderAPIAddr()
+		return err == nil
+	}, waitTimeout, pollInterval, "Node %s does not know the leader", n.node.config.NodeID)
+}
+
+func (s *ClusterTestSuite) leader() *testNode {
+	for _, n := range s.nodes {
+		if n.node.IsLeader() {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *ClusterTestSuite) followers() []*testNode {
+	var followers []*testNode
+	for _, n := range s.nodes {
+		if !n.node.IsLeader() {
+			followers = append(followers, n)
+		}
+	}
+	return followers
+}
+
+func (s *ClusterTestSuite) SetupTest() {
+	s.nodes = nil
+}
+
+func (s *ClusterTestSuite) TearDownTest() {
+	for _, n := range s.nodes {
+		n.node.Shutdown()
+		n.server.Close()
+	}
+}
+
+func (s *ClusterTestSuite) Test_StartCluster_ElectsOneLeader() {
+	s.startCluster(3)
+
+	leaders := 0
+	for _, n := range s.nodes {
+		if n.node.IsLeader() {
+			leaders++
+		}
+	}
+	assert.Equal(s.T(), 1, leaders, "Cluster should have exactly one leader")
+
+	members, err := s.nodes[0].node.Members()
+	assert.Nil(s.T(), err, "Problem getting members")
+	assert.Equal(s.T(), 3, len(members), "Cluster should have three members")
+
+	for _, member := range members {
+		assert.True(s.T(), member.Voter, "Member %s should be a voter", member.ID)
+		assert.NotEmpty(s.T(), member.APIAddr, "API address of member %s should be known", member.ID)
+	}
+}
+
+func (s *ClusterTestSuite) Test_AddEntryOnLeader_ReplicatedToAllNodes() {
+	s.startCluster(3)
+
+	entry := dummyMachineMetrics
+	rc := s.leader().node.AddEntry(entry.ID, &entry)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	// committed entries are applied on the leader before AddEntry returns
+	assert.Equal(s.T(), 1, len(s.leader().node.GetAllEntries()), "Leader should contain the entry")
+
+	for _, n := range s.nodes {
+		assert.Eventually(s.T(), func() bool {
+			return len(n.node.GetAllEntries()) == 1
+		}, waitTimeout, pollInterval, "Node %s should contain the entry", n.node.config.NodeID)
+	}
+
+	assert.EqualValues(s.T(), &entry, s.followers()[0].node.GetAllEntries()[0],
+		"Replicated entry does not match the one that was added")
+}
+
+func (s *ClusterTestSuite) Test_AddEntriesWithMeta_SameSequenceOnAllNodes() {
+	s.startCluster(3)
+
+	for i := 0; i < 3; i++ {
+		entry := dummyMachineMetrics
+		entry.ID = fmt.Sprintf("test-%d", i)
+		entry.Meta = &model.IngestionMeta{RemoteAddr: "10.0.0.1"}
+		assert.Equal(s.T(), ds.Success, s.nodes[i].node.AddEntry(entry.ID, &entry), "Problem adding entry")
+	}
+
+	for _, n := range s.nodes {
+		assert.Eventually(s.T(), func() bool {
+			return len(n.node.GetAllEntries()) == 3
+		}, waitTimeout, pollInterval, "Node %s should contain all entries", n.node.config.NodeID)
+	}
+
+	expected := map[string]uint64{}
+	for _, entry := range s.leader().node.GetAllEntries() {
+		expected[entry.ID] = entry.Meta.Sequence
+	}
+	assert.ElementsMatch(s.T(), []uint64{1, 2, 3}, []uint64{expected["test-0"], expected["test-1"], expected["test-2"]},
+		"Sequence numbers should be assigned in commit order")
+
+	for _, n := range s.followers() {
+		for _, entry := range n.node.GetAllEntries() {
+			assert.Equal(s.T(), expected[entry.ID], entry.Meta.Sequence,
+				"Node %s has a different sequence for entry %s", n.node.config.NodeID, entry.ID)
+		}
+	}
+}
+
+func (s *ClusterTestSuite) Test_Version_SameOnAllNodes() {
+	s.startCluster(3)
+
+	entry := dummyMachineMetrics
+	assert.Equal(s.T(), ds.Success, s.leader().node.AddEntry(entry.ID, &entry), "Problem adding entry")
+	assert.Equal(s.T(), ds.Success, s.leader().node.DeleteEntry(entry.ID), "Problem deleting entry")
+
+	expected := s.leader().node.Version().Tag
+	for _, n := range s.followers() {
+		assert.Eventually(s.T(), func() bool {
+			return n.node.Version().Tag == expected
+		}, waitTimeout, pollInterval, "Node %s should have the version of the leader", n.node.config.NodeID)
+	}
+}
+
+func (s *ClusterTestSuite) Test_AddEntryOnFollower_ForwardedToLeader() {
+	s.startCluster(3)
+
+	entry := dummyMachineMetrics
+	rc := s.followers()[0].node.AddEntry(entry.ID, &entry)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	assert.Equal(s.T(), 1, len(s.leader().node.GetAllEntries()), "Leader should contain the forwarded entry")
+}
+
+func (s *ClusterTestSuite) Test_AddEntryWithExistingKey_ReturnsKeyExistsError() {
+	s.startCluster(3)
+
+	entry := dummyMachineMetrics
+	rc := s.leader().node.AddEntry(entry.ID, &entry)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	rc = s.followers()[0].node.AddEntry(entry.ID, &entry)
+	assert.Equal(s.T(), ds.ErrorKeyExists, rc, "ReturnCode should be "+ds.ErrorKeyExists.String())
+}
+
+func (s *ClusterTestSuite) Test_DeleteEntryOnFollower_DeletedOnAllNodes() {
+	s.startCluster(3)
+
+	entry := dummyMachineMetrics
+	assert.Equal(s.T(), ds.Success, s.leader().node.AddEntry(entry.ID, &entry), "Problem adding entry")
+
+	rc := s.followers()[0].node.DeleteEntry(entry.ID)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	for _, n := range s.nodes {
+		assert.Eventually(s.T(), func() bool {
+			return len(n.node.GetAllEntries()) == 0
+		}, waitTimeout, pollInterval, "Entry should be deleted on node %s", n.node.config.NodeID)
+	}
+
+	rc = s.leader().node.DeleteEntry(entry.ID)
+	assert.Equal(s.T(), ds.ErrorKeyNotFound, rc, "ReturnCode should be "+ds.ErrorKeyNotFound.String())
+}
+
+func (s *ClusterTestSuite) Test_AddEntryWithEmptyKeyOrNilValue_NotReplicated() {
+	s.startCluster(1)
+
+	rc := s.nodes[0].node.AddEntry("", &dummyMachineMetrics)
+	assert.Equal(s.T(), ds.ErrorKeyNotSpecified, rc, "ReturnCode should be "+ds.ErrorKeyNotSpecified.String())
+
+	rc = s.nodes[0].node.AddEntry("dummyKey", nil)
+	assert.Equal(s.T(), ds.ErrorValueNotSpecified, rc, "ReturnCode should be "+ds.ErrorValueNotSpecified.String())
+}
+
+func (s *ClusterTestSuite) Test_LeaderShutdown_NewLeaderAcceptsWrites() {
+	s.startCluster(3)
+
+	oldLeader := s.leader()
+	entry := dummyMachineMetrics
+	assert.Equal(s.T(), ds.Success, oldLeader.node.AddEntry(entry.ID, &entry), "Problem adding entry")
+
+	oldLeader.node.Shutdown()
+	oldLeader.server.Close()
+
+	remaining := []*testNode{}
+	for _, n := range s.nodes {
+		if n != oldLeader {
+			remaining = append(remaining, n)
+		}
+	}
+	s.nodes = remaining
+
+	require.Eventually(s.T(), func() bool {
+		return s.leader() != nil
+	}, waitTimeout, pollInterval, "A new leader should have been elected")
+
+	for _, n := range s.nodes {
+		s.waitForLeader(n)
+	}
+
+	second := dummyMachineMetrics
+	second.ID = "test-2"
+	rc := s.nodes[0].node.AddEntry(second.ID, &second)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	assert.Equal(s.T(), 2, len(s.leader().node.GetAllEntries()), "New leader should contain both entries")
+}
+
+func (s *ClusterTestSuite) Test_RemoveMemberViaFollowerAdminAPI_RedirectedToLeader() {
+	s.startCluster(3)
+
+	removed := s.followers()[1]
+	request, err := http.NewRequest("DELETE", s.followers()[0].server.URL+nodesPath+"/"+removed.node.config.NodeID, nil)
+	require.Nil(s.T(), err, "Problem creating request")
+	remote.SetSecret(request, internalSecret)
+
+	httpClient := &http.Client{CheckRedirect: remote.KeepSecretOnRedirect(internalSecret)}
+	response, err := httpClient.Do(request)
+	require.Nil(s.T(), err, "Problem sending request")
+	response.Body.Close()
+
+	assert.Equal(s.T(), http.StatusNoContent, response.StatusCode, "Status code is incorrect")
+
+	members, err := s.leader().node.Members()
+	assert.Nil(s.T(), err, "Problem getting members")
+	assert.Equal(s.T(), 2, len(members), "Cluster should have two members")
+
+	for _, member := range members {
+		assert.NotEqual(s.T(), removed.node.config.NodeID, member.ID, "Removed node should not be a member")
+	}
+}
+
+func (s *ClusterTestSuite) Test_JoinViaFollower_RedirectedToLeaderWithSecret() {
+	s.startCluster(2)
+
+	joining := s.startNode("node2", false)
+	member := Member{ID: "node2", RaftAddr: string(joining.transport.LocalAddr()), APIAddr: joining.node.config.APIAddr}
+	require.Nil(s.T(), JoinCluster(s.followers()[0].server.URL, member, internalSecret, waitTimeout), "Problem joining via follower")
+
+	members, err := s.leader().node.Members()
+	assert.Nil(s.T(), err, "Problem getting members")
+	assert.Equal(s.T(), 3, len(members), "Cluster should have three members")
+}
+
+func (s *ClusterTestSuite) Test_AdminAPIWithoutSecret_Returns401() {
+	s.startCluster(2)
+
+	joining := s.startNode("node2", false)
+	member := Member{ID: "node2", RaftAddr: string(joining.transport.LocalAddr()), APIAddr: joining.node.config.APIAddr}
+
+	for _, secret := range []string{"", "wrong-secret"} {
+		err := JoinCluster(s.leader().server.URL, member, secret, waitTimeout)
+		assert.ErrorContains(s.T(), err, "401", "Join with secret %q should be refused", secret)
+
+		request, err := http.NewRequest("DELETE", s.leader().server.URL+nodesPath+"/"+s.followers()[0].node.config.NodeID, nil)
+		require.Nil(s.T(), err, "Problem creating request")
+		remote.SetSecret(request, secret)
+
+		response, err := http.DefaultClient.Do(request)
+		require.Nil(s.T(), err, "Problem sending request")
+		response.Body.Close()
+
+		assert.Equal(s.T(), http.StatusUnauthorized, response.StatusCode, "Remove with secret %q should be refused", secret)
+		assert.Equal(s.T(), "Bearer", response.Header.Get("WWW-Authenticate"), "WWW-Authenticate header is incorrect")
+	}
+
+	members, err := s.leader().node.Members()
+	assert.Nil(s.T(), err, "Problem getting members")
+	assert.Equal(s.T(), 2, len(members), "Membership should not change")
+}
+
+func (s *ClusterTestSuite) Test_JoinWithMissingFields_Returns400() {
+	s.startCluster(1)
+
+	err := JoinCluster(s.nodes[0].server.URL, Member{ID: "node1"}, internalSecret, waitTimeout)
+	assert.NotNil(s.T(), err, "Join without addresses should fail")
+}
+
+func (s *ClusterTestSuite) Test_Snapshot_RestoresEntriesAndAddresses() {
+	s.startCluster(1)
+
+	entry := dummyMachineMetrics
+	assert.Equal(s.T(), ds.Success, s.nodes[0].node.AddEntry(entry.ID, &entry), "Problem adding entry")
+
+	snapshot, err := s.nodes[0].node.fsm.Snapshot()
+	require.Nil(s.T(), err, "Problem taking snapshot")
+
+	sink := &memorySnapshotSink{}
+	require.Nil(s.T(), snapshot.Persist(sink), "Problem persisting snapshot")
+
+	restored := newFSM()
+	require.Nil(s.T(), restored.Restore(sink), "Problem restoring snapshot")
+
+	assert.EqualValues(s.T(), s.nodes[0].node.GetAllEntries(), restored.getAllEntries(), "Restored entries do not match")
+	assert.Equal(s.T(), s.nodes[0].node.config.APIAddr, restored.nodeAddr("node0"), "Restored address does not match")
+	assert.Equal(s.T(), s.nodes[0].node.Version().Tag, restored.getVersion().Tag, "Restored version does not match")
+}
+
+func (s *ClusterTestSuite) Test_RestartFromScratch_VersionNotRepeated() {
+	first := s.startNode("node0", true)
+	s.waitForLeader(first)
+
+	entry := dummyMachineMetrics
+	require.Equal(s.T(), ds.Success, first.node.AddEntry(entry.ID, &entry), "Problem adding entry")
+	version := first.node.Version()
+
+	require.Nil(s.T(), first.node.Shutdown(), "Problem shutting node down")
+	first.server.Close()
+	s.nodes = nil
+
+	// the new cluster commits other entries at the same terms and indexes
+	restarted := s.startNode("node0", true)
+	s.waitForLeader(restarted)
+
+	other := dummyMachineMetrics
+	other.ID = "other-id"
+	require.Equal(s.T(), ds.Success, restarted.node.AddEntry(other.ID, &other), "Problem adding entry")
+
+	restartedVersion := restarted.node.Version()
+	assert.Equal(s.T(), version.Tag[strings.LastIndex(version.Tag, "-"):], restartedVersion.Tag[strings.LastIndex(restartedVersion.Tag, "-"):],
+		"Entries should be committed at the same term and index")
+	assert.NotEqual(s.T(), version.Tag, restartedVersion.Tag, "Version should not be repeated by a new cluster")
+}
+
+func (s *ClusterTestSuite) Test_RestartWithDataDir_EntriesAndVersionRestored() {
+	dataDir := s.T().TempDir()
+
+	first := s.startNodeInDir("node0", true, dataDir)
+	s.waitForLeader(first)
+
+	entry := dummyMachineMetrics
+	other := dummyMachineMetrics
+	other.ID = "other-id"
+	assert.Equal(s.T(), ds.Success, first.node.AddEntry(entry.ID, &entry), "Problem adding entry")
+	assert.Equal(s.T(), ds.Success, first.node.AddEntry(other.ID, &other), "Problem adding entry")
+	assert.Equal(s.T(), ds.Success, first.node.DeleteEntry(other.ID), "Problem deleting entry")
+
+	entries := first.node.GetAllEntries()
+	version := first.node.Version()
+
+	require.Nil(s.T(), first.node.Shutdown(), "Problem shutting node down")
+	first.server.Close()
+	s.nodes = nil
+
+	// bootstrapping again is skipped, as the node already has state
+	restarted := s.startNodeInDir("node0", true, dataDir)
+	s.waitForLeader(restarted)
+
+	require.Eventually(s.T(), func() bool {
+		return restarted.node.Version().Tag == version.Tag
+	}, waitTimeout, pollInterval, "Version is not restored")
+	assert.EqualValues(s.T(), entries, restarted.node.GetAllEntries(), "Restored entries do not match")
+	assert.Equal(s.T(), ds.Success, restarted.node.AddEntry(other.ID, &other), "Restarted node does not accept writes")
+}
+
+func TestClusterTestSuite(t *testing.T) {
+	suite.Run(t, new(ClusterTestSuite))
+}
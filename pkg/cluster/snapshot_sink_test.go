@@ -0,0 +1,19 @@
+package cluster
+
+import (
+	"bytes"
+
+	"github.com/hashicorp/raft"
+)
+
+// memorySnapshotSink implements raft.SnapshotSink and io.ReadCloser,
+// so that a persisted snapshot can be restored straight away
+type memorySnapshotSink struct {
+	bytes.Buffer
+}
+
+func (m *memorySnapshotSink) ID() string    { return "memory" }
+func (m *memorySnapshotSink) Cancel() error { return nil }
+func (m *memorySnapshotSink) Close() error  { return nil }
+
+var _ raft.SnapshotSink = (*memorySnapshotSink)(nil)
@@ -0,0 +1,33 @@
+// Copyright Konstantin Bakanov 2023
+
+package datastore
+
+import (
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// CheckBatch returns what AddBatch has to return for entries before looking at the
+// datastore, Success if the batch has entries, all of them with distinct IDs
+func CheckBatch(entries []*model.MachineMetrics) DatastoreReturnCode {
+	if len(entries) == 0 {
+		return ErrorValueNotSpecified
+	}
+
+	keys := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry == nil {
+			return ErrorValueNotSpecified
+		}
+
+		if entry.ID == "" {
+			return ErrorKeyNotSpecified
+		}
+
+		if keys[entry.ID] {
+			return ErrorKeyExists
+		}
+		keys[entry.ID] = true
+	}
+
+	return Success
+}
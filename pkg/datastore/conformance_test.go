@@ -0,0 +1,14 @@
+package datastore_test
+
+import (
+	"testing"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/datastore/datastoretest"
+)
+
+func TestDatastoreAsMap_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) datastore.DatastoreInterface {
+		return datastore.NewDatastoreAsMap()
+	})
+}
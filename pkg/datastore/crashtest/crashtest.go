@@ -0,0 +1,267 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package crashtest checks that a persisted datastore survives crashes. The
+// datastore is run against a fault-injecting filesystem which crashes at random
+// points, then it is opened again and its entries are compared with what was
+// acknowledged before the crash
+package crashtest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+	"github.com/kostik-b/metrics-store/pkg/vfs/faultfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Store is a persisted datastore
+type Store interface {
+	datastore.DatastoreInterface
+	Close() error
+}
+
+// Config describes the datastore under test and the shape of the test
+type Config struct {
+	// Open opens the datastore kept in fs, it is called again after every crash
+	Open func(fs vfs.FS) (Store, error)
+
+	// Maintain runs the background work of the datastore, e.g. a migration, it is optional
+	Maintain func(store Store) error
+
+	Seed       int64   // makes the operations, the faults and the crashes reproducible
+	Rounds     int     // number of crashes
+	Operations int     // maximal number of operations before a crash
+	FaultRate  float64 // probability of an injected fault per filesystem operation
+}
+
+// state is what is known about an entry before the crash
+type state int
+
+const (
+	added        state = iota // the entry was acknowledged, it has to be there
+	deleted                   // the deletion was acknowledged, the entry must not be there
+	maybeAdded                // the addition failed, the entry may be there
+	maybeDeleted              // the deletion failed, the entry may still be there
+)
+
+// expectedEntry is an entry the datastore was asked to store
+type expectedEntry struct {
+	entry *model.MachineMetrics
+	state state
+}
+
+type crashTest struct {
+	t        *testing.T
+	config   Config
+	random   *rand.Rand
+	fs       *faultfs.FS
+	expected map[string]*expectedEntry
+	nextKey  int
+}
+
+// Run crashes the datastore config.Rounds times and checks after
+// every crash that no acknowledged change was lost
+func Run(t *testing.T, config Config) {
+	c := &crashTest{
+		t:        t,
+		config:   config,
+		random:   rand.New(rand.NewSource(config.Seed)),
+		fs:       faultfs.New(config.Seed),
+		expected: make(map[string]*expectedEntry),
+	}
+
+	for round := 0; round < config.Rounds; round++ {
+		store := c.open()
+		c.verify(store, round)
+
+		c.fs.InjectFaults(config.FaultRate, faultfs.AllFaults...)
+		c.fs.CrashAfter(1 + c.random.Intn(5*config.Operations))
+
+		for i := 0; i < config.Operations && !c.fs.Crashed(); i++ {
+			c.operate(store)
+		}
+
+		c.fs.Crash()
+		store.Close()
+		c.fs.Restart()
+	}
+
+	store := c.open()
+	c.verify(store, config.Rounds)
+	assert.Nil(t, store.Close(), "Problem closing datastore")
+}
+
+// open opens the datastore after a crash, faults are only injected while it runs
+func (c *crashTest) open() Store {
+	store, err := c.config.Open(c.fs)
+	require.Nil(c.t, err, "Datastore should open after a crash")
+
+	return store
+}
+
+// operate runs a random operation against the datastore
+func (c *crashTest) operate(store Store) {
+	switch n := c.random.Intn(100); {
+	case n < 60:
+		c.add(store)
+	case n < 85:
+		c.delete(store)
+	case n < 90:
+		c.addExisting(store)
+	default:
+		if c.config.Maintain != nil {
+			c.config.Maintain(store)
+		}
+	}
+}
+
+func (c *crashTest) add(store Store) {
+	key := fmt.Sprintf("key%d", c.nextKey)
+	entry := newEntry(key, c.nextKey)
+	c.nextKey++
+
+	expected := &expectedEntry{entry: entry, state: maybeAdded}
+	c.expected[key] = expected
+
+	switch rc := store.AddEntry(key, entry); rc {
+	case datastore.Success:
+		expected.state = added
+	case datastore.ErrorNotAvailable:
+	default:
+		c.t.Fatalf("Unexpected return code for the new entry %s: %s", key, rc)
+	}
+}
+
+func (c *crashTest) delete(store Store) {
+	key, expected := c.pick(added, maybeAdded)
+	if expected == nil {
+		return
+	}
+
+	switch rc := store.DeleteEntry(key); rc {
+	case datastore.Success:
+		expected.state = deleted
+	case datastore.ErrorKeyNotFound:
+		require.Equal(c.t, maybeAdded, expected.state, "Acknowledged entry %s should be found", key)
+	case datastore.ErrorNotAvailable:
+		if expected.state == added {
+			expected.state = maybeDeleted
+		}
+	default:
+		c.t.Fatalf("Unexpected return code for deleting %s: %s", key, rc)
+	}
+}
+
+// addExisting checks that an acknowledged entry cannot be added twice
+func (c *crashTest) addExisting(store Store) {
+	key, expected := c.pick(added)
+	if expected == nil {
+		return
+	}
+
+	rc := store.AddEntry(key, newEntry(key, -1))
+	require.NotEqual(c.t, datastore.Success, rc, "Entry %s should exist already", key)
+}
+
+// pick returns a random entry in one of the given states
+func (c *crashTest) pick(states ...state) (string, *expectedEntry) {
+	candidates := []string{}
+	for key, expected := range c.expected {
+		for _, s := range states {
+			if expected.state == s {
+				candidates = append(candidates, key)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	// map iteration order is random, sort for a reproducible choice
+	sort.Strings(candidates)
+	key := candidates[c.random.Intn(len(candidates))]
+
+	return key, c.expected[key]
+}
+
+// verify compares the entries of the datastore with the expected ones and
+// then settles the uncertain ones to what the datastore holds
+func (c *crashTest) verify(store Store, round int) {
+	entries := store.GetAllEntries()
+	require.NotNil(c.t, entries, "Entries should be readable after crash %d", round)
+
+	found := make(map[string]*model.MachineMetrics, len(entries))
+	sequences := make(map[uint64]string, len(entries))
+
+	for _, entry := range entries {
+		require.NotNil(c.t, entry, "Entries should not be nil after crash %d", round)
+		require.NotContains(c.t, found, entry.ID, "Entry %s returned twice after crash %d", entry.ID, round)
+		found[entry.ID] = entry
+
+		expected, known := c.expected[entry.ID]
+		require.True(c.t, known, "Unknown entry %s returned after crash %d", entry.ID, round)
+		require.Equal(c.t, withoutSequence(expected.entry), withoutSequence(entry),
+			"Entry %s is corrupt after crash %d", entry.ID, round)
+
+		require.NotNil(c.t, entry.Meta, "Entry %s lost its metadata after crash %d", entry.ID, round)
+		require.NotZero(c.t, entry.Meta.Sequence, "Entry %s has no sequence after crash %d", entry.ID, round)
+		require.NotContains(c.t, sequences, entry.Meta.Sequence, "Sequence of %s is not unique after crash %d", entry.ID, round)
+		sequences[entry.Meta.Sequence] = entry.ID
+	}
+
+	for key, expected := range c.expected {
+		_, isThere := found[key]
+
+		switch expected.state {
+		case added:
+			require.True(c.t, isThere, "Acknowledged entry %s lost after crash %d", key, round)
+		case deleted:
+			require.False(c.t, isThere, "Deleted entry %s came back after crash %d", key, round)
+		case maybeAdded, maybeDeleted:
+			if isThere {
+				expected.state = added
+			} else {
+				expected.state = deleted
+			}
+		}
+	}
+}
+
+func newEntry(key string, n int) *model.MachineMetrics {
+	return &model.MachineMetrics{
+		ID:        key,
+		MachineID: n,
+		Stats: model.MetricsStats{
+			CPUTemp:  n % 100,
+			FanSpeed: n % 1000,
+			HDDSpace: n,
+		},
+		LastLoggedIn: "admin/user" + key,
+		SysTime:      model.NewSysTime(time.Date(2023, 1, 1, 0, 0, n, 0, time.UTC)),
+		Meta: &model.IngestionMeta{
+			ReceivedAt: time.Date(2023, 1, 1, 0, 0, n, 0, time.UTC),
+			RemoteAddr: "127.0.0.1",
+		},
+	}
+}
+
+// withoutSequence returns a copy of entry without the sequence number assigned by the datastore
+func withoutSequence(entry *model.MachineMetrics) model.MachineMetrics {
+	copied := *entry
+	if entry.Meta != nil {
+		meta := *entry.Meta
+		meta.Sequence = 0
+		copied.Meta = &meta
+	}
+
+	return copied
+}
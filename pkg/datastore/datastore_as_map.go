@@ -10,8 +10,10 @@ var once sync.Once
 
 // datastoreAsMap implementes DatastoreInterface
 type datastoreAsMap struct {
-	entries map[string]*model.MachineMetrics
-	mutex   sync.Mutex // we need this for concurrent access
+	entries      map[string]*model.MachineMetrics
+	nextSequence uint64 // sequence number of the next entry with ingestion metadata
+	changes      *ChangeCounter
+	mutex        sync.Mutex // we need this for concurrent access
 }
 
 // datastore as map is a singleton and can only be retrieved
@@ -21,11 +23,25 @@ var metricsStore datastoreAsMap
 func GetInstance() DatastoreInterface {
 	once.Do(func() {
 		metricsStore.entries = make(map[string]*model.MachineMetrics)
+		metricsStore.nextSequence = 1
+		metricsStore.changes = NewChangeCounter()
 	})
 
 	return &metricsStore
 }
 
+// NewDatastoreAsMap returns a new, empty datastore as map which
+// is independent of the singleton returned by GetInstance().
+// It is used where more than one datastore lives in the same process,
+// e.g. as a state machine of a cluster node
+func NewDatastoreAsMap() DatastoreInterface {
+	return &datastoreAsMap{
+		entries:      make(map[string]*model.MachineMetrics),
+		nextSequence: 1,
+		changes:      NewChangeCounter(),
+	}
+}
+
 // GetAllEntries returns all entries stored in the map
 // or an empty slide otherwise
 func (d *datastoreAsMap) GetAllEntries() []*model.MachineMetrics {
@@ -40,7 +56,25 @@ func (d *datastoreAsMap) GetAllEntries() []*model.MachineMetrics {
 	return allEntries
 }
 
-// AddEntry adds entry to the map based on key
+// GetEntry returns the entry stored under key
+func (d *datastoreAsMap) GetEntry(key string) (*model.MachineMetrics, DatastoreReturnCode) {
+	if key == "" {
+		return nil, ErrorKeyNotSpecified
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	entry, found := d.entries[key]
+	if !found {
+		return nil, ErrorKeyNotFound
+	}
+
+	return entry, Success
+}
+
+// AddEntry adds entry to the map based on key,
+// a sequence number is assigned to the entry if it has ingestion metadata
 func (d *datastoreAsMap) AddEntry(key string, entry *model.MachineMetrics) DatastoreReturnCode {
 	if key == "" {
 		return ErrorKeyNotSpecified
@@ -59,7 +93,59 @@ func (d *datastoreAsMap) AddEntry(key string, entry *model.MachineMetrics) Datas
 		return ErrorKeyExists
 	}
 
-	d.entries[key] = entry
+	d.entries[key] = AssignSequence(entry, &d.nextSequence)
+	d.changes.Changed()
 
 	return Success
 }
+
+// AddBatch adds all entries to the map under their IDs, or none of them if any of
+// the IDs exists
+func (d *datastoreAsMap) AddBatch(entries []*model.MachineMetrics) DatastoreReturnCode {
+	if rc := CheckBatch(entries); rc != Success {
+		return rc
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, entry := range entries {
+		if _, found := d.entries[entry.ID]; found {
+			return ErrorKeyExists
+		}
+	}
+
+	for _, entry := range entries {
+		d.entries[entry.ID] = AssignSequence(entry, &d.nextSequence)
+	}
+	d.changes.Changed()
+
+	return Success
+}
+
+// DeleteEntry removes entry with the given key from the map
+func (d *datastoreAsMap) DeleteEntry(key string) DatastoreReturnCode {
+	if key == "" {
+		return ErrorKeyNotSpecified
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, found := d.entries[key]; !found {
+		return ErrorKeyNotFound
+	}
+
+	delete(d.entries, key)
+	d.changes.Changed()
+
+	return Success
+}
+
+// Version returns the version of the entries in the map
+func (d *datastoreAsMap) Version() Version {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.changes.Version()
+}
@@ -2,6 +2,7 @@ package datastore
 
 import (
 	"testing"
+	"time"
 
 	"github.com/kostik-b/metrics-store/pkg/model"
 
@@ -21,7 +22,7 @@ var dummyMachineMetrics model.MachineMetrics = model.MachineMetrics{
 		InternalTemp: &internalTemp,
 	},
 	LastLoggedIn: "userA",
-	SysTime:      "timestamp",
+	SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
 }
 
 type DatastoreTestSuite struct {
@@ -35,6 +36,7 @@ func (s *DatastoreTestSuite) SetupTest() {
 	for k := range metricsStore.entries {
 		delete(metricsStore.entries, k)
 	}
+	metricsStore.nextSequence = 1
 }
 
 func (s *DatastoreTestSuite) Test_AddEntryWithEmptyKey_ReturnsKeyNotSpecifiedError() {
@@ -70,6 +72,65 @@ func (s *DatastoreTestSuite) Test_AddEntryWithNonExistingKeyNonNilvalue_ReturnsS
 	assert.Equal(s.T(), err, Success, "ReturnCode should be "+Success.String())
 }
 
+func (s *DatastoreTestSuite) Test_AddEntryWithMeta_AssignsIncreasingSequence() {
+	datastore := GetInstance()
+
+	first := dummyMachineMetrics
+	first.Meta = &model.IngestionMeta{RemoteAddr: "10.0.0.1"}
+	second := first
+
+	datastore.AddEntry("dummyKey1", &first)
+	datastore.AddEntry("dummyKey2", &second)
+
+	assert.Equal(s.T(), uint64(0), first.Meta.Sequence, "Entry passed in should not be modified")
+
+	// both entries share the same ID, so look them up via the map itself
+	assert.Equal(s.T(), uint64(1), metricsStore.entries["dummyKey1"].Meta.Sequence, "First entry should get sequence 1")
+	assert.Equal(s.T(), uint64(2), metricsStore.entries["dummyKey2"].Meta.Sequence, "Second entry should get sequence 2")
+	assert.Equal(s.T(), "10.0.0.1", metricsStore.entries["dummyKey2"].Meta.RemoteAddr, "Other metadata should be kept")
+}
+
+func (s *DatastoreTestSuite) Test_AddEntryWithSequence_KeepsItAndContinuesAfterIt() {
+	datastore := GetInstance()
+
+	moved := dummyMachineMetrics
+	moved.Meta = &model.IngestionMeta{Sequence: 10}
+	fresh := dummyMachineMetrics
+	fresh.Meta = &model.IngestionMeta{}
+
+	datastore.AddEntry("dummyKey1", &moved)
+	datastore.AddEntry("dummyKey2", &fresh)
+
+	assert.Equal(s.T(), uint64(10), metricsStore.entries["dummyKey1"].Meta.Sequence, "Existing sequence should be kept")
+	assert.Equal(s.T(), uint64(11), metricsStore.entries["dummyKey2"].Meta.Sequence, "Sequence should continue after the existing one")
+}
+
+func (s *DatastoreTestSuite) Test_DeleteEntryWithEmptyKey_ReturnsKeyNotSpecifiedError() {
+	datastore := GetInstance()
+
+	err := datastore.DeleteEntry("")
+
+	assert.Equal(s.T(), err, ErrorKeyNotSpecified, "Error should be "+ErrorKeyNotSpecified.String())
+}
+
+func (s *DatastoreTestSuite) Test_DeleteEntryWithNonExistingKey_ReturnsKeyNotFoundError() {
+	datastore := GetInstance()
+
+	err := datastore.DeleteEntry("dummyKey")
+
+	assert.Equal(s.T(), err, ErrorKeyNotFound, "Error should be "+ErrorKeyNotFound.String())
+}
+
+func (s *DatastoreTestSuite) Test_DeleteEntryWithExistingKey_EntryRemoved() {
+	datastore := GetInstance()
+
+	datastore.AddEntry("dummyKey", &dummyMachineMetrics)
+	err := datastore.DeleteEntry("dummyKey")
+
+	assert.Equal(s.T(), err, Success, "ReturnCode should be "+Success.String())
+	assert.Equal(s.T(), len(datastore.GetAllEntries()), 0, "Map should be empty")
+}
+
 func (s *DatastoreTestSuite) Test_GetAllEntries_MapEmpty_ReturnsEmptySlice() {
 	datastore := GetInstance()
 
@@ -141,6 +202,19 @@ func (s *DatastoreTestSuite) Test_GetInstanceTwice_HaveSameAddress() {
 	assert.Same(s.T(), datastore, datastore2, "GetInstance should return the same object")
 }
 
+func (s *DatastoreTestSuite) Test_NewDatastoreAsMap_IsIndependentOfInstance() {
+	datastore := GetInstance()
+	independent := NewDatastoreAsMap()
+
+	assert.NotSame(s.T(), datastore, independent, "NewDatastoreAsMap should not return the singleton")
+
+	err := independent.AddEntry("dummyKey", &dummyMachineMetrics)
+	assert.Equal(s.T(), err, Success, "Return Code should be "+Success.String())
+
+	assert.Equal(s.T(), len(independent.GetAllEntries()), 1, "Independent datastore should contain one entry")
+	assert.Equal(s.T(), len(datastore.GetAllEntries()), 0, "Singleton datastore should not be affected")
+}
+
 func TestDatastoreTestSuite(t *testing.T) {
 	suite.Run(t, new(DatastoreTestSuite))
 }
@@ -15,6 +15,9 @@ const (
 	ErrorKeyExists
 	ErrorKeyNotSpecified
 	ErrorValueNotSpecified
+	ErrorNotAvailable
+	ErrorKeyNotFound
+	ErrorBatchNotSupported
 )
 
 func (d DatastoreReturnCode) String() string {
@@ -27,15 +30,29 @@ func (d DatastoreReturnCode) String() string {
 		return "Key not specified"
 	case ErrorValueNotSpecified:
 		return "Value not specified"
+	case ErrorNotAvailable:
+		return "Datastore not available"
+	case ErrorKeyNotFound:
+		return "Key not found"
+	case ErrorBatchNotSupported:
+		return "Batch cannot be added at once"
 	default:
 		return "Unknown return code"
 	}
 }
 
-// A datastore interface to add one entry to the datastore
+// A datastore interface to add one entry to the datastore,
+// to delete one entry from the datastore,
+// to retrieve one entry by its key
 // and to retrieve all entries from a datastore
-// if there are no entries in the datastore, an empty slice will be returned
+// if there are no entries in the datastore, an empty slice will be returned.
+// AddBatch adds either all of the entries, each under its ID, or none of them.
+// Version tells if anything changed without retrieving the entries
 type DatastoreInterface interface {
 	GetAllEntries() []*model.MachineMetrics
+	GetEntry(string) (*model.MachineMetrics, DatastoreReturnCode)
 	AddEntry(string, *model.MachineMetrics) DatastoreReturnCode
+	AddBatch([]*model.MachineMetrics) DatastoreReturnCode
+	DeleteEntry(string) DatastoreReturnCode
+	Version() Version
 }
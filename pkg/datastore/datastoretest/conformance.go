@@ -0,0 +1,483 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package datastoretest contains a conformance suite which every
+// implementation of DatastoreInterface has to pass, e.g.
+//
+//	func TestConformance(t *testing.T) {
+//		datastoretest.Run(t, func(t *testing.T) datastore.DatastoreInterface {
+//			return NewMyDatastore()
+//		})
+//	}
+//
+// Each test gets a new datastore from the factory, so the factory must
+// return an empty datastore every time. Cleanup can be registered with t.Cleanup
+package datastoretest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new, empty datastore
+type Factory func(t *testing.T) datastore.DatastoreInterface
+
+const (
+	concurrentWriters        = 8
+	entriesPerWriter         = 25
+	concurrentDuplicateAdds  = 8
+	orderedEntriesPerMachine = 20
+)
+
+// Run runs all conformance tests against datastores returned by factory
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, d datastore.DatastoreInterface)
+	}{
+		{"GetAllEntries_Empty_ReturnsEmptySlice", testGetAllEntriesEmpty},
+		{"AddEntryWithEmptyKey_ReturnsKeyNotSpecifiedError", testAddEntryWithEmptyKey},
+		{"AddEntryWithNilValue_ReturnsValueNotSpecifiedError", testAddEntryWithNilValue},
+		{"AddEntryWithExistingKey_ReturnsKeyExistsError", testAddEntryWithExistingKey},
+		{"AddEntry_ReturnedByGetAllEntries", testAddEntryReturned},
+		{"AddEntry_CallersEntryNotModified", testAddEntryCallersEntryNotModified},
+		{"AddEntries_AllReturnedOnce", testAddEntriesAllReturned},
+		{"AddBatchNotAddable_NoneAdded", testAddBatchNotAddable},
+		{"AddBatch_AllAddedInOrder", testAddBatch},
+		{"GetEntryWithEmptyKey_ReturnsKeyNotSpecifiedError", testGetEntryWithEmptyKey},
+		{"GetEntry_ReturnsEntryUntilDeleted", testGetEntry},
+		{"DeleteEntryWithEmptyKey_ReturnsKeyNotSpecifiedError", testDeleteEntryWithEmptyKey},
+		{"DeleteEntryWithNonExistingKey_ReturnsKeyNotFoundError", testDeleteEntryWithNonExistingKey},
+		{"DeleteEntry_NotReturnedAndKeyFree", testDeleteEntry},
+		{"Version_ChangesOnAddAndDelete", testVersion},
+		{"AddEntriesWithMeta_SequenceIncreasesPerMachine", testSequenceIncreasesPerMachine},
+		{"AddEntryWithSequence_SequenceKept", testSequenceKept},
+		{"AddEntryWithoutMeta_NoMetaAssigned", testNoMetaAssigned},
+		{"ConcurrentAddEntries_AllStored", testConcurrentAddEntries},
+		{"ConcurrentAddEntriesWithSameKey_OneSucceeds", testConcurrentAddEntriesWithSameKey},
+		{"ConcurrentAddAndDeleteEntries_Consistent", testConcurrentAddAndDeleteEntries},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, factory(t))
+		})
+	}
+}
+
+// NewEntry returns an entry which can be used to test datastores
+func NewEntry(id string, machineID int) *model.MachineMetrics {
+	internalTemp := 765
+
+	return &model.MachineMetrics{
+		ID:        id,
+		MachineID: machineID,
+		Stats: model.MetricsStats{
+			CPUTemp:      456,
+			FanSpeed:     789,
+			HDDSpace:     987,
+			InternalTemp: &internalTemp,
+			Custom:       map[string]float64{"gpuTemp": 71.5, "psu.voltage": 12.1},
+		},
+		LastLoggedIn: "userA",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+		Labels:       map[string]string{"dc": "eu-west-1", "os": "linux"},
+	}
+}
+
+// newEntryWithMeta returns an entry with ingestion metadata as set by the metrics handler
+func newEntryWithMeta(id string, machineID int) *model.MachineMetrics {
+	entry := NewEntry(id, machineID)
+	entry.Meta = &model.IngestionMeta{
+		ReceivedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		RemoteAddr: "10.0.0.1",
+		UserAgent:  "datastoretest",
+	}
+
+	return entry
+}
+
+// byID returns entries indexed by id, failing if an id is returned more than once
+func byID(t *testing.T, entries []*model.MachineMetrics) map[string]*model.MachineMetrics {
+	indexed := make(map[string]*model.MachineMetrics, len(entries))
+
+	for _, entry := range entries {
+		require.NotNil(t, entry, "Nil entry returned")
+		_, duplicate := indexed[entry.ID]
+		require.False(t, duplicate, "Entry %s returned more than once", entry.ID)
+		indexed[entry.ID] = entry
+	}
+
+	return indexed
+}
+
+func mustAdd(t *testing.T, d datastore.DatastoreInterface, entry *model.MachineMetrics) {
+	rc := d.AddEntry(entry.ID, entry)
+	require.Equal(t, datastore.Success, rc, "Problem adding entry %s: %s", entry.ID, rc.String())
+}
+
+func testGetAllEntriesEmpty(t *testing.T, d datastore.DatastoreInterface) {
+	allEntries := d.GetAllEntries()
+
+	assert.NotNil(t, allEntries, "Empty slice, not nil, should be returned")
+	assert.Empty(t, allEntries, "No entries should be returned")
+}
+
+func testAddEntryWithEmptyKey(t *testing.T, d datastore.DatastoreInterface) {
+	rc := d.AddEntry("", NewEntry("test-id", 1))
+
+	assert.Equal(t, datastore.ErrorKeyNotSpecified, rc, "ReturnCode should be "+datastore.ErrorKeyNotSpecified.String())
+	assert.Empty(t, d.GetAllEntries(), "Nothing should be stored")
+}
+
+func testAddEntryWithNilValue(t *testing.T, d datastore.DatastoreInterface) {
+	rc := d.AddEntry("test-id", nil)
+
+	assert.Equal(t, datastore.ErrorValueNotSpecified, rc, "ReturnCode should be "+datastore.ErrorValueNotSpecified.String())
+	assert.Empty(t, d.GetAllEntries(), "Nothing should be stored")
+}
+
+func testAddEntryWithExistingKey(t *testing.T, d datastore.DatastoreInterface) {
+	first := NewEntry("test-id", 1)
+	mustAdd(t, d, first)
+
+	// same machine, as a router only detects duplicates among the entries of one machine
+	second := NewEntry("test-id", 1)
+	second.LastLoggedIn = "userB"
+	rc := d.AddEntry(second.ID, second)
+
+	assert.Equal(t, datastore.ErrorKeyExists, rc, "ReturnCode should be "+datastore.ErrorKeyExists.String())
+
+	allEntries := d.GetAllEntries()
+	require.Equal(t, 1, len(allEntries), "One entry should be stored")
+	assert.Equal(t, first, allEntries[0], "The first entry should be kept")
+}
+
+func testAddEntryReturned(t *testing.T, d datastore.DatastoreInterface) {
+	entry := NewEntry("test-id", 1)
+	mustAdd(t, d, entry)
+
+	allEntries := d.GetAllEntries()
+	require.Equal(t, 1, len(allEntries), "One entry should be returned")
+	assert.Equal(t, entry, allEntries[0], "Returned entry does not match the one that was added")
+}
+
+func testAddEntryCallersEntryNotModified(t *testing.T, d datastore.DatastoreInterface) {
+	entry := newEntryWithMeta("test-id", 1)
+	mustAdd(t, d, entry)
+
+	assert.Equal(t, newEntryWithMeta("test-id", 1), entry, "Entry passed in should not be modified")
+}
+
+func testAddEntriesAllReturned(t *testing.T, d datastore.DatastoreInterface) {
+	expected := []*model.MachineMetrics{}
+	for i := 0; i < 30; i++ {
+		entry := NewEntry(fmt.Sprintf("test-%d", i), i)
+		mustAdd(t, d, entry)
+		expected = append(expected, entry)
+	}
+
+	allEntries := d.GetAllEntries()
+	byID(t, allEntries)
+
+	assert.ElementsMatch(t, expected, allEntries, "Returned entries do not match the ones that were added")
+}
+
+// entries of a batch are of the same machine, as a router only adds batches of entries on one shard
+func testAddBatchNotAddable(t *testing.T, d datastore.DatastoreInterface) {
+	existing := NewEntry("existing", 1)
+	mustAdd(t, d, existing)
+	version := d.Version()
+
+	batches := []struct {
+		name     string
+		entries  []*model.MachineMetrics
+		expected datastore.DatastoreReturnCode
+	}{
+		{"empty", []*model.MachineMetrics{}, datastore.ErrorValueNotSpecified},
+		{"nil entry", []*model.MachineMetrics{NewEntry("new-1", 1), nil}, datastore.ErrorValueNotSpecified},
+		{"empty key", []*model.MachineMetrics{NewEntry("new-1", 1), NewEntry("", 1)}, datastore.ErrorKeyNotSpecified},
+		{"duplicate key", []*model.MachineMetrics{NewEntry("new-1", 1), NewEntry("new-1", 1)}, datastore.ErrorKeyExists},
+		{"existing key", []*model.MachineMetrics{NewEntry("new-1", 1), NewEntry("existing", 1)}, datastore.ErrorKeyExists},
+	}
+
+	for _, batch := range batches {
+		rc := d.AddBatch(batch.entries)
+		assert.Equal(t, batch.expected, rc, "ReturnCode for a batch with %s should be %s", batch.name, batch.expected.String())
+	}
+
+	assert.Equal(t, []*model.MachineMetrics{existing}, d.GetAllEntries(), "No entry of the batches should be added")
+	assert.Equal(t, version.Tag, d.Version().Tag, "Batches which were not added should not change the version")
+}
+
+func testAddBatch(t *testing.T, d datastore.DatastoreInterface) {
+	version := d.Version()
+
+	batch := []*model.MachineMetrics{newEntryWithMeta("first", 1), newEntryWithMeta("second", 1), NewEntry("third", 1)}
+	rc := d.AddBatch(batch)
+	require.Equal(t, datastore.Success, rc, "ReturnCode should be "+datastore.Success.String())
+
+	assert.Equal(t, newEntryWithMeta("first", 1), batch[0], "Entries passed in should not be modified")
+	assert.NotEqual(t, version.Tag, d.Version().Tag, "Adding a batch should change the version")
+
+	stored := byID(t, d.GetAllEntries())
+	require.Equal(t, 3, len(stored), "All entries of the batch should be returned")
+	assert.Equal(t, batch[2], stored["third"], "Entry without metadata should be returned as added")
+
+	require.NotNil(t, stored["first"].Meta, "Metadata should be returned")
+	require.NotNil(t, stored["second"].Meta, "Metadata should be returned")
+	assert.Greater(t, stored["second"].Meta.Sequence, stored["first"].Meta.Sequence, "Sequence should follow the order of the batch")
+
+	entry, rc := d.GetEntry("second")
+	assert.Equal(t, datastore.Success, rc, "Entry of a batch should be found by its key")
+	assert.Equal(t, stored["second"], entry, "Entry should be the one returned by GetAllEntries")
+
+	mustAdd(t, d, newEntryWithMeta("after", 1))
+	assert.Greater(t, byID(t, d.GetAllEntries())["after"].Meta.Sequence, stored["second"].Meta.Sequence,
+		"Sequence should continue after the batch")
+}
+
+func testGetEntryWithEmptyKey(t *testing.T, d datastore.DatastoreInterface) {
+	entry, rc := d.GetEntry("")
+
+	assert.Equal(t, datastore.ErrorKeyNotSpecified, rc, "ReturnCode should be "+datastore.ErrorKeyNotSpecified.String())
+	assert.Nil(t, entry, "No entry should be returned")
+}
+
+func testGetEntry(t *testing.T, d datastore.DatastoreInterface) {
+	entry, rc := d.GetEntry("test-id")
+	assert.Equal(t, datastore.ErrorKeyNotFound, rc, "ReturnCode should be "+datastore.ErrorKeyNotFound.String())
+	assert.Nil(t, entry, "No entry should be returned")
+
+	added := newEntryWithMeta("test-id", 1)
+	mustAdd(t, d, added)
+	mustAdd(t, d, NewEntry("other", 2))
+
+	entry, rc = d.GetEntry("test-id")
+	require.Equal(t, datastore.Success, rc, "ReturnCode should be "+datastore.Success.String())
+	require.NotNil(t, entry, "Entry should be returned")
+	assert.Equal(t, byID(t, d.GetAllEntries())["test-id"], entry, "Entry should be the one returned by GetAllEntries")
+
+	require.Equal(t, datastore.Success, d.DeleteEntry("test-id"), "Problem deleting entry")
+
+	entry, rc = d.GetEntry("test-id")
+	assert.Equal(t, datastore.ErrorKeyNotFound, rc, "Deleted entry should not be found")
+	assert.Nil(t, entry, "No entry should be returned")
+}
+
+func testDeleteEntryWithEmptyKey(t *testing.T, d datastore.DatastoreInterface) {
+	rc := d.DeleteEntry("")
+
+	assert.Equal(t, datastore.ErrorKeyNotSpecified, rc, "ReturnCode should be "+datastore.ErrorKeyNotSpecified.String())
+}
+
+func testDeleteEntryWithNonExistingKey(t *testing.T, d datastore.DatastoreInterface) {
+	rc := d.DeleteEntry("test-id")
+
+	assert.Equal(t, datastore.ErrorKeyNotFound, rc, "ReturnCode should be "+datastore.ErrorKeyNotFound.String())
+}
+
+func testDeleteEntry(t *testing.T, d datastore.DatastoreInterface) {
+	kept := NewEntry("kept", 1)
+	mustAdd(t, d, kept)
+	mustAdd(t, d, NewEntry("deleted", 2))
+
+	rc := d.DeleteEntry("deleted")
+	assert.Equal(t, datastore.Success, rc, "ReturnCode should be "+datastore.Success.String())
+
+	assert.Equal(t, []*model.MachineMetrics{kept}, d.GetAllEntries(), "Only the kept entry should be returned")
+
+	rc = d.DeleteEntry("deleted")
+	assert.Equal(t, datastore.ErrorKeyNotFound, rc, "Second deletion should return "+datastore.ErrorKeyNotFound.String())
+
+	replacement := NewEntry("deleted", 3)
+	rc = d.AddEntry(replacement.ID, replacement)
+	assert.Equal(t, datastore.Success, rc, "Key of a deleted entry should be free again")
+	assert.ElementsMatch(t, []*model.MachineMetrics{kept, replacement}, d.GetAllEntries(), "Replacement should be returned")
+}
+
+func testVersion(t *testing.T, d datastore.DatastoreInterface) {
+	empty := d.Version()
+	require.NotEmpty(t, empty.Tag, "Version should have a tag")
+
+	mustAdd(t, d, NewEntry("test-id", 1))
+	added := d.Version()
+	assert.NotEqual(t, empty.Tag, added.Tag, "Adding an entry should change the version")
+	assert.False(t, added.Modified.Before(empty.Modified), "Adding an entry should not move Modified back")
+
+	d.GetAllEntries()
+	d.GetEntry("test-id")
+	assert.Equal(t, added.Tag, d.Version().Tag, "Reading entries should not change the version")
+
+	d.AddEntry("test-id", NewEntry("test-id", 1))
+	d.DeleteEntry("missing")
+	assert.Equal(t, added.Tag, d.Version().Tag, "Failed changes should not change the version")
+
+	require.Equal(t, datastore.Success, d.DeleteEntry("test-id"), "Problem deleting entry")
+	deleted := d.Version()
+	assert.NotEqual(t, added.Tag, deleted.Tag, "Deleting an entry should change the version")
+	assert.NotEqual(t, empty.Tag, deleted.Tag, "Version should not go back to that of the empty datastore")
+	assert.False(t, deleted.Modified.Before(added.Modified), "Deleting an entry should not move Modified back")
+}
+
+// sequence numbers are only guaranteed to increase among the reports of one machine,
+// as e.g. a router keeps a separate sequence on each shard
+func testSequenceIncreasesPerMachine(t *testing.T, d datastore.DatastoreInterface) {
+	machines := []int{1, 2, 3}
+
+	var added []string
+	for i := 0; i < orderedEntriesPerMachine; i++ {
+		for _, machineID := range machines {
+			entry := newEntryWithMeta(fmt.Sprintf("machine-%d-%d", machineID, i), machineID)
+			mustAdd(t, d, entry)
+			added = append(added, entry.ID)
+		}
+	}
+
+	stored := byID(t, d.GetAllEntries())
+	require.Equal(t, len(added), len(stored), "All entries should be returned")
+
+	lastSequence := map[int]uint64{}
+	for _, id := range added {
+		entry := stored[id]
+		require.NotNil(t, entry, "Entry %s not returned", id)
+		require.NotNil(t, entry.Meta, "Metadata of entry %s not returned", id)
+
+		assert.Greater(t, entry.Meta.Sequence, lastSequence[entry.MachineID],
+			"Sequence of entry %s should be greater than that of the previous entry of machine %d", id, entry.MachineID)
+		lastSequence[entry.MachineID] = entry.Meta.Sequence
+
+		expected := newEntryWithMeta(id, entry.MachineID)
+		expected.Meta.Sequence = entry.Meta.Sequence
+		assert.Equal(t, expected, entry, "Entry %s should only differ in its sequence", id)
+	}
+}
+
+func testSequenceKept(t *testing.T, d datastore.DatastoreInterface) {
+	moved := newEntryWithMeta("moved", 1)
+	moved.Meta.Sequence = 1000
+	mustAdd(t, d, moved)
+
+	fresh := newEntryWithMeta("fresh", 1)
+	mustAdd(t, d, fresh)
+
+	stored := byID(t, d.GetAllEntries())
+	assert.Equal(t, uint64(1000), stored["moved"].Meta.Sequence, "Existing sequence should be kept")
+	assert.Greater(t, stored["fresh"].Meta.Sequence, uint64(1000), "Sequence should continue after the existing one")
+}
+
+func testNoMetaAssigned(t *testing.T, d datastore.DatastoreInterface) {
+	mustAdd(t, d, NewEntry("test-id", 1))
+
+	allEntries := d.GetAllEntries()
+	require.Equal(t, 1, len(allEntries), "One entry should be returned")
+	assert.Nil(t, allEntries[0].Meta, "Metadata should only be recorded by the metrics handler")
+}
+
+func testConcurrentAddEntries(t *testing.T, d datastore.DatastoreInterface) {
+	var waitGroup sync.WaitGroup
+	results := make([][]datastore.DatastoreReturnCode, concurrentWriters)
+
+	for writer := 0; writer < concurrentWriters; writer++ {
+		waitGroup.Add(1)
+		go func(writer int) {
+			defer waitGroup.Done()
+			for i := 0; i < entriesPerWriter; i++ {
+				entry := newEntryWithMeta(fmt.Sprintf("writer-%d-%d", writer, i), writer)
+				results[writer] = append(results[writer], d.AddEntry(entry.ID, entry))
+
+				// readers run alongside writers
+				d.GetAllEntries()
+			}
+		}(writer)
+	}
+	waitGroup.Wait()
+
+	for writer, codes := range results {
+		for i, rc := range codes {
+			assert.Equal(t, datastore.Success, rc, "Problem adding entry %d of writer %d", i, writer)
+		}
+	}
+
+	stored := byID(t, d.GetAllEntries())
+	assert.Equal(t, concurrentWriters*entriesPerWriter, len(stored), "All entries should be stored")
+
+	// each writer uses its own machine, so its sequence numbers must be unique and increasing
+	for writer := 0; writer < concurrentWriters; writer++ {
+		var last uint64
+		for i := 0; i < entriesPerWriter; i++ {
+			entry := stored[fmt.Sprintf("writer-%d-%d", writer, i)]
+			require.NotNil(t, entry, "Entry %d of writer %d not stored", i, writer)
+			assert.Greater(t, entry.Meta.Sequence, last, "Sequence of writer %d should increase", writer)
+			last = entry.Meta.Sequence
+		}
+	}
+}
+
+func testConcurrentAddEntriesWithSameKey(t *testing.T, d datastore.DatastoreInterface) {
+	var waitGroup sync.WaitGroup
+	results := make([]datastore.DatastoreReturnCode, concurrentDuplicateAdds)
+
+	for i := 0; i < concurrentDuplicateAdds; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			results[i] = d.AddEntry("test-id", NewEntry("test-id", 1))
+		}(i)
+	}
+	waitGroup.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+
+	expected := []datastore.DatastoreReturnCode{datastore.Success}
+	for i := 1; i < concurrentDuplicateAdds; i++ {
+		expected = append(expected, datastore.ErrorKeyExists)
+	}
+
+	assert.Equal(t, expected, results, "Exactly one AddEntry should succeed")
+	assert.Equal(t, 1, len(d.GetAllEntries()), "One entry should be stored")
+}
+
+func testConcurrentAddAndDeleteEntries(t *testing.T, d datastore.DatastoreInterface) {
+	for i := 0; i < entriesPerWriter; i++ {
+		mustAdd(t, d, NewEntry(fmt.Sprintf("deleted-%d", i), i))
+	}
+
+	var waitGroup sync.WaitGroup
+	deleteResults := make([]datastore.DatastoreReturnCode, entriesPerWriter)
+
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		for i := 0; i < entriesPerWriter; i++ {
+			deleteResults[i] = d.DeleteEntry(fmt.Sprintf("deleted-%d", i))
+		}
+	}()
+	go func() {
+		defer waitGroup.Done()
+		for i := 0; i < entriesPerWriter; i++ {
+			entry := NewEntry(fmt.Sprintf("added-%d", i), i)
+			assert.Equal(t, datastore.Success, d.AddEntry(entry.ID, entry), "Problem adding entry %d", i)
+		}
+	}()
+	waitGroup.Wait()
+
+	for i, rc := range deleteResults {
+		assert.Equal(t, datastore.Success, rc, "Problem deleting entry %d", i)
+	}
+
+	stored := byID(t, d.GetAllEntries())
+	assert.Equal(t, entriesPerWriter, len(stored), "Only the added entries should be stored")
+	for id := range stored {
+		assert.Regexp(t, "^added-", id, "Deleted entry %s returned", id)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright Konstantin Bakanov 2023
+
+package datastore
+
+import (
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// AssignSequence returns a copy of entry with the sequence number in its
+// ingestion metadata set to *next, if entry has metadata without one.
+// Entries without metadata are returned as they are, entries which already
+// have a sequence number (e.g. moved from another datastore) keep it.
+// *next is advanced past whatever sequence number the returned entry has,
+// so that numbers keep increasing. It has to be called under a lock
+func AssignSequence(entry *model.MachineMetrics, next *uint64) *model.MachineMetrics {
+	if entry.Meta == nil {
+		return entry
+	}
+
+	if entry.Meta.Sequence != 0 {
+		if entry.Meta.Sequence >= *next {
+			*next = entry.Meta.Sequence + 1
+		}
+		return entry
+	}
+
+	// copy, so that the caller's entry is not modified
+	stamped := *entry
+	meta := *entry.Meta
+	meta.Sequence = *next
+	stamped.Meta = &meta
+
+	*next++
+
+	return &stamped
+}
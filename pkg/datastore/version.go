@@ -0,0 +1,42 @@
+// Copyright Konstantin Bakanov 2023
+
+package datastore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Version identifies the contents of a datastore, it changes whenever an entry is added or deleted
+type Version struct {
+	Tag      string    `json:"tag"`                // opaque, empty if the datastore cannot tell its version
+	Modified time.Time `json:"modified,omitempty"` // when an entry was last added or deleted, zero if not known
+}
+
+// ChangeCounter keeps the Version of a datastore held by one process. Tags start with an id
+// unique to the counter, so that a datastore which is opened again never repeats a tag it
+// had before. Modified starts at the time the counter is created, as the contents may have
+// changed before. It has to be used under the lock of the datastore
+type ChangeCounter struct {
+	epoch    string
+	changes  uint64
+	modified time.Time
+}
+
+// NewChangeCounter returns the counter of a datastore which is being opened
+func NewChangeCounter() *ChangeCounter {
+	return &ChangeCounter{epoch: uuid.New().String(), modified: time.Now()}
+}
+
+// Changed is called whenever an entry is added or deleted
+func (c *ChangeCounter) Changed() {
+	c.changes++
+	c.modified = time.Now()
+}
+
+// Version returns the current version of the datastore
+func (c *ChangeCounter) Version() Version {
+	return Version{Tag: fmt.Sprintf("%s-%d", c.epoch, c.changes), Modified: c.modified}
+}
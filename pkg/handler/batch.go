@@ -0,0 +1,286 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/schema"
+	"github.com/kostik-b/metrics-store/pkg/validation"
+)
+
+// atomicParam makes a batch all or nothing, none of its reports is stored unless all of them can be
+const atomicParam = "atomic"
+
+// DefaultMaxBatchSize is the largest number of reports a POST request can carry, unless set on the handler
+const DefaultMaxBatchSize = 1000
+
+// batchTooLargeError is returned for a batch with more than the allowed number of reports
+type batchTooLargeError struct {
+	maxBatchSize int
+}
+
+func (e *batchTooLargeError) Error() string {
+	return fmt.Sprintf("Batch has more than %d reports", e.maxBatchSize)
+}
+
+// batchItemResult is the outcome for a report of a batch, either the id it was stored with or why it was not
+type batchItemResult struct {
+	Index      int                    `json:"index"` // of the report in the batch
+	Status     int                    `json:"status"`
+	ID         string                 `json:"id,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Violations []validation.Violation `json:"violations,omitempty"`
+}
+
+// batchResponse is the body of a 207 response to a batch, or of a 400 response to an atomic batch
+type batchResponse struct {
+	Message string            `json:"message"`
+	Results []batchItemResult `json:"results"` // in the order of the reports
+}
+
+// startsWithArray tells if the next value of body is a JSON array, without consuming anything but whitespace
+func startsWithArray(body *bufio.Reader) bool {
+	for {
+		next, err := body.Peek(1)
+		if err != nil {
+			return false
+		}
+
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			body.ReadByte()
+		default:
+			return next[0] == '['
+		}
+	}
+}
+
+// parseAtomic parses the atomic parameter, a batch is not atomic unless it is set
+func parseAtomic(query url.Values) (bool, error) {
+	if !query.Has(atomicParam) {
+		return false, nil
+	}
+
+	atomic, err := strconv.ParseBool(query.Get(atomicParam))
+	if err != nil {
+		return false, fmt.Errorf("query parameter %s %q is not true or false", atomicParam, query.Get(atomicParam))
+	}
+
+	return atomic, nil
+}
+
+// readBatch reads the reports of a batch as raw JSON, either a JSON array or, if ndjson, a report per line.
+// A *batchTooLargeError is returned once there are more than maxBatchSize reports
+func readBatch(body io.Reader, ndjson bool, maxBatchSize int) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(body)
+
+	if !ndjson {
+		if _, err := decoder.Token(); err != nil { // the opening bracket
+			return nil, err
+		}
+	}
+
+	reports := []json.RawMessage{}
+	for (ndjson || decoder.More()) && len(reports) <= maxBatchSize {
+		var report json.RawMessage
+		if err := decoder.Decode(&report); err != nil {
+			if ndjson && err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		reports = append(reports, report)
+	}
+
+	if len(reports) > maxBatchSize {
+		return nil, &batchTooLargeError{maxBatchSize: maxBatchSize}
+	}
+	if len(reports) == 0 {
+		return nil, errors.New("batch has no reports")
+	}
+
+	if !ndjson {
+		if _, err := decoder.Token(); err != nil { // the closing bracket
+			return nil, err
+		}
+
+		// check that there is no additional data in the body
+		if err := decoder.Decode(&struct{}{}); err != io.EOF {
+			return nil, errors.New("request body can only contain one JSON array")
+		}
+	}
+
+	return reports, nil
+}
+
+// handleBatch stores the reports of a batch, a JSON array or NDJSON, see storeBatch
+func (m *metricsHandler) handleBatch(responseWriter http.ResponseWriter, request *http.Request, body io.Reader, ndjson bool) {
+	atomic, err := parseAtomic(request.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: POST - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	raws, err := readBatch(body, ndjson, m.MaxBatchSize)
+	if err != nil {
+		var tooLarge *batchTooLargeError
+		if errors.As(err, &tooLarge) {
+			log.Printf("ERROR: POST - %s\n", err.Error())
+			http.Error(responseWriter, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		badRequestParsing(responseWriter, err)
+		return
+	}
+
+	reports := make([]*model.MachineMetrics, len(raws))
+	results := make([]batchItemResult, len(raws))
+	for i, raw := range raws {
+		// reports of an older schemaVersion are upgraded to the current one
+		machineMetrics, err := schema.Decode(raw, m.AllowUnknownFields)
+		if err != nil {
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Error parsing report: "+err.Error()
+			continue
+		}
+
+		reports[i] = machineMetrics
+	}
+
+	m.storeBatch(responseWriter, request, reports, results, atomic)
+}
+
+// storeBatch stores the reports of a batch, results already has the outcome for the reports which could not
+// be decoded. Every report is checked before any of them is stored. Every report is then stored on its own and
+// the outcome for each of them is returned with 207, unless the batch is atomic, see storeAtomicBatch
+func (m *metricsHandler) storeBatch(responseWriter http.ResponseWriter, request *http.Request,
+	reports []*model.MachineMetrics, results []batchItemResult, atomic bool) {
+	rejected := 0
+	for i, machineMetrics := range reports {
+		results[i].Index = i
+		if results[i].Status != 0 {
+			rejected++
+			continue
+		}
+
+		violations, err := m.reportProblems(machineMetrics)
+
+		switch {
+		case err != nil:
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Error parsing report: "+err.Error()
+		case len(violations) > 0:
+			results[i].Status, results[i].Error = http.StatusBadRequest, fmt.Sprintf("Report violates %d validation rules", len(violations))
+			results[i].Violations = violations
+		default:
+			continue
+		}
+
+		reports[i] = nil
+		rejected++
+	}
+
+	if m.Debug {
+		log.Printf("POST - received a batch of %d reports, %d of them rejected\n", len(reports), rejected)
+	}
+
+	if atomic {
+		m.storeAtomicBatch(responseWriter, request, reports, results, rejected)
+		return
+	}
+
+	stored := 0
+	for i, machineMetrics := range reports {
+		if machineMetrics == nil {
+			continue
+		}
+
+		if rc := m.addReport(request, machineMetrics); rc != datastore.Success {
+			log.Printf("ERROR: POST - could not add entry %d of the batch to the datastore: error - %s, key - %s\n", i, rc.String(), machineMetrics.ID)
+			results[i].Status, results[i].Error = storeFailure(rc)
+			continue
+		}
+
+		results[i].Status, results[i].ID = http.StatusCreated, machineMetrics.ID
+		stored++
+	}
+
+	writeBatchResponse(responseWriter, http.StatusMultiStatus, &batchResponse{
+		Message: fmt.Sprintf("%d of %d reports added to the data store", stored, len(reports)),
+		Results: results,
+	})
+}
+
+// storeAtomicBatch stores either all reports of a batch or none of them. If any of them is rejected, the
+// outcome for each of them is returned with 400. Otherwise they are added to the datastore at once, which
+// stores all of them or none
+func (m *metricsHandler) storeAtomicBatch(responseWriter http.ResponseWriter, request *http.Request,
+	reports []*model.MachineMetrics, results []batchItemResult, rejected int) {
+	if rejected > 0 {
+		for i := range results {
+			if reports[i] != nil {
+				results[i].Status, results[i].Error = http.StatusFailedDependency, "Not stored as other reports of the batch were rejected"
+			}
+		}
+
+		log.Printf("ERROR: POST - %d reports of an atomic batch were rejected\n", rejected)
+		writeBatchResponse(responseWriter, http.StatusBadRequest, &batchResponse{
+			Message: fmt.Sprintf("%d of %d reports rejected, none added to the data store", rejected, len(reports)),
+			Results: results,
+		})
+		return
+	}
+
+	ids := make([]string, len(reports))
+	for i, machineMetrics := range reports {
+		m.prepareReport(request, machineMetrics)
+		ids[i] = machineMetrics.ID
+	}
+
+	if rc := m.MetricsDatastore.AddBatch(reports); rc != datastore.Success {
+		log.Printf("ERROR: POST - could not add atomic batch of %d entries to the datastore: error - %s\n", len(reports), rc.String())
+
+		// e.g. a router, when the machines of the reports are on different shards
+		if rc == datastore.ErrorBatchNotSupported {
+			http.Error(responseWriter, "Reports of the batch cannot be stored at once, send them without "+atomicParam, http.StatusBadRequest)
+			return
+		}
+
+		status, message := storeFailure(rc)
+		http.Error(responseWriter, message, status)
+		return
+	}
+
+	writeBatchResponse(responseWriter, http.StatusCreated, &listCreatedResponse{
+		Message: fmt.Sprintf("%d new entries added to the data store", len(ids)),
+		IDs:     ids,
+	})
+}
+
+func writeBatchResponse(responseWriter http.ResponseWriter, status int, response interface{}) {
+	responseAsBytes, err := json.MarshalIndent(response, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: POST - could not marshal batch response: %s\n", err.Error())
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+
+	if _, err := responseWriter.Write(responseAsBytes); err != nil {
+		log.Printf("ERROR: POST - could not write response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// content codings of compressed requests and responses
+const (
+	gzipEncoding     = "gzip"
+	zstdEncoding     = "zstd"
+	identityEncoding = "identity"
+)
+
+// zstdStreamingWindow is the largest window zstd encoders use by default
+const zstdStreamingWindow = 8 << 20
+
+// unsupportedEncodingError is returned for a request body in a content coding which cannot be decompressed
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+func (e *unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("Content-Encoding %s is not supported, only %s and %s are", e.encoding, gzipEncoding, zstdEncoding)
+}
+
+// negotiateEncoding returns the content coding a response is compressed with, as preferred by the
+// Accept-Encoding header, or an empty string if it is not to be compressed. zstd is chosen over gzip
+// if the header prefers neither of them. "*" only stands for the codings the header does not list,
+// so that a coding excluded with q=0 is not chosen through it
+func negotiateEncoding(acceptEncoding string) string {
+	type acceptedCoding struct {
+		coding  string
+		quality float64
+	}
+
+	accepted := []acceptedCoding{}
+	listed := map[string]bool{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+
+		accepted = append(accepted, acceptedCoding{coding: coding, quality: quality})
+		listed[coding] = true
+	}
+
+	best, bestQuality := "", 0.0
+
+	for _, a := range accepted {
+		coding := a.coding
+		if coding == "*" {
+			switch {
+			case !listed[zstdEncoding]:
+				coding = zstdEncoding
+			case !listed[gzipEncoding]:
+				coding = gzipEncoding
+			default:
+				continue
+			}
+		}
+		if coding != gzipEncoding && coding != zstdEncoding {
+			continue
+		}
+
+		if a.quality > bestQuality || (a.quality > 0 && a.quality == bestQuality && coding == zstdEncoding) {
+			best, bestQuality = coding, a.quality
+		}
+	}
+
+	return best
+}
+
+// compressedResponseWriter compresses the body of a response, the Content-Encoding header is set
+// when the status is written, so that error responses set their headers as usual
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	wroteHeader bool
+	hasBody     bool // the status of the response allows a body
+	encoder     io.WriteCloser
+}
+
+// compressResponse returns responseWriter compressing the body in the coding request prefers, or responseWriter
+// itself if the response is not to be compressed. The returned function has to be called once the response is written
+func compressResponse(responseWriter http.ResponseWriter, request *http.Request) (http.ResponseWriter, func()) {
+	// GET responses are in the format negotiated with Accept as well, so caches have to tell both apart
+	responseWriter.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	encoding := negotiateEncoding(request.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return responseWriter, func() {}
+	}
+
+	compressed := &compressedResponseWriter{ResponseWriter: responseWriter, encoding: encoding}
+	return compressed, compressed.close
+}
+
+func (c *compressedResponseWriter) startBody(statusCode int) {
+	c.wroteHeader = true
+	c.hasBody = statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+
+	if c.hasBody {
+		c.Header().Set("Content-Encoding", c.encoding)
+		c.Header().Del("Content-Length") // of the uncompressed body
+	}
+}
+
+func (c *compressedResponseWriter) WriteHeader(statusCode int) {
+	if !c.wroteHeader {
+		c.startBody(statusCode)
+	}
+
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *compressedResponseWriter) Write(data []byte) (int, error) {
+	if !c.wroteHeader {
+		c.startBody(http.StatusOK)
+	}
+	if !c.hasBody {
+		return c.ResponseWriter.Write(data)
+	}
+
+	if c.encoder == nil {
+		if c.encoding == gzipEncoding {
+			c.encoder = gzip.NewWriter(c.ResponseWriter)
+		} else {
+			// a response is compressed by a single goroutine, as requests are served concurrently anyway
+			encoder, err := zstd.NewWriter(c.ResponseWriter, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return 0, err
+			}
+			c.encoder = encoder
+		}
+	}
+
+	return c.encoder.Write(data)
+}
+
+// Flush writes what has been compressed so far, so that streamed responses reach the client
+func (c *compressedResponseWriter) Flush() {
+	if flusher, canFlush := c.encoder.(interface{ Flush() error }); canFlush {
+		flusher.Flush()
+	}
+
+	if flusher, canFlush := c.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the response writer the compressed body is written to,
+// so that http.ResponseController can set the write deadline of a stream
+func (c *compressedResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close writes the end of the compressed body, if anything was written
+func (c *compressedResponseWriter) close() {
+	if c.encoder != nil {
+		c.encoder.Close()
+	}
+}
+
+// decompressedBody returns body of request decompressed as given by its Content-Encoding,
+// an *unsupportedEncodingError is returned for a coding other than gzip and zstd.
+// The size of the decompressed body is not limited, only the memory zstd may need for it
+func decompressedBody(request *http.Request, body io.ReadCloser, maxBodySize int64) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+
+	switch encoding {
+	case "", identityEncoding:
+		return body, nil
+	case gzipEncoding:
+		return gzip.NewReader(body)
+	case zstdEncoding:
+		// a frame may ask for a window as large as it likes, which is allocated before anything is decompressed.
+		// Streaming encoders use a window of up to 8MB, as they do not know the size of the body
+		maxWindow := uint64(zstdStreamingWindow)
+		if maxBodySize > zstdStreamingWindow {
+			maxWindow = uint64(maxBodySize)
+		}
+
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, &unsupportedEncodingError{encoding: encoding}
+}
@@ -0,0 +1,117 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+)
+
+// responseVersion returns the version of what GET responses are made of, the reports and the descriptions
+// of their machines, without reading any of them. It has no tag if the datastore cannot tell its version
+func (m *metricsHandler) responseVersion() datastore.Version {
+	version := m.MetricsDatastore.Version()
+	if version.Tag == "" || m.MachineInfos == nil {
+		return version
+	}
+
+	infos := m.MachineInfos.Version()
+	version.Tag += "/" + infos.Tag
+	if !version.Modified.IsZero() && infos.Modified.After(version.Modified) {
+		version.Modified = infos.Modified
+	}
+
+	return version
+}
+
+// entityTag returns a weak ETag of a GET response, or an empty string if the version is not known.
+// It is worked out from the version of the datastore rather than from the reports, so that it is checked
+// before anything is read, and changes whenever any report is stored or deleted, not only a matching one.
+// The tag is weak as the same reports are returned in different content codings
+func entityTag(format string, query url.Values, version datastore.Version) string {
+	if version.Tag == "" {
+		return ""
+	}
+
+	hash := fnv.New64a()
+
+	// every parameter which could change the response, in a canonical order
+	io.WriteString(hash, format+"\n"+query.Encode()+"\n"+version.Tag)
+
+	return fmt.Sprintf("W/\"%016x\"", hash.Sum64())
+}
+
+// lastModified returns the time sent in Last-Modified, the zero time if none is sent. A change in the
+// same second as now could not be told apart by If-Modified-Since, which only has a precision of seconds,
+// so the header is only sent once the second of the last change has passed
+func lastModified(version datastore.Version, now time.Time) time.Time {
+	if version.Modified.IsZero() || !version.Modified.Before(now.Truncate(time.Second)) {
+		return time.Time{}
+	}
+
+	return version.Modified
+}
+
+// notModified tells if the client already has the response, as its If-None-Match header has the ETag or,
+// without If-None-Match, nothing was added or deleted after its If-Modified-Since header, as in RFC 9110
+func notModified(request *http.Request, etag string, modified time.Time) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+
+			// weak comparison, as the tags are weak
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if modified.IsZero() {
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	// Last-Modified only has a precision of seconds
+	return !modified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// writeNotModified responds with 304 if the client already has the response, after setting the
+// ETag and Last-Modified headers, which are sent with the response either way
+func writeNotModified(responseWriter http.ResponseWriter, request *http.Request, etag string, modified time.Time) bool {
+	if etag != "" {
+		responseWriter.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		responseWriter.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if !notModified(request, etag, modified) {
+		return false
+	}
+
+	responseWriter.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// clearValidators removes the headers set by writeNotModified from an error response
+func clearValidators(responseWriter http.ResponseWriter) {
+	responseWriter.Header().Del("ETag")
+	responseWriter.Header().Del("Last-Modified")
+}
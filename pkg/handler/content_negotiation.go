@@ -0,0 +1,95 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kostik-b/metrics-store/pkg/reportpb"
+)
+
+// formatParam chooses the format of a GET response by name, e.g. format=ndjson, instead of the Accept header
+const formatParam = "format"
+
+// formats are the names formatParam takes, with their media types
+var formats = []struct {
+	name      string
+	mediaType string
+}{
+	{"json", jsonContentType},
+	{"ndjson", ndjsonContentType},
+	{"protobuf", reportpb.ContentType},
+	{"csv", csvContentType},
+}
+
+// responseFormat returns the media type of offers the response to request is written in, as named by
+// formatParam if given, otherwise as negotiated with the Accept header. A name which is not one of offers is rejected
+func responseFormat(request *http.Request, offers ...string) (string, error) {
+	if !request.URL.Query().Has(formatParam) {
+		return negotiate(request.Header.Get("Accept"), offers...), nil
+	}
+
+	format := request.URL.Query().Get(formatParam)
+	names := []string{}
+	for _, known := range formats {
+		for _, offer := range offers {
+			if known.mediaType != offer {
+				continue
+			}
+			if known.name == format {
+				return offer, nil
+			}
+			names = append(names, known.name)
+		}
+	}
+
+	return "", fmt.Errorf("query parameter %s %q is not one of %s", formatParam, format, strings.Join(names, ", "))
+}
+
+// negotiate returns the media type of offers which the Accept header prefers, by its quality and then by
+// the order of the header. A wildcard matches the first offer it covers, and the first offer is returned
+// if the header is empty or accepts none of them, so that clients which do not ask get JSON as they always did
+func negotiate(accept string, offers ...string) string {
+	best, bestQuality := offers[0], 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, found := params["q"]; found {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+
+		for _, offer := range offers {
+			if mediaTypeMatches(mediaType, offer) {
+				if quality > bestQuality {
+					best, bestQuality = offer, quality
+				}
+				break
+			}
+		}
+	}
+
+	return best
+}
+
+// mediaTypeMatches tells if offer is covered by accepted, which can be e.g. "*/*" or "application/*"
+func mediaTypeMatches(accepted, offer string) bool {
+	if accepted == "*/*" || accepted == offer {
+		return true
+	}
+
+	acceptedType, acceptedSubtype, _ := strings.Cut(accepted, "/")
+	offerType, _, _ := strings.Cut(offer, "/")
+
+	return acceptedSubtype == "*" && acceptedType == offerType
+}
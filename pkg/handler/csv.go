@@ -0,0 +1,217 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// csvContentType is the media type of responses with a report per row
+const csvContentType = "text/csv"
+
+// csvColumn is a column of a CSV response, named by the path of the field as selected with fieldsParam
+type csvColumn struct {
+	name  string
+	value func(entry *model.MachineMetrics) string // empty if the report does not have the field
+}
+
+func csvInt(value int) string {
+	return strconv.Itoa(value)
+}
+
+func csvFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// csvText returns a value sent by a client so that spreadsheets do not take it for a formula,
+// by prefixing a value which starts like one with a single quote
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// csvColumns returns the columns of entries in the order of the fields of the JSON format, with a column
+// for every custom metric, disk and label any of them has, ordered by name. Text sent by clients is passed
+// through csvText
+func csvColumns(entries []*model.MachineMetrics) []csvColumn {
+	customMetrics, devices, labelKeys := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, entry := range entries {
+		for name := range entry.Stats.Custom {
+			customMetrics[name] = true
+		}
+		for _, disk := range entry.Stats.Disks {
+			devices[disk.Device] = true
+		}
+		for key := range entry.Labels {
+			labelKeys[key] = true
+		}
+	}
+
+	columns := []csvColumn{
+		{"id", func(entry *model.MachineMetrics) string { return entry.ID }},
+		{"machineId", func(entry *model.MachineMetrics) string { return csvInt(entry.MachineID) }},
+		{"stats.cpuTemp", func(entry *model.MachineMetrics) string { return csvInt(entry.Stats.CPUTemp) }},
+		{"stats.fanSpeed", func(entry *model.MachineMetrics) string { return csvInt(entry.Stats.FanSpeed) }},
+		{"stats.HDDSpace", func(entry *model.MachineMetrics) string { return csvInt(entry.Stats.HDDSpace) }},
+		{"stats.internalTemp", func(entry *model.MachineMetrics) string {
+			if entry.Stats.InternalTemp == nil {
+				return ""
+			}
+			return csvInt(*entry.Stats.InternalTemp)
+		}},
+	}
+
+	for _, name := range sortedKeys(customMetrics) {
+		name := name
+		columns = append(columns, csvColumn{"stats.custom." + name, func(entry *model.MachineMetrics) string {
+			if value, found := entry.Stats.Custom[name]; found {
+				return csvFloat(value)
+			}
+			return ""
+		}})
+	}
+
+	for _, device := range sortedKeys(devices) {
+		for _, field := range []string{"total", "free"} {
+			metric := model.DiskMetricName(device, field)
+			columns = append(columns, csvColumn{"stats." + metric, func(entry *model.MachineMetrics) string {
+				if value, found := entry.Stats.Metric(metric); found {
+					return csvFloat(value)
+				}
+				return ""
+			}})
+		}
+	}
+
+	columns = append(columns,
+		csvColumn{"lastLoggedIn", func(entry *model.MachineMetrics) string { return csvText(entry.LastLoggedIn) }},
+		csvColumn{"sysTime", func(entry *model.MachineMetrics) string { return entry.SysTime.String() }},
+	)
+
+	for _, key := range sortedKeys(labelKeys) {
+		key := key
+		columns = append(columns, csvColumn{"labels." + key, func(entry *model.MachineMetrics) string { return csvText(entry.Labels[key]) }})
+	}
+
+	meta := func(value func(meta *model.IngestionMeta) string) func(entry *model.MachineMetrics) string {
+		return func(entry *model.MachineMetrics) string {
+			if entry.Meta == nil {
+				return ""
+			}
+			return value(entry.Meta)
+		}
+	}
+	machine := func(value func(machine *model.MachineInfo) string) func(entry *model.MachineMetrics) string {
+		return func(entry *model.MachineMetrics) string {
+			if entry.Machine == nil {
+				return ""
+			}
+			return value(entry.Machine)
+		}
+	}
+
+	return append(columns,
+		csvColumn{"meta.receivedAt", meta(func(meta *model.IngestionMeta) string { return meta.ReceivedAt.UTC().Format(time.RFC3339Nano) })},
+		csvColumn{"meta.sequence", meta(func(meta *model.IngestionMeta) string { return strconv.FormatUint(meta.Sequence, 10) })},
+		csvColumn{"meta.remoteAddr", meta(func(meta *model.IngestionMeta) string { return meta.RemoteAddr })},
+		csvColumn{"meta.userAgent", meta(func(meta *model.IngestionMeta) string { return csvText(meta.UserAgent) })},
+		csvColumn{"meta.principal", meta(func(meta *model.IngestionMeta) string { return csvText(meta.Principal) })},
+		csvColumn{"machine.hostname", machine(func(machine *model.MachineInfo) string { return csvText(machine.Hostname) })},
+		csvColumn{"machine.owner", machine(func(machine *model.MachineInfo) string { return csvText(machine.Owner) })},
+		csvColumn{"machine.location", machine(func(machine *model.MachineInfo) string { return csvText(machine.Location) })},
+	)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// selects tells if the column named name is one of the selected fields or inside of one of them
+func (f *fieldSelection) selects(name string) bool {
+	for _, path := range f.paths {
+		selected := strings.Join(path, ".")
+		if name == selected || strings.HasPrefix(name, selected+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeCSV streams entries as RFC 4180 CSV with a header row, a row per report, in the current version of the format.
+// The columns are those of matching, all reports of which entries is a page, so that every page has the same columns.
+// Like writeNDJSON, an error after the first row can only be logged
+func (m *metricsHandler) writeCSV(responseWriter http.ResponseWriter, entries []*model.MachineMetrics, matching []*model.MachineMetrics, fields *fieldSelection) {
+	columns := csvColumns(matching)
+	if fields != nil {
+		selected := []csvColumn{}
+		for _, column := range columns {
+			if fields.selects(column.name) {
+				selected = append(selected, column)
+			}
+		}
+		columns = selected
+	}
+
+	responseWriter.Header().Set("Content-Type", csvContentType+"; charset=utf-8; header=present")
+
+	writer := csv.NewWriter(responseWriter)
+	writer.UseCRLF = true
+
+	controller := http.NewResponseController(responseWriter)
+	m.extendWriteDeadline(controller)
+
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = column.name
+	}
+	if err := writer.Write(row); err != nil {
+		log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+		return
+	}
+
+	flusher, canFlush := responseWriter.(http.Flusher)
+
+	for i, entry := range entries {
+		for j, column := range columns {
+			row[j] = column.value(entry)
+		}
+
+		if err := writer.Write(row); err != nil {
+			log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+			return
+		}
+
+		if (i+1)%streamFlushInterval == 0 {
+			writer.Flush()
+			if canFlush {
+				flusher.Flush()
+			}
+			m.extendWriteDeadline(controller)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+	} else if m.Debug {
+		log.Printf("GET - sent %d entries as CSV\n", len(entries))
+	}
+}
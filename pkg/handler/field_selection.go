@@ -0,0 +1,156 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// fieldsParam selects comma separated fields of reports, the others are left out, e.g. fields=machineId,stats.cpuTemp
+const fieldsParam = "fields"
+
+// selectableFields are the fields of reports which can be selected, with the fields of the objects among them.
+// The keys of labels and stats.custom are selected as e.g. labels.dc and stats.custom.gpuTemp
+var selectableFields = map[string][]string{
+	"id":           nil,
+	"machineId":    nil,
+	"stats":        {"cpuTemp", "fanSpeed", "HDDSpace", "internalTemp", "custom", "disks"},
+	"lastLoggedIn": nil,
+	"login":        {"role", "user"},
+	"sysTime":      nil,
+	"labels":       nil,
+	"meta":         {"receivedAt", "sequence", "remoteAddr", "userAgent", "principal"},
+	"machine":      {"hostname", "owner", "location"},
+}
+
+// mapFields are the fields whose keys are not known in advance, the rest of a path after them is a single key
+var mapFields = map[string]bool{"labels": true, "stats.custom": true}
+
+// fieldSelection holds the paths of the selected fields, e.g. ["stats", "cpuTemp"]
+type fieldSelection struct {
+	paths [][]string
+}
+
+// parseFieldSelection parses the fields parameter, nil is returned if it is not given.
+// A field reports do not have is rejected
+func parseFieldSelection(query url.Values) (*fieldSelection, error) {
+	if query.Get(fieldsParam) == "" {
+		return nil, nil
+	}
+
+	selection := &fieldSelection{}
+	for _, field := range strings.Split(query.Get(fieldsParam), ",") {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+
+		selection.paths = append(selection.paths, path)
+	}
+
+	return selection, nil
+}
+
+func parseFieldPath(field string) ([]string, error) {
+	unknown := fmt.Errorf("query parameter %s cannot select %q, reports do not have it", fieldsParam, field)
+
+	name, rest, nested := strings.Cut(field, ".")
+	children, found := selectableFields[name]
+	if !found {
+		return nil, unknown
+	}
+
+	path := []string{name}
+	for nested {
+		if mapFields[strings.Join(path, ".")] {
+			if rest == "" {
+				return nil, unknown
+			}
+			return append(path, rest), nil
+		}
+
+		name, rest, nested = strings.Cut(rest, ".")
+		if !contains(children, name) {
+			return nil, unknown
+		}
+
+		path, children = append(path, name), nil
+	}
+
+	return path, nil
+}
+
+// projectList leaves out the fields which are not selected from rendered, a list of reports as marshalled as JSON
+func (f *fieldSelection) projectList(rendered interface{}) (interface{}, error) {
+	renderedAsBytes, err := json.Marshal(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(renderedAsBytes, &entries); err != nil {
+		return nil, err
+	}
+
+	projected := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		projected = append(projected, f.project(entry))
+	}
+
+	return projected, nil
+}
+
+// projectEntry leaves out the fields which are not selected from rendered, a single report as marshalled as JSON
+func (f *fieldSelection) projectEntry(rendered interface{}) (interface{}, error) {
+	renderedAsBytes, err := json.Marshal(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.project(renderedAsBytes), nil
+}
+
+func (f *fieldSelection) project(entry json.RawMessage) map[string]interface{} {
+	projected := map[string]interface{}{}
+	for _, path := range f.paths {
+		selectPath(entry, path, projected)
+	}
+
+	return projected
+}
+
+// selectPath copies the field at path from object into selected, if object has it.
+// Objects on the way are only added if some of their fields are selected
+func selectPath(object json.RawMessage, path []string, selected map[string]interface{}) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(object, &fields); err != nil {
+		return // e.g. null, which has no fields
+	}
+
+	value, found := fields[path[0]]
+	if !found {
+		return
+	}
+
+	if len(path) == 1 {
+		selected[path[0]] = value
+		return
+	}
+
+	child, isObject := selected[path[0]].(map[string]interface{})
+	if !isObject {
+		if _, whole := selected[path[0]]; whole {
+			return // the whole object is selected already
+		}
+		child = map[string]interface{}{}
+	}
+
+	selectPath(value, path[1:], child)
+
+	if len(child) > 0 {
+		selected[path[0]] = child
+	}
+}
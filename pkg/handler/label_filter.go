@@ -0,0 +1,58 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// labelParamPrefix starts a query parameter filtering by a label, e.g. label.dc=eu-west-1
+const labelParamPrefix = "label."
+
+// labelFilter maps a label key to the values it may have. A report has to match
+// every key, a key given more than once matches any of its values
+type labelFilter map[string][]string
+
+func parseLabelFilter(query url.Values) (labelFilter, error) {
+	filter := labelFilter{}
+
+	for param, values := range query {
+		if !strings.HasPrefix(param, labelParamPrefix) {
+			continue
+		}
+
+		key := strings.TrimPrefix(param, labelParamPrefix)
+		if !model.ValidLabelKey(key) {
+			return nil, fmt.Errorf("query parameter %s does not name a valid label key", param)
+		}
+
+		filter[key] = values
+	}
+
+	return filter, nil
+}
+
+func (l labelFilter) matches(entry *model.MachineMetrics) bool {
+	for key, values := range l {
+		value, found := entry.Labels[key]
+		if !found || !contains(values, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
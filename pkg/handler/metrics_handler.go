@@ -3,16 +3,40 @@
 package handler
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/machines"
+	"github.com/kostik-b/metrics-store/pkg/metadata"
 	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/reportpb"
+	"github.com/kostik-b/metrics-store/pkg/schema"
+	"github.com/kostik-b/metrics-store/pkg/validation"
 )
 
+// Path is the route of the collection of reports, a single report is at Path/{id}
+const Path = "/metrics"
+
+// jsonContentType is the media type of JSON requests and responses
+const jsonContentType = "application/json"
+
+// schemaVersionParam is the query parameter GET requests ask for an older version of the report format with
+const schemaVersionParam = "schemaVersion"
+
 // an HTTP handler to handle incoming requests
 // making it unexported as its member variables have to be set
 type metricsHandler struct {
@@ -20,6 +44,40 @@ type metricsHandler struct {
 	Debug              bool
 	AllowUnknownFields bool
 	MaxBodySize        int64
+
+	// MetricsRegistry describes the metrics, values outside of their valid range are rejected.
+	// Ranges are not checked if it is nil
+	MetricsRegistry *metadata.Registry
+
+	// ValidationRules are checked for every report, all violations are reported together.
+	// No rules are checked if it is nil
+	ValidationRules *validation.RulesFile
+
+	// MachineInfos describe machines, the description is returned with every report of the machine.
+	// Reports are returned as stored if it is nil
+	MachineInfos *machines.InfoStore
+
+	// LabelLimits restricts the number and the length of labels of a report
+	LabelLimits model.LabelLimits
+
+	// LenientSysTime accepts a sysTime which is not in a known time format, it is stored as sent
+	LenientSysTime bool
+
+	// PrincipalHeader is the request header which carries the authenticated user,
+	// e.g. set by an authenticating reverse proxy. Principal is not recorded if empty
+	PrincipalHeader string
+
+	// DefaultPageSize is the number of reports returned by a GET request without a limit,
+	// MaxPageSize the largest limit which can be asked for
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// MaxBatchSize is the largest number of reports a POST request can carry
+	MaxBatchSize int
+
+	// StreamWriteTimeout is the time NDJSON and CSV responses have to write every streamFlushInterval
+	// reports, instead of the WriteTimeout of the server for the whole response. It is not set if 0
+	StreamWriteTimeout time.Duration
 }
 
 func NewMetricsHandler(metricsDatastore datastore.DatastoreInterface,
@@ -30,16 +88,38 @@ func NewMetricsHandler(metricsDatastore datastore.DatastoreInterface,
 		Debug:              debug,
 		AllowUnknownFields: allowUnknownFields,
 		MaxBodySize:        maxBodySize,
+		LabelLimits:        model.DefaultLabelLimits,
+		DefaultPageSize:    DefaultPageSize,
+		MaxPageSize:        DefaultMaxPageSize,
+		MaxBatchSize:       DefaultMaxBatchSize,
+		StreamWriteTimeout: DefaultStreamWriteTimeout,
 	}
 }
 
 // implementing http.Handler interface
 func (m *metricsHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
 
+	// a single report
+	if id, found := strings.CutPrefix(request.URL.Path, Path+"/"); found && id != "" {
+		if request.Method == "GET" {
+			compressed, closeCompressed := compressResponse(responseWriter, request)
+			defer closeCompressed()
+
+			m.handleGetEntryRequest(compressed, request, id)
+		} else {
+			responseWriter.Header().Set("Allow", "GET")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
 	// differentiate between post and get
 	// if unknown return 405
 	if request.Method == "GET" {
-		m.handleGetRequest(responseWriter, request)
+		compressed, closeCompressed := compressResponse(responseWriter, request)
+		defer closeCompressed()
+
+		m.handleGetRequest(compressed, request)
 	} else if request.Method == "POST" {
 		m.handlePostRequest(responseWriter, request)
 	} else {
@@ -60,22 +140,121 @@ func (m *metricsHandler) handleGetRequest(responseWriter http.ResponseWriter, re
 		log.Println("Handling GET request")
 	}
 
+	filter, err := parseQueryFilter(request.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	schemaVersion, err := parseSchemaVersion(request.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := responseFormat(request, jsonContentType, reportpb.ContentType, ndjsonContentType, csvContentType)
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// streamed responses are only paged if a limit is given
+	defaultPageSize := m.DefaultPageSize
+	if format == ndjsonContentType || format == csvContentType {
+		defaultPageSize = math.MaxInt
+	}
+
+	paging, err := parsePageRequest(request.URL.Query(), defaultPageSize, m.MaxPageSize)
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fields, err := parseFieldSelection(request.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == reportpb.ContentType && !protobufAvailable(responseWriter, schemaVersion, fields) {
+		return
+	}
+	if format == csvContentType && !versionAvailable(responseWriter, schemaVersion, "CSV") {
+		return
+	}
+
+	// the version is taken before the entries are read, so a change in between
+	// can only make the client ask again, not keep an outdated response
+	version := m.responseVersion()
+	if writeNotModified(responseWriter, request, entityTag(format, request.URL.Query(), version), lastModified(version, time.Now())) {
+		if m.Debug {
+			log.Println("GET - entries not modified")
+		}
+		return
+	}
+
 	allEntries := m.MetricsDatastore.GetAllEntries()
 
 	if allEntries == nil {
 		log.Println("ERROR: GET - could not get entries from the datastore")
+		clearValidators(responseWriter)
 		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	allEntriesAsBytes, err := json.MarshalIndent(allEntries, "", "  ") // for easier readability
+	matching := filter.filter(allEntries)
+	total := len(matching)
+
+	allEntries, next := paging.page(matching)
+	allEntries = m.withMachineInfo(allEntries)
+
+	if err := paging.setPageHeaders(responseWriter, request.URL, next, total); err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		clearValidators(responseWriter)
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case reportpb.ContentType:
+		m.writeProtobuf(responseWriter, allEntries)
+		return
+	case ndjsonContentType:
+		m.writeNDJSON(responseWriter, allEntries, schemaVersion, fields)
+		return
+	case csvContentType:
+		m.writeCSV(responseWriter, allEntries, matching, fields)
+		return
+	}
+
+	rendered, err := schema.Render(allEntries, schemaVersion)
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if fields != nil {
+		if rendered, err = fields.projectList(rendered); err != nil {
+			log.Printf("ERROR: GET - could not select fields of entries: %s\n", err.Error())
+			http.Error(responseWriter, "Error selecting fields", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	allEntriesAsBytes, err := json.MarshalIndent(rendered, "", "  ") // for easier readability
 	if err != nil {
 		log.Printf("ERROR: GET - could not marshal entries as a byte array: %s\n", err.Error())
 		http.Error(responseWriter, "Error marshalling entries", http.StatusInternalServerError)
 		return
 	}
 
-	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Content-Type", jsonContentType)
 
 	// the 200 header will be set automatically
 	_, err = responseWriter.Write(allEntriesAsBytes)
@@ -91,80 +270,269 @@ func (m *metricsHandler) handleGetRequest(responseWriter http.ResponseWriter, re
 
 }
 
+// handleGetEntryRequest responds with the report with the given id
+func (m *metricsHandler) handleGetEntryRequest(responseWriter http.ResponseWriter, request *http.Request, id string) {
+	if m.Debug {
+		log.Printf("Handling GET request for entry %s\n", id)
+	}
+
+	// ids are assigned by us, so anything which is not a UUID cannot be found
+	if _, err := uuid.Parse(id); err != nil {
+		log.Printf("ERROR: GET - malformed entry id %q\n", id)
+		writeEntryError(responseWriter, http.StatusBadRequest, fmt.Sprintf("Entry id %q is not a valid UUID", id), id)
+		return
+	}
+
+	schemaVersion, err := parseSchemaVersion(request.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fields, err := parseFieldSelection(request.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := responseFormat(request, jsonContentType, reportpb.ContentType)
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, rc := m.MetricsDatastore.GetEntry(id)
+
+	if rc == datastore.ErrorKeyNotFound {
+		if m.Debug {
+			log.Printf("GET - entry %s not found\n", id)
+		}
+		writeEntryError(responseWriter, http.StatusNotFound, "No entry in the data store with id - "+id, id)
+		return
+	}
+
+	if rc != datastore.Success {
+		log.Printf("ERROR: GET - could not get entry %s from the datastore: %s\n", id, rc.String())
+		if rc == datastore.ErrorNotAvailable {
+			http.Error(responseWriter, "Service Unavailable", http.StatusServiceUnavailable)
+		} else {
+			http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	entry = m.withMachineInfo([]*model.MachineMetrics{entry})[0]
+
+	if format == reportpb.ContentType {
+		if !protobufAvailable(responseWriter, schemaVersion, fields) {
+			return
+		}
+
+		responseWriter.Header().Set("Content-Type", reportpb.ContentType)
+		if _, err := responseWriter.Write(reportpb.Marshal(entry)); err != nil {
+			log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+		}
+		return
+	}
+
+	rendered, err := schema.RenderEntry(entry, schemaVersion)
+	if err != nil {
+		log.Printf("ERROR: GET - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if fields != nil {
+		if rendered, err = fields.projectEntry(rendered); err != nil {
+			log.Printf("ERROR: GET - could not select fields of entry %s: %s\n", id, err.Error())
+			http.Error(responseWriter, "Error selecting fields", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	entryAsBytes, err := json.MarshalIndent(rendered, "", "  ") // for easier readability
+	if err != nil {
+		log.Printf("ERROR: GET - could not marshal entry %s: %s\n", id, err.Error())
+		http.Error(responseWriter, "Error marshalling entry", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", jsonContentType)
+
+	if _, err = responseWriter.Write(entryAsBytes); err != nil {
+		log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+	} else if m.Debug {
+		log.Printf("GET - sending response: %v\n", string(entryAsBytes))
+	}
+}
+
+// entryErrorResponse is the body of a 400 or 404 response to a request for a single report
+type entryErrorResponse struct {
+	Message string `json:"message"`
+	ID      string `json:"id"`
+}
+
+func writeEntryError(responseWriter http.ResponseWriter, status int, message, id string) {
+	responseAsBytes, err := json.MarshalIndent(&entryErrorResponse{Message: message, ID: id}, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: GET - could not marshal error response: %s\n", err.Error())
+		http.Error(responseWriter, message, status)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", jsonContentType)
+	responseWriter.WriteHeader(status)
+
+	if _, err = responseWriter.Write(responseAsBytes); err != nil {
+		log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+	}
+}
+
+// versionAvailable responds with 400 and returns false unless schemaVersion is the current one,
+// the only one format is available in
+func versionAvailable(responseWriter http.ResponseWriter, schemaVersion int, format string) bool {
+	if schemaVersion == schema.CurrentVersion {
+		return true
+	}
+
+	errMsg := fmt.Sprintf("schemaVersion %d is not available as %s, only version %d is", schemaVersion, format, schema.CurrentVersion)
+	log.Printf("ERROR: GET - %s\n", errMsg)
+	http.Error(responseWriter, errMsg, http.StatusBadRequest)
+	return false
+}
+
+// protobufAvailable responds with 400 and returns false unless schemaVersion is the current one
+// and no fields are selected, as messages always have all of them
+func protobufAvailable(responseWriter http.ResponseWriter, schemaVersion int, fields *fieldSelection) bool {
+	if !versionAvailable(responseWriter, schemaVersion, "protobuf") {
+		return false
+	}
+
+	if fields != nil {
+		errMsg := fmt.Sprintf("query parameter %s is not available as protobuf", fieldsParam)
+		log.Printf("ERROR: GET - %s\n", errMsg)
+		http.Error(responseWriter, errMsg, http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// writeProtobuf responds with entries as a MachineMetricsList message
+func (m *metricsHandler) writeProtobuf(responseWriter http.ResponseWriter, entries []*model.MachineMetrics) {
+	responseWriter.Header().Set("Content-Type", reportpb.ListContentType)
+
+	if _, err := responseWriter.Write(reportpb.MarshalList(entries)); err != nil {
+		log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+		http.Error(responseWriter, "Error writing response", http.StatusInternalServerError)
+	} else if m.Debug {
+		log.Printf("GET - sending %d entries as protobuf\n", len(entries))
+	}
+}
+
 func (m *metricsHandler) handlePostRequest(responseWriter http.ResponseWriter, request *http.Request) {
 	if m.Debug {
 		log.Printf("Handling POST request")
 	}
 
 	// check whether content type is correct
+	mediaType, params := jsonContentType, map[string]string{}
 	if contentType := request.Header.Get("Content-Type"); contentType != "" {
-		if contentType != "application/json" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != jsonContentType && mediaType != ndjsonContentType && mediaType != reportpb.ContentType) {
 			if m.Debug {
 				log.Printf("POST - received incorrect content type %s\n", contentType)
 			}
-			http.Error(responseWriter, "Content-Type header is not application/json", http.StatusUnsupportedMediaType)
+			http.Error(responseWriter, "Content-Type header is not application/json, application/x-ndjson or application/x-protobuf", http.StatusUnsupportedMediaType)
 			return
 		}
 	}
 
-	requestBodyMaxBytesReader := http.MaxBytesReader(responseWriter, request.Body, m.MaxBodySize)
-
-	decoder := json.NewDecoder(requestBodyMaxBytesReader)
+	// the limit applies to the body as sent and once it is decompressed, so that a small compressed body
+	// cannot expand into an arbitrarily large one
+	body, err := decompressedBody(request, http.MaxBytesReader(responseWriter, request.Body, m.MaxBodySize), m.MaxBodySize)
+	if err != nil {
+		var unsupported *unsupportedEncodingError
+		if errors.As(err, &unsupported) {
+			if m.Debug {
+				log.Printf("POST - received unsupported content encoding %s\n", unsupported.encoding)
+			}
+			http.Error(responseWriter, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
 
-	// disallow unknown fields in the request
-	if !m.AllowUnknownFields {
-		decoder.DisallowUnknownFields()
+		badRequestParsing(responseWriter, err)
+		return
 	}
+	defer body.Close()
 
-	var machineMetrics *model.MachineMetrics = &model.MachineMetrics{}
-	err := decoder.Decode(&machineMetrics)
+	requestBodyMaxBytesReader := bufio.NewReader(http.MaxBytesReader(responseWriter, body, m.MaxBodySize))
 
-	if err != nil {
-		errMsg := "Error parsing request body: " + err.Error()
-		log.Printf("ERROR: %s\n", errMsg)
-		http.Error(responseWriter, errMsg, http.StatusBadRequest)
+	// a JSON array or NDJSON is a batch, each of its reports is stored on its own
+	if mediaType == ndjsonContentType || (mediaType == jsonContentType && startsWithArray(requestBodyMaxBytesReader)) {
+		m.handleBatch(responseWriter, request, requestBodyMaxBytesReader, mediaType == ndjsonContentType)
 		return
 	}
 
-	// check that there is no additional data in the body
-	err = decoder.Decode(&struct{}{})
-	if err != io.EOF {
-		log.Println("ERROR: POST - request body contains more than one object")
-		http.Error(responseWriter, "Request body can only contain one JSON object", http.StatusBadRequest)
+	var reports []*model.MachineMetrics
+	var isList, ok bool
+	if mediaType == reportpb.ContentType {
+		reports, isList, ok = decodeProtobuf(responseWriter, requestBodyMaxBytesReader, reportpb.MessageType(params))
+	} else {
+		reports, ok = m.decodeJSON(responseWriter, requestBodyMaxBytesReader)
+	}
+
+	if !ok {
 		return
 	}
 
-	// if we got to here, then it's all good
-	if m.Debug {
-		log.Printf("POST - successfully received and decoded request: %#v\n", machineMetrics)
+	if len(reports) > m.MaxBatchSize {
+		err := &batchTooLargeError{maxBatchSize: m.MaxBatchSize}
+		log.Printf("ERROR: POST - %s\n", err.Error())
+		http.Error(responseWriter, err.Error(), http.StatusRequestEntityTooLarge)
+		return
 	}
 
-	machineMetrics.ID = uuid.New().String()
+	// a protobuf list is a batch as well
+	if isList {
+		atomic, err := parseAtomic(request.URL.Query())
+		if err != nil {
+			log.Printf("ERROR: POST - %s\n", err.Error())
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	rc := m.MetricsDatastore.AddEntry(machineMetrics.ID, machineMetrics)
+		m.storeBatch(responseWriter, request, reports, make([]batchItemResult, len(reports)), atomic)
+		return
+	}
 
-	// in a super rare case when the UUID is duplicate, generate another one
-	if rc == datastore.ErrorKeyExists {
-		log.Printf("ERROR: POST - could not add entry to the datastore: error - %s, key - %s, value - %#v\n", rc.String(), machineMetrics.ID, machineMetrics)
-		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+	machineMetrics := reports[0]
+	if !m.checkReport(responseWriter, machineMetrics) {
 		return
+	}
 
-	} else if rc != datastore.Success {
-		// if it's any other error, just return 500
-		log.Printf("ERROR: POST - could not add entry to the datastore: error - %s, key - %s, value - %#v\n", rc.String(), machineMetrics.ID, machineMetrics)
-		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+	// if we got to here, then it's all good
+	if m.Debug {
+		log.Printf("POST - successfully received and decoded request: %#v\n", machineMetrics)
+	}
+
+	if !m.storeReport(responseWriter, request, machineMetrics) {
 		return
 	}
 
 	responseWriter.Header().Set("Content-Type", "application/json")
 	responseWriter.WriteHeader(http.StatusCreated)
 
-	response := make(map[string]string)
-
-	// this is for human readability
-	response["message"] = "New entry added to the data store with id - " + machineMetrics.ID
-	// this is for machine parsing
-	response["id"] = machineMetrics.ID
+	response := map[string]string{
+		// this is for human readability
+		"message": "New entry added to the data store with id - " + machineMetrics.ID,
+		// this is for machine parsing
+		"id": machineMetrics.ID,
+	}
 
 	responseAsBytes, err := json.MarshalIndent(response, "", "  ") // for readability
 	if err != nil {
@@ -184,3 +552,274 @@ func (m *metricsHandler) handlePostRequest(responseWriter http.ResponseWriter, r
 	}
 
 }
+
+// listCreatedResponse is the body of a 201 response to an atomic batch
+type listCreatedResponse struct {
+	Message string   `json:"message"`
+	IDs     []string `json:"ids"` // in the order of the reports
+}
+
+// decodeJSON reads one JSON report of any supported schemaVersion,
+// it responds with 400 and returns false if the body cannot be parsed
+func (m *metricsHandler) decodeJSON(responseWriter http.ResponseWriter, body io.Reader) ([]*model.MachineMetrics, bool) {
+	decoder := json.NewDecoder(body)
+
+	var report json.RawMessage
+	err := decoder.Decode(&report)
+
+	if err != nil {
+		badRequestParsing(responseWriter, err)
+		return nil, false
+	}
+
+	// check that there is no additional data in the body
+	err = decoder.Decode(&struct{}{})
+	if err != io.EOF {
+		log.Println("ERROR: POST - request body contains more than one object")
+		http.Error(responseWriter, "Request body can only contain one JSON object", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// reports of an older schemaVersion are upgraded to the current one
+	machineMetrics, err := schema.Decode(report, m.AllowUnknownFields)
+	if err != nil {
+		badRequestParsing(responseWriter, err)
+		return nil, false
+	}
+
+	return []*model.MachineMetrics{machineMetrics}, true
+}
+
+// decodeProtobuf reads a MachineMetrics or a MachineMetricsList message, as named by messageType,
+// it responds with 400 and returns false if the body cannot be parsed
+func decodeProtobuf(responseWriter http.ResponseWriter, body io.Reader, messageType string) (reports []*model.MachineMetrics, isList bool, ok bool) {
+	if messageType != reportpb.MessageTypeReport && messageType != reportpb.MessageTypeList {
+		badRequestParsing(responseWriter, fmt.Errorf("messageType %q is not %s or %s", messageType, reportpb.MessageTypeReport, reportpb.MessageTypeList))
+		return nil, false, false
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		badRequestParsing(responseWriter, err)
+		return nil, false, false
+	}
+
+	if messageType == reportpb.MessageTypeList {
+		reports, err = reportpb.UnmarshalList(data)
+		if err == nil && len(reports) == 0 {
+			err = errors.New("list has no reports")
+		}
+		isList = true
+	} else {
+		var machineMetrics *model.MachineMetrics
+		machineMetrics, err = reportpb.Unmarshal(data)
+		reports = []*model.MachineMetrics{machineMetrics}
+	}
+
+	if err != nil {
+		badRequestParsing(responseWriter, err)
+		return nil, false, false
+	}
+
+	return reports, isList, true
+}
+
+// badRequestParsing responds with 400 to a request body which cannot be parsed
+func badRequestParsing(responseWriter http.ResponseWriter, err error) {
+	errMsg := "Error parsing request body: " + err.Error()
+	log.Printf("ERROR: %s\n", errMsg)
+	http.Error(responseWriter, errMsg, http.StatusBadRequest)
+}
+
+// checkReport responds with 400 and returns false if machineMetrics cannot be stored
+func (m *metricsHandler) checkReport(responseWriter http.ResponseWriter, machineMetrics *model.MachineMetrics) bool {
+	violations, err := m.reportProblems(machineMetrics)
+
+	if err != nil {
+		badRequestParsing(responseWriter, err)
+		return false
+	}
+
+	if len(violations) > 0 {
+		log.Printf("ERROR: POST - report violates %d validation rules\n", len(violations))
+		writeViolations(responseWriter, violations)
+		return false
+	}
+
+	return true
+}
+
+// reportProblems returns why machineMetrics cannot be stored, either the validation rules it violates
+// or an error, neither if it can be stored
+func (m *metricsHandler) reportProblems(machineMetrics *model.MachineMetrics) ([]validation.Violation, error) {
+	if !machineMetrics.SysTime.Valid() && !m.LenientSysTime {
+		if machineMetrics.SysTime.Raw != "" {
+			return nil, fmt.Errorf("sysTime %q is not in a known time format", machineMetrics.SysTime.Raw)
+		}
+		return nil, errors.New("sysTime is missing")
+	}
+
+	if err := machineMetrics.Stats.Validate(); err != nil {
+		return nil, err
+	}
+
+	if violations := m.violations(machineMetrics); len(violations) > 0 {
+		return violations, nil
+	}
+
+	return nil, m.LabelLimits.Validate(machineMetrics.Labels)
+}
+
+// storeReport adds machineMetrics to the datastore with the fields the server assigns,
+// it responds with an error and returns false if it could not be added
+func (m *metricsHandler) storeReport(responseWriter http.ResponseWriter, request *http.Request, machineMetrics *model.MachineMetrics) bool {
+	rc := m.addReport(request, machineMetrics)
+	if rc == datastore.Success {
+		return true
+	}
+
+	status, message := storeFailure(rc)
+	if status == http.StatusServiceUnavailable {
+		log.Printf("ERROR: POST - could not add entry to the datastore: error - %s, key - %s\n", rc.String(), machineMetrics.ID)
+	} else {
+		log.Printf("ERROR: POST - could not add entry to the datastore: error - %s, key - %s, value - %#v\n", rc.String(), machineMetrics.ID, machineMetrics)
+	}
+
+	http.Error(responseWriter, message, status)
+	return false
+}
+
+// addReport assigns the fields the server is responsible for to machineMetrics and adds it to the datastore
+func (m *metricsHandler) addReport(request *http.Request, machineMetrics *model.MachineMetrics) datastore.DatastoreReturnCode {
+	m.prepareReport(request, machineMetrics)
+
+	return m.MetricsDatastore.AddEntry(machineMetrics.ID, machineMetrics)
+}
+
+// prepareReport assigns the fields the server is responsible for to machineMetrics
+func (m *metricsHandler) prepareReport(request *http.Request, machineMetrics *model.MachineMetrics) {
+	machineMetrics.ID = uuid.New().String()
+
+	// whatever the client sent as metadata is replaced, the sequence number is assigned by the datastore
+	machineMetrics.Meta = m.ingestionMeta(request)
+
+	// whatever the client sent as login is replaced as well
+	machineMetrics.Login = model.ParseLogin(machineMetrics.LastLoggedIn)
+
+	// the description of the machine is kept in the machine registry
+	machineMetrics.Machine = nil
+}
+
+// storeFailure returns the status and the message of the response to a report the datastore could not add
+func storeFailure(rc datastore.DatastoreReturnCode) (int, string) {
+	// e.g. a cluster without a leader, the client can retry later
+	if rc == datastore.ErrorNotAvailable {
+		return http.StatusServiceUnavailable, "Service Unavailable"
+	}
+
+	// including the super rare case of a duplicate UUID
+	return http.StatusInternalServerError, "Internal Server Error"
+}
+
+// parseSchemaVersion returns the version entries are requested in, the current one if none is given.
+// A version which is not supported is rejected
+func parseSchemaVersion(query url.Values) (int, error) {
+	if !query.Has(schemaVersionParam) {
+		return schema.CurrentVersion, nil
+	}
+
+	version, err := strconv.Atoi(query.Get(schemaVersionParam))
+	if err != nil {
+		return 0, fmt.Errorf("query parameter %s has to be a number", schemaVersionParam)
+	}
+
+	return version, schema.Supported(version)
+}
+
+// withMachineInfo returns entries with the descriptions of their machines, the entries themselves are not modified
+func (m *metricsHandler) withMachineInfo(entries []*model.MachineMetrics) []*model.MachineMetrics {
+	if m.MachineInfos == nil {
+		return entries
+	}
+
+	infos := m.MachineInfos.All()
+	if len(infos) == 0 {
+		return entries
+	}
+
+	described := make([]*model.MachineMetrics, 0, len(entries))
+	for _, entry := range entries {
+		if info, found := infos[entry.MachineID]; found {
+			copied := *entry
+			copied.Machine = &info
+			entry = &copied
+		}
+		described = append(described, entry)
+	}
+
+	return described
+}
+
+// violations checks entry against the valid ranges of the metrics and the validation rules
+func (m *metricsHandler) violations(entry *model.MachineMetrics) []validation.Violation {
+	violations := []validation.Violation{}
+
+	if m.MetricsRegistry != nil {
+		for _, rangeErr := range m.MetricsRegistry.Violations(entry.Stats) {
+			violations = append(violations, validation.Violation{Field: validation.MetricField(rangeErr.Metric), Message: rangeErr.Error()})
+		}
+	}
+
+	if m.ValidationRules != nil {
+		violations = append(violations, m.ValidationRules.Rules().Validate(entry)...)
+	}
+
+	return violations
+}
+
+// violationsResponse is the body of a 400 response to a report which breaks validation rules
+type violationsResponse struct {
+	Message    string                 `json:"message"`
+	Violations []validation.Violation `json:"violations"`
+}
+
+func writeViolations(responseWriter http.ResponseWriter, violations []validation.Violation) {
+	response := &violationsResponse{
+		Message:    fmt.Sprintf("Report violates %d validation rules", len(violations)),
+		Violations: violations,
+	}
+
+	responseAsBytes, err := json.MarshalIndent(response, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: POST - could not marshal violations: %s\n", err.Error())
+		http.Error(responseWriter, response.Message, http.StatusBadRequest)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusBadRequest)
+
+	if _, err = responseWriter.Write(responseAsBytes); err != nil {
+		log.Printf("ERROR: POST - could not write response: %s\n", err.Error())
+	}
+}
+
+// ingestionMeta records what we know about the request a report arrived in
+func (m *metricsHandler) ingestionMeta(request *http.Request) *model.IngestionMeta {
+	meta := &model.IngestionMeta{
+		ReceivedAt: time.Now().UTC(),
+		RemoteAddr: request.RemoteAddr,
+		UserAgent:  request.UserAgent(),
+	}
+
+	// drop the port, it is different for every connection
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		meta.RemoteAddr = host
+	}
+
+	if m.PrincipalHeader != "" {
+		meta.Principal = request.Header.Get(m.PrincipalHeader)
+	}
+
+	return meta
+}
@@ -1,15 +1,32 @@
 package handler
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/machines"
+	"github.com/kostik-b/metrics-store/pkg/metadata"
 	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/reportpb"
+	"github.com/kostik-b/metrics-store/pkg/validation"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
@@ -29,7 +46,7 @@ var dummyMachineMetrics model.MachineMetrics = model.MachineMetrics{
 		InternalTemp: &internalTemp,
 	},
 	LastLoggedIn: "userA",
-	SysTime:      "timestamp",
+	SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
 }
 
 // implements Datastore interface
@@ -37,6 +54,7 @@ type datastoreMock struct {
 	mock.Mock
 
 	addEntryArgument *model.MachineMetrics
+	version          ds.Version // returned by Version, without a tag unless a test sets one
 }
 
 func (d *datastoreMock) GetAllEntries() []*model.MachineMetrics {
@@ -44,6 +62,16 @@ func (d *datastoreMock) GetAllEntries() []*model.MachineMetrics {
 	return args.Get(0).([]*model.MachineMetrics)
 }
 
+func (d *datastoreMock) Version() ds.Version {
+	return d.version
+}
+
+func (d *datastoreMock) GetEntry(key string) (*model.MachineMetrics, ds.DatastoreReturnCode) {
+	args := d.Called(key)
+	entry, _ := args.Get(0).(*model.MachineMetrics)
+	return entry, args.Get(1).(ds.DatastoreReturnCode)
+}
+
 func (d *datastoreMock) AddEntry(key string, value *model.MachineMetrics) ds.DatastoreReturnCode {
 	d.addEntryArgument = value
 
@@ -51,6 +79,16 @@ func (d *datastoreMock) AddEntry(key string, value *model.MachineMetrics) ds.Dat
 	return args.Get(0).(ds.DatastoreReturnCode)
 }
 
+func (d *datastoreMock) AddBatch(entries []*model.MachineMetrics) ds.DatastoreReturnCode {
+	args := d.Called(entries)
+	return args.Get(0).(ds.DatastoreReturnCode)
+}
+
+func (d *datastoreMock) DeleteEntry(key string) ds.DatastoreReturnCode {
+	args := d.Called(key)
+	return args.Get(0).(ds.DatastoreReturnCode)
+}
+
 // implements http.ResponseWriter interface
 type responseWriterMock struct {
 	mock.Mock
@@ -68,7 +106,9 @@ func (r *responseWriterMock) Header() http.Header {
 func (r *responseWriterMock) Write(msg []byte) (int, error) {
 	r.writeArgument = string(msg)
 
-	args := r.Called(msg)
+	// callers such as fmt.Fprintln reuse their buffer once Write returns,
+	// so the mock has to keep its own copy
+	args := r.Called([]byte(r.writeArgument))
 	return args.Int(0), args.Error(1)
 }
 
@@ -128,7 +168,7 @@ func (s *MetricsHandlerTestSuite) Test_GET_OneElementInDatastore_ReturnsOneEleme
       "internalTemp": 765
     },
     "lastLoggedIn": "userA",
-    "sysTime": "timestamp"
+    "sysTime": "2021-07-28T14:16:27Z"
   }
 ]`
 
@@ -160,7 +200,7 @@ func (s *MetricsHandlerTestSuite) Test_GET_ThreeElementsInDatastore_ReturnsThree
 	expectedJSON :=
 		`[
   {
-    "id": "test-id",
+    "id": "test-1",
     "machineId": 123,
     "stats": {
       "cpuTemp": 456,
@@ -169,30 +209,30 @@ func (s *MetricsHandlerTestSuite) Test_GET_ThreeElementsInDatastore_ReturnsThree
       "internalTemp": 765
     },
     "lastLoggedIn": "userA",
-    "sysTime": "timestamp"
+    "sysTime": "2021-07-28T14:16:27Z"
   },
   {
-    "id": "test-1",
+    "id": "test-2",
     "machineId": 123,
     "stats": {
       "cpuTemp": 456,
       "fanSpeed": 789,
-      "HDDSpace": 987,
-      "internalTemp": 765
+      "HDDSpace": 987
     },
     "lastLoggedIn": "userA",
-    "sysTime": "timestamp"
+    "sysTime": "2021-07-28T14:16:27Z"
   },
   {
-    "id": "test-2",
+    "id": "test-id",
     "machineId": 123,
     "stats": {
       "cpuTemp": 456,
       "fanSpeed": 789,
-      "HDDSpace": 987
+      "HDDSpace": 987,
+      "internalTemp": 765
     },
     "lastLoggedIn": "userA",
-    "sysTime": "timestamp"
+    "sysTime": "2021-07-28T14:16:27Z"
   }
 ]`
 
@@ -229,10 +269,21 @@ func (s *MetricsHandlerTestSuite) Test_GET_ThreeElementsInDatastore_ReturnsThree
 	assert.Equal(s.T(), contentType, "application/json", "Content type is incorrect")
 }
 
-func (s *MetricsHandlerTestSuite) Test_GET_NilElementsFromDatastore_Returns500() {
-	// set return values on datastore mock
-	var machineMetrics []*model.MachineMetrics
-	s.dstoreMock.On("GetAllEntries").Return(machineMetrics)
+func (s *MetricsHandlerTestSuite) Test_GET_LabelFilter_ReturnsMatchingEntries() {
+	labelled := func(id string, labels map[string]string) *model.MachineMetrics {
+		entry := dummyMachineMetrics
+		entry.ID = id
+		entry.Labels = labels
+		return &entry
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{
+		labelled("eu-linux", map[string]string{"dc": "eu-west-1", "os": "linux"}),
+		labelled("eu-windows", map[string]string{"dc": "eu-west-1", "os": "windows"}),
+		labelled("us-linux", map[string]string{"dc": "us-east-1", "os": "linux"}),
+		labelled("ap-linux", map[string]string{"dc": "ap-south-1", "os": "linux"}),
+		labelled("unlabelled", nil),
+	})
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -240,61 +291,73 @@ func (s *MetricsHandlerTestSuite) Test_GET_NilElementsFromDatastore_Returns500()
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?label.os=linux&label.dc=eu-west-1&label.dc=us-east-1", nil)
 	assert.Nil(s.T(), err, "Problem creating request")
 
 	metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// inspect call to response writer
-	responseBody := "Internal Server Error\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
-}
-
-func (s *MetricsHandlerTestSuite) Test_GET_CannotWriteResponse_Returns500() {
-	// set return values on datastore mock
-	machineMetrics := []*model.MachineMetrics{}
-	machineMetrics = append(machineMetrics, &dummyMachineMetrics)
+	var returned []*model.MachineMetrics
+	assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
 
-	s.dstoreMock.On("GetAllEntries").Return(machineMetrics)
+	ids := []string{}
+	for _, entry := range returned {
+		ids = append(ids, entry.ID)
+	}
+	assert.Equal(s.T(), []string{"eu-linux", "us-linux"}, ids, "Only entries with matching labels should be returned")
+}
 
+func (s *MetricsHandlerTestSuite) Test_GET_InvalidLabelFilter_Returns400() {
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
 	// set return values on response writer mock
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
-	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0,
-		fmt.Errorf("dummy error"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?label.=linux", nil)
 	assert.Nil(s.T(), err, "Problem creating request")
 
 	metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// inspect calls to response writer
-	responseBody := "Error writing response\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("query parameter label. does not name a valid label key\n"))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
 }
 
-// --------------- POST --------------------
-
-func (s *MetricsHandlerTestSuite) Test_POST_WrongContentType_Returns415() {
-	// even though request body is irrelevant at the moment, we still have to set it since
-	// the implementation can change
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    }`
-
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+func (s *MetricsHandlerTestSuite) Test_GET_QueryFilter_ReturnsMatchingEntries() {
+	report := func(id string, machineID int, cpuTemp int, lastLoggedIn string, sysTime time.Time) *model.MachineMetrics {
+		entry := dummyMachineMetrics
+		entry.ID = id
+		entry.MachineID = machineID
+		entry.Stats.CPUTemp = cpuTemp
+		entry.Stats.Custom = map[string]float64{"gpuTemp": float64(cpuTemp) - 10}
+		entry.LastLoggedIn = lastLoggedIn
+		entry.SysTime = model.NewSysTime(sysTime)
+		return &entry
+	}
+
+	day := time.Date(2022, 4, 21, 0, 0, 0, 0, time.UTC)
+	entries := []*model.MachineMetrics{
+		report("hot", 1, 90, "admin/Tim", day.Add(time.Hour)),
+		report("cool", 1, 50, "admin/Tim", day.Add(2*time.Hour)),
+		report("other-machine", 3, 95, "admin/Tim", day.Add(time.Hour)),
+		report("user", 2, 85, "user/Ann", day.Add(time.Hour)),
+		report("day-before", 2, 85, "admin/Ian", day.Add(-time.Hour)),
+		report("at-to", 2, 85, "admin/Ian", day.Add(24*time.Hour)),
+	}
+
+	filters := map[string][]string{
+		"machineId=1&machineId=2":                            {"at-to", "cool", "day-before", "hot", "user"},
+		"from=2022-04-21T00:00:00Z&to=2022-04-22%2000:00:00": {"cool", "hot", "other-machine", "user"},
+		"lastLoggedIn=admin/Tim&lastLoggedIn=user/Ann":       {"cool", "hot", "other-machine", "user"},
+		"lastLoggedIn.prefix=admin/I":                        {"at-to", "day-before"},
+		"cpuTemp.gt=80&cpuTemp.lte=90":                       {"at-to", "day-before", "hot", "user"},
+		"gpuTemp.gte=80&machineId=1&machineId=3":             {"hot", "other-machine"},
+		"internalTemp.eq=765&cpuTemp.ne=85":                  {"cool", "hot", "other-machine"},
+		"memoryUsed.gt=0":                                    {},
+		"machineId=2&from=1650499200&lastLoggedIn.prefix=":   {"at-to", "user"},
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return(entries)
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -302,37 +365,53 @@ func (s *MetricsHandlerTestSuite) Test_POST_WrongContentType_Returns415() {
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
-	assert.Nil(s.T(), err, "Problem creating request")
+	for query, expectedIDs := range filters {
+		request, err := http.NewRequest("GET", "http://localhost:4000/metrics?"+query, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
 
-	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	metricsHandler.ServeHTTP(s.respWriterMock, request)
+		var returned []*model.MachineMetrics
+		assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
 
-	// inspect call to response writer
-	responseBody := "Content-Type header is not application/json\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusUnsupportedMediaType)
+		ids := []string{}
+		for _, entry := range returned {
+			ids = append(ids, entry.ID)
+		}
+		assert.Equal(s.T(), expectedIDs, ids, "Entries returned for %s are incorrect", query)
+	}
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_MalformedJSON_Returns400() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    }`
-
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+func (s *MetricsHandlerTestSuite) Test_GET_MetaFilter_ReturnsMatchingEntries() {
+	report := func(id string, meta *model.IngestionMeta) *model.MachineMetrics {
+		entry := dummyMachineMetrics
+		entry.ID = id
+		entry.Meta = meta
+		return &entry
+	}
+
+	received := time.Date(2022, 4, 21, 19, 0, 0, 0, time.UTC)
+	entries := []*model.MachineMetrics{
+		report("early", &model.IngestionMeta{ReceivedAt: received.Add(-time.Minute), RemoteAddr: "10.0.0.1", Principal: "ann"}),
+		report("at-from", &model.IngestionMeta{ReceivedAt: received, RemoteAddr: "10.0.0.2", Principal: "tim"}),
+		report("later", &model.IngestionMeta{ReceivedAt: received.Add(time.Hour), RemoteAddr: "10.0.0.1"}),
+		report("no-meta", nil),
+	}
+
+	filters := map[string][]string{
+		"meta.receivedAt.from=2022-04-21T19:00:00Z":                                        {"at-from", "later"},
+		"meta.receivedAt.to=2022-04-21%2020:00:00":                                         {"at-from", "early"},
+		"meta.receivedAt.from=1650567600&meta.receivedAt.to=2022-04-21T20:00:00Z":          {"at-from"},
+		"meta.principal=ann&meta.principal=tim":                                            {"at-from", "early"},
+		"meta.remoteAddr=10.0.0.1":                                                         {"early", "later"},
+		"meta.remoteAddr=10.0.0.1&meta.principal=ann":                                      {"early"},
+		"meta.remoteAddr=10.0.0.3":                                                         {},
+		"meta.receivedAt.from=2022-04-21T00:00:00Z&meta.remoteAddr=10.0.0.2&machineId=123": {"at-from"},
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return(entries)
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -340,37 +419,35 @@ func (s *MetricsHandlerTestSuite) Test_POST_MalformedJSON_Returns400() {
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
-	assert.Nil(s.T(), err, "Problem creating request")
+	for query, expectedIDs := range filters {
+		request, err := http.NewRequest("GET", "http://localhost:4000/metrics?"+query, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
 
-	request.Header.Set("Content-Type", "application/json")
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	metricsHandler.ServeHTTP(s.respWriterMock, request)
+		var returned []*model.MachineMetrics
+		assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
 
-	// inspect call to response writer
-	responseBody := "Error parsing request body: invalid character '\"' after object key:value pair\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+		ids := []string{}
+		for _, entry := range returned {
+			ids = append(ids, entry.ID)
+		}
+		assert.Equal(s.T(), expectedIDs, ids, "Entries returned for %s are incorrect", query)
+	}
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_MoreThanOneJSONObject_Returns400() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    },`
-
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+func (s *MetricsHandlerTestSuite) Test_GET_InvalidQueryFilter_Returns400() {
+	filters := map[string]string{
+		"machineId=web-1": "query parameter machineId \"web-1\" is not a number",
+		"from=yesterday":  "query parameter from \"yesterday\" is not in a known time format",
+		"from=2022-04-22T00:00:00Z&to=2022-04-21T00:00:00Z": "query parameter from has to be before to",
+		"cpuTemp.gt=hot":          "query parameter cpuTemp.gt \"hot\" is not a number",
+		"cpu%20temp.lt=5":         "query parameter cpu temp.lt does not name a valid metric",
+		"meta.receivedAt.to=soon": "query parameter meta.receivedAt.to \"soon\" is not in a known time format",
+		"meta.receivedAt.from=2022-04-22T00:00:00Z&meta.receivedAt.to=2022-04-22T00:00:00Z": "query parameter meta.receivedAt.from has to be before meta.receivedAt.to",
+	}
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -378,75 +455,166 @@ func (s *MetricsHandlerTestSuite) Test_POST_MoreThanOneJSONObject_Returns400() {
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
-	assert.Nil(s.T(), err, "Problem creating request")
+	for query, expectedError := range filters {
+		request, err := http.NewRequest("GET", "http://localhost:4000/metrics?"+query, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
 
-	request.Header.Set("Content-Type", "application/json")
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	metricsHandler.ServeHTTP(s.respWriterMock, request)
+		s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedError+"\n"))
+	}
 
-	// inspect call to response writer
-	responseBody := "Request body can only contain one JSON object\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertNumberOfCalls(s.T(), "WriteHeader", len(filters))
 	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
+}
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+func (s *MetricsHandlerTestSuite) Test_GET_Pages_NoneSkippedOrRepeatedWhileWriting() {
+	received := time.Date(2022, 4, 21, 19, 25, 44, 0, time.UTC)
+	report := func(id string, sequence uint64) *model.MachineMetrics {
+		entry := dummyMachineMetrics
+		entry.ID = id
+		entry.Meta = &model.IngestionMeta{ReceivedAt: received.Add(time.Duration(sequence) * time.Second), Sequence: sequence}
+		return &entry
+	}
+
+	// the order of the datastore is not the order of the pages
+	before := []*model.MachineMetrics{report("e3", 3), report("e1", 1), report("e5", 5), report("e2", 2), report("e4", 4)}
+
+	// e1 is deleted and e6 is stored after the first page is returned
+	after := []*model.MachineMetrics{report("e6", 6), report("e4", 4), report("e2", 2), report("e5", 5), report("e3", 3)}
+
+	s.dstoreMock.On("GetAllEntries").Return(before).Once()
+	s.dstoreMock.On("GetAllEntries").Return(after)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	nextLink := regexp.MustCompile(`^<(.+)>; rel="next"$`)
+
+	pages := [][]string{}
+	totalCounts := []string{}
+	path := "/metrics?limit=2&machineId=123&totalCount=true"
+	for path != "" {
+		s.respWriterMock.responseHeader = make(http.Header)
+
+		request, err := http.NewRequest("GET", "http://localhost:4000"+path, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
+
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+		var returned []*model.MachineMetrics
+		assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
+
+		ids := []string{}
+		for _, entry := range returned {
+			ids = append(ids, entry.ID)
+		}
+		pages = append(pages, ids)
+		totalCounts = append(totalCounts, s.respWriterMock.responseHeader.Get("X-Total-Count"))
+
+		path = ""
+		if link := s.respWriterMock.responseHeader.Get("Link"); link != "" {
+			match := nextLink.FindStringSubmatch(link)
+			if !assert.NotNil(s.T(), match, "Link header %q is not a next link", link) {
+				break
+			}
+			assert.Contains(s.T(), match[1], "machineId=123", "Next link should keep the filters")
+			path = match[1]
+		}
+	}
+
+	assert.Equal(s.T(), [][]string{{"e1", "e2"}, {"e3", "e4"}, {"e5", "e6"}}, pages, "Pages are incorrect")
+	assert.Equal(s.T(), []string{"5", "5", "5"}, totalCounts, "X-Total-Count should be the number of matching entries")
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_RequestBodyTooLarge_Returns400() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    }`
+func (s *MetricsHandlerTestSuite) Test_GET_Pages_ReportStoredLateComesAfterCursor() {
+	received := time.Date(2022, 4, 21, 19, 25, 44, 0, time.UTC)
+	datastore := ds.NewDatastoreAsMap()
+	store := func(id string, receivedAt time.Time) {
+		entry := dummyMachineMetrics
+		entry.ID = id
+		entry.Meta = &model.IngestionMeta{ReceivedAt: receivedAt}
+		assert.Equal(s.T(), ds.Success, datastore.AddEntry(id, &entry), "Problem adding entry %s", id)
+	}
+
+	for i := 1; i <= 4; i++ {
+		store(fmt.Sprintf("e%d", i), received.Add(time.Duration(i)*time.Second))
+	}
+
+	metricsHandler := NewMetricsHandler(datastore, false, false, defaultMaxBodySize)
+	nextLink := regexp.MustCompile(`^<(.+)>; rel="next"$`)
+
+	pages := [][]string{}
+	path := "/metrics?limit=2"
+	for path != "" {
+		recorder := httptest.NewRecorder()
+		metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+
+		var returned []*model.MachineMetrics
+		if !assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &returned), "Problem parsing response") {
+			break
+		}
+
+		ids := []string{}
+		for _, entry := range returned {
+			ids = append(ids, entry.ID)
+		}
+		pages = append(pages, ids)
+
+		// reports received before the ones already returned, but stored while the client is paging,
+		// as with requests which took longer
+		store(fmt.Sprintf("late%d", len(pages)), received)
+
+		path = ""
+		if match := nextLink.FindStringSubmatch(recorder.Header().Get("Link")); match != nil {
+			path = match[1]
+		}
+	}
+
+	assert.Equal(s.T(), [][]string{{"e1", "e2"}, {"e3", "e4"}, {"late1", "late2"}}, pages,
+		"Reports stored while paging should come after the cursor")
+}
 
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+func (s *MetricsHandlerTestSuite) Test_GET_DefaultPageSize_ReturnsFirstPage() {
+	first, second := dummyMachineMetrics, dummyMachineMetrics
+	first.ID, second.ID = "test-1", "test-2"
 
-	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, 2)
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&second, &first})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.DefaultPageSize = 1
 
 	// set return values on response writer mock
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
 	assert.Nil(s.T(), err, "Problem creating request")
 
-	request.Header.Set("Content-Type", "application/json")
-
 	metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// inspect call to response writer
-	responseBody := "Error parsing request body: http: request body too large\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	var returned []*model.MachineMetrics
+	assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
+	assert.Equal(s.T(), []*model.MachineMetrics{&first}, returned, "Only the first entry should be returned")
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+	assert.Regexp(s.T(), `^</metrics\?cursor=[A-Za-z0-9_-]+>; rel="next"$`, s.respWriterMock.responseHeader.Get("Link"), "Link header is incorrect")
+	assert.Empty(s.T(), s.respWriterMock.responseHeader.Get("X-Total-Count"), "X-Total-Count should only be set when asked for")
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_CannotAddToDatastoreKeyExists_Returns500() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    }`
-
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.ErrorKeyExists)
+func (s *MetricsHandlerTestSuite) Test_GET_InvalidPageParameters_Returns400() {
+	queries := map[string]string{
+		"limit=0":          "query parameter limit \"0\" has to be a number from 1 to 10000",
+		"limit=10001":      "query parameter limit \"10001\" has to be a number from 1 to 10000",
+		"limit=all":        "query parameter limit \"all\" has to be a number from 1 to 10000",
+		"cursor=e3":        "query parameter cursor \"e3\" is not a cursor returned by the server",
+		"totalCount=maybe": "query parameter totalCount \"maybe\" is not true or false",
+	}
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -454,37 +622,52 @@ func (s *MetricsHandlerTestSuite) Test_POST_CannotAddToDatastoreKeyExists_Return
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
-	assert.Nil(s.T(), err, "Problem creating request")
-
-	request.Header.Set("Content-Type", "application/json")
+	for query, expectedError := range queries {
+		request, err := http.NewRequest("GET", "http://localhost:4000/metrics?"+query, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
 
-	metricsHandler.ServeHTTP(s.respWriterMock, request)
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// inspect call to response writer
-	responseBody := "Internal Server Error\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+		s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedError+"\n"))
+	}
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+	s.respWriterMock.AssertNumberOfCalls(s.T(), "WriteHeader", len(queries))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_CannotAddToDatastoreKeyNotSpecified_Returns500() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    }`
-
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.ErrorKeyNotSpecified)
+func (s *MetricsHandlerTestSuite) Test_GET_Sort_ReturnsEntriesInOrder() {
+	report := func(id string, machineID int, cpuTemp int, gpuTemp *float64, sysTime model.SysTime) *model.MachineMetrics {
+		entry := dummyMachineMetrics
+		entry.ID = id
+		entry.MachineID = machineID
+		entry.Stats.CPUTemp = cpuTemp
+		if gpuTemp != nil {
+			entry.Stats.Custom = map[string]float64{"gpuTemp": *gpuTemp}
+		}
+		entry.SysTime = sysTime
+		return &entry
+	}
+
+	hot, cool := 95.0, 45.5
+	day := time.Date(2022, 4, 21, 0, 0, 0, 0, time.UTC)
+	entries := []*model.MachineMetrics{
+		report("a", 2, 80, &cool, model.NewSysTime(day.Add(time.Hour))),
+		report("b", 1, 90, nil, model.NewSysTime(day)),
+		report("c", 1, 70, &hot, model.SysTime{Raw: "yesterday"}),
+		report("d", 2, 90, nil, model.NewSysTime(day)),
+	}
+
+	sorts := map[string][]string{
+		"sort=sysTime,-cpuTemp":  {"b", "d", "a", "c"},
+		"sort=-sysTime,id":       {"a", "b", "d", "c"},
+		"sort=machineId,cpuTemp": {"c", "b", "a", "d"},
+		"sort=-gpuTemp":          {"c", "a", "b", "d"},
+		"sort=gpuTemp":           {"a", "c", "b", "d"},
+		"sort=-id&limit=3":       {"d", "c", "b"},
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return(entries)
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -492,38 +675,56 @@ func (s *MetricsHandlerTestSuite) Test_POST_CannotAddToDatastoreKeyNotSpecified_
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
-	assert.Nil(s.T(), err, "Problem creating request")
+	for query, expectedIDs := range sorts {
+		request, err := http.NewRequest("GET", "http://localhost:4000/metrics?"+query, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
 
-	request.Header.Set("Content-Type", "application/json")
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+		var returned []*model.MachineMetrics
+		assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
+
+		ids := []string{}
+		for _, entry := range returned {
+			ids = append(ids, entry.ID)
+		}
+		assert.Equal(s.T(), expectedIDs, ids, "Entries returned for %s are incorrect", query)
+	}
 
+	// the next page continues in the same order
+	s.respWriterMock.responseHeader = make(http.Header)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?sort=sysTime,-cpuTemp&limit=2", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
 	metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// inspect call to response writer
-	responseBody := "Internal Server Error\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+	link := regexp.MustCompile(`^<(.+)>; rel="next"$`).FindStringSubmatch(s.respWriterMock.responseHeader.Get("Link"))
+	if assert.NotNil(s.T(), link, "Link header should be set") {
+		request, err = http.NewRequest("GET", "http://localhost:4000"+link[1], nil)
+		assert.Nil(s.T(), err, "Problem creating request")
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+		var returned []*model.MachineMetrics
+		assert.Nil(s.T(), json.Unmarshal([]byte(s.respWriterMock.writeArgument), &returned), "Problem parsing response")
+		assert.Equal(s.T(), []*model.MachineMetrics{entries[0], entries[2]}, returned, "Second page is incorrect")
+	}
+
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldNotAllowed_Returns400() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
-        "extraField": "extraValue",
-        "sysTime": "2022-04-23T18:25:43.511Z"
-    }`
+func (s *MetricsHandlerTestSuite) Test_GET_InvalidSortOrFields_Returns400() {
+	cursor, err := encodeCursor(pageKey{Sort: "sysTime", Values: []sortValue{{Text: "2022-04-21T00:00:00.000000000Z"}}, ID: "b"})
+	assert.Nil(s.T(), err, "Problem encoding cursor")
 
-	// set return values on datastore mock
-	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+	queries := map[string]string{
+		"sort=cpu%20temp":                "query parameter sort cannot sort by \"cpu temp\", it is not a field or a metric",
+		"sort=sysTime,,id":               "query parameter sort cannot sort by \"\", it is not a field or a metric",
+		"sort=-cpuTemp&cursor=" + cursor: "query parameter cursor was returned for a different sort",
+		"fields=machineId,hostname":      "query parameter fields cannot select \"hostname\", reports do not have it",
+		"fields=stats.gpuTemp":           "query parameter fields cannot select \"stats.gpuTemp\", reports do not have it",
+		"fields=sysTime.year":            "query parameter fields cannot select \"sysTime.year\", reports do not have it",
+		"fields=labels.":                 "query parameter fields cannot select \"labels.\", reports do not have it",
+	}
 
 	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
@@ -531,32 +732,1166 @@ func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldNotAllowed_Returns400()
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
 	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
 
-	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
-		strings.NewReader(requestBody))
-	assert.Nil(s.T(), err, "Problem creating request")
+	for query, expectedError := range queries {
+		request, err := http.NewRequest("GET", "http://localhost:4000/metrics?"+query, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
 
-	request.Header.Set("Content-Type", "application/json")
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	metricsHandler.ServeHTTP(s.respWriterMock, request)
+		s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedError+"\n"))
+	}
 
-	// inspect call to response writer
-	responseBody := "Error parsing request body: json: unknown field \"extraField\"\n"
-	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertNumberOfCalls(s.T(), "WriteHeader", len(queries))
 	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
-
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldAllowed_Returns201() {
-	requestBody :=
-		`{
-        "machineId": 12345,
-        "stats": {
-            "cpuTemp": 90,
-            "fanSpeed": 400,
-            "HDDSpace": 800
-        },
-        "lastLoggedIn": "admin/Paul",
+func (s *MetricsHandlerTestSuite) Test_GET_Fields_ReturnsSelectedFields() {
+	expectedJSON :=
+		`[
+  {
+    "machineId": 123,
+    "stats": {
+      "cpuTemp": 456
+    }
+  },
+  {
+    "labels": {
+      "dc.zone": "eu-west-1a"
+    },
+    "machineId": 123,
+    "meta": {
+      "sequence": 7
+    },
+    "stats": {
+      "cpuTemp": 456,
+      "custom": {
+        "gpuTemp": 71.5
+      }
+    }
+  }
+]`
+
+	selected := dummyMachineMetrics
+	selected.ID = "test-1"
+	selected.Stats.Custom = map[string]float64{"gpuTemp": 71.5, "psu": 12}
+	selected.Labels = map[string]string{"dc.zone": "eu-west-1a", "os": "linux"}
+	selected.Meta = &model.IngestionMeta{Sequence: 7, RemoteAddr: "10.0.0.7"}
+
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&selected, &dummyMachineMetrics})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET",
+		"http://localhost:4000/metrics?fields=machineId,stats.cpuTemp,stats.custom.gpuTemp,labels.dc.zone,meta.sequence,machine", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
+
+	// protobuf messages always have all the fields
+	request.Header.Set("Accept", "application/x-protobuf")
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("query parameter fields is not available as protobuf\n"))
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_Conditional_Returns304WhenNotModified() {
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&dummyMachineMetrics})
+	s.dstoreMock.version = ds.Version{Tag: "v1", Modified: time.Date(2022, 4, 21, 19, 27, 44, 17000000, time.UTC)}
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	get := func(query string, headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/metrics"+query, nil)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+
+		recorder := httptest.NewRecorder()
+		metricsHandler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	response := get("", nil)
+	etag := response.Header().Get("ETag")
+	assert.Equal(s.T(), http.StatusOK, response.Code, "Status is incorrect")
+	assert.Regexp(s.T(), `^W/"[0-9a-f]{16}"$`, etag, "ETag is incorrect")
+	assert.Equal(s.T(), "Thu, 21 Apr 2022 19:27:44 GMT", response.Header().Get("Last-Modified"), "Last-Modified is incorrect")
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "GetAllEntries", 1)
+
+	response = get("", map[string]string{"If-None-Match": `"other", ` + etag})
+	assert.Equal(s.T(), http.StatusNotModified, response.Code, "Unchanged entries should not be returned")
+	assert.Empty(s.T(), response.Body.String(), "304 should have no body")
+	assert.Equal(s.T(), etag, response.Header().Get("ETag"), "ETag should be sent with 304")
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "GetAllEntries", 1)
+
+	response = get("?machineId=123", map[string]string{"If-None-Match": etag})
+	assert.Equal(s.T(), http.StatusOK, response.Code, "ETag of other filters should not match")
+	filteredETag := response.Header().Get("ETag")
+	assert.NotEqual(s.T(), etag, filteredETag, "Filters should change the ETag")
+
+	response = get("", map[string]string{"If-Modified-Since": "Thu, 21 Apr 2022 19:27:44 GMT"})
+	assert.Equal(s.T(), http.StatusNotModified, response.Code, "Nothing was changed since If-Modified-Since")
+
+	response = get("", map[string]string{"If-Modified-Since": "Thu, 21 Apr 2022 19:27:44 GMT", "If-None-Match": `"other"`})
+	assert.Equal(s.T(), http.StatusOK, response.Code, "If-None-Match should take precedence over If-Modified-Since")
+
+	// a report is stored or deleted
+	s.dstoreMock.version = ds.Version{Tag: "v2", Modified: time.Date(2022, 4, 21, 19, 30, 0, 0, time.UTC)}
+
+	response = get("?machineId=123", map[string]string{"If-None-Match": filteredETag})
+	assert.Equal(s.T(), http.StatusOK, response.Code, "Change of the datastore should change the ETag")
+
+	response = get("", map[string]string{"If-Modified-Since": "Thu, 21 Apr 2022 19:27:44 GMT"})
+	assert.Equal(s.T(), http.StatusOK, response.Code, "Datastore was changed since If-Modified-Since")
+	etag = response.Header().Get("ETag")
+
+	// a machine is described, in the current second
+	infos, err := machines.NewInfoStore("")
+	assert.Nil(s.T(), err, "Problem creating machine info store")
+	metricsHandler.MachineInfos = infos
+	assert.Nil(s.T(), infos.Put(123, model.MachineInfo{Hostname: "web-1"}), "Problem describing machine")
+
+	response = get("", map[string]string{"If-None-Match": etag})
+	assert.Equal(s.T(), http.StatusOK, response.Code, "Description of a machine should change the ETag")
+	assert.NotEmpty(s.T(), response.Header().Get("ETag"), "ETag should be sent")
+	assert.Empty(s.T(), response.Header().Get("Last-Modified"), "Last-Modified should not be sent in the second of a change")
+	etag = response.Header().Get("ETag")
+
+	response = get("", map[string]string{"If-None-Match": etag})
+	assert.Equal(s.T(), http.StatusNotModified, response.Code, "Nothing was changed since the description")
+
+	// the datastore cannot tell its version
+	s.dstoreMock.version = ds.Version{}
+
+	response = get("", map[string]string{"If-None-Match": "*"})
+	assert.Equal(s.T(), http.StatusOK, response.Code, "Entries should be returned without a known version")
+	assert.Empty(s.T(), response.Header().Get("ETag"), "ETag should not be sent without a known version")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_DescribedMachine_ReturnsMachineInfo() {
+	expectedJSON :=
+		`[
+  {
+    "id": "test-id",
+    "machineId": 123,
+    "stats": {
+      "cpuTemp": 456,
+      "fanSpeed": 789,
+      "HDDSpace": 987,
+      "internalTemp": 765
+    },
+    "lastLoggedIn": "userA",
+    "sysTime": "2021-07-28T14:16:27Z",
+    "machine": {
+      "hostname": "web-1",
+      "owner": "ops"
+    }
+  }
+]`
+
+	infos, err := machines.NewInfoStore("")
+	assert.Nil(s.T(), err, "Problem creating store")
+	assert.Nil(s.T(), infos.Put(123, model.MachineInfo{Hostname: "web-1", Owner: "ops"}), "Problem describing machine")
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&dummyMachineMetrics})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.MachineInfos = infos
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+	assert.Nil(s.T(), dummyMachineMetrics.Machine, "Stored entry should not be modified")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_EntryWithDisks_ReturnsDisks() {
+	expectedJSON :=
+		`[
+  {
+    "id": "test-id",
+    "machineId": 123,
+    "stats": {
+      "cpuTemp": 456,
+      "fanSpeed": 789,
+      "HDDSpace": 987,
+      "internalTemp": 765,
+      "disks": [
+        {
+          "device": "sda",
+          "mountPoint": "/",
+          "total": 500,
+          "free": 120
+        },
+        {
+          "device": "sdb",
+          "total": 4000,
+          "free": 3
+        }
+      ]
+    },
+    "lastLoggedIn": "userA",
+    "sysTime": "2021-07-28T14:16:27Z"
+  }
+]`
+
+	entry := dummyMachineMetrics
+	entry.Stats.Disks = []model.Disk{
+		{Device: "sda", MountPoint: "/", Total: 500, Free: 120},
+		{Device: "sdb", Total: 4000, Free: 3},
+	}
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&entry})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_SchemaVersion1_ReturnsEntriesInVersion1() {
+	expectedJSON :=
+		`[
+  {
+    "id": "test-id",
+    "machineId": 123,
+    "stats": {
+      "cpuTemp": 456,
+      "fanSpeed": 789,
+      "HDDSpace": 987,
+      "internalTemp": 765
+    },
+    "lastLoggedIn": "userA",
+    "sysTime": "Wed 2021-07-28 14:16:27"
+  }
+]`
+
+	// fields which version 1 does not know about are dropped
+	entry := dummyMachineMetrics
+	entry.Stats.Custom = map[string]float64{"gpuTemp": 71.5}
+	entry.Stats.Disks = []model.Disk{{Device: "sda", Total: 500, Free: 120}}
+	entry.Labels = map[string]string{"dc": "eu-west-1"}
+	entry.Meta = &model.IngestionMeta{Sequence: 1, RemoteAddr: "10.0.0.1"}
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&entry})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?schemaVersion=1", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_UnsupportedSchemaVersion_Returns400() {
+	// set return values on datastore mock
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?schemaVersion=one", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("query parameter schemaVersion has to be a number\n"))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_AcceptProtobuf_ReturnsProtobufList() {
+	entries := []*model.MachineMetrics{{ID: "other-id", MachineID: 7, Labels: map[string]string{"dc": "eu-west-1"}}, &dummyMachineMetrics}
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetAllEntries").Return(entries)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+	request.Header.Set("Accept", "application/json;q=0.5, application/x-protobuf")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", reportpb.MarshalList(entries))
+	assert.Equal(s.T(), "application/x-protobuf; messageType=metricsstore.MachineMetricsList",
+		s.respWriterMock.responseHeader.Get("Content-Type"), "Content type is incorrect")
+
+	decoded, err := reportpb.UnmarshalList([]byte(s.respWriterMock.writeArgument))
+	assert.Nil(s.T(), err, "Problem decoding response")
+	assert.Equal(s.T(), entries, decoded, "Decoded entries should be the same as the stored ones")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_NegotiatedResponses_VaryOnAcceptAndAcceptEncoding() {
+	id := "c7055826-b23b-41d5-8026-951f0c424751"
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&dummyMachineMetrics})
+	s.dstoreMock.On("GetEntry", id).Return(&dummyMachineMetrics, ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	for _, path := range []string{"/metrics", "/metrics/" + id} {
+		for _, accept := range []string{"", "application/json", "application/x-protobuf"} {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", path, nil)
+			request.Header.Set("Accept", accept)
+			request.Header.Set("Accept-Encoding", "gzip")
+
+			metricsHandler.ServeHTTP(recorder, request)
+
+			assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status for %s with %q is incorrect", path, accept)
+			assert.Equal(s.T(), "Accept, Accept-Encoding", recorder.Header().Get("Vary"), "Vary header for %s with %q is incorrect", path, accept)
+		}
+	}
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_AcceptProtobufOlderSchemaVersion_Returns400() {
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&dummyMachineMetrics})
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?schemaVersion=1", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+	request.Header.Set("Accept", "application/x-protobuf")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("schemaVersion 1 is not available as protobuf, only version 2 is\n"))
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_NDJSON_StreamsOneEntryPerLine() {
+	entries := []*model.MachineMetrics{}
+	for i := 0; i < streamFlushInterval+1; i++ {
+		entry := dummyMachineMetrics
+		entry.ID = fmt.Sprintf("test-%03d", i)
+		entries = append(entries, &entry)
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return(entries)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.DefaultPageSize = 10 // streamed responses are not paged unless asked for
+
+	for _, header := range []string{"Accept", ""} {
+		recorder := httptest.NewRecorder()
+
+		request := httptest.NewRequest("GET", "/metrics?fields=id,stats.cpuTemp&schemaVersion=2", nil)
+		if header != "" {
+			request.Header.Set(header, "application/x-ndjson")
+		} else {
+			request = httptest.NewRequest("GET", "/metrics?fields=id,stats.cpuTemp&schemaVersion=2&format=ndjson", nil)
+		}
+
+		metricsHandler.ServeHTTP(recorder, request)
+
+		assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect")
+		assert.Equal(s.T(), "application/x-ndjson", recorder.Header().Get("Content-Type"), "Content type is incorrect")
+		assert.True(s.T(), recorder.Flushed, "Response should be flushed while it is written")
+
+		lines := strings.Split(recorder.Body.String(), "\n")
+		assert.Equal(s.T(), len(entries)+1, len(lines), "There should be a line per entry and a final newline")
+		assert.Equal(s.T(), `{"id":"test-000","stats":{"cpuTemp":456}}`, lines[0], "Entry should be compact JSON")
+		assert.Equal(s.T(), `{"id":"test-100","stats":{"cpuTemp":456}}`, lines[len(entries)-1], "Last entry is incorrect")
+		assert.Empty(s.T(), recorder.Header().Get("Link"), "All entries should be returned")
+	}
+
+	// an explicit limit still pages
+	recorder := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?format=ndjson&limit=2", nil))
+	assert.Equal(s.T(), 2, strings.Count(recorder.Body.String(), "\n"), "Only a page should be returned")
+	assert.NotEmpty(s.T(), recorder.Header().Get("Link"), "Link header should be set")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_CSV_ReturnsRowPerEntry() {
+	first := dummyMachineMetrics
+	first.ID = "test-1"
+	first.MachineID = 2
+	first.LastLoggedIn = `admin/"Tim", jr`
+	first.Stats.Custom = map[string]float64{"gpuTemp": 71.5}
+	first.Labels = map[string]string{"dc": "eu-west-1"}
+	first.Meta = &model.IngestionMeta{ReceivedAt: time.Date(2022, 4, 21, 19, 25, 44, 17000000, time.UTC), Sequence: 3, RemoteAddr: "10.0.0.7"}
+
+	second := dummyMachineMetrics
+	second.ID = "test-2"
+	second.Stats.InternalTemp = nil
+	second.Stats.Disks = []model.Disk{{Device: "sda", Total: 500, Free: 100}}
+
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&first, &second})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/metrics?sort=machineId&machineId=2&machineId=123", nil)
+	request.Header.Set("Accept", "text/csv")
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "text/csv; charset=utf-8; header=present", recorder.Header().Get("Content-Type"), "Content type is incorrect")
+	assert.Equal(s.T(), "id,machineId,stats.cpuTemp,stats.fanSpeed,stats.HDDSpace,stats.internalTemp,stats.custom.gpuTemp,"+
+		"stats.disks.sda.total,stats.disks.sda.free,lastLoggedIn,sysTime,labels.dc,meta.receivedAt,meta.sequence,"+
+		"meta.remoteAddr,meta.userAgent,meta.principal,machine.hostname,machine.owner,machine.location\r\n"+
+		`test-1,2,456,789,987,765,71.5,,,"admin/""Tim"", jr",2021-07-28T14:16:27Z,eu-west-1,2022-04-21T19:25:44.017Z,3,10.0.0.7,,,,,`+"\r\n"+
+		"test-2,123,456,789,987,,,500,100,userA,2021-07-28T14:16:27Z,,,,,,,,,\r\n",
+		recorder.Body.String(), "CSV is incorrect")
+
+	recorder = httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?format=csv&fields=id,stats.disks,lastLoggedIn&sort=-id", nil))
+	assert.Equal(s.T(), "id,stats.disks.sda.total,stats.disks.sda.free,lastLoggedIn\r\n"+
+		"test-2,500,100,userA\r\n"+
+		`test-1,,,"admin/""Tim"", jr"`+"\r\n",
+		recorder.Body.String(), "Selected columns are incorrect")
+
+	recorder = httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?format=csv&schemaVersion=1", nil))
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "schemaVersion 1 is not available as CSV, only version 2 is\n", recorder.Body.String())
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_CSVPages_SameColumnsOnEveryPage() {
+	first := dummyMachineMetrics
+	first.ID = "test-1"
+	first.Stats.InternalTemp = nil
+
+	second := dummyMachineMetrics
+	second.ID = "test-2"
+	second.Stats.InternalTemp = nil
+	second.Stats.Custom = map[string]float64{"gpuTemp": 71.5}
+	second.Labels = map[string]string{"dc": "eu-west-1"}
+
+	other := dummyMachineMetrics
+	other.ID = "test-3"
+	other.MachineID = 7
+	other.Labels = map[string]string{"os": "linux"}
+
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&first, &second, &other})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// the report of the other machine is filtered out, so its label is not a column
+	pages := []string{}
+	target := "/metrics?format=csv&fields=id,stats.custom,labels&machineId=123&sort=id&limit=1"
+	for target != "" {
+		recorder := httptest.NewRecorder()
+		metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if !assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect") {
+			break
+		}
+		pages = append(pages, recorder.Body.String())
+
+		target = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			target = strings.TrimPrefix(link[:strings.Index(link, ">")], "<")
+		}
+	}
+
+	assert.Equal(s.T(), []string{
+		"id,stats.custom.gpuTemp,labels.dc\r\ntest-1,,\r\n",
+		"id,stats.custom.gpuTemp,labels.dc\r\ntest-2,71.5,eu-west-1\r\n",
+	}, pages, "Pages are incorrect")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_CSV_FormulasNeutralized() {
+	entry := dummyMachineMetrics
+	entry.LastLoggedIn = "=HYPERLINK(\"http://example.com\")"
+	entry.Stats.Custom = map[string]float64{"delta": -5}
+	entry.Labels = map[string]string{"a": "+1", "b": "-2", "c": "@SUM(A1)", "d": "safe=1"}
+	entry.Meta = &model.IngestionMeta{UserAgent: "=cmd", Principal: "@admin"}
+
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&entry})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?format=csv&fields=stats.custom,lastLoggedIn,labels,meta.userAgent,meta.principal", nil))
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "stats.custom.delta,lastLoggedIn,labels.a,labels.b,labels.c,labels.d,meta.userAgent,meta.principal\r\n"+
+		`-5,"'=HYPERLINK(""http://example.com"")",'+1,'-2,'@SUM(A1),safe=1,'=cmd,'@admin`+"\r\n",
+		recorder.Body.String(), "Formulas should be neutralized, numbers kept")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_StreamToSlowClient_OutlastsServerWriteTimeout() {
+	// random logins keep the compressed response large
+	random := rand.New(rand.NewSource(1))
+	entries := []*model.MachineMetrics{}
+	for i := 0; i < 100*streamFlushInterval; i++ {
+		entry := dummyMachineMetrics
+		entry.ID = fmt.Sprintf("test-%05d", i)
+		entry.LastLoggedIn = fmt.Sprintf("%x%x", random.Int63(), random.Int63())
+		entries = append(entries, &entry)
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return(entries)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.StreamWriteTimeout = time.Second
+
+	// socket buffers smaller than the response make the handler wait for the client
+	server := httptest.NewUnstartedServer(metricsHandler)
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Config.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		conn.(*net.TCPConn).SetWriteBuffer(32 << 10)
+		return ctx
+	}
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableCompression: true,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err == nil {
+				conn.(*net.TCPConn).SetReadBuffer(32 << 10)
+			}
+			return conn, err
+		},
+	}}
+
+	for _, test := range []struct{ format, encoding string }{{"ndjson", ""}, {"csv", "gzip"}} {
+		request, err := http.NewRequest("GET", server.URL+"/metrics?format="+test.format, nil)
+		assert.Nil(s.T(), err, "Problem creating request")
+		if test.encoding != "" {
+			request.Header.Set("Accept-Encoding", test.encoding)
+		}
+
+		response, err := client.Do(request)
+		if !assert.Nil(s.T(), err, "Problem sending request") {
+			continue
+		}
+
+		// the client falls behind for longer than the write timeout of the server
+		time.Sleep(3 * server.Config.WriteTimeout)
+
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Nil(s.T(), err, "%s response should not be cut short", test.format)
+
+		if test.encoding != "" {
+			assert.Equal(s.T(), test.encoding, response.Header.Get("Content-Encoding"), "Response should be compressed")
+			body = []byte(decompressed(s.T(), test.encoding, body))
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		if test.format == "csv" {
+			lines = lines[1:]
+		}
+		assert.Equal(s.T(), len(entries), len(lines), "%s response should have every entry", test.format)
+		assert.True(s.T(), strings.Contains(lines[len(lines)-1], "test-09999"), "%s response should end with the last entry", test.format)
+	}
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_UnknownFormat_Returns400() {
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?format=xml", nil))
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "query parameter format \"xml\" is not one of json, ndjson, protobuf, csv\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics/c7055826-b23b-41d5-8026-951f0c424751?format=ndjson", nil))
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "query parameter format \"ndjson\" is not one of json, protobuf\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?format=ndjson&schemaVersion=3", nil))
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "schemaVersion 3 is not supported, supported versions are 1 to 2\n", recorder.Body.String())
+
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
+}
+
+func (s *MetricsHandlerTestSuite) Test_Negotiate_PrefersByQualityThenOrder() {
+	offers := []string{"application/json", "application/x-protobuf"}
+
+	assert.Equal(s.T(), "application/json", negotiate("", offers...), "JSON should be returned if nothing is asked for")
+	assert.Equal(s.T(), "application/json", negotiate("text/html", offers...), "JSON should be returned if nothing offered is accepted")
+	assert.Equal(s.T(), "application/json", negotiate("*/*", offers...), "Wildcard should match JSON")
+	assert.Equal(s.T(), "application/x-protobuf", negotiate("application/x-protobuf, application/json", offers...), "First listed should be preferred")
+	assert.Equal(s.T(), "application/json", negotiate("application/x-protobuf;q=0.1, application/*", offers...), "Higher quality should be preferred")
+	assert.Equal(s.T(), "application/json", negotiate("application/x-protobuf;q=0", offers...), "Zero quality should never be chosen")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_EntryByID_ReturnsEntry() {
+	expectedJSON :=
+		`{
+  "id": "c7055826-b23b-41d5-8026-951f0c424751",
+  "machineId": 123,
+  "stats": {
+    "cpuTemp": 456,
+    "fanSpeed": 789,
+    "HDDSpace": 987,
+    "internalTemp": 765
+  },
+  "lastLoggedIn": "userA",
+  "sysTime": "2021-07-28T14:16:27Z"
+}`
+
+	entry := dummyMachineMetrics
+	entry.ID = "c7055826-b23b-41d5-8026-951f0c424751"
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetEntry", entry.ID).Return(&entry, ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics/c7055826-b23b-41d5-8026-951f0c424751", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
+	assert.Equal(s.T(), "application/json", s.respWriterMock.responseHeader.Get("Content-Type"), "Content type is incorrect")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_EntryByIDWithFields_ReturnsSelectedFields() {
+	expectedJSON :=
+		`{
+  "id": "c7055826-b23b-41d5-8026-951f0c424751",
+  "stats": {
+    "HDDSpace": 987,
+    "internalTemp": 765
+  }
+}`
+
+	entry := dummyMachineMetrics
+	entry.ID = "c7055826-b23b-41d5-8026-951f0c424751"
+
+	s.dstoreMock.On("GetEntry", entry.ID).Return(&entry, ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET",
+		"http://localhost:4000/metrics/c7055826-b23b-41d5-8026-951f0c424751?fields=id,stats.HDDSpace,stats.internalTemp", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", mock.Anything)
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_EntryByIDDatastoreNotAvailable_Returns503() {
+	// set return values on datastore mock
+	s.dstoreMock.On("GetEntry", "c7055826-b23b-41d5-8026-951f0c424751").Return(nil, ds.ErrorNotAvailable)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics/c7055826-b23b-41d5-8026-951f0c424751", nil))
+
+	assert.Equal(s.T(), http.StatusServiceUnavailable, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "Service Unavailable\n", recorder.Body.String(), "Body is incorrect")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_EntryByIDNotFound_Returns404() {
+	expectedJSON :=
+		`{
+  "message": "No entry in the data store with id - c7055826-b23b-41d5-8026-951f0c424751",
+  "id": "c7055826-b23b-41d5-8026-951f0c424751"
+}`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("GetEntry", "c7055826-b23b-41d5-8026-951f0c424751").Return(nil, ds.ErrorKeyNotFound)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics/c7055826-b23b-41d5-8026-951f0c424751", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusNotFound)
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+	assert.Equal(s.T(), "application/json", s.respWriterMock.responseHeader.Get("Content-Type"), "Content type is incorrect")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_EntryByMalformedID_Returns400() {
+	expectedJSON :=
+		`{
+  "message": "Entry id \"not-a-uuid\" is not a valid UUID",
+  "id": "not-a-uuid"
+}`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics/not-a-uuid", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+	s.dstoreMock.AssertNotCalled(s.T(), "GetAllEntries")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_EntryByID_Returns405() {
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics/c7055826-b23b-41d5-8026-951f0c424751", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusMethodNotAllowed)
+	assert.Equal(s.T(), "GET", s.respWriterMock.responseHeader.Get("Allow"), "Allow header is incorrect")
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_NilElementsFromDatastore_Returns500() {
+	// set return values on datastore mock
+	var machineMetrics []*model.MachineMetrics
+	s.dstoreMock.On("GetAllEntries").Return(machineMetrics)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Internal Server Error\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_NextPageAfterNonFiniteMetric_Returns500() {
+	// stored before such values were rejected
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{
+		{ID: "a", Stats: model.MetricsStats{Custom: map[string]float64{"gpuTemp": math.NaN()}}},
+		{ID: "b", Stats: model.MetricsStats{Custom: map[string]float64{"gpuTemp": 70}}},
+	})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics?sort=gpuTemp&limit=1", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("Internal Server Error\n"))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+	assert.Empty(s.T(), s.respWriterMock.Header().Get("Link"), "No link to a next page should be returned")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_CannotWriteResponse_Returns500() {
+	// set return values on datastore mock
+	machineMetrics := []*model.MachineMetrics{}
+	machineMetrics = append(machineMetrics, &dummyMachineMetrics)
+
+	s.dstoreMock.On("GetAllEntries").Return(machineMetrics)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0,
+		fmt.Errorf("dummy error"))
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect calls to response writer
+	responseBody := "Error writing response\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+}
+
+// --------------- POST --------------------
+
+func (s *MetricsHandlerTestSuite) Test_POST_WrongContentType_Returns415() {
+	// even though request body is irrelevant at the moment, we still have to set it since
+	// the implementation can change
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Content-Type header is not application/json, application/x-ndjson or application/x-protobuf\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusUnsupportedMediaType)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_MalformedJSON_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: invalid character '\"' after object key:value pair\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_MoreThanOneJSONObject_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    },`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Request body can only contain one JSON object\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_RequestBodyTooLarge_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, 2)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: http: request body too large\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_CannotAddToDatastoreKeyExists_Returns500() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.ErrorKeyExists)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Internal Server Error\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_CannotAddToDatastoreKeyNotSpecified_Returns500() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.ErrorKeyNotSpecified)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Internal Server Error\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusInternalServerError)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_DatastoreNotAvailable_Returns503() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.ErrorNotAvailable)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Service Unavailable\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusServiceUnavailable)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldNotAllowed_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "extraField": "extraValue",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: json: unknown field \"extraField\"\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldAllowed_Returns201() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
         "extraField": "extraValue",
         "sysTime": "2022-04-23T18:25:43.511Z"
     }`
@@ -564,7 +1899,908 @@ func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldAllowed_Returns201() {
 	// set return values on datastore mock
 	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
 
-	metricsHandler := NewMetricsHandler(s.dstoreMock, false, true, defaultMaxBodySize)
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, true, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// try to match the response against regex
+	regexPattern :=
+		`{
+  "id": ".*",
+  "message": "New entry added to the data store with id - .*"
+}`
+	assert.Regexp(s.T(), regexp.MustCompile(regexPattern), s.respWriterMock.writeArgument,
+		"Response body should match expected regex")
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+
+	// verify the calls to AddEntry
+	assert.Equal(s.T(), 12345, s.dstoreMock.addEntryArgument.MachineID,
+		"MachineID in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 90, s.dstoreMock.addEntryArgument.Stats.CPUTemp,
+		"Stats.CPUTemp in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 400, s.dstoreMock.addEntryArgument.Stats.FanSpeed,
+		"Stats.FanSpeed in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 800, s.dstoreMock.addEntryArgument.Stats.HDDSpace,
+		"Stats.HDDSpace in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), "admin/Paul", s.dstoreMock.addEntryArgument.LastLoggedIn,
+		"LastLoggedIn in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), "2022-04-23T18:25:43.511Z", s.dstoreMock.addEntryArgument.SysTime.String(),
+		"SysTime in the stored model does not match that of JSON object")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_OptionalField_Returns201() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800,
+            "internalTemp": 23
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, true, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// try to match the response against regex
+	regexPattern :=
+		`{
+  "id": ".*",
+  "message": "New entry added to the data store with id - .*"
+}`
+	assert.Regexp(s.T(), regexp.MustCompile(regexPattern), s.respWriterMock.writeArgument,
+		"Response body should match expected regex")
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+
+	// verify the calls to AddEntry
+	assert.Equal(s.T(), 12345, s.dstoreMock.addEntryArgument.MachineID,
+		"MachineID in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 90, s.dstoreMock.addEntryArgument.Stats.CPUTemp,
+		"Stats.CPUTemp in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 400, s.dstoreMock.addEntryArgument.Stats.FanSpeed,
+		"Stats.FanSpeed in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 800, s.dstoreMock.addEntryArgument.Stats.HDDSpace,
+		"Stats.HDDSpace in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), 23, *s.dstoreMock.addEntryArgument.Stats.InternalTemp,
+		"Stats.HDDSpace in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), "admin/Paul", s.dstoreMock.addEntryArgument.LastLoggedIn,
+		"LastLoggedIn in the stored model does not match that of JSON object")
+	assert.Equal(s.T(), "2022-04-23T18:25:43.511Z", s.dstoreMock.addEntryArgument.SysTime.String(),
+		"SysTime in the stored model does not match that of JSON object")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_UnknownSysTimeFormat_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "yesterday"
+    }`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: sysTime \"yesterday\" is not in a known time format\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_UnknownSysTimeFormatLenient_Returns201() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "yesterday"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.LenientSysTime = true
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+
+	assert.Equal(s.T(), model.SysTime{Raw: "yesterday"}, s.dstoreMock.addEntryArgument.SysTime,
+		"SysTime should be stored as sent")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_LegacySysTimeFormat_Normalized() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "Wed 2021-07-28 14:16:27"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	assert.Equal(s.T(), "2021-07-28T14:16:27Z", s.dstoreMock.addEntryArgument.SysTime.String(),
+		"SysTime should be normalized to UTC RFC3339")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_SchemaVersion1_UpgradedReturns201() {
+	requestBody :=
+		`{
+        "schemaVersion": 1,
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "Wed 2021-07-28 14:16:27"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+
+	entry := s.dstoreMock.addEntryArgument
+	assert.Equal(s.T(), 12345, entry.MachineID, "MachineID is incorrect")
+	assert.Equal(s.T(), 400, entry.Stats.FanSpeed, "FanSpeed is incorrect")
+	assert.Equal(s.T(), "2021-07-28T14:16:27Z", entry.SysTime.String(), "SysTime should be upgraded")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_SchemaVersion1WithLabels_Returns400() {
+	requestBody :=
+		`{
+        "schemaVersion": 1,
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "Wed 2021-07-28 14:16:27",
+        "labels": {"dc": "eu-west-1"}
+    }`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("Error parsing request body: json: unknown field \"labels\"\n"))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_UnsupportedSchemaVersion_Returns400() {
+	requestBody :=
+		`{
+        "schemaVersion": 7,
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte("Error parsing request body: schemaVersion 7 is not supported, supported versions are 1 to 2\n"))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_CustomMetrics_Returns201() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800,
+            "custom": {
+                "gpuTemp": 71.5,
+                "psu.voltage": 12
+            }
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+
+	assert.Equal(s.T(), map[string]float64{"gpuTemp": 71.5, "psu.voltage": 12}, s.dstoreMock.addEntryArgument.Stats.Custom,
+		"Custom metrics in the stored model do not match those of JSON object")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_CustomMetricNamedAsTypedMetric_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800,
+            "custom": {
+                "cpuTemp": 95
+            }
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: stats.custom cannot contain \"cpuTemp\", it is a field of stats\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_Disks_Returns201() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "disks": [
+                {"device": "sda", "mountPoint": "/", "total": 500, "free": 120},
+                {"device": "sdb", "mountPoint": "/data", "total": 4000, "free": 3}
+            ]
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+
+	assert.Equal(s.T(), []model.Disk{
+		{Device: "sda", MountPoint: "/", Total: 500, Free: 120},
+		{Device: "sdb", MountPoint: "/data", Total: 4000, Free: 3},
+	}, s.dstoreMock.addEntryArgument.Stats.Disks, "Disks in the stored model do not match those of JSON object")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_DiskFreeGreaterThanTotal_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800,
+            "disks": [
+                {"device": "sda", "total": 500, "free": 600}
+            ]
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: stats.disks[0] has free 600 greater than total 500\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_Protobuf_Returns201() {
+	internalTemp := 23
+	sent := &model.MachineMetrics{
+		MachineID: 61616,
+		Stats: model.MetricsStats{
+			CPUTemp:      78,
+			FanSpeed:     500,
+			HDDSpace:     100,
+			InternalTemp: &internalTemp,
+			Custom:       map[string]float64{"gpuTemp": 71.5},
+		},
+		LastLoggedIn: "admin/Tim",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+		Labels:       map[string]string{"dc": "eu-west-1"},
+	}
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics", bytes.NewReader(reportpb.Marshal(sent)))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/x-protobuf")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+
+	stored := s.dstoreMock.addEntryArgument
+	assert.NotNil(s.T(), stored.Meta, "Ingestion meta should be recorded")
+	assert.Equal(s.T(), &model.Login{Role: "admin", User: "Tim"}, stored.Login, "Login should be parsed")
+
+	// the rest is as sent
+	sent.ID, sent.Meta, sent.Login = stored.ID, stored.Meta, stored.Login
+	assert.Equal(s.T(), sent, stored, "Stored model does not match the protobuf message")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_JSONArrayBatch_Returns207WithResultPerReport() {
+	requestBody := `[
+		{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"},
+		{"machineId": 2, "stats": {"cpuTemp": 60}},
+		{"machineId": 3, "stats": {"cpuTemp": 70}, "sysTime": "2022-04-23T18:25:43.511Z"}
+	]`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/metrics", strings.NewReader(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusMultiStatus, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 2)
+
+	var response batchResponse
+	assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &response), "Response should be JSON")
+	assert.Equal(s.T(), "2 of 3 reports added to the data store", response.Message)
+	assert.Equal(s.T(), 3, len(response.Results), "There should be a result per report")
+
+	assert.Equal(s.T(), http.StatusCreated, response.Results[0].Status)
+	assert.NotEmpty(s.T(), response.Results[0].ID, "Stored report should have an id")
+	assert.Equal(s.T(), batchItemResult{Index: 1, Status: http.StatusBadRequest, Error: "Error parsing report: sysTime is missing"}, response.Results[1])
+	assert.Equal(s.T(), 2, response.Results[2].Index)
+	assert.Equal(s.T(), http.StatusCreated, response.Results[2].Status)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_NDJSONBatch_DatastoreFailureOnlyFailsItsReport() {
+	requestBody := `{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"}
+{"machineId": 2, "stats": {"cpuTemp": 60}, "sysTime": "2022-04-23T18:25:43.511Z"}
+`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.ErrorNotAvailable).Once()
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/metrics", strings.NewReader(requestBody))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusMultiStatus, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+
+	var response batchResponse
+	assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &response), "Response should be JSON")
+	assert.Equal(s.T(), "1 of 2 reports added to the data store", response.Message)
+	assert.Equal(s.T(), batchItemResult{Index: 0, Status: http.StatusServiceUnavailable, Error: "Service Unavailable"}, response.Results[0])
+	assert.Equal(s.T(), http.StatusCreated, response.Results[1].Status)
+	assert.Equal(s.T(), s.dstoreMock.addEntryArgument.ID, response.Results[1].ID)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_AtomicBatch_NothingStoredIfAnyRejected() {
+	requestBody := `[
+		{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"},
+		{"machineId": 2, "stats": {"cpuTemp": 60}}
+	]`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/metrics?atomic=true", strings.NewReader(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
+
+	var response batchResponse
+	assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &response), "Response should be JSON")
+	assert.Equal(s.T(), "1 of 2 reports rejected, none added to the data store", response.Message)
+	assert.Equal(s.T(), http.StatusFailedDependency, response.Results[0].Status)
+	assert.Equal(s.T(), http.StatusBadRequest, response.Results[1].Status)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_AtomicBatch_DatastoreFailureReturnedAsForSingleReport() {
+	requestBody := `[
+		{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"},
+		{"machineId": 2, "stats": {"cpuTemp": 60}, "sysTime": "2022-04-23T18:25:43.511Z"}
+	]`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	failures := []struct {
+		rc             ds.DatastoreReturnCode
+		expectedStatus int
+		expectedBody   string
+	}{
+		{ds.ErrorNotAvailable, http.StatusServiceUnavailable, "Service Unavailable\n"},
+		{ds.ErrorKeyExists, http.StatusInternalServerError, "Internal Server Error\n"},
+		{ds.ErrorBatchNotSupported, http.StatusBadRequest, "Reports of the batch cannot be stored at once, send them without atomic\n"},
+	}
+
+	for _, failure := range failures {
+		s.dstoreMock.On("AddBatch", mock.Anything).Return(failure.rc).Once()
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/metrics?atomic=true", strings.NewReader(requestBody))
+		request.Header.Set("Content-Type", "application/json")
+
+		metricsHandler.ServeHTTP(recorder, request)
+
+		assert.Equal(s.T(), failure.expectedStatus, recorder.Code, "Status for %s is incorrect", failure.rc.String())
+		assert.Equal(s.T(), failure.expectedBody, recorder.Body.String(), "Body for %s is incorrect", failure.rc.String())
+	}
+
+	// the datastore stores all reports of the batch or none, so nothing is left to clean up
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
+	s.dstoreMock.AssertNotCalled(s.T(), "DeleteEntry", mock.Anything)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_AtomicBatch_AllStoredReturns201() {
+	requestBody := `[
+		{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"},
+		{"machineId": 2, "stats": {"cpuTemp": 60}, "sysTime": "2022-04-23T18:25:43.511Z"}
+	]`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddBatch", mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/metrics?atomic=true", strings.NewReader(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusCreated, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddBatch", 1)
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
+
+	stored := s.dstoreMock.Calls[0].Arguments.Get(0).([]*model.MachineMetrics)
+	assert.Equal(s.T(), 2, len(stored), "Both reports should be added at once")
+	assert.Equal(s.T(), 1, stored[0].MachineID, "Reports should be added in order")
+	assert.NotNil(s.T(), stored[1].Meta, "Ingestion meta should be recorded")
+
+	var response listCreatedResponse
+	assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &response), "Response should be JSON")
+	assert.Equal(s.T(), "2 new entries added to the data store", response.Message)
+	assert.Equal(s.T(), []string{stored[0].ID, stored[1].ID}, response.IDs, "Ids should be returned in the order of the reports")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_BatchLargerThanMaxBatchSize_Returns413() {
+	report := `{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"}`
+	reports := []*model.MachineMetrics{
+		{MachineID: 1, Stats: model.MetricsStats{CPUTemp: 50}, SysTime: model.NewSysTime(time.Now())},
+		{MachineID: 2, Stats: model.MetricsStats{CPUTemp: 60}, SysTime: model.NewSysTime(time.Now())},
+		{MachineID: 3, Stats: model.MetricsStats{CPUTemp: 70}, SysTime: model.NewSysTime(time.Now())},
+	}
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.MaxBatchSize = 2
+
+	requests := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", "[" + report + "," + report + "," + report + "]"},
+		{"application/x-ndjson", report + "\n" + report + "\n" + report + "\n"},
+		{"application/x-protobuf; messageType=metricsstore.MachineMetricsList", string(reportpb.MarshalList(reports))},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/metrics", strings.NewReader(r.body))
+		request.Header.Set("Content-Type", r.contentType)
+
+		metricsHandler.ServeHTTP(recorder, request)
+
+		assert.Equal(s.T(), http.StatusRequestEntityTooLarge, recorder.Code, "Status for %s is incorrect", r.contentType)
+		assert.Equal(s.T(), "Batch has more than 2 reports\n", recorder.Body.String(), "Body for %s is incorrect", r.contentType)
+	}
+
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_InvalidBatch_Returns400() {
+	report := `{"machineId": 1, "stats": {"cpuTemp": 50}, "sysTime": "2022-04-23T18:25:43.511Z"}`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	requests := []struct {
+		contentType  string
+		target       string
+		body         string
+		expectedBody string
+	}{
+		{"application/json", "/metrics", " [ ]", "Error parsing request body: batch has no reports\n"},
+		{"application/x-ndjson", "/metrics", "", "Error parsing request body: batch has no reports\n"},
+		{"application/json", "/metrics", "[" + report + "]" + report, "Error parsing request body: request body can only contain one JSON array\n"},
+		{"application/json", "/metrics", "[" + report, "Error parsing request body: unexpected end of JSON input\n"},
+		{"application/json", "/metrics?atomic=maybe", "[" + report + "]", "query parameter atomic \"maybe\" is not true or false\n"},
+	}
+
+	for _, r := range requests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", r.target, strings.NewReader(r.body))
+		request.Header.Set("Content-Type", r.contentType)
+
+		metricsHandler.ServeHTTP(recorder, request)
+
+		assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status for %q is incorrect", r.body)
+		assert.Equal(s.T(), r.expectedBody, recorder.Body.String(), "Body for %q is incorrect", r.body)
+	}
+
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_ProtobufList_Returns207WithResultPerReport() {
+	reports := []*model.MachineMetrics{
+		{MachineID: 1, Stats: model.MetricsStats{CPUTemp: 50}, SysTime: model.NewSysTime(time.Now())},
+		{MachineID: 2},
+		{MachineID: 3, Stats: model.MetricsStats{CPUTemp: 70}, SysTime: model.NewSysTime(time.Now())},
+	}
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/metrics", bytes.NewReader(reportpb.MarshalList(reports)))
+	request.Header.Set("Content-Type", "application/x-protobuf; messageType=metricsstore.MachineMetricsList")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusMultiStatus, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 2)
+
+	var response batchResponse
+	assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &response), "Response should be JSON")
+	assert.Equal(s.T(), "2 of 3 reports added to the data store", response.Message)
+	assert.Equal(s.T(), 3, len(response.Results), "There should be a result per report")
+
+	assert.Equal(s.T(), batchItemResult{Index: 0, Status: http.StatusCreated, ID: s.dstoreMock.Calls[0].Arguments.String(0)}, response.Results[0])
+	assert.Equal(s.T(), batchItemResult{Index: 1, Status: http.StatusBadRequest, Error: "Error parsing report: sysTime is missing"}, response.Results[1])
+	assert.Equal(s.T(), batchItemResult{Index: 2, Status: http.StatusCreated, ID: s.dstoreMock.Calls[1].Arguments.String(0)}, response.Results[2])
+	assert.Equal(s.T(), 3, s.dstoreMock.addEntryArgument.MachineID, "Reports should be stored in order")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_AtomicProtobufList_NothingStoredIfAnyRejected() {
+	reports := []*model.MachineMetrics{
+		{MachineID: 1, SysTime: model.NewSysTime(time.Now())},
+		{MachineID: 2},
+	}
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/metrics?atomic=true", bytes.NewReader(reportpb.MarshalList(reports)))
+	request.Header.Set("Content-Type", "application/x-protobuf; messageType=metricsstore.MachineMetricsList")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+	s.dstoreMock.AssertNotCalled(s.T(), "AddBatch", mock.Anything)
+
+	var response batchResponse
+	assert.Nil(s.T(), json.Unmarshal(recorder.Body.Bytes(), &response), "Response should be JSON")
+	assert.Equal(s.T(), "1 of 2 reports rejected, none added to the data store", response.Message)
+	assert.Equal(s.T(), http.StatusFailedDependency, response.Results[0].Status)
+	assert.Equal(s.T(), http.StatusBadRequest, response.Results[1].Status)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_ProtobufNonFiniteMetric_Returns400() {
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		sent := &model.MachineMetrics{
+			MachineID: 61616,
+			Stats:     model.MetricsStats{Custom: map[string]float64{"gpuTemp": value}},
+			SysTime:   model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+		}
+
+		request, err := http.NewRequest("POST", "http://localhost:4000/metrics", bytes.NewReader(reportpb.Marshal(sent)))
+		assert.Nil(s.T(), err, "Problem creating request")
+
+		request.Header.Set("Content-Type", "application/x-protobuf")
+
+		metricsHandler.ServeHTTP(s.respWriterMock, request)
+	}
+
+	s.respWriterMock.AssertNumberOfCalls(s.T(), "WriteHeader", 3)
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.respWriterMock.AssertNotCalled(s.T(), "WriteHeader", http.StatusCreated)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_ProtobufMalformed_Returns400() {
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics", strings.NewReader(`{"machineId": 1}`))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/x-protobuf")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_TooManyLabels_Returns400() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z",
+        "labels": {
+            "dc": "eu-west-1",
+            "rack": "r12",
+            "os": "linux"
+        }
+    }`
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.LabelLimits = model.LabelLimits{MaxLabels: 2, MaxLabelValueLength: 16}
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	responseBody := "Error parsing request body: labels has 3 labels, at most 2 are allowed\n"
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(responseBody))
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_Labels_Returns201() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 90,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z",
+        "labels": {
+            "dc": "eu-west-1",
+            "hw-model": "R740"
+        }
+    }`
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
 
 	// set return values on response writer mock
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
@@ -578,52 +2814,141 @@ func (s *MetricsHandlerTestSuite) Test_POST_UnknownFieldAllowed_Returns201() {
 
 	metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// try to match the response against regex
-	regexPattern :=
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	assert.Equal(s.T(), map[string]string{"dc": "eu-west-1", "hw-model": "R740"}, s.dstoreMock.addEntryArgument.Labels,
+		"Labels in the stored model do not match those of JSON object")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_MetricOutsideOfValidRange_Returns400() {
+	requestBody :=
 		`{
-  "id": ".*",
-  "message": "New entry added to the data store with id - .*"
-}`
-	assert.Regexp(s.T(), regexp.MustCompile(regexPattern), s.respWriterMock.writeArgument,
-		"Response body should match expected regex")
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 900,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "admin/Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
 
-	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
+	registry, err := metadata.NewRegistry()
+	assert.Nil(s.T(), err, "Problem creating registry")
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.MetricsRegistry = registry
 
-	// verify the calls to AddEntry
-	assert.Equal(s.T(), 12345, s.dstoreMock.addEntryArgument.MachineID,
-		"MachineID in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 90, s.dstoreMock.addEntryArgument.Stats.CPUTemp,
-		"Stats.CPUTemp in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 400, s.dstoreMock.addEntryArgument.Stats.FanSpeed,
-		"Stats.FanSpeed in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 800, s.dstoreMock.addEntryArgument.Stats.HDDSpace,
-		"Stats.HDDSpace in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), "admin/Paul", s.dstoreMock.addEntryArgument.LastLoggedIn,
-		"LastLoggedIn in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), "2022-04-23T18:25:43.511Z", s.dstoreMock.addEntryArgument.SysTime,
-		"SysTime in the stored model does not match that of JSON object")
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	assert.JSONEq(s.T(), `{
+  "message": "Report violates 1 validation rules",
+  "violations": [
+    {"field": "stats.cpuTemp", "message": "cpuTemp is 900 celsius, valid range is -50 to 150"}
+  ]
+}`, s.respWriterMock.writeArgument, "Response body is incorrect")
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
 }
 
-func (s *MetricsHandlerTestSuite) Test_POST_OptionalField_Returns201() {
+func (s *MetricsHandlerTestSuite) Test_POST_SeveralRulesBroken_AllViolationsReturned() {
+	requestBody :=
+		`{
+        "machineId": 12345,
+        "stats": {
+            "cpuTemp": 900,
+            "fanSpeed": 400,
+            "HDDSpace": 800
+        },
+        "lastLoggedIn": "Paul",
+        "sysTime": "2022-04-23T18:25:43.511Z"
+    }`
+
+	rulesPath := filepath.Join(s.T().TempDir(), "rules.yaml")
+	rules := `
+machineId:
+  ranges:
+    - {min: 1, max: 9999}
+lastLoggedIn:
+  pattern: "(admin|user)/[A-Za-z]+"
+labels:
+  dc: {required: true}
+`
+	assert.Nil(s.T(), os.WriteFile(rulesPath, []byte(rules), 0644), "Problem writing rules")
+
+	validationRules, err := validation.LoadRulesFile(rulesPath)
+	assert.Nil(s.T(), err, "Problem loading rules")
+
+	registry, err := metadata.NewRegistry()
+	assert.Nil(s.T(), err, "Problem creating registry")
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.MetricsRegistry = registry
+	metricsHandler.ValidationRules = validationRules
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("POST", "http://localhost:4000/metrics",
+		strings.NewReader(requestBody))
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	request.Header.Set("Content-Type", "application/json")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusBadRequest)
+	assert.JSONEq(s.T(), `{
+  "message": "Report violates 4 validation rules",
+  "violations": [
+    {"field": "stats.cpuTemp", "message": "cpuTemp is 900 celsius, valid range is -50 to 150"},
+    {"field": "machineId", "message": "machineId 12345 is not in any of the allowed ranges"},
+    {"field": "lastLoggedIn", "message": "lastLoggedIn \"Paul\" does not match (admin|user)/[A-Za-z]+"},
+    {"field": "labels.dc", "message": "labels.dc is required"}
+  ]
+}`, s.respWriterMock.writeArgument, "Response body is incorrect")
+
+	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 0)
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_IngestionMetaRecorded_ClientMetaReplaced() {
 	requestBody :=
 		`{
         "machineId": 12345,
         "stats": {
             "cpuTemp": 90,
             "fanSpeed": 400,
-            "HDDSpace": 800,
-            "internalTemp": 23
+            "HDDSpace": 800
         },
         "lastLoggedIn": "admin/Paul",
-        "sysTime": "2022-04-23T18:25:43.511Z"
+        "sysTime": "2022-04-23T18:25:43.511Z",
+        "meta": {
+            "sequence": 42,
+            "remoteAddr": "spoofed"
+        },
+        "machine": {
+            "owner": "spoofed"
+        }
     }`
 
 	// set return values on datastore mock
 	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
 
-	metricsHandler := NewMetricsHandler(s.dstoreMock, false, true, defaultMaxBodySize)
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+	metricsHandler.PrincipalHeader = "X-Authenticated-User"
 
 	// set return values on response writer mock
 	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
@@ -634,37 +2959,253 @@ func (s *MetricsHandlerTestSuite) Test_POST_OptionalField_Returns201() {
 	assert.Nil(s.T(), err, "Problem creating request")
 
 	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "metrics-agent/1.0")
+	request.Header.Set("X-Authenticated-User", "alice")
+	request.RemoteAddr = "10.0.0.1:54321"
 
+	before := time.Now()
 	metricsHandler.ServeHTTP(s.respWriterMock, request)
 
-	// try to match the response against regex
-	regexPattern :=
-		`{
-  "id": ".*",
-  "message": "New entry added to the data store with id - .*"
-}`
-	assert.Regexp(s.T(), regexp.MustCompile(regexPattern), s.respWriterMock.writeArgument,
-		"Response body should match expected regex")
-
 	s.respWriterMock.AssertCalled(s.T(), "WriteHeader", http.StatusCreated)
 
-	s.dstoreMock.AssertNumberOfCalls(s.T(), "AddEntry", 1)
+	meta := s.dstoreMock.addEntryArgument.Meta
+	assert.NotNil(s.T(), meta, "Ingestion metadata should be recorded")
+	assert.Equal(s.T(), uint64(0), meta.Sequence, "Sequence should be left to the datastore")
+	assert.Equal(s.T(), "10.0.0.1", meta.RemoteAddr, "RemoteAddr is incorrect")
+	assert.Equal(s.T(), "metrics-agent/1.0", meta.UserAgent, "UserAgent is incorrect")
+	assert.Equal(s.T(), "alice", meta.Principal, "Principal is incorrect")
+	assert.False(s.T(), meta.ReceivedAt.Before(before.Truncate(time.Second)), "ReceivedAt is too early")
+	assert.False(s.T(), meta.ReceivedAt.After(time.Now()), "ReceivedAt is too late")
+	assert.Nil(s.T(), s.dstoreMock.addEntryArgument.Machine, "Machine info should be left to the machine registry")
+	assert.Equal(s.T(), &model.Login{Role: "admin", User: "Paul"}, s.dstoreMock.addEntryArgument.Login, "Login should be parsed")
+}
 
-	// verify the calls to AddEntry
-	assert.Equal(s.T(), 12345, s.dstoreMock.addEntryArgument.MachineID,
-		"MachineID in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 90, s.dstoreMock.addEntryArgument.Stats.CPUTemp,
-		"Stats.CPUTemp in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 400, s.dstoreMock.addEntryArgument.Stats.FanSpeed,
-		"Stats.FanSpeed in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 800, s.dstoreMock.addEntryArgument.Stats.HDDSpace,
-		"Stats.HDDSpace in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), 23, *s.dstoreMock.addEntryArgument.Stats.InternalTemp,
-		"Stats.HDDSpace in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), "admin/Paul", s.dstoreMock.addEntryArgument.LastLoggedIn,
-		"LastLoggedIn in the stored model does not match that of JSON object")
-	assert.Equal(s.T(), "2022-04-23T18:25:43.511Z", s.dstoreMock.addEntryArgument.SysTime,
-		"SysTime in the stored model does not match that of JSON object")
+func (s *MetricsHandlerTestSuite) Test_GET_EntryWithIngestionMeta_ReturnsMetaObject() {
+	expectedJSON :=
+		`[
+  {
+    "id": "test-id",
+    "machineId": 123,
+    "stats": {
+      "cpuTemp": 456,
+      "fanSpeed": 789,
+      "HDDSpace": 987,
+      "internalTemp": 765
+    },
+    "lastLoggedIn": "userA",
+    "sysTime": "2021-07-28T14:16:27Z",
+    "meta": {
+      "receivedAt": "2023-01-02T03:04:05Z",
+      "sequence": 7,
+      "remoteAddr": "10.0.0.1"
+    }
+  }
+]`
+
+	// set return values on datastore mock
+	withMeta := dummyMachineMetrics
+	withMeta.Meta = &model.IngestionMeta{
+		ReceivedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Sequence:   7,
+		RemoteAddr: "10.0.0.1",
+	}
+
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&withMeta})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// set return values on response writer mock
+	s.respWriterMock.On("WriteHeader", mock.AnythingOfType("int"))
+	s.respWriterMock.On("Write", mock.AnythingOfType("[]uint8")).Return(0, nil)
+
+	request, err := http.NewRequest("GET", "http://localhost:4000/metrics", nil)
+	assert.Nil(s.T(), err, "Problem creating request")
+
+	metricsHandler.ServeHTTP(s.respWriterMock, request)
+
+	// inspect call to response writer
+	s.respWriterMock.AssertCalled(s.T(), "Write", []byte(expectedJSON))
+}
+
+// compressed returns data compressed in the content coding encoding
+func compressed(t *testing.T, encoding string, data []byte) []byte {
+	var buffer bytes.Buffer
+
+	var writer io.WriteCloser
+	if encoding == "gzip" {
+		writer = gzip.NewWriter(&buffer)
+	} else {
+		var err error
+		writer, err = zstd.NewWriter(&buffer)
+		assert.Nil(t, err, "Problem creating zstd writer")
+	}
+
+	_, err := writer.Write(data)
+	assert.Nil(t, err, "Problem compressing")
+	assert.Nil(t, writer.Close(), "Problem compressing")
+
+	return buffer.Bytes()
+}
+
+// decompressed returns data decompressed from the content coding encoding
+func decompressed(t *testing.T, encoding string, data []byte) string {
+	var reader io.Reader
+	var err error
+	if encoding == "gzip" {
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	} else {
+		reader, err = zstd.NewReader(bytes.NewReader(data))
+	}
+	assert.Nil(t, err, "Problem creating %s reader", encoding)
+
+	decompressedData, err := io.ReadAll(reader)
+	assert.Nil(t, err, "Problem decompressing %s", encoding)
+
+	return string(decompressedData)
+}
+
+func (s *MetricsHandlerTestSuite) Test_NegotiateEncoding_PrefersByQuality() {
+	acceptEncodings := map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"br":                        "",
+		"gzip":                      "gzip",
+		"gzip, deflate, br":         "gzip",
+		"GZIP;q=0.5, zstd;q=0.8":    "zstd",
+		"zstd;q=0.2, gzip":          "gzip",
+		"gzip, zstd":                "zstd",
+		"*":                         "zstd",
+		"gzip;q=0, zstd;q=0":        "",
+		"gzip;q=high, zstd;q=0.001": "zstd",
+		"zstd;q=0, *":               "gzip",
+		"GZIP;q=0, *":               "zstd",
+		"zstd;q=0, gzip;q=0, *":     "",
+		"zstd;q=0.5, *":             "gzip",
+		"gzip, *;q=0":               "gzip",
+	}
+
+	for acceptEncoding, expected := range acceptEncodings {
+		assert.Equal(s.T(), expected, negotiateEncoding(acceptEncoding), "Encoding for %q is incorrect", acceptEncoding)
+	}
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_AcceptEncodingExcludedByQualityZero_NotChosenForWildcard() {
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&dummyMachineMetrics})
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Accept-Encoding", "zstd;q=0, *")
+
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "gzip", recorder.Header().Get("Content-Encoding"), "Content encoding is incorrect")
+}
+
+func (s *MetricsHandlerTestSuite) Test_GET_AcceptEncoding_ReturnsCompressedResponse() {
+	s.dstoreMock.On("GetAllEntries").Return([]*model.MachineMetrics{&dummyMachineMetrics})
+	s.dstoreMock.On("GetEntry", mock.Anything).Return(nil, ds.ErrorKeyNotFound)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	recorder := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	uncompressed := recorder.Body.String()
+	assert.Empty(s.T(), recorder.Header().Get("Content-Encoding"), "Response should not be compressed unless asked for")
+	assert.Equal(s.T(), "Accept, Accept-Encoding", recorder.Header().Get("Vary"), "Vary header is incorrect")
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		for _, query := range []string{"", "?format=ndjson", "?format=csv"} {
+			recorder = httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/metrics"+query, nil)
+			request.Header.Set("Accept-Encoding", encoding)
+
+			metricsHandler.ServeHTTP(recorder, request)
+
+			assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status is incorrect")
+			assert.Equal(s.T(), encoding, recorder.Header().Get("Content-Encoding"), "Content encoding is incorrect")
+
+			body := decompressed(s.T(), encoding, recorder.Body.Bytes())
+			if query == "" {
+				assert.Equal(s.T(), uncompressed, body, "Decompressed response should be the uncompressed one")
+			} else {
+				assert.Contains(s.T(), body, "test-id", "Decompressed response should have the entry")
+			}
+		}
+	}
+
+	// error responses are compressed as well
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/metrics/c7055826-b23b-41d5-8026-951f0c424751", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	metricsHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(s.T(), http.StatusNotFound, recorder.Code, "Status is incorrect")
+	assert.Equal(s.T(), "gzip", recorder.Header().Get("Content-Encoding"), "Content encoding is incorrect")
+	assert.Contains(s.T(), decompressed(s.T(), "gzip", recorder.Body.Bytes()), "No entry in the data store", "Body is incorrect")
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_CompressedBody_Returns201() {
+	requestBody := []byte(`{"machineId": 12345, "stats": {"cpuTemp": 90}, "sysTime": "2022-04-23T18:25:43.511Z"}`)
+
+	// set return values on datastore mock
+	s.dstoreMock.On("AddEntry", mock.Anything, mock.Anything).Return(ds.Success)
+
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	for _, encoding := range []string{"gzip", "zstd", "identity"} {
+		body := requestBody
+		if encoding != "identity" {
+			body = compressed(s.T(), encoding, requestBody)
+		}
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/metrics", bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Content-Encoding", encoding)
+
+		metricsHandler.ServeHTTP(recorder, request)
+
+		assert.Equal(s.T(), http.StatusCreated, recorder.Code, "Status for %s is incorrect: %s", encoding, recorder.Body.String())
+		assert.Equal(s.T(), 12345, s.dstoreMock.addEntryArgument.MachineID, "Report should be decompressed")
+	}
+}
+
+func (s *MetricsHandlerTestSuite) Test_POST_InvalidCompressedBody_Rejected() {
+	metricsHandler := NewMetricsHandler(s.dstoreMock, false, false, defaultMaxBodySize)
+
+	// a report padded with whitespace, which compresses to a fraction of the limit
+	bomb := []byte(`{"machineId": 12345, "stats": {"cpuTemp": 90}, "sysTime": "2022-04-23T18:25:43.511Z"` +
+		strings.Repeat(" ", 2*defaultMaxBodySize) + "}")
+
+	requests := []struct {
+		encoding       string
+		body           []byte
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"br", []byte("{}"), http.StatusUnsupportedMediaType, "Content-Encoding br is not supported, only gzip and zstd are\n"},
+		{"gzip", []byte("{}"), http.StatusBadRequest, "Error parsing request body: unexpected EOF\n"},
+		{"gzip", compressed(s.T(), "gzip", bomb), http.StatusBadRequest, "Error parsing request body: http: request body too large\n"},
+		{"zstd", compressed(s.T(), "zstd", bomb), http.StatusBadRequest, "Error parsing request body: http: request body too large\n"},
+	}
+
+	for _, request := range requests {
+		assert.Less(s.T(), len(request.body), defaultMaxBodySize, "Compressed body should be within the limit")
+
+		recorder := httptest.NewRecorder()
+		httpRequest := httptest.NewRequest("POST", "/metrics", bytes.NewReader(request.body))
+		httpRequest.Header.Set("Content-Encoding", request.encoding)
+
+		metricsHandler.ServeHTTP(recorder, httpRequest)
+
+		assert.Equal(s.T(), request.expectedStatus, recorder.Code, "Status for %s is incorrect", request.encoding)
+		assert.Equal(s.T(), request.expectedBody, recorder.Body.String(), "Body for %s is incorrect", request.encoding)
+	}
+
+	s.dstoreMock.AssertNotCalled(s.T(), "AddEntry", mock.Anything, mock.Anything)
 }
 
 func (s *MetricsHandlerTestSuite) Test_UnknownMethod_Returns405() {
@@ -0,0 +1,80 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/schema"
+)
+
+// ndjsonContentType is the media type of responses with one JSON report per line
+const ndjsonContentType = "application/x-ndjson"
+
+// streamFlushInterval is the number of reports written between flushes of a streamed response,
+// so that clients get the first reports without waiting for the whole response
+const streamFlushInterval = 100
+
+// DefaultStreamWriteTimeout is the time a streamed response has to write the next streamFlushInterval reports
+const DefaultStreamWriteTimeout = 10 * time.Second
+
+// extendWriteDeadline gives a streamed response another StreamWriteTimeout to write, it is called before every
+// streamFlushInterval reports. The WriteTimeout of the server applies to the whole response and would cut a
+// long stream short, while a client which reads too slowly is still disconnected
+func (m *metricsHandler) extendWriteDeadline(controller *http.ResponseController) {
+	if m.StreamWriteTimeout <= 0 {
+		return
+	}
+
+	// response writers which are not backed by a connection, e.g. in tests, have no deadline
+	err := controller.SetWriteDeadline(time.Now().Add(m.StreamWriteTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("ERROR: GET - could not extend the write deadline: %s\n", err.Error())
+	}
+}
+
+// writeNDJSON streams entries one compact JSON object per line, rather than marshalling all of them first,
+// so the memory it needs does not depend on the number of entries. The status is sent with the first
+// report, so an error after it can only be logged and the response is cut short
+func (m *metricsHandler) writeNDJSON(responseWriter http.ResponseWriter, entries []*model.MachineMetrics,
+	schemaVersion int, fields *fieldSelection) {
+	responseWriter.Header().Set("Content-Type", ndjsonContentType)
+
+	flusher, canFlush := responseWriter.(http.Flusher)
+	encoder := json.NewEncoder(responseWriter)
+
+	controller := http.NewResponseController(responseWriter)
+	m.extendWriteDeadline(controller)
+
+	for i, entry := range entries {
+		rendered, err := schema.RenderEntry(entry, schemaVersion)
+		if err == nil && fields != nil {
+			rendered, err = fields.projectEntry(rendered)
+		}
+		if err != nil {
+			log.Printf("ERROR: GET - could not render entry %s: %s\n", entry.ID, err.Error())
+			return
+		}
+
+		if err := encoder.Encode(rendered); err != nil {
+			log.Printf("ERROR: GET - could not write response: %s\n", err.Error())
+			return
+		}
+
+		if (i+1)%streamFlushInterval == 0 {
+			if canFlush {
+				flusher.Flush()
+			}
+			m.extendWriteDeadline(controller)
+		}
+	}
+
+	if m.Debug {
+		log.Printf("GET - sent %d entries as NDJSON\n", len(entries))
+	}
+}
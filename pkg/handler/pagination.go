@@ -0,0 +1,191 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// query parameters paging through the reports of GET requests
+const (
+	limitParam      = "limit"      // number of reports on a page
+	cursorParam     = "cursor"     // as given in the next link of the previous page
+	totalCountParam = "totalCount" // set to true to get the number of matching reports in X-Total-Count
+)
+
+// page sizes used unless set on the handler
+const (
+	DefaultPageSize    = 1000
+	DefaultMaxPageSize = 10000
+)
+
+// totalCountHeader is the response header with the number of reports which match the filters of a GET request
+const totalCountHeader = "X-Total-Count"
+
+// pageKey is the position of a report in the order pages are returned in. Unless sorted by other fields,
+// reports are ordered by the sequence the datastore assigned when storing them, so reports stored while
+// a client is paging come after the page it is on and no report is skipped or returned twice. The time a
+// report was received is not used, as a report received earlier can be stored after a later one.
+// The id makes the order total, reports stored before ingestion metadata was recorded all come first, ordered by their id
+type pageKey struct {
+	Sort     string      `json:"o,omitempty"` // sort parameter the key was made for
+	Values   []sortValue `json:"v,omitempty"` // values of the report for every sort key
+	Sequence uint64      `json:"s"`
+	ID       string      `json:"i"`
+}
+
+func (p *pageRequest) keyOf(entry *model.MachineMetrics) pageKey {
+	key := pageKey{Sort: p.sort, Values: sortValues(p.sortKeys, entry), ID: entry.ID}
+	if entry.Meta != nil {
+		key.Sequence = entry.Meta.Sequence
+	}
+
+	return key
+}
+
+func (p *pageRequest) before(k, other pageKey) bool {
+	for i, key := range p.sortKeys {
+		if comparison := k.Values[i].compare(other.Values[i], key.descending); comparison != 0 {
+			return comparison < 0
+		}
+	}
+
+	if k.Sequence != other.Sequence {
+		return k.Sequence < other.Sequence
+	}
+
+	return k.ID < other.ID
+}
+
+// encodeCursor makes key opaque to clients, they are only expected to pass it back.
+// It fails for a sort value which is not a finite number
+func encodeCursor(key pageKey) (string, error) {
+	keyAsBytes, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("could not encode cursor: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(keyAsBytes), nil
+}
+
+func decodeCursor(cursor string) (pageKey, error) {
+	var key pageKey
+
+	keyAsBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(keyAsBytes, &key)
+	}
+	if err != nil {
+		return pageKey{}, fmt.Errorf("query parameter %s %q is not a cursor returned by the server", cursorParam, cursor)
+	}
+
+	return key, nil
+}
+
+// pageRequest holds the paging query parameters of a GET request
+type pageRequest struct {
+	limit      int
+	after      *pageKey // nil for the first page
+	totalCount bool
+	sort       string // as given, empty if not sorted by other fields
+	sortKeys   []sortKey
+}
+
+func parsePageRequest(query url.Values, defaultPageSize, maxPageSize int) (*pageRequest, error) {
+	sortKeys, err := parseSortKeys(query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &pageRequest{limit: defaultPageSize, sort: query.Get(sortParam), sortKeys: sortKeys}
+
+	if query.Has(limitParam) {
+		limit, err := strconv.Atoi(query.Get(limitParam))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return nil, fmt.Errorf("query parameter %s %q has to be a number from 1 to %d", limitParam, query.Get(limitParam), maxPageSize)
+		}
+		page.limit = limit
+	}
+
+	if query.Has(cursorParam) {
+		key, err := decodeCursor(query.Get(cursorParam))
+		if err != nil {
+			return nil, err
+		}
+		if key.Sort != page.sort || len(key.Values) != len(page.sortKeys) {
+			return nil, fmt.Errorf("query parameter %s was returned for a different %s", cursorParam, sortParam)
+		}
+		page.after = &key
+	}
+
+	if query.Has(totalCountParam) {
+		totalCount, err := strconv.ParseBool(query.Get(totalCountParam))
+		if err != nil {
+			return nil, fmt.Errorf("query parameter %s %q is not true or false", totalCountParam, query.Get(totalCountParam))
+		}
+		page.totalCount = totalCount
+	}
+
+	return page, nil
+}
+
+// page sorts entries and returns the ones on the requested page, and the key of the last of them
+// if more entries follow it, nil otherwise
+func (p *pageRequest) page(entries []*model.MachineMetrics) ([]*model.MachineMetrics, *pageKey) {
+	// the keys are worked out once rather than on every comparison
+	keys := make(map[*model.MachineMetrics]pageKey, len(entries))
+	for _, entry := range entries {
+		keys[entry] = p.keyOf(entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return p.before(keys[entries[i]], keys[entries[j]])
+	})
+
+	start := 0
+	if p.after != nil {
+		start = sort.Search(len(entries), func(i int) bool {
+			return p.before(*p.after, keys[entries[i]])
+		})
+	}
+
+	// the limit can be too large to add to start
+	if len(entries)-start <= p.limit {
+		return entries[start:], nil
+	}
+
+	end := start + p.limit
+	last := keys[entries[end-1]]
+	return entries[start:end], &last
+}
+
+// setPageHeaders sets the Link header to the next page, if there is one, and X-Total-Count if it was asked for
+func (p *pageRequest) setPageHeaders(responseWriter http.ResponseWriter, requestURL *url.URL, next *pageKey, total int) error {
+	if next != nil {
+		cursor, err := encodeCursor(*next)
+		if err != nil {
+			return err
+		}
+
+		query := requestURL.Query()
+		query.Set(cursorParam, cursor)
+
+		// a reference relative to the request, as RFC 8288 allows
+		nextURL := url.URL{Path: requestURL.Path, RawQuery: query.Encode()}
+		responseWriter.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextURL.String()))
+	}
+
+	if p.totalCount {
+		responseWriter.Header().Set(totalCountHeader, strconv.Itoa(total))
+	}
+
+	return nil
+}
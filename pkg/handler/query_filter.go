@@ -0,0 +1,243 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// query parameters filtering GET requests, other than the labels
+const (
+	machineIDParam          = "machineId"            // can be repeated, matches any of the ids
+	fromParam               = "from"                 // sysTime at or after
+	toParam                 = "to"                   // sysTime before
+	lastLoggedInParam       = "lastLoggedIn"         // can be repeated, matches any of the values
+	lastLoggedInPrefixParam = "lastLoggedIn.prefix"  // can be repeated, matches any of the prefixes
+	receivedFromParam       = "meta.receivedAt.from" // meta.receivedAt at or after
+	receivedToParam         = "meta.receivedAt.to"   // meta.receivedAt before
+	principalParam          = "meta.principal"       // can be repeated, matches any of the principals
+	remoteAddrParam         = "meta.remoteAddr"      // can be repeated, matches any of the addresses
+)
+
+// comparisonOperators are the suffixes of the query parameters comparing a metric with a number, e.g. cpuTemp.gt=80
+var comparisonOperators = map[string]func(value, operand float64) bool{
+	"gt":  func(value, operand float64) bool { return value > operand },
+	"gte": func(value, operand float64) bool { return value >= operand },
+	"lt":  func(value, operand float64) bool { return value < operand },
+	"lte": func(value, operand float64) bool { return value <= operand },
+	"eq":  func(value, operand float64) bool { return value == operand },
+	"ne":  func(value, operand float64) bool { return value != operand },
+}
+
+// metricComparison is a condition on a metric, a report without the metric does not match
+type metricComparison struct {
+	metric   string
+	operator string
+	operand  float64
+}
+
+// queryFilter holds the conditions of the query parameters of a GET request, a report has to match all of them.
+// Parameters it does not know about are ignored
+type queryFilter struct {
+	machineIDs           []int
+	from, to             time.Time // zero if not given
+	lastLoggedIn         []string
+	lastLoggedInPrefixes []string
+	receivedFrom         time.Time // zero if not given
+	receivedTo           time.Time // zero if not given
+	principals           []string
+	remoteAddrs          []string
+	comparisons          []metricComparison
+	labels               labelFilter
+}
+
+func parseQueryFilter(query url.Values) (*queryFilter, error) {
+	labels, err := parseLabelFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &queryFilter{
+		labels:               labels,
+		lastLoggedIn:         query[lastLoggedInParam],
+		lastLoggedInPrefixes: query[lastLoggedInPrefixParam],
+		principals:           query[principalParam],
+		remoteAddrs:          query[remoteAddrParam],
+	}
+
+	for _, value := range query[machineIDParam] {
+		machineID, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("query parameter %s %q is not a number", machineIDParam, value)
+		}
+		filter.machineIDs = append(filter.machineIDs, machineID)
+	}
+
+	if filter.from, err = parseTimeBound(query, fromParam); err != nil {
+		return nil, err
+	}
+	if filter.to, err = parseTimeBound(query, toParam); err != nil {
+		return nil, err
+	}
+	if !filter.from.IsZero() && !filter.to.IsZero() && !filter.from.Before(filter.to) {
+		return nil, fmt.Errorf("query parameter %s has to be before %s", fromParam, toParam)
+	}
+
+	if filter.receivedFrom, err = parseTimeBound(query, receivedFromParam); err != nil {
+		return nil, err
+	}
+	if filter.receivedTo, err = parseTimeBound(query, receivedToParam); err != nil {
+		return nil, err
+	}
+	if !filter.receivedFrom.IsZero() && !filter.receivedTo.IsZero() && !filter.receivedFrom.Before(filter.receivedTo) {
+		return nil, fmt.Errorf("query parameter %s has to be before %s", receivedFromParam, receivedToParam)
+	}
+
+	for param, values := range query {
+		if strings.HasPrefix(param, labelParamPrefix) {
+			continue
+		}
+
+		separator := strings.LastIndex(param, ".")
+		if separator < 0 {
+			continue
+		}
+
+		metric, operator := param[:separator], param[separator+1:]
+		if _, found := comparisonOperators[operator]; !found {
+			continue
+		}
+
+		if !validMetricName(metric) {
+			return nil, fmt.Errorf("query parameter %s does not name a valid metric", param)
+		}
+
+		for _, value := range values {
+			operand, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("query parameter %s %q is not a number", param, value)
+			}
+			filter.comparisons = append(filter.comparisons, metricComparison{metric: metric, operator: operator, operand: operand})
+		}
+	}
+
+	return filter, nil
+}
+
+// parseTimeBound parses a time in any of the formats sysTime is accepted in, the zero time is returned if it is not given
+func parseTimeBound(query url.Values, param string) (time.Time, error) {
+	if !query.Has(param) {
+		return time.Time{}, nil
+	}
+
+	bound := model.ParseSysTime(query.Get(param))
+	if !bound.Valid() {
+		return time.Time{}, fmt.Errorf("query parameter %s %q is not in a known time format", param, query.Get(param))
+	}
+
+	return bound.Time, nil
+}
+
+// validMetricName tells if name could be the name of a typed, custom or disk metric
+func validMetricName(name string) bool {
+	if model.IsTypedMetric(name) || model.IsDiskMetric(name) {
+		return true
+	}
+
+	return (model.MetricsStats{Custom: map[string]float64{name: 0}}).Validate() == nil
+}
+
+func (q *queryFilter) matches(entry *model.MachineMetrics) bool {
+	if len(q.machineIDs) > 0 && !containsInt(q.machineIDs, entry.MachineID) {
+		return false
+	}
+
+	// a report whose sysTime could not be parsed is outside of any bound
+	if !q.from.IsZero() && (!entry.SysTime.Valid() || entry.SysTime.Time.Before(q.from)) {
+		return false
+	}
+	if !q.to.IsZero() && (!entry.SysTime.Valid() || !entry.SysTime.Time.Before(q.to)) {
+		return false
+	}
+
+	if len(q.lastLoggedIn) > 0 && !contains(q.lastLoggedIn, entry.LastLoggedIn) {
+		return false
+	}
+	if len(q.lastLoggedInPrefixes) > 0 && !hasAnyPrefix(entry.LastLoggedIn, q.lastLoggedInPrefixes) {
+		return false
+	}
+
+	if !q.matchesMeta(entry.Meta) {
+		return false
+	}
+
+	for _, comparison := range q.comparisons {
+		value, found := entry.Stats.Metric(comparison.metric)
+		if !found || !comparisonOperators[comparison.operator](value, comparison.operand) {
+			return false
+		}
+	}
+
+	return q.labels.matches(entry)
+}
+
+// matchesMeta tells if the ingestion metadata matches, a report without it does not match any meta filter
+func (q *queryFilter) matchesMeta(meta *model.IngestionMeta) bool {
+	if q.receivedFrom.IsZero() && q.receivedTo.IsZero() && len(q.principals) == 0 && len(q.remoteAddrs) == 0 {
+		return true
+	}
+	if meta == nil {
+		return false
+	}
+
+	if !q.receivedFrom.IsZero() && meta.ReceivedAt.Before(q.receivedFrom) {
+		return false
+	}
+	if !q.receivedTo.IsZero() && !meta.ReceivedAt.Before(q.receivedTo) {
+		return false
+	}
+
+	if len(q.principals) > 0 && !contains(q.principals, meta.Principal) {
+		return false
+	}
+
+	return len(q.remoteAddrs) == 0 || contains(q.remoteAddrs, meta.RemoteAddr)
+}
+
+// filter returns the entries which match
+func (q *queryFilter) filter(entries []*model.MachineMetrics) []*model.MachineMetrics {
+	filtered := []*model.MachineMetrics{}
+	for _, entry := range entries {
+		if q.matches(entry) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
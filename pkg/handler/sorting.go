@@ -0,0 +1,123 @@
+// Copyright Konstantin Bakanov 2023
+
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// sortParam orders the reports of GET requests by comma separated fields, each descending if prefixed with '-',
+// e.g. sort=sysTime,-cpuTemp
+const sortParam = "sort"
+
+// sortTimeLayout formats times so that their text sorts in the same order as the times, which are all in UTC
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// sortValue is the value of a report a sort key orders by, either a number or a text.
+// It is part of the cursor of the next page, so it is kept short as JSON
+type sortValue struct {
+	Missing bool    `json:"m,omitempty"` // the report does not have the value, it comes after the ones which do
+	Number  float64 `json:"n,omitempty"`
+	Text    string  `json:"t,omitempty"`
+}
+
+// compare returns a negative number if v comes before other in ascending order, a positive one if after
+// and 0 if they are the same. A missing value comes last in either order
+func (v sortValue) compare(other sortValue, descending bool) int {
+	if v.Missing || other.Missing {
+		if v.Missing == other.Missing {
+			return 0
+		}
+		if v.Missing {
+			return 1
+		}
+		return -1
+	}
+
+	comparison := 0
+	switch {
+	case v.Number < other.Number:
+		comparison = -1
+	case v.Number > other.Number:
+		comparison = 1
+	default:
+		comparison = strings.Compare(v.Text, other.Text)
+	}
+
+	if descending {
+		return -comparison
+	}
+	return comparison
+}
+
+// sortFields are the fields of reports other than the metrics which can be sorted by
+var sortFields = map[string]func(entry *model.MachineMetrics) sortValue{
+	"id":           func(entry *model.MachineMetrics) sortValue { return sortValue{Text: entry.ID} },
+	"machineId":    func(entry *model.MachineMetrics) sortValue { return sortValue{Number: float64(entry.MachineID)} },
+	"lastLoggedIn": func(entry *model.MachineMetrics) sortValue { return sortValue{Text: entry.LastLoggedIn} },
+	"sysTime": func(entry *model.MachineMetrics) sortValue {
+		if !entry.SysTime.Valid() {
+			return sortValue{Missing: true}
+		}
+		return sortValue{Text: entry.SysTime.Time.UTC().Format(sortTimeLayout)}
+	},
+	"meta.receivedAt": func(entry *model.MachineMetrics) sortValue {
+		if entry.Meta == nil {
+			return sortValue{Missing: true}
+		}
+		return sortValue{Text: entry.Meta.ReceivedAt.UTC().Format(sortTimeLayout)}
+	},
+}
+
+// sortKey is one of the fields reports are sorted by
+type sortKey struct {
+	value      func(entry *model.MachineMetrics) sortValue
+	descending bool
+}
+
+// parseSortKeys parses the sort parameter, a field which is neither in sortFields nor a metric is rejected
+func parseSortKeys(query url.Values) ([]sortKey, error) {
+	if query.Get(sortParam) == "" {
+		return nil, nil
+	}
+
+	keys := []sortKey{}
+	for _, field := range strings.Split(query.Get(sortParam), ",") {
+		key := sortKey{}
+		field, key.descending = strings.CutPrefix(field, "-")
+
+		if value, found := sortFields[field]; found {
+			key.value = value
+		} else if validMetricName(field) {
+			metric := field
+			key.value = func(entry *model.MachineMetrics) sortValue {
+				value, found := entry.Stats.Metric(metric)
+				return sortValue{Number: value, Missing: !found}
+			}
+		} else {
+			return nil, fmt.Errorf("query parameter %s cannot sort by %q, it is not a field or a metric", sortParam, field)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// sortValues returns the values of entry which keys sort by
+func sortValues(keys []sortKey, entry *model.MachineMetrics) []sortValue {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	values := make([]sortValue, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, key.value(entry))
+	}
+
+	return values
+}
@@ -0,0 +1,168 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package machines keeps track of the machines which send reports to us
+package machines
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// maxInfoLength is the maximum length of each field of model.MachineInfo, in bytes
+const maxInfoLength = 256
+
+// InfoStore holds the descriptions of machines set by operators, by machine id.
+// It is kept in memory and optionally in a JSON file
+type InfoStore struct {
+	mutex   sync.RWMutex
+	infos   map[int]model.MachineInfo
+	path    string // not persisted if empty
+	changes *datastore.ChangeCounter
+}
+
+// NewInfoStore creates a store kept in the file at path, which is loaded if it exists.
+// Nothing is persisted if path is empty
+func NewInfoStore(path string) (*InfoStore, error) {
+	s := &InfoStore{infos: map[int]model.MachineInfo{}, path: path, changes: datastore.NewChangeCounter()}
+
+	if path == "" {
+		return s, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &s.infos); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Get returns the description of a machine, found is false if it has not been described
+func (s *InfoStore) Get(machineID int) (info model.MachineInfo, found bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	info, found = s.infos[machineID]
+	return info, found
+}
+
+// All returns a copy of all descriptions
+func (s *InfoStore) All() map[int]model.MachineInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	infos := make(map[int]model.MachineInfo, len(s.infos))
+	for machineID, info := range s.infos {
+		infos[machineID] = info
+	}
+
+	return infos
+}
+
+// Put replaces the description of a machine, it is not changed if it cannot be persisted
+func (s *InfoStore) Put(machineID int, info model.MachineInfo) error {
+	if err := validateInfo(info); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.infos[machineID]
+	s.infos[machineID] = info
+
+	if err := s.save(); err != nil {
+		if existed {
+			s.infos[machineID] = previous
+		} else {
+			delete(s.infos, machineID)
+		}
+		return err
+	}
+	s.changes.Changed()
+
+	return nil
+}
+
+// Version changes whenever a description is put
+func (s *InfoStore) Version() datastore.Version {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.changes.Version()
+}
+
+func validateInfo(info model.MachineInfo) error {
+	fields := []struct{ name, value string }{
+		{"hostname", info.Hostname},
+		{"owner", info.Owner},
+		{"location", info.Location},
+	}
+
+	for _, field := range fields {
+		if len(field.value) > maxInfoLength {
+			return fmt.Errorf("%s is longer than %d bytes", field.name, maxInfoLength)
+		}
+	}
+
+	return nil
+}
+
+// save atomically replaces the file with the current descriptions, has to be called with the lock held
+func (s *InfoStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	contents, err := json.MarshalIndent(s.infos, "", "  ") // keyed by machine id
+	if err != nil {
+		return err
+	}
+
+	tempPath := s.path + ".tmp"
+	if err := writeAndSync(tempPath, contents); err != nil {
+		return fmt.Errorf("could not write %s: %w", tempPath, err)
+	}
+
+	if err := os.Rename(tempPath, s.path); err != nil {
+		return fmt.Errorf("could not replace %s: %w", s.path, err)
+	}
+
+	// make the rename durable
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func writeAndSync(path string, contents []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(contents); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright Konstantin Bakanov 2023
+
+package machines
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// LoginChange is a change of lastLoggedIn between consecutive reports of a machine
+type LoginChange struct {
+	From         time.Time    `json:"from"`            // when the first report with the value was received
+	Until        *time.Time   `json:"until,omitempty"` // when the value changed, nil if it is still current
+	LastLoggedIn string       `json:"lastLoggedIn"`
+	Login        *model.Login `json:"login,omitempty"`
+	ReportID     string       `json:"reportId"` // the first report with the value
+}
+
+// Logins returns the history of lastLoggedIn of a machine in the order the reports were received,
+// the first report of the machine always starts a change. Reports without a known time are skipped
+func Logins(entries []*model.MachineMetrics, machineID int) []*LoginChange {
+	reports := []*model.MachineMetrics{}
+	for _, entry := range entries {
+		if entry.MachineID == machineID && !seenAt(entry).IsZero() {
+			reports = append(reports, entry)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		first, second := seenAt(reports[i]), seenAt(reports[j])
+		if !first.Equal(second) {
+			return first.Before(second)
+		}
+		return later(reports[j], reports[i])
+	})
+
+	changes := []*LoginChange{}
+	for _, report := range reports {
+		if len(changes) > 0 && changes[len(changes)-1].LastLoggedIn == report.LastLoggedIn {
+			continue
+		}
+
+		seen := seenAt(report)
+		if len(changes) > 0 {
+			changes[len(changes)-1].Until = &seen
+		}
+
+		login := report.Login
+		if login == nil {
+			// stored before logins were parsed
+			login = model.ParseLogin(report.LastLoggedIn)
+		}
+
+		changes = append(changes, &LoginChange{
+			From:         seen,
+			LastLoggedIn: report.LastLoggedIn,
+			Login:        login,
+			ReportID:     report.ID,
+		})
+	}
+
+	return changes
+}
+
+// LoginsBetween returns the changes whose value was current at some point at or after from and before to,
+// a zero from or to is not checked
+func LoginsBetween(changes []*LoginChange, from, to time.Time) []*LoginChange {
+	between := []*LoginChange{}
+
+	for _, change := range changes {
+		if !to.IsZero() && !change.From.Before(to) {
+			continue
+		}
+		if !from.IsZero() && change.Until != nil && !change.Until.After(from) {
+			continue
+		}
+
+		between = append(between, change)
+	}
+
+	return between
+}
@@ -0,0 +1,100 @@
+// Copyright Konstantin Bakanov 2023
+
+package machines
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// Machine summarises the reports of one machine
+type Machine struct {
+	MachineID   int                 `json:"machineId"`
+	FirstSeen   *time.Time          `json:"firstSeen,omitempty"` // when the first stored report was received
+	LastSeen    *time.Time          `json:"lastSeen,omitempty"`  // when the latest stored report was received
+	ReportCount int                 `json:"reportCount"`
+	LatestStats *model.MetricsStats `json:"latestStats,omitempty"` // stats of the latest stored report
+	Info        *model.MachineInfo  `json:"info,omitempty"`        // set by operators
+}
+
+// Summarise returns every machine which has reports in entries or a description in infos, sorted by id
+func Summarise(entries []*model.MachineMetrics, infos map[int]model.MachineInfo) []*Machine {
+	byID := map[int]*Machine{}
+	latest := map[int]*model.MachineMetrics{}
+
+	machine := func(machineID int) *Machine {
+		if byID[machineID] == nil {
+			byID[machineID] = &Machine{MachineID: machineID}
+		}
+		return byID[machineID]
+	}
+
+	for _, entry := range entries {
+		m := machine(entry.MachineID)
+		m.ReportCount++
+
+		seen := seenAt(entry)
+		if seen.IsZero() {
+			continue // neither received time nor sysTime is known
+		}
+
+		if m.FirstSeen == nil || seen.Before(*m.FirstSeen) {
+			m.FirstSeen = &seen
+		}
+
+		if m.LastSeen == nil || seen.After(*m.LastSeen) || (seen.Equal(*m.LastSeen) && later(entry, latest[entry.MachineID])) {
+			m.LastSeen = &seen
+			latest[entry.MachineID] = entry
+		}
+	}
+
+	for machineID, entry := range latest {
+		stats := entry.Stats
+		byID[machineID].LatestStats = &stats
+	}
+
+	for machineID, info := range infos {
+		info := info
+		machine(machineID).Info = &info
+	}
+
+	machines := make([]*Machine, 0, len(byID))
+	for _, m := range byID {
+		machines = append(machines, m)
+	}
+
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].MachineID < machines[j].MachineID
+	})
+
+	return machines
+}
+
+// seenAt is when the report was received, reports stored before that was recorded fall back to their sysTime
+func seenAt(entry *model.MachineMetrics) time.Time {
+	if entry.Meta != nil && !entry.Meta.ReceivedAt.IsZero() {
+		return entry.Meta.ReceivedAt
+	}
+
+	return entry.SysTime.Time
+}
+
+// later breaks the tie between reports received at the same time by their sequence and then their id
+func later(entry, other *model.MachineMetrics) bool {
+	entrySequence, otherSequence := sequence(entry), sequence(other)
+	if entrySequence != otherSequence {
+		return entrySequence > otherSequence
+	}
+
+	return entry.ID > other.ID
+}
+
+func sequence(entry *model.MachineMetrics) uint64 {
+	if entry.Meta == nil {
+		return 0
+	}
+
+	return entry.Meta.Sequence
+}
@@ -0,0 +1,231 @@
+// Copyright Konstantin Bakanov 2023
+
+package machines
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// Path is the route listing all machines, the routes of the machines are below it:
+//
+//	GET /machines      - list every machine with its first and last seen times, report count and latest stats
+//	GET /machines/{id} - one machine
+//	PUT /machines/{id} - describe a machine, body is an object with hostname, owner and location
+//	GET /machines/{id}/logins - history of lastLoggedIn of a machine, optionally between the from and to query parameters
+const Path = "/machines"
+
+// loginsSuffix is the last segment of the route of the login history of a machine
+const loginsSuffix = "logins"
+
+// query parameters limiting the login history, as the sysTime bounds of GET /metrics
+const (
+	fromParam = "from" // at or after
+	toParam   = "to"   // before
+)
+
+// maxInfoBodySize limits the body of a PUT request
+const maxInfoBodySize = 4096
+
+// an HTTP handler for the machine registry
+type machinesHandler struct {
+	MetricsDatastore datastore.DatastoreInterface
+	Infos            *InfoStore
+	Debug            bool
+}
+
+func NewMachinesHandler(metricsDatastore datastore.DatastoreInterface, infos *InfoStore, debug bool) *machinesHandler {
+	return &machinesHandler{
+		MetricsDatastore: metricsDatastore,
+		Infos:            infos,
+		Debug:            debug,
+	}
+}
+
+// implementing http.Handler interface
+func (m *machinesHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == Path || request.URL.Path == Path+"/" {
+		if request.Method == "GET" {
+			m.handleGetMachines(responseWriter)
+		} else {
+			responseWriter.Header().Set("Allow", "GET")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	idAsString, subresource, hasSubresource := strings.Cut(strings.TrimPrefix(request.URL.Path, Path+"/"), "/")
+	machineID, err := strconv.Atoi(idAsString)
+	if err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Machine id %q is not a number", idAsString), http.StatusBadRequest)
+		return
+	}
+
+	if hasSubresource {
+		if subresource != loginsSuffix {
+			http.NotFound(responseWriter, request)
+		} else if request.Method == "GET" {
+			m.handleGetLogins(responseWriter, request, machineID)
+		} else {
+			responseWriter.Header().Set("Allow", "GET")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if request.Method == "GET" {
+		m.handleGetMachine(responseWriter, machineID)
+	} else if request.Method == "PUT" {
+		m.handlePutInfo(responseWriter, request, machineID)
+	} else {
+		responseWriter.Header().Set("Allow", "GET, PUT")
+		responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *machinesHandler) summarise() []*Machine {
+	allEntries := m.MetricsDatastore.GetAllEntries()
+	if allEntries == nil {
+		return nil
+	}
+
+	return Summarise(allEntries, m.Infos.All())
+}
+
+func (m *machinesHandler) handleGetMachines(responseWriter http.ResponseWriter) {
+	machines := m.summarise()
+	if machines == nil {
+		log.Println("ERROR: machines - could not get entries from the datastore")
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(responseWriter, http.StatusOK, machines)
+}
+
+func (m *machinesHandler) handleGetMachine(responseWriter http.ResponseWriter, machineID int) {
+	machines := m.summarise()
+	if machines == nil {
+		log.Println("ERROR: machines - could not get entries from the datastore")
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, machine := range machines {
+		if machine.MachineID == machineID {
+			writeJSON(responseWriter, http.StatusOK, machine)
+			return
+		}
+	}
+
+	http.Error(responseWriter, fmt.Sprintf("Machine %d has not been seen", machineID), http.StatusNotFound)
+}
+
+func (m *machinesHandler) handleGetLogins(responseWriter http.ResponseWriter, request *http.Request, machineID int) {
+	query := request.URL.Query()
+
+	from, err := parseTimeParam(query, fromParam)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to, err := parseTimeParam(query, toParam)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		http.Error(responseWriter, fmt.Sprintf("query parameter %s has to be before %s", fromParam, toParam), http.StatusBadRequest)
+		return
+	}
+
+	allEntries := m.MetricsDatastore.GetAllEntries()
+	if allEntries == nil {
+		log.Println("ERROR: machines - could not get entries from the datastore")
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(responseWriter, http.StatusOK, LoginsBetween(Logins(allEntries, machineID), from, to))
+}
+
+// parseTimeParam parses a time from the query in any of the formats sysTime is accepted in, as GET /metrics does,
+// the zero time is returned if it is not given
+func parseTimeParam(query url.Values, name string) (time.Time, error) {
+	if !query.Has(name) {
+		return time.Time{}, nil
+	}
+
+	parsed := model.ParseSysTime(query.Get(name))
+	if !parsed.Valid() {
+		return time.Time{}, fmt.Errorf("query parameter %s %q is not in a known time format", name, query.Get(name))
+	}
+
+	return parsed.Time, nil
+}
+
+func (m *machinesHandler) handlePutInfo(responseWriter http.ResponseWriter, request *http.Request, machineID int) {
+	if contentType := request.Header.Get("Content-Type"); contentType != "" && contentType != "application/json" {
+		http.Error(responseWriter, "Content-Type header is not application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(responseWriter, request.Body, maxInfoBodySize))
+	decoder.DisallowUnknownFields()
+
+	var info model.MachineInfo
+	if err := decoder.Decode(&info); err != nil {
+		http.Error(responseWriter, "Error parsing request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		http.Error(responseWriter, "Request body can only contain one JSON object", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateInfo(info); err != nil {
+		http.Error(responseWriter, "Error parsing request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := m.Infos.Put(machineID, info); err != nil {
+		log.Printf("ERROR: machines - could not store the description of machine %d: %s\n", machineID, err.Error())
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if m.Debug {
+		log.Printf("machines - described machine %d: %#v\n", machineID, info)
+	}
+
+	writeJSON(responseWriter, http.StatusOK, info)
+}
+
+func writeJSON(responseWriter http.ResponseWriter, status int, value interface{}) {
+	valueAsBytes, err := json.MarshalIndent(value, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: machines - could not marshal response: %s\n", err.Error())
+		http.Error(responseWriter, "Error marshalling response", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+
+	if _, err = responseWriter.Write(valueAsBytes); err != nil {
+		log.Printf("ERROR: machines - could not write response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,260 @@
+package machines
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+var startTime = time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func report(id string, machineID int, cpuTemp int, receivedAfter time.Duration) *model.MachineMetrics {
+	return &model.MachineMetrics{
+		ID:        id,
+		MachineID: machineID,
+		Stats:     model.MetricsStats{CPUTemp: cpuTemp},
+		SysTime:   model.NewSysTime(startTime),
+		Meta:      &model.IngestionMeta{ReceivedAt: startTime.Add(receivedAfter)},
+	}
+}
+
+type MachinesTestSuite struct {
+	suite.Suite
+	datastore datastore.DatastoreInterface
+	infos     *InfoStore
+	handler   http.Handler
+}
+
+func (s *MachinesTestSuite) SetupTest() {
+	var err error
+	s.infos, err = NewInfoStore(filepath.Join(s.T().TempDir(), "machines.json"))
+	require.Nil(s.T(), err, "Problem creating store")
+
+	s.datastore = datastore.NewDatastoreAsMap()
+	s.handler = NewMachinesHandler(s.datastore, s.infos, false)
+}
+
+func (s *MachinesTestSuite) serve(method, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func (s *MachinesTestSuite) Test_Summarise_ReportsGroupedByMachine() {
+	entries := []*model.MachineMetrics{
+		report("b", 7, 60, 2*time.Minute),
+		report("a", 7, 50, time.Minute),
+		report("c", 3, 70, 3*time.Minute),
+		report("d", 7, 40, 30*time.Second),
+	}
+
+	machines := Summarise(entries, map[int]model.MachineInfo{9: {Owner: "ops"}})
+
+	require.Len(s.T(), machines, 3, "Every machine should be listed")
+
+	assert.Equal(s.T(), 3, machines[0].MachineID, "Machines should be sorted by id")
+	assert.Equal(s.T(), 1, machines[0].ReportCount, "Report count is incorrect")
+
+	assert.Equal(s.T(), 7, machines[1].MachineID, "Machines should be sorted by id")
+	assert.Equal(s.T(), 3, machines[1].ReportCount, "Report count is incorrect")
+	assert.Equal(s.T(), startTime.Add(30*time.Second), *machines[1].FirstSeen, "First seen is incorrect")
+	assert.Equal(s.T(), startTime.Add(2*time.Minute), *machines[1].LastSeen, "Last seen is incorrect")
+	assert.Equal(s.T(), 60, machines[1].LatestStats.CPUTemp, "Stats of the latest report should be returned")
+	assert.Nil(s.T(), machines[1].Info, "Machine has not been described")
+
+	assert.Equal(s.T(), &Machine{MachineID: 9, Info: &model.MachineInfo{Owner: "ops"}}, machines[2],
+		"Described machine without reports should be listed")
+}
+
+func (s *MachinesTestSuite) Test_Summarise_SameReceivedTime_HigherSequenceIsLatest() {
+	first := report("b", 7, 50, 0)
+	first.Meta.Sequence = 1
+	second := report("a", 7, 60, 0)
+	second.Meta.Sequence = 2
+
+	machines := Summarise([]*model.MachineMetrics{second, first}, nil)
+
+	require.Len(s.T(), machines, 1, "One machine should be listed")
+	assert.Equal(s.T(), 60, machines[0].LatestStats.CPUTemp, "Report with the higher sequence should be the latest")
+}
+
+func (s *MachinesTestSuite) Test_GET_Machines_ReturnsSummaries() {
+	s.datastore.AddEntry("a", report("a", 7, 50, 0))
+	require.Nil(s.T(), s.infos.Put(7, model.MachineInfo{Hostname: "web-1"}), "Problem describing machine")
+
+	recorder := s.serve("GET", "/machines", "")
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+	assert.Equal(s.T(), "application/json", recorder.Header().Get("Content-Type"), "Content type is incorrect")
+	assert.JSONEq(s.T(), `[
+  {
+    "machineId": 7,
+    "firstSeen": "2023-05-01T12:00:00Z",
+    "lastSeen": "2023-05-01T12:00:00Z",
+    "reportCount": 1,
+    "latestStats": {"cpuTemp": 50, "fanSpeed": 0, "HDDSpace": 0},
+    "info": {"hostname": "web-1"}
+  }
+]`, recorder.Body.String(), "Response body is incorrect")
+}
+
+func (s *MachinesTestSuite) Test_GET_Machine_UnknownMachine_Returns404() {
+	s.datastore.AddEntry("a", report("a", 7, 50, 0))
+
+	recorder := s.serve("GET", "/machines/7", "")
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Known machine should be found")
+
+	recorder = s.serve("GET", "/machines/8", "")
+	assert.Equal(s.T(), http.StatusNotFound, recorder.Code, "Unknown machine should not be found")
+
+	recorder = s.serve("GET", "/machines/web-1", "")
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Machine id has to be a number")
+}
+
+func (s *MachinesTestSuite) Test_PUT_Machine_InfoStoredAndPersisted() {
+	recorder := s.serve("PUT", "/machines/7", `{"hostname": "web-1", "owner": "ops", "location": "rack 12"}`)
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+
+	info, found := s.infos.Get(7)
+	assert.True(s.T(), found, "Machine should be described")
+	assert.Equal(s.T(), model.MachineInfo{Hostname: "web-1", Owner: "ops", Location: "rack 12"}, info, "Info is incorrect")
+
+	reopened, err := NewInfoStore(s.infos.path)
+	require.Nil(s.T(), err, "Problem reopening store")
+	assert.Equal(s.T(), s.infos.All(), reopened.All(), "Info should be persisted")
+}
+
+func (s *MachinesTestSuite) Test_PUT_Machine_InvalidInfo_Returns400() {
+	recorder := s.serve("PUT", "/machines/7", `{"hostname": "web-1", "colour": "red"}`)
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Unknown field should be rejected")
+
+	recorder = s.serve("PUT", "/machines/7", `{"owner": "`+strings.Repeat("a", maxInfoLength+1)+`"}`)
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Too long owner should be rejected")
+	assert.Equal(s.T(), "Error parsing request body: owner is longer than 256 bytes\n", recorder.Body.String(), "Response body is incorrect")
+
+	_, found := s.infos.Get(7)
+	assert.False(s.T(), found, "Machine should not be described")
+}
+
+func (s *MachinesTestSuite) Test_PUT_Machine_CannotPersist_InfoNotChanged() {
+	require.Nil(s.T(), s.infos.Put(7, model.MachineInfo{Owner: "ops"}), "Problem describing machine")
+	require.Nil(s.T(), os.Mkdir(s.infos.path+".tmp", 0755), "Problem blocking the temporary file")
+
+	recorder := s.serve("PUT", "/machines/7", `{"owner": "dev"}`)
+
+	assert.Equal(s.T(), http.StatusInternalServerError, recorder.Code, "Status code is incorrect")
+
+	info, _ := s.infos.Get(7)
+	assert.Equal(s.T(), "ops", info.Owner, "Previous info should be kept")
+}
+
+func (s *MachinesTestSuite) Test_Logins_ChangesBetweenConsecutiveReports() {
+	first := report("a", 7, 50, 0)
+	first.LastLoggedIn = "admin/Tim"
+	second := report("b", 7, 50, time.Minute)
+	second.LastLoggedIn = "admin/Tim"
+	third := report("c", 7, 50, 2*time.Minute)
+	third.LastLoggedIn = "Ann"
+	third.Login = &model.Login{User: "Ann"}
+	other := report("d", 8, 50, 90*time.Second)
+	other.LastLoggedIn = "root/Bob"
+
+	changes := Logins([]*model.MachineMetrics{third, other, second, first}, 7)
+
+	until := startTime.Add(2 * time.Minute)
+	assert.Equal(s.T(), []*LoginChange{
+		{From: startTime, Until: &until, LastLoggedIn: "admin/Tim", Login: &model.Login{Role: "admin", User: "Tim"}, ReportID: "a"},
+		{From: startTime.Add(2 * time.Minute), LastLoggedIn: "Ann", Login: &model.Login{User: "Ann"}, ReportID: "c"},
+	}, changes, "Changes are incorrect")
+
+	between := LoginsBetween(changes, startTime.Add(30*time.Second), startTime.Add(time.Minute))
+	require.Len(s.T(), between, 1, "One login should be current in the period")
+	assert.Equal(s.T(), "a", between[0].ReportID, "Login current in the period is incorrect")
+
+	between = LoginsBetween(changes, startTime.Add(2*time.Minute), time.Time{})
+	require.Len(s.T(), between, 1, "One login should be current after the change")
+	assert.Equal(s.T(), "c", between[0].ReportID, "Login current after the change is incorrect")
+
+	between = LoginsBetween(changes, time.Time{}, startTime.Add(2*time.Minute))
+	require.Len(s.T(), between, 1, "Login changed at the end of the period should not be current in it")
+	assert.Equal(s.T(), "a", between[0].ReportID, "Login current before the change is incorrect")
+}
+
+func (s *MachinesTestSuite) Test_GET_Logins_ReturnsHistory() {
+	first := report("a", 7, 50, 0)
+	first.LastLoggedIn = "admin/Tim"
+	second := report("b", 7, 50, time.Hour)
+	second.LastLoggedIn = "Ann"
+	s.datastore.AddEntry("a", first)
+	s.datastore.AddEntry("b", second)
+
+	recorder := s.serve("GET", "/machines/7/logins?from=2023-05-01T12:30:00Z&to=2023-05-01T12:45:00Z", "")
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+	assert.JSONEq(s.T(), `[
+  {
+    "from": "2023-05-01T12:00:00Z",
+    "until": "2023-05-01T13:00:00Z",
+    "lastLoggedIn": "admin/Tim",
+    "login": {"role": "admin", "user": "Tim"},
+    "reportId": "a"
+  }
+]`, recorder.Body.String(), "Response body is incorrect")
+
+	recorder = s.serve("GET", "/machines/8/logins", "")
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+	assert.JSONEq(s.T(), `[]`, recorder.Body.String(), "Machine without reports should have no logins")
+
+	// the same formats as sysTime, here a Unix timestamp, with to before the second change
+	recorder = s.serve("GET", "/machines/7/logins?from=1682942400&to=2023-05-01T13:00:00Z", "")
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+	assert.JSONEq(s.T(), `[
+  {
+    "from": "2023-05-01T12:00:00Z",
+    "until": "2023-05-01T13:00:00Z",
+    "lastLoggedIn": "admin/Tim",
+    "login": {"role": "admin", "user": "Tim"},
+    "reportId": "a"
+  }
+]`, recorder.Body.String(), "Login changed at the end of the period should not be returned")
+
+	recorder = s.serve("GET", "/machines/7/logins?from=yesterday", "")
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Invalid time should be rejected")
+	assert.Equal(s.T(), "query parameter from \"yesterday\" is not in a known time format\n", recorder.Body.String(), "Error is incorrect")
+
+	recorder = s.serve("GET", "/machines/7/logins?from=2023-05-01T13:00:00Z&to=2023-05-01T12:00:00Z", "")
+	assert.Equal(s.T(), http.StatusBadRequest, recorder.Code, "Empty period should be rejected")
+	assert.Equal(s.T(), "query parameter from has to be before to\n", recorder.Body.String(), "Error is incorrect")
+
+	recorder = s.serve("GET", "/machines/7/sessions", "")
+	assert.Equal(s.T(), http.StatusNotFound, recorder.Code, "Unknown subresource should not be found")
+}
+
+func (s *MachinesTestSuite) Test_UnknownMethod_Returns405() {
+	recorder := s.serve("POST", "/machines", "")
+	assert.Equal(s.T(), http.StatusMethodNotAllowed, recorder.Code, "Status code is incorrect")
+	assert.Equal(s.T(), "GET", recorder.Header().Get("Allow"), "Allow header is incorrect")
+
+	recorder = s.serve("DELETE", "/machines/7", "")
+	assert.Equal(s.T(), http.StatusMethodNotAllowed, recorder.Code, "Status code is incorrect")
+	assert.Equal(s.T(), "GET, PUT", recorder.Header().Get("Allow"), "Allow header is incorrect")
+
+	recorder = s.serve("PUT", "/machines/7/logins", "")
+	assert.Equal(s.T(), http.StatusMethodNotAllowed, recorder.Code, "Status code is incorrect")
+}
+
+func TestMachinesTestSuite(t *testing.T) {
+	suite.Run(t, new(MachinesTestSuite))
+}
@@ -0,0 +1,46 @@
+// Copyright Konstantin Bakanov 2023
+
+package metadata
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Path is the route on which the descriptions of all metrics are exposed
+const Path = "/metrics/metadata"
+
+// an HTTP handler which returns the descriptions of all metrics as JSON
+type metadataHandler struct {
+	Registry *Registry
+}
+
+func NewMetadataHandler(registry *Registry) *metadataHandler {
+	return &metadataHandler{
+		Registry: registry,
+	}
+}
+
+// implementing http.Handler interface
+func (m *metadataHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		responseWriter.Header().Set("Allow", "GET")
+		responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	metrics := m.Registry.All()
+
+	metricsAsBytes, err := json.MarshalIndent(metrics, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: metadata - could not marshal metrics: %s\n", err.Error())
+		http.Error(responseWriter, "Error marshalling metrics", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	if _, err = responseWriter.Write(metricsAsBytes); err != nil {
+		log.Printf("ERROR: metadata - could not write response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package metadata describes the metrics reported to us: their units,
+// types and valid ranges
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// MetricType tells how the values of a metric behave over time
+type MetricType string
+
+const (
+	Gauge   MetricType = "gauge"   // a value which goes up and down, e.g. a temperature
+	Counter MetricType = "counter" // a value which only increases, e.g. a number of errors
+)
+
+// Metric describes one metric
+type Metric struct {
+	Name        string     `json:"name"`
+	Unit        string     `json:"unit"`
+	Type        MetricType `json:"type"`
+	Description string     `json:"description"`
+	Min         *float64   `json:"min,omitempty"` // lowest valid value, unbounded if nil
+	Max         *float64   `json:"max,omitempty"` // highest valid value, unbounded if nil
+}
+
+func bound(value float64) *float64 {
+	return &value
+}
+
+// DefaultMetrics describes the typed metrics of model.MetricsStats
+var DefaultMetrics = []Metric{
+	{
+		Name:        model.MetricCPUTemp,
+		Unit:        "celsius",
+		Type:        Gauge,
+		Description: "Temperature of the CPU",
+		Min:         bound(-50),
+		Max:         bound(150),
+	},
+	{
+		Name:        model.MetricFanSpeed,
+		Unit:        "rpm",
+		Type:        Gauge,
+		Description: "Speed of the CPU fan",
+		Min:         bound(0),
+	},
+	{
+		Name:        model.MetricHDDSpace,
+		Unit:        "gigabytes",
+		Type:        Gauge,
+		Description: "Free space on the system disk",
+		Min:         bound(0),
+	},
+	{
+		Name:        model.MetricInternalTemp,
+		Unit:        "celsius",
+		Type:        Gauge,
+		Description: "Temperature inside the case",
+		Min:         bound(-50),
+		Max:         bound(150),
+	},
+}
+
+// Registry holds the descriptions of metrics by name
+type Registry struct {
+	mutex   sync.RWMutex
+	metrics map[string]Metric
+}
+
+// NewRegistry creates a registry describing DefaultMetrics and then metrics,
+// a metric with the name of a default metric replaces it
+func NewRegistry(metrics ...Metric) (*Registry, error) {
+	r := &Registry{metrics: make(map[string]Metric)}
+
+	for _, metric := range append(append([]Metric{}, DefaultMetrics...), metrics...) {
+		if err := r.Register(metric); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// LoadFile reads metric descriptions from a JSON file holding an array of metrics
+func LoadFile(path string) ([]Metric, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := []Metric{}
+	if err := json.Unmarshal(contents, &metrics); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	return metrics, nil
+}
+
+// Register adds metric to the registry or replaces the metric of the same name
+func (r *Registry) Register(metric Metric) error {
+	if metric.Name == "" {
+		return fmt.Errorf("metric has no name")
+	}
+
+	if !model.IsTypedMetric(metric.Name) && !model.IsDiskMetric(metric.Name) {
+		if err := (model.MetricsStats{Custom: map[string]float64{metric.Name: 0}}).Validate(); err != nil {
+			return fmt.Errorf("metric %q cannot be registered: %w", metric.Name, err)
+		}
+	}
+
+	if metric.Type != Gauge && metric.Type != Counter {
+		return fmt.Errorf("metric %q has type %q, it has to be %s or %s", metric.Name, metric.Type, Gauge, Counter)
+	}
+
+	if metric.Min != nil && metric.Max != nil && *metric.Min > *metric.Max {
+		return fmt.Errorf("metric %q has min %v greater than max %v", metric.Name, *metric.Min, *metric.Max)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics[metric.Name] = metric
+
+	return nil
+}
+
+// Lookup returns the description of the metric called name
+func (r *Registry) Lookup(name string) (Metric, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	metric, found := r.metrics[name]
+	return metric, found
+}
+
+// All returns the descriptions of all metrics sorted by name
+func (r *Registry) All() []Metric {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	metrics := make([]Metric, 0, len(r.metrics))
+	for _, metric := range r.metrics {
+		metrics = append(metrics, metric)
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+
+	return metrics
+}
+
+// RangeError tells that a metric is outside of its valid range
+type RangeError struct {
+	Metric string
+	Value  float64
+	Unit   string
+	Range  string // e.g. "-50 to 150"
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%s is %s %s, valid range is %s", e.Metric, formatValue(e.Value), e.Unit, e.Range)
+}
+
+// Violations returns an error for every metric in stats which has a description and
+// is outside of its valid range, sorted by metric name. Metrics without a description are not checked
+func (r *Registry) Violations(stats model.MetricsStats) []*RangeError {
+	values := stats.Metrics()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report violations in the same order every time
+
+	violations := []*RangeError{}
+	for _, name := range names {
+		metric, found := r.Lookup(name)
+		if !found {
+			continue
+		}
+
+		value := values[name]
+		if (metric.Min != nil && value < *metric.Min) || (metric.Max != nil && value > *metric.Max) {
+			violations = append(violations, &RangeError{Metric: name, Value: value, Unit: metric.Unit, Range: metric.validRange()})
+		}
+	}
+
+	return violations
+}
+
+// Validate returns the first of Violations or nil if there are none
+func (r *Registry) Validate(stats model.MetricsStats) error {
+	if violations := r.Violations(stats); len(violations) > 0 {
+		return violations[0]
+	}
+
+	return nil
+}
+
+func (m Metric) validRange() string {
+	switch {
+	case m.Min != nil && m.Max != nil:
+		return fmt.Sprintf("%s to %s", formatValue(*m.Min), formatValue(*m.Max))
+	case m.Min != nil:
+		return fmt.Sprintf("%s or more", formatValue(*m.Min))
+	default:
+		return fmt.Sprintf("%s or less", formatValue(*m.Max))
+	}
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,140 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	registry *Registry
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	var err error
+	s.registry, err = NewRegistry(Metric{
+		Name:        "gpuTemp",
+		Unit:        "celsius",
+		Type:        Gauge,
+		Description: "Temperature of the GPU",
+		Max:         bound(120),
+	})
+	require.Nil(s.T(), err, "Problem creating registry")
+}
+
+func (s *RegistryTestSuite) Test_NewRegistry_DefaultAndAddedMetricsDescribed() {
+	names := []string{}
+	for _, metric := range s.registry.All() {
+		names = append(names, metric.Name)
+	}
+
+	assert.Equal(s.T(), []string{"HDDSpace", "cpuTemp", "fanSpeed", "gpuTemp", "internalTemp"}, names,
+		"All metrics should be described, sorted by name")
+
+	metric, found := s.registry.Lookup("gpuTemp")
+	assert.True(s.T(), found, "Added metric should be found")
+	assert.Equal(s.T(), "celsius", metric.Unit, "Unit is incorrect")
+}
+
+func (s *RegistryTestSuite) Test_NewRegistry_DefaultMetricReplaced() {
+	registry, err := NewRegistry(Metric{Name: "cpuTemp", Unit: "fahrenheit", Type: Gauge, Max: bound(300)})
+	require.Nil(s.T(), err, "Problem creating registry")
+
+	metric, _ := registry.Lookup("cpuTemp")
+	assert.Equal(s.T(), "fahrenheit", metric.Unit, "Default metric should be replaced")
+	assert.Nil(s.T(), registry.Validate(model.MetricsStats{CPUTemp: 250}), "Replaced range should be used")
+}
+
+func (s *RegistryTestSuite) Test_Register_InvalidMetricsRejected() {
+	assert.NotNil(s.T(), s.registry.Register(Metric{Type: Gauge}), "Metric without a name should be rejected")
+	assert.NotNil(s.T(), s.registry.Register(Metric{Name: "gpu temp", Type: Gauge}), "Invalid name should be rejected")
+	assert.NotNil(s.T(), s.registry.Register(Metric{Name: "errors", Type: "histogram"}), "Unknown type should be rejected")
+	assert.NotNil(s.T(), s.registry.Register(Metric{Name: "errors", Type: Counter, Min: bound(10), Max: bound(1)}),
+		"Min greater than max should be rejected")
+}
+
+func (s *RegistryTestSuite) Test_Validate_ValuesOutsideOfRangeRejected() {
+	stats := model.MetricsStats{CPUTemp: 70, FanSpeed: 500, HDDSpace: 100, Custom: map[string]float64{"gpuTemp": 80, "undescribed": -1}}
+	assert.Nil(s.T(), s.registry.Validate(stats), "Values within their ranges should be accepted")
+
+	stats.CPUTemp = 151
+	err := s.registry.Validate(stats)
+	require.NotNil(s.T(), err, "CPU temperature above its range should be rejected")
+	assert.Equal(s.T(), "cpuTemp is 151 celsius, valid range is -50 to 150", err.Error(), "Error is incorrect")
+
+	stats.CPUTemp = 70
+	stats.FanSpeed = -1
+	err = s.registry.Validate(stats)
+	require.NotNil(s.T(), err, "Negative fan speed should be rejected")
+	assert.Equal(s.T(), "fanSpeed is -1 rpm, valid range is 0 or more", err.Error(), "Error is incorrect")
+
+	stats.FanSpeed = 500
+	stats.Custom["gpuTemp"] = 120.5
+	err = s.registry.Validate(stats)
+	require.NotNil(s.T(), err, "Custom metric above its range should be rejected")
+	assert.Equal(s.T(), "gpuTemp is 120.5 celsius, valid range is 120 or less", err.Error(), "Error is incorrect")
+}
+
+func (s *RegistryTestSuite) Test_Validate_DiskMetricOutsideOfRangeRejected() {
+	require.Nil(s.T(), s.registry.Register(Metric{Name: "disks.sdb.free", Unit: "gigabytes", Type: Gauge, Min: bound(10)}),
+		"Problem registering disk metric")
+
+	stats := model.MetricsStats{Disks: []model.Disk{{Device: "sda", Total: 500, Free: 5}, {Device: "sdb", Total: 4000, Free: 3}}}
+	err := s.registry.Validate(stats)
+	require.NotNil(s.T(), err, "Disk with too little free space should be rejected")
+	assert.Equal(s.T(), "disks.sdb.free is 3 gigabytes, valid range is 10 or more", err.Error(), "Error is incorrect")
+}
+
+func (s *RegistryTestSuite) Test_LoadFile_MetricsRead() {
+	path := filepath.Join(s.T().TempDir(), "metrics.json")
+	require.Nil(s.T(), os.WriteFile(path, []byte(`[
+  {"name": "psu.voltage", "unit": "volts", "type": "gauge", "description": "Output of the PSU", "min": 11.4, "max": 12.6}
+]`), 0644), "Problem writing file")
+
+	metrics, err := LoadFile(path)
+	assert.Nil(s.T(), err, "Problem loading file")
+	assert.Equal(s.T(), []Metric{{Name: "psu.voltage", Unit: "volts", Type: Gauge, Description: "Output of the PSU",
+		Min: bound(11.4), Max: bound(12.6)}}, metrics, "Metrics are incorrect")
+
+	require.Nil(s.T(), os.WriteFile(path, []byte(`{"name": "psu.voltage"}`), 0644), "Problem writing file")
+	_, err = LoadFile(path)
+	assert.NotNil(s.T(), err, "File which is not an array should be rejected")
+}
+
+func (s *RegistryTestSuite) Test_MetadataHandler_ReturnsMetricsAsJSON() {
+	registry, err := NewRegistry()
+	require.Nil(s.T(), err, "Problem creating registry")
+
+	recorder := httptest.NewRecorder()
+	NewMetadataHandler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", Path, nil))
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+	assert.Equal(s.T(), "application/json", recorder.Header().Get("Content-Type"), "Content type is incorrect")
+	assert.JSONEq(s.T(), `[
+  {"name": "HDDSpace", "unit": "gigabytes", "type": "gauge", "description": "Free space on the system disk", "min": 0},
+  {"name": "cpuTemp", "unit": "celsius", "type": "gauge", "description": "Temperature of the CPU", "min": -50, "max": 150},
+  {"name": "fanSpeed", "unit": "rpm", "type": "gauge", "description": "Speed of the CPU fan", "min": 0},
+  {"name": "internalTemp", "unit": "celsius", "type": "gauge", "description": "Temperature inside the case", "min": -50, "max": 150}
+]`, recorder.Body.String(), "Response body is incorrect")
+}
+
+func (s *RegistryTestSuite) Test_MetadataHandler_UnknownMethod_Returns405() {
+	recorder := httptest.NewRecorder()
+	NewMetadataHandler(s.registry).ServeHTTP(recorder, httptest.NewRequest("POST", Path, nil))
+
+	assert.Equal(s.T(), http.StatusMethodNotAllowed, recorder.Code, "Status code is incorrect")
+	assert.Equal(s.T(), "GET", recorder.Header().Get("Allow"), "Allow header is incorrect")
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
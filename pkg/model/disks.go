@@ -0,0 +1,95 @@
+// Copyright Konstantin Bakanov 2023
+
+package model
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MaxDisks           = 64 // maximal number of disks in one report
+	MaxDiskFieldLength = 256
+
+	// diskMetricPrefix starts the names of the metrics of disks, e.g. "disks.sda.free",
+	// custom metrics cannot use it
+	diskMetricPrefix = "disks."
+
+	diskMetricTotal = "total"
+	diskMetricFree  = "free"
+)
+
+// Disk is one disk of a machine, sizes are in gigabytes like HDDSpace
+type Disk struct {
+	Device     string `json:"device"`               // e.g. "sda" or "/dev/nvme0n1", unique within a report
+	MountPoint string `json:"mountPoint,omitempty"` // e.g. "/data"
+	Total      int    `json:"total"`
+	Free       int    `json:"free"`
+}
+
+// DiskMetricName returns the name the metric field of the disk device is queried by,
+// field is either "total" or "free"
+func DiskMetricName(device, field string) string {
+	return diskMetricPrefix + device + "." + field
+}
+
+// IsDiskMetric tells if name is the name of a metric of a disk
+func IsDiskMetric(name string) bool {
+	return strings.HasPrefix(name, diskMetricPrefix)
+}
+
+// diskMetric returns the metric of a disk called name and whether the disk is in disks
+func diskMetric(disks []Disk, name string) (float64, bool) {
+	rest := strings.TrimPrefix(name, diskMetricPrefix)
+
+	separator := strings.LastIndex(rest, ".")
+	if separator < 0 {
+		return 0, false
+	}
+	device, field := rest[:separator], rest[separator+1:]
+
+	for _, disk := range disks {
+		if disk.Device != device {
+			continue
+		}
+
+		switch field {
+		case diskMetricTotal:
+			return float64(disk.Total), true
+		case diskMetricFree:
+			return float64(disk.Free), true
+		}
+	}
+
+	return 0, false
+}
+
+// validateDisks checks the number of disks and that each of them is consistent
+func validateDisks(disks []Disk) error {
+	if len(disks) > MaxDisks {
+		return fmt.Errorf("stats.disks has %d disks, at most %d are allowed", len(disks), MaxDisks)
+	}
+
+	devices := make(map[string]bool, len(disks))
+	for i, disk := range disks {
+		switch {
+		case disk.Device == "":
+			return fmt.Errorf("stats.disks[%d] has no device", i)
+		case utf8.RuneCountInString(disk.Device) > MaxDiskFieldLength:
+			return fmt.Errorf("stats.disks[%d] has a device longer than %d characters", i, MaxDiskFieldLength)
+		case utf8.RuneCountInString(disk.MountPoint) > MaxDiskFieldLength:
+			return fmt.Errorf("stats.disks[%d] has a mountPoint longer than %d characters", i, MaxDiskFieldLength)
+		case devices[disk.Device]:
+			return fmt.Errorf("stats.disks has device %q more than once", disk.Device)
+		case disk.Total < 0 || disk.Free < 0:
+			return fmt.Errorf("stats.disks[%d] cannot have a negative total or free", i)
+		case disk.Free > disk.Total:
+			return fmt.Errorf("stats.disks[%d] has free %d greater than total %d", i, disk.Free, disk.Total)
+		}
+
+		devices[disk.Device] = true
+	}
+
+	return nil
+}
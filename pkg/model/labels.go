@@ -0,0 +1,52 @@
+// Copyright Konstantin Bakanov 2023
+
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	MaxLabelKeyLength = 64
+
+	DefaultMaxLabels           = 16
+	DefaultMaxLabelValueLength = 128
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// LabelLimits restricts the labels of a report
+type LabelLimits struct {
+	MaxLabels           int // maximal number of labels in one report
+	MaxLabelValueLength int
+}
+
+// DefaultLabelLimits are used unless configured otherwise
+var DefaultLabelLimits = LabelLimits{MaxLabels: DefaultMaxLabels, MaxLabelValueLength: DefaultMaxLabelValueLength}
+
+// ValidLabelKey tells if key can be used as a label key
+func ValidLabelKey(key string) bool {
+	return len(key) <= MaxLabelKeyLength && labelKeyPattern.MatchString(key)
+}
+
+// Validate checks labels against the limits and the keys against the allowed format
+func (l LabelLimits) Validate(labels map[string]string) error {
+	if len(labels) > l.MaxLabels {
+		return fmt.Errorf("labels has %d labels, at most %d are allowed", len(labels), l.MaxLabels)
+	}
+
+	for key, value := range labels {
+		if !ValidLabelKey(key) {
+			return fmt.Errorf("label key %q is invalid, keys start with a letter, "+
+				"contain only letters, digits, '_', '.' and '-' and are at most %d characters long", key, MaxLabelKeyLength)
+		}
+
+		if length := utf8.RuneCountInString(value); length > l.MaxLabelValueLength {
+			return fmt.Errorf("value of label %q is %d characters long, at most %d are allowed", key, length, l.MaxLabelValueLength)
+		}
+	}
+
+	return nil
+}
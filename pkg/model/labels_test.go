@@ -0,0 +1,23 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LabelLimits_Validate(t *testing.T) {
+	limits := LabelLimits{MaxLabels: 2, MaxLabelValueLength: 5}
+
+	assert.Nil(t, limits.Validate(nil), "No labels should be valid")
+	assert.Nil(t, limits.Validate(map[string]string{"dc": "eu-1", "hw-model.v2": "ünïcö"}),
+		"Labels within the limits should be valid")
+
+	assert.NotNil(t, limits.Validate(map[string]string{"a": "1", "b": "2", "c": "3"}), "Too many labels should be rejected")
+	assert.NotNil(t, limits.Validate(map[string]string{"dc": "eu-west-1"}), "Too long value should be rejected")
+
+	for _, key := range []string{"", "1dc", "data center", "dc=1", strings.Repeat("k", MaxLabelKeyLength+1)} {
+		assert.NotNil(t, limits.Validate(map[string]string{key: "x"}), "Key %q should be rejected", key)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright Konstantin Bakanov 2023
+
+package model
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultLoginPatterns are the patterns lastLoggedIn is parsed with unless configured otherwise,
+// e.g. "admin/Tim" is the user Tim in the role admin and "Tim" is the user Tim without a role
+var DefaultLoginPatterns = []string{
+	`^(?P<role>[^/]+)/(?P<user>.+)$`,
+	`^(?P<user>.+)$`,
+}
+
+// loginPatterns are the patterns lastLoggedIn is parsed with, tried in order
+var loginPatterns = mustCompileLoginPatterns(DefaultLoginPatterns)
+
+// Login is lastLoggedIn parsed into its components
+type Login struct {
+	Role string `json:"role,omitempty"`
+	User string `json:"user"`
+}
+
+// SetLoginPatterns replaces the regular expressions lastLoggedIn is parsed with. Every pattern
+// has to have a group named user and can have a group named role. It is meant to be called
+// once at startup, before any request is handled
+func SetLoginPatterns(patterns []string) error {
+	compiled, err := compileLoginPatterns(patterns)
+	if err != nil {
+		return err
+	}
+
+	loginPatterns = compiled
+	return nil
+}
+
+// ParseLogin parses lastLoggedIn with the first pattern which matches it,
+// nil is returned if it is empty or no pattern matches it
+func ParseLogin(lastLoggedIn string) *Login {
+	if lastLoggedIn == "" {
+		return nil
+	}
+
+	for _, pattern := range loginPatterns {
+		match := pattern.FindStringSubmatch(lastLoggedIn)
+		if match == nil {
+			continue
+		}
+
+		login := &Login{}
+		if index := pattern.SubexpIndex("role"); index > 0 {
+			login.Role = match[index]
+		}
+		login.User = match[pattern.SubexpIndex("user")]
+
+		return login
+	}
+
+	return nil
+}
+
+func compileLoginPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("login pattern %q is not a valid regular expression: %w", pattern, err)
+		}
+
+		if re.SubexpIndex("user") < 0 {
+			return nil, fmt.Errorf("login pattern %q has no group named user", pattern)
+		}
+
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+func mustCompileLoginPatterns(patterns []string) []*regexp.Regexp {
+	compiled, err := compileLoginPatterns(patterns)
+	if err != nil {
+		panic(err)
+	}
+
+	return compiled
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseLogin_DefaultPatterns(t *testing.T) {
+	assert.Equal(t, &Login{Role: "admin", User: "Tim"}, ParseLogin("admin/Tim"), "Role and user should be parsed")
+	assert.Equal(t, &Login{Role: "admin", User: "Tim/2"}, ParseLogin("admin/Tim/2"), "Role should end at the first slash")
+	assert.Equal(t, &Login{User: "userA"}, ParseLogin("userA"), "Login without a role should be parsed")
+	assert.Nil(t, ParseLogin(""), "Nobody logged in should not be parsed")
+}
+
+func Test_ParseLogin_ConfiguredPatterns(t *testing.T) {
+	defer SetLoginPatterns(DefaultLoginPatterns)
+
+	assert.Nil(t, SetLoginPatterns([]string{`^(?P<user>[^@]+)@(?P<role>.+)$`}), "Problem setting patterns")
+
+	assert.Equal(t, &Login{Role: "admin", User: "tim"}, ParseLogin("tim@admin"), "Role and user should be parsed")
+	assert.Nil(t, ParseLogin("admin/Tim"), "Login which matches no pattern should not be parsed")
+}
+
+func Test_SetLoginPatterns_InvalidPatterns_Rejected(t *testing.T) {
+	defer SetLoginPatterns(DefaultLoginPatterns)
+
+	assert.NotNil(t, SetLoginPatterns([]string{`^(?P<user>.+`}), "Invalid regular expression should be rejected")
+	assert.NotNil(t, SetLoginPatterns([]string{`^(?P<role>.+)$`}), "Pattern without a user group should be rejected")
+
+	assert.Equal(t, &Login{Role: "admin", User: "Tim"}, ParseLogin("admin/Tim"), "Patterns should not be changed")
+}
@@ -2,18 +2,45 @@
 
 package model
 
+import "time"
+
 // MachineMetrics contains metrics reported to us
 type MachineMetrics struct {
-	ID           string       `json:"id"`
-	MachineID    int          `json:"machineId"`
-	Stats        MetricsStats `json:"stats"`
-	LastLoggedIn string       `json:"lastLoggedIn"`
-	SysTime      string       `json:"sysTime"`
+	ID           string            `json:"id"`
+	MachineID    int               `json:"machineId"`
+	Stats        MetricsStats      `json:"stats"`
+	LastLoggedIn string            `json:"lastLoggedIn"`
+	Login        *Login            `json:"login,omitempty"` // parsed from LastLoggedIn by the server
+	SysTime      SysTime           `json:"sysTime"`
+	Labels       map[string]string `json:"labels,omitempty"`  // e.g. "dc": "eu-west-1"
+	Meta         *IngestionMeta    `json:"meta,omitempty"`    // assigned by the server, never by the client
+	Machine      *MachineInfo      `json:"machine,omitempty"` // added from the machine registry when returned, never stored
+}
+
+// MachineInfo describes a machine, it is set by operators rather than reported by the machine
+type MachineInfo struct {
+	Hostname string `json:"hostname,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Location string `json:"location,omitempty"`
 }
 
+// MetricsStats holds the metrics known to us as typed fields,
+// any other metric goes into Custom
 type MetricsStats struct {
-	CPUTemp      int  `json:"cpuTemp"`
-	FanSpeed     int  `json:"fanSpeed"`
-	HDDSpace     int  `json:"HDDSpace"`
-	InternalTemp *int `json:"internalTemp,omitempty"` // optional field
+	CPUTemp      int                `json:"cpuTemp"`
+	FanSpeed     int                `json:"fanSpeed"`
+	HDDSpace     int                `json:"HDDSpace"`
+	InternalTemp *int               `json:"internalTemp,omitempty"` // optional field
+	Custom       map[string]float64 `json:"custom,omitempty"`       // named metrics, e.g. "gpuTemp"
+	Disks        []Disk             `json:"disks,omitempty"`        // every disk of the machine, HDDSpace is the system disk only
+}
+
+// IngestionMeta is recorded by the server when a report is received,
+// unlike SysTime it does not depend on the clock of the machine
+type IngestionMeta struct {
+	ReceivedAt time.Time `json:"receivedAt"`
+	Sequence   uint64    `json:"sequence"` // assigned by the datastore, increases with every stored report
+	RemoteAddr string    `json:"remoteAddr"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Principal  string    `json:"principal,omitempty"` // authenticated user which sent the report, if any
 }
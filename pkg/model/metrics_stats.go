@@ -0,0 +1,112 @@
+// Copyright Konstantin Bakanov 2023
+
+package model
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+const (
+	MaxCustomMetrics          = 64 // maximal number of custom metrics in one report
+	MaxCustomMetricNameLength = 64
+)
+
+// names of the typed metrics, custom metrics cannot use them
+const (
+	MetricCPUTemp      = "cpuTemp"
+	MetricFanSpeed     = "fanSpeed"
+	MetricHDDSpace     = "HDDSpace"
+	MetricInternalTemp = "internalTemp"
+)
+
+var customMetricNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.]*$`)
+
+// Metrics returns all metrics of the report by name, the typed ones and the ones of the disks included,
+// so that all kinds can be queried the same way
+func (s MetricsStats) Metrics() map[string]float64 {
+	metrics := make(map[string]float64, len(s.Custom)+2*len(s.Disks)+4)
+
+	for name, value := range s.Custom {
+		metrics[name] = value
+	}
+
+	metrics[MetricCPUTemp] = float64(s.CPUTemp)
+	metrics[MetricFanSpeed] = float64(s.FanSpeed)
+	metrics[MetricHDDSpace] = float64(s.HDDSpace)
+
+	if s.InternalTemp != nil {
+		metrics[MetricInternalTemp] = float64(*s.InternalTemp)
+	}
+
+	for _, disk := range s.Disks {
+		metrics[DiskMetricName(disk.Device, diskMetricTotal)] = float64(disk.Total)
+		metrics[DiskMetricName(disk.Device, diskMetricFree)] = float64(disk.Free)
+	}
+
+	return metrics
+}
+
+// Metric returns the metric called name and whether the report has it
+func (s MetricsStats) Metric(name string) (float64, bool) {
+	switch name {
+	case MetricCPUTemp:
+		return float64(s.CPUTemp), true
+	case MetricFanSpeed:
+		return float64(s.FanSpeed), true
+	case MetricHDDSpace:
+		return float64(s.HDDSpace), true
+	case MetricInternalTemp:
+		if s.InternalTemp == nil {
+			return 0, false
+		}
+		return float64(*s.InternalTemp), true
+	}
+
+	if IsDiskMetric(name) {
+		return diskMetric(s.Disks, name)
+	}
+
+	value, found := s.Custom[name]
+	return value, found
+}
+
+// IsTypedMetric tells if name is one of the metrics with a field of its own
+func IsTypedMetric(name string) bool {
+	switch name {
+	case MetricCPUTemp, MetricFanSpeed, MetricHDDSpace, MetricInternalTemp:
+		return true
+	}
+
+	return false
+}
+
+// Validate checks the names, the values and the number of custom metrics and the disks
+func (s MetricsStats) Validate() error {
+	if len(s.Custom) > MaxCustomMetrics {
+		return fmt.Errorf("stats.custom has %d metrics, at most %d are allowed", len(s.Custom), MaxCustomMetrics)
+	}
+
+	for name, value := range s.Custom {
+		// JSON has no NaN or infinity, they could not be returned
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("stats.custom metric %q is %v, only finite numbers are allowed", name, value)
+		}
+
+		if IsTypedMetric(name) {
+			return fmt.Errorf("stats.custom cannot contain %q, it is a field of stats", name)
+		}
+
+		if IsDiskMetric(name) {
+			return fmt.Errorf("stats.custom cannot contain %q, names starting with %q are metrics of stats.disks", name, diskMetricPrefix)
+		}
+
+		if len(name) > MaxCustomMetricNameLength || !customMetricNamePattern.MatchString(name) {
+			return fmt.Errorf("stats.custom metric name %q is invalid, names start with a letter, "+
+				"contain only letters, digits, '_' and '.' and are at most %d characters long", name, MaxCustomMetricNameLength)
+		}
+	}
+
+	return validateDisks(s.Disks)
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MetricsStats_Metrics_TypedAndCustom(t *testing.T) {
+	internalTemp := 23
+	stats := MetricsStats{
+		CPUTemp:      78,
+		FanSpeed:     500,
+		HDDSpace:     100,
+		InternalTemp: &internalTemp,
+		Custom:       map[string]float64{"gpuTemp": 71.5},
+	}
+
+	assert.Equal(t, map[string]float64{
+		"cpuTemp":      78,
+		"fanSpeed":     500,
+		"HDDSpace":     100,
+		"internalTemp": 23,
+		"gpuTemp":      71.5,
+	}, stats.Metrics(), "All metrics should be returned")
+
+	value, found := stats.Metric("gpuTemp")
+	assert.True(t, found, "Custom metric should be found")
+	assert.Equal(t, 71.5, value, "Unexpected value of custom metric")
+
+	value, found = stats.Metric("cpuTemp")
+	assert.True(t, found, "Typed metric should be found")
+	assert.Equal(t, float64(78), value, "Unexpected value of typed metric")
+
+	_, found = MetricsStats{}.Metric("internalTemp")
+	assert.False(t, found, "Optional metric should not be found if not set")
+
+	_, found = stats.Metric("memoryUsed")
+	assert.False(t, found, "Unknown metric should not be found")
+}
+
+func Test_MetricsStats_Validate(t *testing.T) {
+	assert.Nil(t, MetricsStats{}.Validate(), "Stats without custom metrics should be valid")
+	assert.Nil(t, MetricsStats{Custom: map[string]float64{"gpu_temp.0": 1}}.Validate(), "Name should be valid")
+
+	for _, name := range []string{"cpuTemp", "HDDSpace", "", "0gpu", "gpu temp", strings.Repeat("a", MaxCustomMetricNameLength+1)} {
+		assert.NotNil(t, MetricsStats{Custom: map[string]float64{name: 1}}.Validate(), "Name %q should be rejected", name)
+	}
+
+	tooMany := map[string]float64{}
+	for i := 0; i <= MaxCustomMetrics; i++ {
+		tooMany[fmt.Sprintf("metric%d", i)] = 1
+	}
+	assert.NotNil(t, MetricsStats{Custom: tooMany}.Validate(), "Too many custom metrics should be rejected")
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		assert.NotNil(t, MetricsStats{Custom: map[string]float64{"gpuTemp": value}}.Validate(), "Value %v should be rejected", value)
+	}
+}
+
+func Test_MetricsStats_Metrics_Disks(t *testing.T) {
+	stats := MetricsStats{
+		HDDSpace: 100,
+		Disks: []Disk{
+			{Device: "sda", MountPoint: "/", Total: 500, Free: 100},
+			{Device: "/dev/nvme0n1", MountPoint: "/data", Total: 4000, Free: 12},
+		},
+	}
+
+	metrics := stats.Metrics()
+	assert.Equal(t, float64(500), metrics["disks.sda.total"], "Total of the disk should be returned")
+	assert.Equal(t, float64(12), metrics["disks./dev/nvme0n1.free"], "Free of the disk should be returned")
+
+	value, found := stats.Metric(DiskMetricName("/dev/nvme0n1", "free"))
+	assert.True(t, found, "Disk metric should be found")
+	assert.Equal(t, float64(12), value, "Unexpected value of disk metric")
+
+	_, found = stats.Metric("disks.sdb.free")
+	assert.False(t, found, "Metric of an unknown disk should not be found")
+
+	_, found = stats.Metric("disks.sda.used")
+	assert.False(t, found, "Unknown metric of a disk should not be found")
+}
+
+func Test_MetricsStats_Validate_Disks(t *testing.T) {
+	assert.Nil(t, MetricsStats{Disks: []Disk{{Device: "sda", Total: 10, Free: 10}, {Device: "sdb"}}}.Validate(),
+		"Disks should be valid")
+
+	invalid := [][]Disk{
+		{{Total: 10, Free: 5}},
+		{{Device: "sda", Total: 10, Free: 5}, {Device: "sda", Total: 10, Free: 5}},
+		{{Device: "sda", Total: 10, Free: 11}},
+		{{Device: "sda", Total: -1, Free: -1}},
+		{{Device: strings.Repeat("d", MaxDiskFieldLength+1)}},
+		make([]Disk, MaxDisks+1),
+	}
+	for _, disks := range invalid {
+		assert.NotNil(t, MetricsStats{Disks: disks}.Validate(), "Disks %v should be rejected", disks)
+	}
+
+	assert.NotNil(t, MetricsStats{Custom: map[string]float64{"disks.sda.free": 1}}.Validate(),
+		"Custom metric should not be named like a disk metric")
+}
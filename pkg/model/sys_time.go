@@ -0,0 +1,120 @@
+// Copyright Konstantin Bakanov 2023
+
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixMillisThreshold separates Unix seconds from Unix milliseconds,
+// as seconds only reach it in the year 33658
+const unixMillisThreshold = 1e12
+
+// DefaultSysTimeLayouts are the layouts sysTime is parsed with unless configured otherwise
+var DefaultSysTimeLayouts = []string{
+	time.RFC3339Nano,
+	"Mon 2006-01-02 15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// SysTimeLayouts are the layouts sysTime is parsed with, tried in order. A time without a zone
+// is taken as UTC. It is meant to be set once at startup, before any request is handled
+var SysTimeLayouts = DefaultSysTimeLayouts
+
+// SysTime is the time reported by a machine. It is parsed with SysTimeLayouts
+// or as Unix seconds or milliseconds, and written as UTC RFC3339
+type SysTime struct {
+	Time time.Time // zero if the value could not be parsed
+	Raw  string    // the value as sent, only set if it could not be parsed
+}
+
+// NewSysTime creates a SysTime holding t
+func NewSysTime(t time.Time) SysTime {
+	return SysTime{Time: t.UTC()}
+}
+
+// Valid tells if the value was parsed
+func (s SysTime) Valid() bool {
+	return !s.Time.IsZero()
+}
+
+// String returns the time as UTC RFC3339 or the raw value if it could not be parsed
+func (s SysTime) String() string {
+	if s.Valid() {
+		return s.Time.Format(time.RFC3339Nano)
+	}
+
+	return s.Raw
+}
+
+func (s SysTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON accepts a string or a number. A value which cannot be parsed
+// is kept in Raw, it is up to the caller whether to accept it
+func (s *SysTime) UnmarshalJSON(data []byte) error {
+	*s = SysTime{}
+
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	var value string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	} else {
+		var number json.Number
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("sysTime has to be a string or a number, got %s", data)
+		}
+		value = number.String()
+	}
+
+	*s = ParseSysTime(value)
+	return nil
+}
+
+// ParseSysTime parses value as sent by a machine, a value which cannot be parsed is kept in Raw
+func ParseSysTime(value string) SysTime {
+	if parsed, ok := parseSysTime(value); ok {
+		return SysTime{Time: parsed}
+	}
+
+	return SysTime{Raw: value}
+}
+
+// parseSysTime tries the canonical layout first, so that values we wrote can
+// always be read back, then the configured layouts and then Unix timestamps
+func parseSysTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+
+	for _, layout := range append([]string{time.RFC3339Nano}, SysTimeLayouts...) {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.UTC(), true
+		}
+	}
+
+	unix, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(unix) || math.IsInf(unix, 0) {
+		return time.Time{}, false
+	}
+
+	if unix >= unixMillisThreshold || unix <= -unixMillisThreshold {
+		return time.UnixMilli(int64(unix)).UTC(), true
+	}
+
+	seconds := int64(unix)
+	return time.Unix(seconds, int64((unix-float64(seconds))*1e9)).UTC(), true
+}
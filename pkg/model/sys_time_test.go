@@ -0,0 +1,72 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SysTime_UnmarshalJSON_KnownFormats(t *testing.T) {
+	expected := time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)
+
+	for _, value := range []string{
+		`"2021-07-28T14:16:27Z"`,
+		`"2021-07-28T16:16:27+02:00"`,
+		`"Wed 2021-07-28 14:16:27"`,
+		`"2021-07-28 14:16:27"`,
+		`"Wed, 28 Jul 2021 14:16:27 +0000"`,
+		`1627481787`,
+		`"1627481787"`,
+		`1627481787000`,
+	} {
+		var sysTime SysTime
+		assert.Nil(t, json.Unmarshal([]byte(value), &sysTime), "Problem unmarshalling %s", value)
+		assert.Equal(t, SysTime{Time: expected}, sysTime, "Unexpected time for %s", value)
+	}
+}
+
+func Test_SysTime_UnmarshalJSON_UnknownFormatKeptRaw(t *testing.T) {
+	var sysTime SysTime
+	assert.Nil(t, json.Unmarshal([]byte(`"yesterday"`), &sysTime), "Problem unmarshalling")
+	assert.False(t, sysTime.Valid(), "Time should not be parsed")
+	assert.Equal(t, "yesterday", sysTime.Raw, "Raw value should be kept")
+
+	asBytes, err := json.Marshal(sysTime)
+	assert.Nil(t, err, "Problem marshalling")
+	assert.Equal(t, `"yesterday"`, string(asBytes), "Raw value should be written as sent")
+}
+
+func Test_SysTime_UnmarshalJSON_WrongTypeReturnsError(t *testing.T) {
+	var sysTime SysTime
+	assert.NotNil(t, json.Unmarshal([]byte(`{"time": 1}`), &sysTime), "Objects should be rejected")
+	assert.NotNil(t, json.Unmarshal([]byte(`true`), &sysTime), "Booleans should be rejected")
+}
+
+func Test_SysTime_MarshalJSON_NormalizedToUTC(t *testing.T) {
+	sysTime := NewSysTime(time.Date(2021, 7, 28, 16, 16, 27, 500000000, time.FixedZone("CEST", 2*60*60)))
+
+	asBytes, err := json.Marshal(sysTime)
+	assert.Nil(t, err, "Problem marshalling")
+	assert.Equal(t, `"2021-07-28T14:16:27.5Z"`, string(asBytes), "Time should be written as UTC RFC3339")
+
+	var roundTripped SysTime
+	assert.Nil(t, json.Unmarshal(asBytes, &roundTripped), "Problem unmarshalling")
+	assert.Equal(t, sysTime, roundTripped, "Time should survive a round trip")
+}
+
+func Test_SysTime_ConfiguredLayouts(t *testing.T) {
+	defer func() { SysTimeLayouts = DefaultSysTimeLayouts }()
+	SysTimeLayouts = []string{"02/01/2006 15:04"}
+
+	var sysTime SysTime
+	assert.Nil(t, json.Unmarshal([]byte(`"28/07/2021 14:16"`), &sysTime), "Problem unmarshalling")
+	assert.Equal(t, time.Date(2021, 7, 28, 14, 16, 0, 0, time.UTC), sysTime.Time, "Configured layout should be used")
+
+	assert.Nil(t, json.Unmarshal([]byte(`"Wed 2021-07-28 14:16:27"`), &sysTime), "Problem unmarshalling")
+	assert.False(t, sysTime.Valid(), "Default layouts should be replaced")
+
+	assert.Nil(t, json.Unmarshal([]byte(`"2021-07-28T14:16:27Z"`), &sysTime), "Problem unmarshalling")
+	assert.True(t, sysTime.Valid(), "RFC3339 should always be accepted")
+}
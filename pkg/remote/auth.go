@@ -0,0 +1,58 @@
+// Copyright Konstantin Bakanov 2023
+
+package remote
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// bearerPrefix starts the Authorization header carrying the shared secret of the nodes
+const bearerPrefix = "Bearer "
+
+// maxRedirects is the number of redirects a client follows, as many as http.Client does by default
+const maxRedirects = 10
+
+// Authorized tells if request carries secret as a bearer token, every request does if secret is empty
+func Authorized(request *http.Request, secret string) bool {
+	if secret == "" {
+		return true
+	}
+
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, bearerPrefix)), []byte(secret)) == 1
+}
+
+// RefuseUnauthorized responds with 401 to a request without the shared secret
+func RefuseUnauthorized(responseWriter http.ResponseWriter, request *http.Request) {
+	log.Printf("ERROR: %s %s - request from %s without the shared secret\n", request.Method, request.URL.Path, request.RemoteAddr)
+	responseWriter.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(responseWriter, "Unauthorized", http.StatusUnauthorized)
+}
+
+// SetSecret sends secret with request as a bearer token, unless it is empty
+func SetSecret(request *http.Request, secret string) {
+	if secret != "" {
+		request.Header.Set("Authorization", bearerPrefix+secret)
+	}
+}
+
+// KeepSecretOnRedirect is the CheckRedirect of a client sending the shared secret,
+// which sends it on when a node redirects, as http.Client drops it when redirected to another host
+func KeepSecretOnRedirect(secret string) func(request *http.Request, via []*http.Request) error {
+	return func(request *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		SetSecret(request, secret)
+		return nil
+	}
+}
@@ -0,0 +1,18 @@
+package remote
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/datastore/datastoretest"
+)
+
+func TestDatastoreClient_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) ds.DatastoreInterface {
+		server := httptest.NewServer(NewDatastoreHandler(ds.NewDatastoreAsMap(), false))
+		t.Cleanup(server.Close)
+
+		return NewDatastoreClient(server.URL, clientTimeout)
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright Konstantin Bakanov 2023
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// datastoreClient implements DatastoreInterface by talking
+// to a datastore handler of another metrics-store node
+type datastoreClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Secret     string // shared secret of the nodes, sent with every request unless empty
+}
+
+// NewDatastoreClient creates a client for the node listening on baseURL,
+// e.g. "http://localhost:4000". A scheme of http is assumed if none is given
+func NewDatastoreClient(baseURL string, timeout time.Duration) *datastoreClient {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+
+	return &datastoreClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// GetAllEntries returns all entries of the remote datastore or nil
+// if they could not be retrieved
+func (d *datastoreClient) GetAllEntries() []*model.MachineMetrics {
+	request, err := http.NewRequest("GET", d.BaseURL+EntriesPath, nil)
+	if err != nil {
+		log.Printf("ERROR: remote GET - %s\n", err.Error())
+		return nil
+	}
+
+	allEntries := []*model.MachineMetrics{}
+	if err = d.do(request, &allEntries); err != nil {
+		log.Printf("ERROR: remote GET - %s\n", err.Error())
+		return nil
+	}
+
+	return allEntries
+}
+
+// GetEntry returns the entry stored under key in the remote datastore, ErrorNotAvailable is returned
+// if the remote datastore could not be reached
+func (d *datastoreClient) GetEntry(key string) (*model.MachineMetrics, datastore.DatastoreReturnCode) {
+	request, err := http.NewRequest("GET", d.BaseURL+EntriesPath+"?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		log.Printf("ERROR: remote GET - %s\n", err.Error())
+		return nil, datastore.ErrorNotAvailable
+	}
+
+	var response entryResponse
+	if err = d.do(request, &response); err != nil {
+		log.Printf("ERROR: remote GET - %s\n", err.Error())
+		return nil, datastore.ErrorNotAvailable
+	}
+
+	return response.Entry, response.ReturnCode
+}
+
+// AddEntry adds entry to the remote datastore, ErrorNotAvailable is returned
+// if the remote datastore could not be reached
+func (d *datastoreClient) AddEntry(key string, entry *model.MachineMetrics) datastore.DatastoreReturnCode {
+	return d.post(&addEntryRequest{Key: key, Entry: entry}, key)
+}
+
+// AddBatch adds all entries to the remote datastore or none of them, ErrorNotAvailable
+// is returned if the remote datastore could not be reached
+func (d *datastoreClient) AddBatch(entries []*model.MachineMetrics) datastore.DatastoreReturnCode {
+	if rc := datastore.CheckBatch(entries); rc != datastore.Success {
+		return rc
+	}
+
+	return d.post(&addEntryRequest{Entries: entries}, entries[0].ID)
+}
+
+// post sends addRequest to the remote datastore, key names it in logs
+func (d *datastoreClient) post(addRequest *addEntryRequest, key string) datastore.DatastoreReturnCode {
+	requestAsBytes, err := json.Marshal(addRequest)
+	if err != nil {
+		log.Printf("ERROR: remote POST - could not marshal entry with key %s: %s\n", key, err.Error())
+		return datastore.ErrorValueNotSpecified
+	}
+
+	request, err := http.NewRequest("POST", d.BaseURL+EntriesPath, bytes.NewReader(requestAsBytes))
+	if err != nil {
+		log.Printf("ERROR: remote POST - %s\n", err.Error())
+		return datastore.ErrorNotAvailable
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	var rcResponse returnCodeResponse
+	if err = d.do(request, &rcResponse); err != nil {
+		log.Printf("ERROR: remote POST - %s\n", err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	return rcResponse.ReturnCode
+}
+
+// DeleteEntry deletes entry from the remote datastore, ErrorNotAvailable is returned
+// if the remote datastore could not be reached
+func (d *datastoreClient) DeleteEntry(key string) datastore.DatastoreReturnCode {
+	request, err := http.NewRequest("DELETE", d.BaseURL+EntriesPath+"?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		log.Printf("ERROR: remote DELETE - %s\n", err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	var rcResponse returnCodeResponse
+	if err = d.do(request, &rcResponse); err != nil {
+		log.Printf("ERROR: remote DELETE - %s\n", err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	return rcResponse.ReturnCode
+}
+
+// Version returns the version of the remote datastore, a version without a tag
+// is returned if the remote datastore could not be reached
+func (d *datastoreClient) Version() datastore.Version {
+	request, err := http.NewRequest("GET", d.BaseURL+EntriesPath+"?version", nil)
+	if err != nil {
+		log.Printf("ERROR: remote GET - %s\n", err.Error())
+		return datastore.Version{}
+	}
+
+	var version datastore.Version
+	if err = d.do(request, &version); err != nil {
+		log.Printf("ERROR: remote GET - %s\n", err.Error())
+		return datastore.Version{}
+	}
+
+	return version
+}
+
+func (d *datastoreClient) do(request *http.Request, responseBody interface{}) error {
+	SetSecret(request, d.Secret)
+
+	response, err := d.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", d.BaseURL, response.Status)
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(responseBody); err != nil {
+		return fmt.Errorf("could not decode response from %s: %w", d.BaseURL, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+const clientTimeout = 5 * time.Second
+
+var dummyMachineMetrics model.MachineMetrics = model.MachineMetrics{
+	ID:        "test-id",
+	MachineID: 123,
+	Stats: model.MetricsStats{
+		CPUTemp:  456,
+		FanSpeed: 789,
+		HDDSpace: 987,
+	},
+	LastLoggedIn: "userA",
+	SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+}
+
+type DatastoreClientTestSuite struct {
+	suite.Suite
+	store  ds.DatastoreInterface
+	server *httptest.Server
+}
+
+func (s *DatastoreClientTestSuite) SetupTest() {
+	s.store = ds.NewDatastoreAsMap()
+	s.server = httptest.NewServer(NewDatastoreHandler(s.store, false))
+}
+
+func (s *DatastoreClientTestSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *DatastoreClientTestSuite) Test_AddEntry_StoredRemotely() {
+	client := NewDatastoreClient(s.server.URL, clientTimeout)
+
+	rc := client.AddEntry("dummyKey", &dummyMachineMetrics)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	allEntries := s.store.GetAllEntries()
+	assert.Equal(s.T(), 1, len(allEntries), "Remote datastore should contain one entry")
+	assert.EqualValues(s.T(), &dummyMachineMetrics, allEntries[0], "Stored entry does not match")
+}
+
+func (s *DatastoreClientTestSuite) Test_AddEntryWithExistingKey_ReturnsKeyExistsError() {
+	client := NewDatastoreClient(s.server.URL, clientTimeout)
+
+	client.AddEntry("dummyKey", &dummyMachineMetrics)
+	rc := client.AddEntry("dummyKey", &dummyMachineMetrics)
+
+	assert.Equal(s.T(), ds.ErrorKeyExists, rc, "ReturnCode should be "+ds.ErrorKeyExists.String())
+}
+
+func (s *DatastoreClientTestSuite) Test_DeleteEntry_DeletedRemotely() {
+	client := NewDatastoreClient(s.server.URL, clientTimeout)
+
+	rc := client.DeleteEntry("dummy/key")
+	assert.Equal(s.T(), ds.ErrorKeyNotFound, rc, "ReturnCode should be "+ds.ErrorKeyNotFound.String())
+
+	s.store.AddEntry("dummy/key", &dummyMachineMetrics)
+
+	rc = client.DeleteEntry("dummy/key")
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	assert.Equal(s.T(), 0, len(s.store.GetAllEntries()), "Remote datastore should be empty")
+}
+
+func (s *DatastoreClientTestSuite) Test_GetAllEntries_ReturnsRemoteEntries() {
+	client := NewDatastoreClient(s.server.URL, clientTimeout)
+
+	allEntries := client.GetAllEntries()
+	assert.Equal(s.T(), []*model.MachineMetrics{}, allEntries, "Empty slice should be returned")
+
+	s.store.AddEntry("dummyKey", &dummyMachineMetrics)
+
+	allEntries = client.GetAllEntries()
+	assert.Equal(s.T(), 1, len(allEntries), "One entry should be returned")
+	assert.EqualValues(s.T(), &dummyMachineMetrics, allEntries[0], "Returned entry does not match")
+}
+
+func (s *DatastoreClientTestSuite) Test_ServerUnreachable_ReturnsNotAvailable() {
+	client := NewDatastoreClient(s.server.URL, clientTimeout)
+	s.server.Close()
+
+	rc := client.AddEntry("dummyKey", &dummyMachineMetrics)
+	assert.Equal(s.T(), ds.ErrorNotAvailable, rc, "ReturnCode should be "+ds.ErrorNotAvailable.String())
+
+	rc = client.DeleteEntry("dummyKey")
+	assert.Equal(s.T(), ds.ErrorNotAvailable, rc, "ReturnCode should be "+ds.ErrorNotAvailable.String())
+
+	assert.Nil(s.T(), client.GetAllEntries(), "Nil should be returned if the server is unreachable")
+}
+
+func (s *DatastoreClientTestSuite) Test_SecretSet_OnlyRequestsWithSecretServed() {
+	handler := NewDatastoreHandler(s.store, false)
+	handler.Secret = "s3cret"
+	s.server.Config.Handler = handler
+
+	s.store.AddEntry("dummyKey", &dummyMachineMetrics)
+
+	for _, secret := range []string{"", "wrong", "s3cret-and-more"} {
+		client := NewDatastoreClient(s.server.URL, clientTimeout)
+		client.Secret = secret
+
+		assert.Equal(s.T(), ds.ErrorNotAvailable, client.AddEntry("otherKey", &dummyMachineMetrics), "Adding with secret %q should fail", secret)
+		assert.Equal(s.T(), ds.ErrorNotAvailable, client.DeleteEntry("dummyKey"), "Deleting with secret %q should fail", secret)
+		assert.Nil(s.T(), client.GetAllEntries(), "Getting entries with secret %q should fail", secret)
+	}
+
+	request := httptest.NewRequest("DELETE", EntriesPath+"?key=dummyKey", nil)
+	request.Header.Set("Authorization", "s3cret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(s.T(), http.StatusUnauthorized, recorder.Code, "Secret should only be accepted as a bearer token")
+	assert.Equal(s.T(), "Bearer", recorder.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(s.T(), []*model.MachineMetrics{&dummyMachineMetrics}, s.store.GetAllEntries(), "Nothing should be changed")
+
+	client := NewDatastoreClient(s.server.URL, clientTimeout)
+	client.Secret = "s3cret"
+	assert.Equal(s.T(), ds.Success, client.AddEntry("otherKey", &dummyMachineMetrics), "Adding with the secret should succeed")
+	assert.Equal(s.T(), 2, len(client.GetAllEntries()), "Getting entries with the secret should succeed")
+}
+
+func (s *DatastoreClientTestSuite) Test_BodyLargerThanMaxBodySize_Returns413() {
+	handler := NewDatastoreHandler(s.store, false)
+	handler.MaxBodySize = 64
+
+	body := `{"key": "dummyKey", "entry": {"machineId": 123, "lastLoggedIn": "` + strings.Repeat("a", 64) + `"}}`
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", EntriesPath, strings.NewReader(body)))
+
+	assert.Equal(s.T(), http.StatusRequestEntityTooLarge, recorder.Code, "Status is incorrect: %s", recorder.Body.String())
+	assert.Empty(s.T(), s.store.GetAllEntries(), "Nothing should be stored")
+}
+
+func TestDatastoreClientTestSuite(t *testing.T) {
+	suite.Run(t, new(DatastoreClientTestSuite))
+}
@@ -0,0 +1,172 @@
+// Copyright Konstantin Bakanov 2023
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// EntriesPath is the route on which one metrics-store node exposes
+// its datastore to other nodes. It is not meant to be used by clients,
+// as entries added through it are stored under the key chosen by the caller
+const EntriesPath = "/internal/entries"
+
+// DefaultMaxBodySize is the largest body of a request to EntriesPath unless set on the handler,
+// a batch of reports grows by the fields a node adds to them before they are passed on
+const DefaultMaxBodySize = 16 << 20
+
+// addEntryRequest is the body of a POST request to EntriesPath,
+// it holds either one entry with its key or a batch of entries
+type addEntryRequest struct {
+	Key     string                  `json:"key"`
+	Entry   *model.MachineMetrics   `json:"entry"`
+	Entries []*model.MachineMetrics `json:"entries,omitempty"` // added at once under their IDs
+}
+
+// returnCodeResponse is the body of a response to a POST or DELETE request to EntriesPath
+type returnCodeResponse struct {
+	ReturnCode datastore.DatastoreReturnCode `json:"returnCode"`
+}
+
+// entryResponse is the body of a response to a GET request to EntriesPath for a single entry
+type entryResponse struct {
+	ReturnCode datastore.DatastoreReturnCode `json:"returnCode"`
+	Entry      *model.MachineMetrics         `json:"entry,omitempty"`
+}
+
+// an HTTP handler which exposes DatastoreInterface to other nodes
+type datastoreHandler struct {
+	Datastore   datastore.DatastoreInterface
+	Debug       bool
+	Secret      string // shared secret of the nodes, requests have to carry it unless it is empty
+	MaxBodySize int64
+}
+
+func NewDatastoreHandler(metricsDatastore datastore.DatastoreInterface, debug bool) *datastoreHandler {
+	return &datastoreHandler{
+		Datastore:   metricsDatastore,
+		Debug:       debug,
+		MaxBodySize: DefaultMaxBodySize,
+	}
+}
+
+// implementing http.Handler interface
+func (d *datastoreHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if !Authorized(request, d.Secret) {
+		RefuseUnauthorized(responseWriter, request)
+		return
+	}
+
+	if request.Method == "GET" {
+		d.handleGetRequest(responseWriter, request)
+	} else if request.Method == "POST" {
+		d.handlePostRequest(responseWriter, request)
+	} else if request.Method == "DELETE" {
+		d.handleDeleteRequest(responseWriter, request)
+	} else {
+		responseWriter.Header().Set("Allow", "POST, GET, DELETE")
+		responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// all entries are returned, or a single entry if its key is passed as "key" query parameter,
+// or the version of the datastore if the "version" query parameter is given
+func (d *datastoreHandler) handleGetRequest(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.URL.Query().Has("version") {
+		writeJSON(responseWriter, d.Datastore.Version())
+		return
+	}
+
+	if request.URL.Query().Has("key") {
+		key := request.URL.Query().Get("key")
+		entry, rc := d.Datastore.GetEntry(key)
+
+		if d.Debug {
+			log.Printf("internal GET - got entry with key %s, return code - %s\n", key, rc.String())
+		}
+
+		writeJSON(responseWriter, &entryResponse{ReturnCode: rc, Entry: entry})
+		return
+	}
+
+	allEntries := d.Datastore.GetAllEntries()
+
+	if allEntries == nil {
+		log.Println("ERROR: internal GET - could not get entries from the datastore")
+		http.Error(responseWriter, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(responseWriter, allEntries)
+}
+
+func (d *datastoreHandler) handlePostRequest(responseWriter http.ResponseWriter, request *http.Request) {
+	var addRequest addEntryRequest
+
+	body := http.MaxBytesReader(responseWriter, request.Body, d.MaxBodySize)
+	if err := json.NewDecoder(body).Decode(&addRequest); err != nil {
+		log.Printf("ERROR: internal POST - could not decode request: %s\n", err.Error())
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(responseWriter, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(responseWriter, "Error parsing request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if addRequest.Entries != nil {
+		rc := d.Datastore.AddBatch(addRequest.Entries)
+
+		if d.Debug {
+			log.Printf("internal POST - added batch of %d entries, return code - %s\n", len(addRequest.Entries), rc.String())
+		}
+
+		writeJSON(responseWriter, &returnCodeResponse{ReturnCode: rc})
+		return
+	}
+
+	rc := d.Datastore.AddEntry(addRequest.Key, addRequest.Entry)
+
+	if d.Debug {
+		log.Printf("internal POST - added entry with key %s, return code - %s\n", addRequest.Key, rc.String())
+	}
+
+	writeJSON(responseWriter, &returnCodeResponse{ReturnCode: rc})
+}
+
+// the key of the entry to delete is passed as "key" query parameter
+func (d *datastoreHandler) handleDeleteRequest(responseWriter http.ResponseWriter, request *http.Request) {
+	key := request.URL.Query().Get("key")
+
+	rc := d.Datastore.DeleteEntry(key)
+
+	if d.Debug {
+		log.Printf("internal DELETE - deleted entry with key %s, return code - %s\n", key, rc.String())
+	}
+
+	writeJSON(responseWriter, &returnCodeResponse{ReturnCode: rc})
+}
+
+func writeJSON(responseWriter http.ResponseWriter, value interface{}) {
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("ERROR: internal - could not marshal response: %s\n", err.Error())
+		http.Error(responseWriter, "Error marshalling response", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+
+	if _, err = responseWriter.Write(valueAsBytes); err != nil {
+		log.Printf("ERROR: internal - could not write response: %s\n", err.Error())
+	}
+}
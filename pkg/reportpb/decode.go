@@ -0,0 +1,381 @@
+// Copyright Konstantin Bakanov 2023
+
+package reportpb
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/schema"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Unmarshal decodes a MachineMetrics message. Unknown fields are skipped,
+// as protobuf readers are expected to do, so that the format can be extended
+func Unmarshal(data []byte) (*model.MachineMetrics, error) {
+	return decodeReport(data)
+}
+
+// UnmarshalList decodes a MachineMetricsList message
+func UnmarshalList(data []byte) ([]*model.MachineMetrics, error) {
+	entries := []*model.MachineMetrics{}
+
+	err := forEachField(data, func(f field) error {
+		if f.num != listReports {
+			return nil
+		}
+
+		message, err := f.message("reports")
+		if err != nil {
+			return err
+		}
+
+		entry, err := decodeReport(message)
+		if err != nil {
+			return fmt.Errorf("reports[%d]: %w", len(entries), err)
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return entries, err
+}
+
+func decodeReport(message []byte) (*model.MachineMetrics, error) {
+	entry := &model.MachineMetrics{}
+
+	err := forEachField(message, func(f field) error {
+		var err error
+		var value string
+		var submessage []byte
+
+		switch f.num {
+		case reportID:
+			entry.ID, err = f.string("id")
+		case reportMachineID:
+			entry.MachineID, err = f.int("machine_id")
+		case reportStats:
+			if submessage, err = f.message("stats"); err == nil {
+				err = decodeStats(submessage, &entry.Stats)
+			}
+		case reportLastLoggedIn:
+			entry.LastLoggedIn, err = f.string("last_logged_in")
+		case reportSysTime:
+			if value, err = f.string("sys_time"); err == nil {
+				entry.SysTime = model.ParseSysTime(value)
+			}
+		case reportLabels:
+			if submessage, err = f.message("labels"); err == nil {
+				if entry.Labels == nil {
+					entry.Labels = map[string]string{}
+				}
+				err = decodeStringMapEntry(submessage, "labels", entry.Labels)
+			}
+		case reportMeta:
+			if submessage, err = f.message("meta"); err == nil {
+				entry.Meta, err = decodeMeta(submessage)
+			}
+		case reportLogin:
+			if submessage, err = f.message("login"); err == nil {
+				entry.Login, err = decodeLogin(submessage)
+			}
+		case reportMachine:
+			if submessage, err = f.message("machine"); err == nil {
+				entry.Machine, err = decodeMachineInfo(submessage)
+			}
+		case reportSchemaVersion:
+			var version int
+			if version, err = f.int("schema_version"); err == nil && version != 0 && version != schema.CurrentVersion {
+				err = fmt.Errorf("schema_version %d is not supported, only version %d can be sent as protobuf", version, schema.CurrentVersion)
+			}
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func decodeStats(message []byte, stats *model.MetricsStats) error {
+	return forEachField(message, func(f field) error {
+		var err error
+		var submessage []byte
+
+		switch f.num {
+		case statsCPUTemp:
+			stats.CPUTemp, err = f.int("stats.cpu_temp")
+		case statsFanSpeed:
+			stats.FanSpeed, err = f.int("stats.fan_speed")
+		case statsHDDSpace:
+			stats.HDDSpace, err = f.int("stats.hdd_space")
+		case statsInternalTemp:
+			var internalTemp int
+			if internalTemp, err = f.int("stats.internal_temp"); err == nil {
+				stats.InternalTemp = &internalTemp
+			}
+		case statsCustom:
+			if submessage, err = f.message("stats.custom"); err == nil {
+				if stats.Custom == nil {
+					stats.Custom = map[string]float64{}
+				}
+				err = decodeDoubleMapEntry(submessage, "stats.custom", stats.Custom)
+			}
+		case statsDisks:
+			if submessage, err = f.message("stats.disks"); err == nil {
+				var disk model.Disk
+				if disk, err = decodeDisk(submessage); err == nil {
+					stats.Disks = append(stats.Disks, disk)
+				}
+			}
+		}
+
+		return err
+	})
+}
+
+func decodeDisk(message []byte) (model.Disk, error) {
+	disk := model.Disk{}
+
+	err := forEachField(message, func(f field) error {
+		var err error
+
+		switch f.num {
+		case diskDevice:
+			disk.Device, err = f.string("stats.disks.device")
+		case diskMountPoint:
+			disk.MountPoint, err = f.string("stats.disks.mount_point")
+		case diskTotal:
+			disk.Total, err = f.int("stats.disks.total")
+		case diskFree:
+			disk.Free, err = f.int("stats.disks.free")
+		}
+
+		return err
+	})
+
+	return disk, err
+}
+
+func decodeMeta(message []byte) (*model.IngestionMeta, error) {
+	meta := &model.IngestionMeta{}
+
+	err := forEachField(message, func(f field) error {
+		var err error
+		var submessage []byte
+
+		switch f.num {
+		case metaReceivedAt:
+			if submessage, err = f.message("meta.received_at"); err == nil {
+				meta.ReceivedAt, err = decodeTimestamp(submessage)
+			}
+		case metaSequence:
+			if err = f.check("meta.sequence", protowire.VarintType); err == nil {
+				meta.Sequence = f.varint
+			}
+		case metaRemoteAddr:
+			meta.RemoteAddr, err = f.string("meta.remote_addr")
+		case metaUserAgent:
+			meta.UserAgent, err = f.string("meta.user_agent")
+		case metaPrincipal:
+			meta.Principal, err = f.string("meta.principal")
+		}
+
+		return err
+	})
+
+	return meta, err
+}
+
+func decodeTimestamp(message []byte) (time.Time, error) {
+	var seconds int64
+	var nanos int
+
+	err := forEachField(message, func(f field) error {
+		var err error
+
+		switch f.num {
+		case timestampSeconds:
+			if err = f.check("meta.received_at.seconds", protowire.VarintType); err == nil {
+				seconds = int64(f.varint)
+			}
+		case timestampNanos:
+			nanos, err = f.int("meta.received_at.nanos")
+		}
+
+		return err
+	})
+
+	return time.Unix(seconds, int64(nanos)).UTC(), err
+}
+
+func decodeLogin(message []byte) (*model.Login, error) {
+	login := &model.Login{}
+
+	err := forEachField(message, func(f field) error {
+		var err error
+
+		switch f.num {
+		case loginRole:
+			login.Role, err = f.string("login.role")
+		case loginUser:
+			login.User, err = f.string("login.user")
+		}
+
+		return err
+	})
+
+	return login, err
+}
+
+func decodeMachineInfo(message []byte) (*model.MachineInfo, error) {
+	info := &model.MachineInfo{}
+
+	err := forEachField(message, func(f field) error {
+		var err error
+
+		switch f.num {
+		case infoHostname:
+			info.Hostname, err = f.string("machine.hostname")
+		case infoOwner:
+			info.Owner, err = f.string("machine.owner")
+		case infoLocation:
+			info.Location, err = f.string("machine.location")
+		}
+
+		return err
+	})
+
+	return info, err
+}
+
+// decodeStringMapEntry adds an entry of a map<string, string> to m
+func decodeStringMapEntry(message []byte, name string, m map[string]string) error {
+	var key, value string
+
+	err := forEachField(message, func(f field) error {
+		var err error
+
+		switch f.num {
+		case mapKey:
+			key, err = f.string(name)
+		case mapValue:
+			value, err = f.string(name)
+		}
+
+		return err
+	})
+
+	m[key] = value
+	return err
+}
+
+// decodeDoubleMapEntry adds an entry of a map<string, double> to m
+func decodeDoubleMapEntry(message []byte, name string, m map[string]float64) error {
+	var key string
+	var value float64
+
+	err := forEachField(message, func(f field) error {
+		var err error
+
+		switch f.num {
+		case mapKey:
+			key, err = f.string(name)
+		case mapValue:
+			if err = f.check(name, protowire.Fixed64Type); err == nil {
+				value = math.Float64frombits(f.fixed64)
+			}
+		}
+
+		return err
+	})
+
+	m[key] = value
+	return err
+}
+
+// field is one field of a message, only the value of its wire type is set
+type field struct {
+	num     protowire.Number
+	typ     protowire.Type
+	varint  uint64
+	fixed64 uint64
+	bytes   []byte
+}
+
+func (f field) check(name string, typ protowire.Type) error {
+	if f.typ != typ {
+		return fmt.Errorf("field %s has wire type %d, expected %d", name, f.typ, typ)
+	}
+
+	return nil
+}
+
+// int returns the value of an int32 or int64 field
+func (f field) int(name string) (int, error) {
+	if err := f.check(name, protowire.VarintType); err != nil {
+		return 0, err
+	}
+
+	return int(int64(f.varint)), nil
+}
+
+func (f field) string(name string) (string, error) {
+	if err := f.check(name, protowire.BytesType); err != nil {
+		return "", err
+	}
+
+	if !utf8.Valid(f.bytes) {
+		return "", fmt.Errorf("field %s is not valid UTF-8", name)
+	}
+
+	return string(f.bytes), nil
+}
+
+func (f field) message(name string) ([]byte, error) {
+	if err := f.check(name, protowire.BytesType); err != nil {
+		return nil, err
+	}
+
+	return f.bytes, nil
+}
+
+// forEachField calls fn for every field of message in the order they were written,
+// the values of groups are skipped as no message uses them
+func forEachField(message []byte, fn func(f field) error) error {
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(message)
+		case protowire.Fixed64Type:
+			f.fixed64, n = protowire.ConsumeFixed64(message)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(message)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, message)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright Konstantin Bakanov 2023
+
+package reportpb
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Marshal encodes entry as a MachineMetrics message. Maps are written sorted by key,
+// so that the same entry is always encoded the same way
+func Marshal(entry *model.MachineMetrics) []byte {
+	return appendReport(nil, entry)
+}
+
+// MarshalList encodes entries as a MachineMetricsList message
+func MarshalList(entries []*model.MachineMetrics) []byte {
+	var b []byte
+	for _, entry := range entries {
+		b = appendMessage(b, listReports, appendReport(nil, entry))
+	}
+
+	return b
+}
+
+func appendReport(b []byte, entry *model.MachineMetrics) []byte {
+	b = appendString(b, reportID, entry.ID)
+	b = appendInt(b, reportMachineID, int64(entry.MachineID))
+	b = appendMessage(b, reportStats, appendStats(nil, entry.Stats))
+	b = appendString(b, reportLastLoggedIn, entry.LastLoggedIn)
+	b = appendString(b, reportSysTime, entry.SysTime.String())
+
+	for _, key := range sortedKeys(entry.Labels) {
+		entryBytes := appendString(nil, mapKey, key)
+		entryBytes = appendString(entryBytes, mapValue, entry.Labels[key])
+		b = appendMessage(b, reportLabels, entryBytes)
+	}
+
+	if entry.Meta != nil {
+		b = appendMessage(b, reportMeta, appendMeta(nil, entry.Meta))
+	}
+
+	if entry.Login != nil {
+		loginBytes := appendString(nil, loginRole, entry.Login.Role)
+		loginBytes = appendString(loginBytes, loginUser, entry.Login.User)
+		b = appendMessage(b, reportLogin, loginBytes)
+	}
+
+	if entry.Machine != nil {
+		infoBytes := appendString(nil, infoHostname, entry.Machine.Hostname)
+		infoBytes = appendString(infoBytes, infoOwner, entry.Machine.Owner)
+		infoBytes = appendString(infoBytes, infoLocation, entry.Machine.Location)
+		b = appendMessage(b, reportMachine, infoBytes)
+	}
+
+	return b
+}
+
+func appendStats(b []byte, stats model.MetricsStats) []byte {
+	b = appendInt(b, statsCPUTemp, int64(stats.CPUTemp))
+	b = appendInt(b, statsFanSpeed, int64(stats.FanSpeed))
+	b = appendInt(b, statsHDDSpace, int64(stats.HDDSpace))
+
+	// optional, so written even if it is 0
+	if stats.InternalTemp != nil {
+		b = protowire.AppendTag(b, statsInternalTemp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*stats.InternalTemp))
+	}
+
+	for _, name := range sortedKeys(stats.Custom) {
+		entryBytes := appendString(nil, mapKey, name)
+		entryBytes = protowire.AppendTag(entryBytes, mapValue, protowire.Fixed64Type)
+		entryBytes = protowire.AppendFixed64(entryBytes, math.Float64bits(stats.Custom[name]))
+		b = appendMessage(b, statsCustom, entryBytes)
+	}
+
+	for _, disk := range stats.Disks {
+		diskBytes := appendString(nil, diskDevice, disk.Device)
+		diskBytes = appendString(diskBytes, diskMountPoint, disk.MountPoint)
+		diskBytes = appendInt(diskBytes, diskTotal, int64(disk.Total))
+		diskBytes = appendInt(diskBytes, diskFree, int64(disk.Free))
+		b = appendMessage(b, statsDisks, diskBytes)
+	}
+
+	return b
+}
+
+func appendMeta(b []byte, meta *model.IngestionMeta) []byte {
+	if !meta.ReceivedAt.IsZero() {
+		b = appendMessage(b, metaReceivedAt, appendTimestamp(nil, meta.ReceivedAt))
+	}
+
+	if meta.Sequence != 0 {
+		b = protowire.AppendTag(b, metaSequence, protowire.VarintType)
+		b = protowire.AppendVarint(b, meta.Sequence)
+	}
+
+	b = appendString(b, metaRemoteAddr, meta.RemoteAddr)
+	b = appendString(b, metaUserAgent, meta.UserAgent)
+	b = appendString(b, metaPrincipal, meta.Principal)
+
+	return b
+}
+
+func appendTimestamp(b []byte, t time.Time) []byte {
+	b = appendInt(b, timestampSeconds, t.Unix())
+	return appendInt(b, timestampNanos, int64(t.Nanosecond()))
+}
+
+// appendInt writes an int64 field, fields with the default value are left out as in proto3
+func appendInt(b []byte, num protowire.Number, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(value))
+}
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// appendMessage writes an embedded message, it is written even if empty so that its presence is kept
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,84 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package reportpb encodes and decodes reports in the protobuf format defined in schemas/metrics.proto.
+// The messages are written and read with protowire directly, so no code has to be generated from the definition
+package reportpb
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType is the media type of protobuf requests and responses
+const ContentType = "application/x-protobuf"
+
+// names of the messages, as given in the messageType parameter of ContentType
+const (
+	MessageTypeReport = "metricsstore.MachineMetrics"
+	MessageTypeList   = "metricsstore.MachineMetricsList"
+)
+
+// messageTypeParam names the message of a protobuf body, e.g. application/x-protobuf; messageType=metricsstore.MachineMetricsList.
+// Parameter names are case-insensitive, mime.ParseMediaType returns them in lower case
+const messageTypeParam = "messagetype"
+
+// ListContentType is the Content-Type of a body holding a MachineMetricsList
+const ListContentType = ContentType + "; messageType=" + MessageTypeList
+
+// MessageType returns the message named by the parameters of a ContentType media type, as parsed by
+// mime.ParseMediaType, MessageTypeReport if none is named
+func MessageType(params map[string]string) string {
+	if messageType, found := params[messageTypeParam]; found {
+		return messageType
+	}
+
+	return MessageTypeReport
+}
+
+// field numbers of the messages in schemas/metrics.proto
+const (
+	reportID            protowire.Number = 1
+	reportMachineID     protowire.Number = 2
+	reportStats         protowire.Number = 3
+	reportLastLoggedIn  protowire.Number = 4
+	reportSysTime       protowire.Number = 5
+	reportLabels        protowire.Number = 6
+	reportMeta          protowire.Number = 7
+	reportLogin         protowire.Number = 8
+	reportMachine       protowire.Number = 9
+	reportSchemaVersion protowire.Number = 10
+
+	listReports protowire.Number = 1
+
+	statsCPUTemp      protowire.Number = 1
+	statsFanSpeed     protowire.Number = 2
+	statsHDDSpace     protowire.Number = 3
+	statsInternalTemp protowire.Number = 4
+	statsCustom       protowire.Number = 5
+	statsDisks        protowire.Number = 6
+
+	diskDevice     protowire.Number = 1
+	diskMountPoint protowire.Number = 2
+	diskTotal      protowire.Number = 3
+	diskFree       protowire.Number = 4
+
+	metaReceivedAt protowire.Number = 1
+	metaSequence   protowire.Number = 2
+	metaRemoteAddr protowire.Number = 3
+	metaUserAgent  protowire.Number = 4
+	metaPrincipal  protowire.Number = 5
+
+	loginRole protowire.Number = 1
+	loginUser protowire.Number = 2
+
+	infoHostname protowire.Number = 1
+	infoOwner    protowire.Number = 2
+	infoLocation protowire.Number = 3
+
+	// fields of google.protobuf.Timestamp
+	timestampSeconds protowire.Number = 1
+	timestampNanos   protowire.Number = 2
+
+	// fields of the entries of maps
+	mapKey   protowire.Number = 1
+	mapValue protowire.Number = 2
+)
@@ -0,0 +1,128 @@
+package reportpb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/schema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func fullEntry() *model.MachineMetrics {
+	internalTemp := 0 // present even though it is the default value
+
+	return &model.MachineMetrics{
+		ID:        "c7055826-b23b-41d5-8026-951f0c424751",
+		MachineID: 61616,
+		Stats: model.MetricsStats{
+			CPUTemp:      -5,
+			FanSpeed:     500,
+			HDDSpace:     100,
+			InternalTemp: &internalTemp,
+			Custom:       map[string]float64{"gpuTemp": 71.5, "psu.voltage": -12.1},
+			Disks: []model.Disk{
+				{Device: "sda", MountPoint: "/", Total: 500, Free: 100},
+				{Device: "sdb", Total: 4000},
+			},
+		},
+		LastLoggedIn: "admin/Tim",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+		Labels:       map[string]string{"dc": "eu-west-1", "os": "linux"},
+		Meta: &model.IngestionMeta{
+			ReceivedAt: time.Date(2022, 4, 21, 19, 25, 44, 17000000, time.UTC),
+			Sequence:   42,
+			RemoteAddr: "10.0.0.7",
+			UserAgent:  "agent/1.2",
+			Principal:  "alice",
+		},
+		Login:   &model.Login{Role: "admin", User: "Tim"},
+		Machine: &model.MachineInfo{Hostname: "web-1", Owner: "ops", Location: "rack 12"},
+	}
+}
+
+func Test_Marshal_RoundTrip(t *testing.T) {
+	entries := []*model.MachineMetrics{
+		fullEntry(),
+		{MachineID: 1, SysTime: model.SysTime{Raw: "yesterday"}},
+		{},
+	}
+
+	for _, entry := range entries {
+		decoded, err := Unmarshal(Marshal(entry))
+		require.Nil(t, err, "Problem decoding %#v", entry)
+		assert.Equal(t, entry, decoded, "Decoded entry should be the same as the encoded one")
+	}
+
+	decoded, err := UnmarshalList(MarshalList(entries))
+	require.Nil(t, err, "Problem decoding list")
+	assert.Equal(t, entries, decoded, "Decoded list should be the same as the encoded one")
+
+	assert.Equal(t, Marshal(fullEntry()), Marshal(fullEntry()), "Encoding should be deterministic")
+}
+
+func Test_Marshal_ParityWithJSON(t *testing.T) {
+	entries := []*model.MachineMetrics{fullEntry(), {MachineID: 7, Stats: model.MetricsStats{CPUTemp: 40}}}
+
+	for _, entry := range entries {
+		asJSON, err := json.Marshal(entry)
+		require.Nil(t, err, "Problem encoding JSON")
+
+		fromJSON, err := schema.Decode(asJSON, false)
+		require.Nil(t, err, "Problem decoding JSON")
+
+		fromProtobuf, err := Unmarshal(Marshal(entry))
+		require.Nil(t, err, "Problem decoding protobuf")
+
+		assert.Equal(t, fromJSON, fromProtobuf, "Protobuf and JSON should decode to the same entry")
+	}
+}
+
+func Test_Unmarshal_SysTimeParsedAsInJSON(t *testing.T) {
+	message := protowire.AppendTag(nil, reportSysTime, protowire.BytesType)
+	message = protowire.AppendString(message, "Wed 2021-07-28 14:16:27")
+
+	entry, err := Unmarshal(message)
+	require.Nil(t, err, "Problem decoding")
+	assert.Equal(t, time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC), entry.SysTime.Time, "sysTime should be parsed")
+}
+
+func Test_Unmarshal_UnknownFieldsSkipped(t *testing.T) {
+	message := protowire.AppendTag(nil, 99, protowire.BytesType)
+	message = protowire.AppendString(message, "from a newer agent")
+	message = protowire.AppendTag(message, 100, protowire.Fixed32Type)
+	message = protowire.AppendFixed32(message, 1)
+	message = append(message, Marshal(&model.MachineMetrics{MachineID: 12})...)
+
+	entry, err := Unmarshal(message)
+	require.Nil(t, err, "Unknown fields should be skipped")
+	assert.Equal(t, 12, entry.MachineID, "Known fields should be decoded")
+}
+
+func Test_Unmarshal_InvalidMessagesRejected(t *testing.T) {
+	wrongType := protowire.AppendTag(nil, reportMachineID, protowire.BytesType)
+	wrongType = protowire.AppendString(wrongType, "61616")
+	_, err := Unmarshal(wrongType)
+	assert.EqualError(t, err, "field machine_id has wire type 2, expected 0", "Field of a wrong wire type should be rejected")
+
+	truncated := Marshal(fullEntry())
+	_, err = Unmarshal(truncated[:len(truncated)-3])
+	assert.NotNil(t, err, "Truncated message should be rejected")
+
+	invalidUTF8 := protowire.AppendTag(nil, reportLastLoggedIn, protowire.BytesType)
+	invalidUTF8 = protowire.AppendBytes(invalidUTF8, []byte{0xff, 0xfe})
+	_, err = Unmarshal(invalidUTF8)
+	assert.NotNil(t, err, "String which is not UTF-8 should be rejected")
+
+	oldVersion := protowire.AppendTag(nil, reportSchemaVersion, protowire.VarintType)
+	oldVersion = protowire.AppendVarint(oldVersion, 1)
+	_, err = Unmarshal(oldVersion)
+	assert.NotNil(t, err, "Older schema version should be rejected")
+
+	_, err = UnmarshalList(protowire.AppendBytes(protowire.AppendTag(nil, listReports, protowire.BytesType), wrongType))
+	assert.EqualError(t, err, "reports[0]: field machine_id has wire type 2, expected 0", "Error should name the report")
+}
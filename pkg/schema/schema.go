@@ -0,0 +1,123 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package schema translates between the versions of the report format. Reports of an older
+// version are upgraded to the current model.MachineMetrics when they are received, and stored
+// reports can be rendered in an older version for consumers which have not been updated
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// CurrentVersion is the version of model.MachineMetrics, it is assumed for a report without schemaVersion
+const CurrentVersion = 2
+
+// olderVersion knows how to translate a version older than the current one
+type olderVersion struct {
+	// upgrade decodes a report of this version into the current format
+	upgrade func(decoder *json.Decoder) (*model.MachineMetrics, error)
+
+	// render converts a stored report into this version
+	render func(entry *model.MachineMetrics) interface{}
+}
+
+// olderVersions are all the versions which are still supported, by number.
+// When the format changes, the current version is added here
+var olderVersions = map[int]olderVersion{
+	1: {upgrade: upgradeV1, render: renderV1},
+}
+
+// currentReport is a report in the current format, which may name its version
+type currentReport struct {
+	SchemaVersion int `json:"schemaVersion"`
+	*model.MachineMetrics
+}
+
+// Decode parses a JSON report of any supported version, as given by its schemaVersion field,
+// and returns it in the current format
+func Decode(data []byte, allowUnknownFields bool) (*model.MachineMetrics, error) {
+	version := struct {
+		SchemaVersion *int `json:"schemaVersion"`
+	}{}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if !allowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+
+	if version.SchemaVersion == nil || *version.SchemaVersion == CurrentVersion {
+		report := &currentReport{MachineMetrics: &model.MachineMetrics{}}
+		if err := decoder.Decode(report); err != nil {
+			return nil, err
+		}
+
+		return report.MachineMetrics, nil
+	}
+
+	older, found := olderVersions[*version.SchemaVersion]
+	if !found {
+		return nil, unsupportedVersion(*version.SchemaVersion)
+	}
+
+	return older.upgrade(decoder)
+}
+
+// Render converts entries into the given version, ready to be marshalled as JSON
+func Render(entries []*model.MachineMetrics, version int) (interface{}, error) {
+	if version == CurrentVersion {
+		return entries, nil
+	}
+
+	older, found := olderVersions[version]
+	if !found {
+		return nil, unsupportedVersion(version)
+	}
+
+	rendered := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		rendered = append(rendered, older.render(entry))
+	}
+
+	return rendered, nil
+}
+
+// RenderEntry converts one entry into the given version, ready to be marshalled as JSON
+func RenderEntry(entry *model.MachineMetrics, version int) (interface{}, error) {
+	if version == CurrentVersion {
+		return entry, nil
+	}
+
+	older, found := olderVersions[version]
+	if !found {
+		return nil, unsupportedVersion(version)
+	}
+
+	return older.render(entry), nil
+}
+
+// Supported returns an error unless entries can be rendered in the given version
+func Supported(version int) error {
+	if _, found := olderVersions[version]; !found && version != CurrentVersion {
+		return unsupportedVersion(version)
+	}
+
+	return nil
+}
+
+func unsupportedVersion(version int) error {
+	oldest := CurrentVersion
+	for older := range olderVersions {
+		if older < oldest {
+			oldest = older
+		}
+	}
+
+	return fmt.Errorf("schemaVersion %d is not supported, supported versions are %d to %d", version, oldest, CurrentVersion)
+}
@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SchemaTestSuite struct {
+	suite.Suite
+}
+
+func (s *SchemaTestSuite) Test_Decode_NoVersion_CurrentVersionAssumed() {
+	entry, err := Decode([]byte(`{"machineId": 1, "labels": {"dc": "eu-west-1"}, "sysTime": "2021-07-28T14:16:27Z"}`), false)
+	require.Nil(s.T(), err, "Report without a version should be decoded")
+
+	assert.Equal(s.T(), map[string]string{"dc": "eu-west-1"}, entry.Labels, "Labels are incorrect")
+	assert.Equal(s.T(), "2021-07-28T14:16:27Z", entry.SysTime.String(), "SysTime is incorrect")
+}
+
+func (s *SchemaTestSuite) Test_Decode_CurrentVersion_UnknownFieldRejected() {
+	_, err := Decode([]byte(`{"schemaVersion": 2, "machineId": 1, "colour": "red"}`), false)
+	assert.NotNil(s.T(), err, "Unknown field should be rejected")
+
+	_, err = Decode([]byte(`{"schemaVersion": 2, "machineId": 1, "colour": "red"}`), true)
+	assert.Nil(s.T(), err, "Unknown field should be allowed")
+}
+
+func (s *SchemaTestSuite) Test_Decode_Version1_Upgraded() {
+	// the legacy layout is dropped from the configured ones, version 1 reports are still understood
+	defer func(layouts []string) { model.SysTimeLayouts = layouts }(model.SysTimeLayouts)
+	model.SysTimeLayouts = []string{}
+
+	entry, err := Decode([]byte(`{
+		"schemaVersion": 1,
+		"machineId": 5,
+		"stats": {"cpuTemp": 70, "fanSpeed": 400, "HDDSpace": 800, "internalTemp": 30},
+		"lastLoggedIn": "admin/Tim",
+		"sysTime": "Wed 2021-07-28 14:16:27"
+	}`), false)
+	require.Nil(s.T(), err, "Version 1 report should be decoded")
+
+	internalTemp := 30
+	assert.Equal(s.T(), &model.MachineMetrics{
+		MachineID:    5,
+		Stats:        model.MetricsStats{CPUTemp: 70, FanSpeed: 400, HDDSpace: 800, InternalTemp: &internalTemp},
+		LastLoggedIn: "admin/Tim",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+	}, entry, "Report should be upgraded to the current version")
+}
+
+func (s *SchemaTestSuite) Test_Decode_Version1OtherSysTimeFormat_Parsed() {
+	entry, err := Decode([]byte(`{"schemaVersion": 1, "sysTime": "2021-07-28T14:16:27Z"}`), false)
+	require.Nil(s.T(), err, "Version 1 report should be decoded")
+	assert.Equal(s.T(), "2021-07-28T14:16:27Z", entry.SysTime.String(), "SysTime is incorrect")
+
+	entry, err = Decode([]byte(`{"schemaVersion": 1, "sysTime": "yesterday"}`), false)
+	require.Nil(s.T(), err, "Version 1 report should be decoded")
+	assert.Equal(s.T(), "yesterday", entry.SysTime.Raw, "Unknown sysTime should be kept as sent")
+}
+
+func (s *SchemaTestSuite) Test_Decode_Version1WithCustomMetrics_Rejected() {
+	_, err := Decode([]byte(`{"schemaVersion": 1, "stats": {"custom": {"gpuTemp": 70}}}`), false)
+	assert.NotNil(s.T(), err, "Custom metrics are not part of version 1")
+}
+
+func (s *SchemaTestSuite) Test_Decode_UnsupportedVersion_Rejected() {
+	_, err := Decode([]byte(`{"schemaVersion": 0}`), false)
+	assert.EqualError(s.T(), err, "schemaVersion 0 is not supported, supported versions are 1 to 2")
+
+	_, err = Decode([]byte(`{"schemaVersion": "1"}`), false)
+	assert.NotNil(s.T(), err, "Version has to be a number")
+}
+
+func (s *SchemaTestSuite) Test_Render_Version1_UnknownFieldsDropped() {
+	entries := []*model.MachineMetrics{{
+		ID:           "test-id",
+		MachineID:    5,
+		Stats:        model.MetricsStats{CPUTemp: 70, Custom: map[string]float64{"gpuTemp": 71.5}},
+		LastLoggedIn: "admin/Tim",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+		Labels:       map[string]string{"dc": "eu-west-1"},
+		Meta:         &model.IngestionMeta{Sequence: 3},
+	}, {
+		ID:      "raw-id",
+		SysTime: model.SysTime{Raw: "yesterday"},
+	}}
+
+	rendered, err := Render(entries, 1)
+	require.Nil(s.T(), err, "Version 1 should be rendered")
+
+	renderedAsBytes, err := json.Marshal(rendered)
+	require.Nil(s.T(), err, "Problem marshalling")
+
+	assert.JSONEq(s.T(), `[
+		{"id": "test-id", "machineId": 5, "stats": {"cpuTemp": 70, "fanSpeed": 0, "HDDSpace": 0},
+		 "lastLoggedIn": "admin/Tim", "sysTime": "Wed 2021-07-28 14:16:27"},
+		{"id": "raw-id", "machineId": 0, "stats": {"cpuTemp": 0, "fanSpeed": 0, "HDDSpace": 0},
+		 "lastLoggedIn": "", "sysTime": "yesterday"}
+	]`, string(renderedAsBytes), "Rendered entries are incorrect")
+}
+
+func (s *SchemaTestSuite) Test_Render_CurrentVersion_EntriesUnchanged() {
+	entries := []*model.MachineMetrics{{ID: "test-id"}}
+
+	rendered, err := Render(entries, CurrentVersion)
+	require.Nil(s.T(), err, "Current version should be rendered")
+
+	assert.Equal(s.T(), entries, rendered, "Entries should be rendered as they are")
+}
+
+func (s *SchemaTestSuite) Test_Render_UnsupportedVersion_Rejected() {
+	_, err := Render([]*model.MachineMetrics{}, 3)
+	assert.EqualError(s.T(), err, "schemaVersion 3 is not supported, supported versions are 1 to 2")
+}
+
+func (s *SchemaTestSuite) Test_Supported_OnlyKnownVersions() {
+	assert.Nil(s.T(), Supported(1), "Version 1 should be supported")
+	assert.Nil(s.T(), Supported(CurrentVersion), "Current version should be supported")
+	assert.EqualError(s.T(), Supported(3), "schemaVersion 3 is not supported, supported versions are 1 to 2")
+}
+
+func TestSchemaTestSuite(t *testing.T) {
+	suite.Run(t, new(SchemaTestSuite))
+}
@@ -0,0 +1,89 @@
+// Copyright Konstantin Bakanov 2023
+
+package schema
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// sysTimeLayoutV1 is the format agents of version 1 send sysTime in, without a zone
+const sysTimeLayoutV1 = "Mon 2006-01-02 15:04:05"
+
+// machineMetricsV1 is the original report format, which had no custom metrics, labels or meta,
+// and a sysTime which was stored as sent
+type machineMetricsV1 struct {
+	SchemaVersion int            `json:"schemaVersion,omitempty"`
+	ID            string         `json:"id"`
+	MachineID     int            `json:"machineId"`
+	Stats         metricsStatsV1 `json:"stats"`
+	LastLoggedIn  string         `json:"lastLoggedIn"`
+	SysTime       string         `json:"sysTime"`
+}
+
+type metricsStatsV1 struct {
+	CPUTemp      int  `json:"cpuTemp"`
+	FanSpeed     int  `json:"fanSpeed"`
+	HDDSpace     int  `json:"HDDSpace"`
+	InternalTemp *int `json:"internalTemp,omitempty"` // optional field
+}
+
+// upgradeV1 parses sysTime in the format of version 1 agents, whatever layouts the server is configured with
+func upgradeV1(decoder *json.Decoder) (*model.MachineMetrics, error) {
+	report := &machineMetricsV1{}
+	if err := decoder.Decode(report); err != nil {
+		return nil, err
+	}
+
+	entry := &model.MachineMetrics{
+		ID:        report.ID,
+		MachineID: report.MachineID,
+		Stats: model.MetricsStats{
+			CPUTemp:      report.Stats.CPUTemp,
+			FanSpeed:     report.Stats.FanSpeed,
+			HDDSpace:     report.Stats.HDDSpace,
+			InternalTemp: report.Stats.InternalTemp,
+		},
+		LastLoggedIn: report.LastLoggedIn,
+	}
+
+	if sysTime, err := time.Parse(sysTimeLayoutV1, report.SysTime); err == nil {
+		entry.SysTime = model.NewSysTime(sysTime)
+	} else {
+		// fall back to the formats the current version accepts
+		sysTimeAsJSON, err := json.Marshal(report.SysTime)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(sysTimeAsJSON, &entry.SysTime); err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// renderV1 drops everything version 1 does not know about
+func renderV1(entry *model.MachineMetrics) interface{} {
+	report := &machineMetricsV1{
+		ID:        entry.ID,
+		MachineID: entry.MachineID,
+		Stats: metricsStatsV1{
+			CPUTemp:      entry.Stats.CPUTemp,
+			FanSpeed:     entry.Stats.FanSpeed,
+			HDDSpace:     entry.Stats.HDDSpace,
+			InternalTemp: entry.Stats.InternalTemp,
+		},
+		LastLoggedIn: entry.LastLoggedIn,
+		SysTime:      entry.SysTime.Raw,
+	}
+
+	if entry.SysTime.Valid() {
+		report.SysTime = entry.SysTime.Time.UTC().Format(sysTimeLayoutV1)
+	}
+
+	return report
+}
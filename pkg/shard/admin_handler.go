@@ -0,0 +1,128 @@
+// Copyright Konstantin Bakanov 2023
+
+package shard
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/kostik-b/metrics-store/pkg/remote"
+)
+
+// AdminPath is the prefix of all router administration routes:
+//
+//	GET  /router/shards    - list shards
+//	POST /router/shards    - add a shard and rebalance, body is {"addr": "localhost:4003"}
+//	POST /router/rebalance - move entries which are not stored on their owner
+//
+// Requests have to carry the internal secret of the router as a bearer token,
+// as entries are moved to whichever shard is added
+const AdminPath = "/router/"
+
+const (
+	shardsPath    = AdminPath + "shards"
+	rebalancePath = AdminPath + "rebalance"
+)
+
+// addShardRequest is the body of a POST request to shardsPath
+type addShardRequest struct {
+	Addr string `json:"addr"`
+}
+
+// rebalanceResponse is returned once rebalancing is finished
+type rebalanceResponse struct {
+	Moved int `json:"moved"`
+}
+
+// an HTTP handler for router administration
+type adminHandler struct {
+	Router *Router
+	Debug  bool
+}
+
+func NewAdminHandler(router *Router, debug bool) *adminHandler {
+	return &adminHandler{
+		Router: router,
+		Debug:  debug,
+	}
+}
+
+// implementing http.Handler interface
+func (a *adminHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if !remote.Authorized(request, a.Router.secret()) {
+		remote.RefuseUnauthorized(responseWriter, request)
+		return
+	}
+
+	switch request.URL.Path {
+	case shardsPath:
+		if request.Method == "GET" {
+			writeJSON(responseWriter, http.StatusOK, a.Router.Shards())
+		} else if request.Method == "POST" {
+			a.handleAddShard(responseWriter, request)
+		} else {
+			responseWriter.Header().Set("Allow", "POST, GET")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case rebalancePath:
+		if request.Method == "POST" {
+			moved, err := a.Router.Rebalance()
+			a.writeRebalanceResult(responseWriter, moved, err)
+		} else {
+			responseWriter.Header().Set("Allow", "POST")
+			responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(responseWriter, request)
+	}
+}
+
+func (a *adminHandler) handleAddShard(responseWriter http.ResponseWriter, request *http.Request) {
+	var addRequest addShardRequest
+	if err := json.NewDecoder(request.Body).Decode(&addRequest); err != nil {
+		http.Error(responseWriter, "Error parsing request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if addRequest.Addr == "" {
+		http.Error(responseWriter, "addr must be specified", http.StatusBadRequest)
+		return
+	}
+
+	for _, existing := range a.Router.Shards() {
+		if existing == addRequest.Addr {
+			http.Error(responseWriter, "Shard already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	moved, err := a.Router.AddShard(addRequest.Addr)
+	a.writeRebalanceResult(responseWriter, moved, err)
+}
+
+func (a *adminHandler) writeRebalanceResult(responseWriter http.ResponseWriter, moved int, err error) {
+	if err != nil {
+		log.Printf("ERROR: router - rebalancing failed after moving %d entries: %s\n", moved, err.Error())
+		http.Error(responseWriter, "Rebalancing failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(responseWriter, http.StatusOK, &rebalanceResponse{Moved: moved})
+}
+
+func writeJSON(responseWriter http.ResponseWriter, statusCode int, value interface{}) {
+	valueAsBytes, err := json.MarshalIndent(value, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: router - could not marshal response: %s\n", err.Error())
+		http.Error(responseWriter, "Error marshalling response", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(statusCode)
+
+	if _, err = responseWriter.Write(valueAsBytes); err != nil {
+		log.Printf("ERROR: router - could not write response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,25 @@
+package shard
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/datastore/datastoretest"
+	"github.com/kostik-b/metrics-store/pkg/remote"
+)
+
+func TestRouter_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) ds.DatastoreInterface {
+		var addrs []string
+		for i := 0; i < 3; i++ {
+			server := httptest.NewServer(remote.NewDatastoreHandler(ds.NewDatastoreAsMap(), false))
+			t.Cleanup(server.Close)
+
+			addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+		}
+
+		return NewRouter(addrs, requestTimeout, false)
+	})
+}
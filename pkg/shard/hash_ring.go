@@ -0,0 +1,94 @@
+// Copyright Konstantin Bakanov 2023
+
+package shard
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// defaultVirtualNodes is how many points every shard gets on the ring,
+// the more there are the more evenly machines are spread across shards
+const defaultVirtualNodes = 128
+
+// hashRing is a consistent hash ring, it maps machine ids to shards so that
+// adding a shard only moves the machines which now belong to the new shard.
+// It is not safe for concurrent use
+type hashRing struct {
+	virtualNodes int
+	hashes       []uint32          // sorted points on the ring
+	owners       map[uint32]string // point on the ring -> shard
+	shards       []string          // in the order they were added
+}
+
+func newHashRing(virtualNodes int) *hashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	return &hashRing{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint32]string),
+	}
+}
+
+// add puts a shard on the ring, adding the same shard twice has no effect
+func (h *hashRing) add(shard string) {
+	if h.contains(shard) {
+		return
+	}
+
+	h.shards = append(h.shards, shard)
+
+	for i := 0; i < h.virtualNodes; i++ {
+		hash := crc32.ChecksumIEEE([]byte(shard + "#" + strconv.Itoa(i)))
+
+		// in an unlikely case of a collision the first shard keeps the point
+		if _, found := h.owners[hash]; found {
+			continue
+		}
+
+		h.owners[hash] = shard
+		h.hashes = append(h.hashes, hash)
+	}
+
+	sort.Slice(h.hashes, func(i, j int) bool { return h.hashes[i] < h.hashes[j] })
+}
+
+func (h *hashRing) contains(shard string) bool {
+	for _, existing := range h.shards {
+		if existing == shard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get returns the shard which owns the machine or an empty string if the ring is empty
+func (h *hashRing) get(machineID int) string {
+	if len(h.hashes) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(machineID)))
+
+	// first point on the ring which is not less than hash, wrapping around
+	i := sort.Search(len(h.hashes), func(i int) bool { return h.hashes[i] >= hash })
+	if i == len(h.hashes) {
+		i = 0
+	}
+
+	return h.owners[h.hashes[i]]
+}
+
+// copy returns a ring with the same shards, which can be modified independently
+func (h *hashRing) copy() *hashRing {
+	copied := newHashRing(h.virtualNodes)
+	for _, shard := range h.shards {
+		copied.add(shard)
+	}
+
+	return copied
+}
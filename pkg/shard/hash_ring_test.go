@@ -0,0 +1,50 @@
+package shard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing_Empty_ReturnsEmptyShard(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+
+	assert.Equal(t, "", ring.get(123), "Empty ring should not return a shard")
+}
+
+func TestHashRing_AddShard_OnlyMovesMachinesToNewShard(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+	ring.add("shardA")
+	ring.add("shardB")
+
+	before := make(map[int]string)
+	for machineID := 0; machineID < 1000; machineID++ {
+		before[machineID] = ring.get(machineID)
+	}
+
+	grown := ring.copy()
+	grown.add("shardC")
+
+	moved := 0
+	for machineID := 0; machineID < 1000; machineID++ {
+		after := grown.get(machineID)
+		if after != before[machineID] {
+			assert.Equal(t, "shardC", after, "Machine %d should only move to the new shard", machineID)
+			moved++
+		}
+
+		assert.Equal(t, before[machineID], ring.get(machineID), "Original ring should not change")
+	}
+
+	assert.Greater(t, moved, 0, "Some machines should move to the new shard")
+	assert.Less(t, moved, 1000, "Not all machines should move to the new shard")
+}
+
+func TestHashRing_AddSameShardTwice_AddedOnce(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+	ring.add("shardA")
+	ring.add("shardA")
+
+	assert.Equal(t, []string{"shardA"}, ring.shards, "Shard should be added once")
+	assert.Equal(t, defaultVirtualNodes, len(ring.hashes), "Virtual nodes should be added once")
+}
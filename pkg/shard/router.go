@@ -0,0 +1,360 @@
+// Copyright Konstantin Bakanov 2023
+
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/remote"
+)
+
+// Router implements DatastoreInterface on top of a set of backend
+// metrics-store nodes (shards). Entries are distributed across shards
+// using consistent hashing on MachineID, reads are scattered
+// across all shards and the results are merged.
+// Keys are only checked for uniqueness on the shard which owns the entry,
+// which is enough as long as keys are generated, e.g. UUIDs
+type Router struct {
+	mutex   sync.RWMutex // protects ring, clients and internalSecret
+	ring    *hashRing
+	clients map[string]datastore.DatastoreInterface // shard address -> client
+
+	rebalanceMutex sync.Mutex // only one rebalancing can run at a time
+
+	requestTimeout time.Duration
+	internalSecret string // sent to the shards, see SetInternalSecret
+	debug          bool
+}
+
+// NewRouter creates a router for shards reachable at shardAddrs, e.g. localhost:4001
+func NewRouter(shardAddrs []string, requestTimeout time.Duration, debug bool) *Router {
+	router := &Router{
+		ring:           newHashRing(defaultVirtualNodes),
+		clients:        make(map[string]datastore.DatastoreInterface),
+		requestTimeout: requestTimeout,
+		debug:          debug,
+	}
+
+	for _, addr := range shardAddrs {
+		router.ring.add(addr)
+		router.clients[addr] = router.newClient(addr)
+	}
+
+	return router
+}
+
+// SetInternalSecret sets the shared secret sent with every request to the shards, see remote.EntriesPath
+func (r *Router) SetInternalSecret(secret string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.internalSecret = secret
+	for addr := range r.clients {
+		r.clients[addr] = r.newClient(addr)
+	}
+}
+
+// secret returns the shared secret set with SetInternalSecret
+func (r *Router) secret() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.internalSecret
+}
+
+func (r *Router) newClient(addr string) datastore.DatastoreInterface {
+	client := remote.NewDatastoreClient(addr, r.requestTimeout)
+	client.Secret = r.internalSecret
+
+	return client
+}
+
+// Shards returns addresses of all shards in the order they were added
+func (r *Router) Shards() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return append([]string{}, r.ring.shards...)
+}
+
+// ShardFor returns the address of the shard which owns the machine
+func (r *Router) ShardFor(machineID int) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.ring.get(machineID)
+}
+
+// AddEntry stores the entry on the shard which owns entry's MachineID
+func (r *Router) AddEntry(key string, entry *model.MachineMetrics) datastore.DatastoreReturnCode {
+	if key == "" {
+		return datastore.ErrorKeyNotSpecified
+	}
+
+	if entry == nil {
+		return datastore.ErrorValueNotSpecified
+	}
+
+	r.mutex.RLock()
+	owner := r.ring.get(entry.MachineID)
+	client := r.clients[owner]
+	r.mutex.RUnlock()
+
+	if client == nil {
+		log.Printf("ERROR: router - no shards to store entry with key %s\n", key)
+		return datastore.ErrorNotAvailable
+	}
+
+	if r.debug {
+		log.Printf("router - storing entry with key %s, machine id %d on shard %s\n", key, entry.MachineID, owner)
+	}
+
+	return client.AddEntry(key, entry)
+}
+
+// AddBatch stores the entries on the shard which owns their MachineID. A batch with entries owned
+// by more than one shard is not stored, as shards cannot add entries together
+func (r *Router) AddBatch(entries []*model.MachineMetrics) datastore.DatastoreReturnCode {
+	if rc := datastore.CheckBatch(entries); rc != datastore.Success {
+		return rc
+	}
+
+	r.mutex.RLock()
+	owner := r.ring.get(entries[0].MachineID)
+	for _, entry := range entries[1:] {
+		if r.ring.get(entry.MachineID) != owner {
+			r.mutex.RUnlock()
+			return datastore.ErrorBatchNotSupported
+		}
+	}
+	client := r.clients[owner]
+	r.mutex.RUnlock()
+
+	if client == nil {
+		log.Printf("ERROR: router - no shards to store batch of %d entries\n", len(entries))
+		return datastore.ErrorNotAvailable
+	}
+
+	if r.debug {
+		log.Printf("router - storing batch of %d entries on shard %s\n", len(entries), owner)
+	}
+
+	return client.AddBatch(entries)
+}
+
+// GetAllEntries returns entries from all shards or nil if any of the shards
+// could not be reached, as a partial result would look like lost data
+func (r *Router) GetAllEntries() []*model.MachineMetrics {
+	clients := r.allClients()
+
+	results := make([][]*model.MachineMetrics, len(clients))
+
+	var waitGroup sync.WaitGroup
+	for i, client := range clients {
+		waitGroup.Add(1)
+		go func(i int, client datastore.DatastoreInterface) {
+			defer waitGroup.Done()
+			results[i] = client.GetAllEntries()
+		}(i, client)
+	}
+	waitGroup.Wait()
+
+	// while rebalancing an entry can briefly live on two shards
+	seen := make(map[string]bool)
+
+	allEntries := []*model.MachineMetrics{}
+	for i, result := range results {
+		if result == nil {
+			log.Printf("ERROR: router - could not get entries from shard %d\n", i)
+			return nil
+		}
+
+		for _, entry := range result {
+			if seen[entry.ID] {
+				continue
+			}
+			seen[entry.ID] = true
+			allEntries = append(allEntries, entry)
+		}
+	}
+
+	return allEntries
+}
+
+// GetEntry returns the entry from the first shard it is found on. As the key
+// does not tell us the MachineID, all shards are asked until one has it
+func (r *Router) GetEntry(key string) (*model.MachineMetrics, datastore.DatastoreReturnCode) {
+	if key == "" {
+		return nil, datastore.ErrorKeyNotSpecified
+	}
+
+	result := datastore.ErrorKeyNotFound
+	for _, client := range r.allClients() {
+		entry, rc := client.GetEntry(key)
+
+		if rc == datastore.Success {
+			return entry, rc
+		} else if rc != datastore.ErrorKeyNotFound {
+			// the entry may be on the shard which could not be asked
+			result = rc
+		}
+	}
+
+	return nil, result
+}
+
+// Version combines the versions of all shards, so that it changes whenever one of them does
+// or a shard is added. It has no tag if the version of any of the shards is not known
+func (r *Router) Version() datastore.Version {
+	r.mutex.RLock()
+	shards := append([]string{}, r.ring.shards...)
+	clients := make([]datastore.DatastoreInterface, 0, len(shards))
+	for _, addr := range shards {
+		clients = append(clients, r.clients[addr])
+	}
+	r.mutex.RUnlock()
+
+	hash := fnv.New64a()
+	combined := datastore.Version{}
+	modifiedKnown := true
+
+	for i, client := range clients {
+		version := client.Version()
+		if version.Tag == "" {
+			return datastore.Version{}
+		}
+
+		io.WriteString(hash, shards[i]+"="+version.Tag+"\n")
+
+		if version.Modified.IsZero() {
+			modifiedKnown = false
+		} else if version.Modified.After(combined.Modified) {
+			combined.Modified = version.Modified
+		}
+	}
+
+	if !modifiedKnown {
+		combined.Modified = time.Time{}
+	}
+
+	combined.Tag = fmt.Sprintf("%016x", hash.Sum64())
+	return combined
+}
+
+// DeleteEntry deletes the entry from every shard it is found on. As the key
+// does not tell us the MachineID, the deletion is sent to all shards
+func (r *Router) DeleteEntry(key string) datastore.DatastoreReturnCode {
+	if key == "" {
+		return datastore.ErrorKeyNotSpecified
+	}
+
+	result := datastore.ErrorKeyNotFound
+	for _, client := range r.allClients() {
+		rc := client.DeleteEntry(key)
+
+		if rc == datastore.Success {
+			result = datastore.Success
+		} else if rc != datastore.ErrorKeyNotFound && result != datastore.Success {
+			result = rc
+		}
+	}
+
+	return result
+}
+
+// AddShard puts a new shard on the ring and moves to it all entries it now owns.
+// New entries are routed to the new shard straight away
+func (r *Router) AddShard(addr string) (int, error) {
+	r.rebalanceMutex.Lock()
+	defer r.rebalanceMutex.Unlock()
+
+	r.mutex.Lock()
+	if r.ring.contains(addr) {
+		r.mutex.Unlock()
+		return 0, fmt.Errorf("shard %s already exists", addr)
+	}
+
+	ring := r.ring.copy()
+	ring.add(addr)
+
+	r.ring = ring
+	r.clients[addr] = r.newClient(addr)
+	r.mutex.Unlock()
+
+	log.Printf("router - added shard %s, rebalancing\n", addr)
+
+	return r.rebalance()
+}
+
+// Rebalance moves every entry which is not stored on its owner to the owner,
+// it can be used to finish a rebalancing that was interrupted by an error
+func (r *Router) Rebalance() (int, error) {
+	r.rebalanceMutex.Lock()
+	defer r.rebalanceMutex.Unlock()
+
+	return r.rebalance()
+}
+
+func (r *Router) rebalance() (int, error) {
+	r.mutex.RLock()
+	ring := r.ring
+	clients := make(map[string]datastore.DatastoreInterface, len(r.clients))
+	for addr, client := range r.clients {
+		clients[addr] = client
+	}
+	r.mutex.RUnlock()
+
+	moved := 0
+	for _, addr := range ring.shards {
+		entries := clients[addr].GetAllEntries()
+		if entries == nil {
+			return moved, fmt.Errorf("could not get entries from shard %s", addr)
+		}
+
+		for _, entry := range entries {
+			owner := ring.get(entry.MachineID)
+			if owner == addr {
+				continue
+			}
+
+			// copy first, then delete, so that the entry is never missing
+			rc := clients[owner].AddEntry(entry.ID, entry)
+			if rc != datastore.Success && rc != datastore.ErrorKeyExists {
+				return moved, fmt.Errorf("could not copy entry %s to shard %s: %s", entry.ID, owner, rc.String())
+			}
+
+			rc = clients[addr].DeleteEntry(entry.ID)
+			if rc != datastore.Success && rc != datastore.ErrorKeyNotFound {
+				return moved, fmt.Errorf("could not delete entry %s from shard %s: %s", entry.ID, addr, rc.String())
+			}
+
+			if r.debug {
+				log.Printf("router - moved entry %s from shard %s to shard %s\n", entry.ID, addr, owner)
+			}
+			moved++
+		}
+	}
+
+	log.Printf("router - rebalancing finished, %d entries moved\n", moved)
+
+	return moved, nil
+}
+
+func (r *Router) allClients() []datastore.DatastoreInterface {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	clients := make([]datastore.DatastoreInterface, 0, len(r.ring.shards))
+	for _, addr := range r.ring.shards {
+		clients = append(clients, r.clients[addr])
+	}
+
+	return clients
+}
@@ -0,0 +1,325 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/remote"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const requestTimeout = 5 * time.Second
+
+// testShard is a backend metrics-store node listening on localhost
+type testShard struct {
+	store  ds.DatastoreInterface
+	server *httptest.Server
+}
+
+func (t *testShard) addr() string {
+	return strings.TrimPrefix(t.server.URL, "http://")
+}
+
+type RouterTestSuite struct {
+	suite.Suite
+	shards []*testShard
+}
+
+func (s *RouterTestSuite) startShard() *testShard {
+	store := ds.NewDatastoreAsMap()
+	started := &testShard{
+		store:  store,
+		server: httptest.NewServer(remote.NewDatastoreHandler(store, false)),
+	}
+	s.shards = append(s.shards, started)
+
+	return started
+}
+
+func (s *RouterTestSuite) startRouter(shardCount int) *Router {
+	var addrs []string
+	for i := 0; i < shardCount; i++ {
+		addrs = append(addrs, s.startShard().addr())
+	}
+
+	return NewRouter(addrs, requestTimeout, false)
+}
+
+func (s *RouterTestSuite) shardByAddr(addr string) *testShard {
+	for _, shard := range s.shards {
+		if shard.addr() == addr {
+			return shard
+		}
+	}
+	return nil
+}
+
+func newEntry(machineID int) *model.MachineMetrics {
+	return &model.MachineMetrics{
+		ID:        fmt.Sprintf("entry-%d", machineID),
+		MachineID: machineID,
+		Stats: model.MetricsStats{
+			CPUTemp:  456,
+			FanSpeed: 789,
+			HDDSpace: 987,
+		},
+		LastLoggedIn: "userA",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+	}
+}
+
+// assertEntriesOnOwners checks that every entry is stored exactly once, on its owner
+func (s *RouterTestSuite) assertEntriesOnOwners(router *Router, expectedCount int) {
+	total := 0
+	for _, shard := range s.shards {
+		for _, entry := range shard.store.GetAllEntries() {
+			assert.Equal(s.T(), router.ShardFor(entry.MachineID), shard.addr(),
+				"Entry %s is not stored on its owner", entry.ID)
+			total++
+		}
+	}
+
+	assert.Equal(s.T(), expectedCount, total, "Every entry should be stored exactly once")
+}
+
+// postAdmin sends body to the admin API with secret as a bearer token
+func (s *RouterTestSuite) postAdmin(url string, body []byte, secret string) (*http.Response, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	remote.SetSecret(request, secret)
+
+	return http.DefaultClient.Do(request)
+}
+
+func (s *RouterTestSuite) SetupTest() {
+	s.shards = nil
+}
+
+func (s *RouterTestSuite) TearDownTest() {
+	for _, shard := range s.shards {
+		shard.server.Close()
+	}
+}
+
+func (s *RouterTestSuite) Test_AddEntry_StoredOnOwnerShard() {
+	router := s.startRouter(3)
+
+	for machineID := 0; machineID < 50; machineID++ {
+		entry := newEntry(machineID)
+		rc := router.AddEntry(entry.ID, entry)
+		assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	}
+
+	s.assertEntriesOnOwners(router, 50)
+
+	for _, shard := range s.shards {
+		assert.NotEmpty(s.T(), shard.store.GetAllEntries(), "Every shard should get some entries")
+	}
+}
+
+func (s *RouterTestSuite) Test_AddEntryWithoutShards_ReturnsNotAvailable() {
+	router := NewRouter(nil, requestTimeout, false)
+
+	entry := newEntry(1)
+	rc := router.AddEntry(entry.ID, entry)
+
+	assert.Equal(s.T(), ds.ErrorNotAvailable, rc, "ReturnCode should be "+ds.ErrorNotAvailable.String())
+}
+
+func (s *RouterTestSuite) Test_AddBatch_OnlyStoredIfOnOneShard() {
+	router := s.startRouter(3)
+
+	// machines owned by the same shard and one owned by another
+	var sameShard []*model.MachineMetrics
+	var otherShard *model.MachineMetrics
+	owner := router.ShardFor(0)
+	for machineID := 0; len(sameShard) < 2 || otherShard == nil; machineID++ {
+		if router.ShardFor(machineID) == owner {
+			sameShard = append(sameShard, newEntry(machineID))
+		} else if otherShard == nil {
+			otherShard = newEntry(machineID)
+		}
+	}
+
+	rc := router.AddBatch([]*model.MachineMetrics{sameShard[0], otherShard})
+	assert.Equal(s.T(), ds.ErrorBatchNotSupported, rc, "ReturnCode should be "+ds.ErrorBatchNotSupported.String())
+	assert.Empty(s.T(), router.GetAllEntries(), "No entry of a batch spanning shards should be stored")
+
+	rc = router.AddBatch(sameShard[:2])
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	assert.ElementsMatch(s.T(), sameShard[:2], s.shardByAddr(owner).store.GetAllEntries(), "Batch should be stored on its owner")
+	s.assertEntriesOnOwners(router, 2)
+}
+
+func (s *RouterTestSuite) Test_SetInternalSecret_SentToShards() {
+	router := s.startRouter(2)
+	for _, shard := range s.shards {
+		handler := remote.NewDatastoreHandler(shard.store, false)
+		handler.Secret = "router-secret"
+		shard.server.Config.Handler = handler
+	}
+
+	entry := newEntry(1)
+	assert.Equal(s.T(), ds.ErrorNotAvailable, router.AddEntry(entry.ID, entry), "Shards should refuse entries without the secret")
+
+	router.SetInternalSecret("router-secret")
+	assert.Equal(s.T(), ds.Success, router.AddEntry(entry.ID, entry), "Shards should accept entries with the secret")
+
+	added := s.startShard()
+	handler := remote.NewDatastoreHandler(added.store, false)
+	handler.Secret = "router-secret"
+	added.server.Config.Handler = handler
+
+	_, err := router.AddShard(added.addr())
+	assert.Nil(s.T(), err, "Secret should be sent to shards added later")
+	assert.Equal(s.T(), []*model.MachineMetrics{entry}, router.GetAllEntries(), "Entry should be returned")
+}
+
+func (s *RouterTestSuite) Test_GetAllEntries_MergesAllShards() {
+	router := s.startRouter(3)
+
+	var expected []*model.MachineMetrics
+	for machineID := 0; machineID < 20; machineID++ {
+		entry := newEntry(machineID)
+		router.AddEntry(entry.ID, entry)
+		expected = append(expected, entry)
+	}
+
+	assert.ElementsMatch(s.T(), expected, router.GetAllEntries(), "Merged entries do not match")
+}
+
+func (s *RouterTestSuite) Test_GetAllEntries_DuplicateOnTwoShards_ReturnedOnce() {
+	router := s.startRouter(2)
+
+	entry := newEntry(1)
+	s.shards[0].store.AddEntry(entry.ID, entry)
+	s.shards[1].store.AddEntry(entry.ID, entry)
+
+	assert.Equal(s.T(), 1, len(router.GetAllEntries()), "Duplicate entry should be returned once")
+}
+
+func (s *RouterTestSuite) Test_GetAllEntries_ShardUnreachable_ReturnsNil() {
+	router := s.startRouter(2)
+
+	s.shards[1].server.Close()
+
+	assert.Nil(s.T(), router.GetAllEntries(), "Nil should be returned if a shard is unreachable")
+}
+
+func (s *RouterTestSuite) Test_DeleteEntry_DeletedFromOwner() {
+	router := s.startRouter(3)
+
+	entry := newEntry(7)
+	router.AddEntry(entry.ID, entry)
+
+	rc := router.DeleteEntry(entry.ID)
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	assert.Empty(s.T(), router.GetAllEntries(), "Entry should be deleted")
+
+	rc = router.DeleteEntry(entry.ID)
+	assert.Equal(s.T(), ds.ErrorKeyNotFound, rc, "ReturnCode should be "+ds.ErrorKeyNotFound.String())
+}
+
+func (s *RouterTestSuite) Test_AddShard_MovesEntriesToNewShard() {
+	router := s.startRouter(2)
+
+	for machineID := 0; machineID < 200; machineID++ {
+		entry := newEntry(machineID)
+		require.Equal(s.T(), ds.Success, router.AddEntry(entry.ID, entry), "Problem adding entry")
+	}
+
+	added := s.startShard()
+	moved, err := router.AddShard(added.addr())
+	assert.Nil(s.T(), err, "Problem adding shard")
+
+	assert.Greater(s.T(), moved, 0, "Some entries should have been moved")
+	assert.Equal(s.T(), moved, len(added.store.GetAllEntries()), "Moved entries should all be on the new shard")
+
+	s.assertEntriesOnOwners(router, 200)
+	assert.Equal(s.T(), 200, len(router.GetAllEntries()), "No entries should be lost")
+
+	_, err = router.AddShard(added.addr())
+	assert.NotNil(s.T(), err, "Adding the same shard twice should fail")
+}
+
+func (s *RouterTestSuite) Test_AdminAddShard_ReturnsMovedCount() {
+	router := s.startRouter(1)
+
+	for machineID := 0; machineID < 100; machineID++ {
+		entry := newEntry(machineID)
+		router.AddEntry(entry.ID, entry)
+	}
+
+	router.SetInternalSecret("router-secret")
+	adminServer := httptest.NewServer(NewAdminHandler(router, false))
+	defer adminServer.Close()
+
+	added := s.startShard()
+	body, _ := json.Marshal(&addShardRequest{Addr: added.addr()})
+
+	response, err := s.postAdmin(adminServer.URL+shardsPath, body, "router-secret")
+	require.Nil(s.T(), err, "Problem sending request")
+	defer response.Body.Close()
+
+	assert.Equal(s.T(), http.StatusOK, response.StatusCode, "Status code is incorrect")
+
+	var result rebalanceResponse
+	require.Nil(s.T(), json.NewDecoder(response.Body).Decode(&result), "Problem decoding response")
+	assert.Equal(s.T(), len(added.store.GetAllEntries()), result.Moved, "Moved count is incorrect")
+
+	assert.Equal(s.T(), []string{s.shards[0].addr(), added.addr()}, router.Shards(), "Shards are incorrect")
+
+	response, err = s.postAdmin(adminServer.URL+shardsPath, body, "router-secret")
+	require.Nil(s.T(), err, "Problem sending request")
+	response.Body.Close()
+
+	assert.Equal(s.T(), http.StatusConflict, response.StatusCode, "Adding the same shard twice should conflict")
+}
+
+func (s *RouterTestSuite) Test_AdminWithoutSecret_Returns401() {
+	router := s.startRouter(1)
+	router.SetInternalSecret("router-secret")
+
+	for machineID := 0; machineID < 10; machineID++ {
+		entry := newEntry(machineID)
+		router.AddEntry(entry.ID, entry)
+	}
+
+	adminServer := httptest.NewServer(NewAdminHandler(router, false))
+	defer adminServer.Close()
+
+	added := s.startShard()
+	body, _ := json.Marshal(&addShardRequest{Addr: added.addr()})
+
+	for _, secret := range []string{"", "wrong-secret"} {
+		for _, path := range []string{shardsPath, rebalancePath} {
+			response, err := s.postAdmin(adminServer.URL+path, body, secret)
+			require.Nil(s.T(), err, "Problem sending request")
+			response.Body.Close()
+
+			assert.Equal(s.T(), http.StatusUnauthorized, response.StatusCode, "%s with secret %q should be refused", path, secret)
+			assert.Equal(s.T(), "Bearer", response.Header.Get("WWW-Authenticate"), "WWW-Authenticate header is incorrect")
+		}
+	}
+
+	assert.Equal(s.T(), []string{s.shards[0].addr()}, router.Shards(), "No shard should be added")
+	assert.Empty(s.T(), added.store.GetAllEntries(), "No entries should be moved")
+}
+
+func TestRouterTestSuite(t *testing.T) {
+	suite.Run(t, new(RouterTestSuite))
+}
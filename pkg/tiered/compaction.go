@@ -0,0 +1,255 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"path/filepath"
+	"sort"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+)
+
+// segments of this size or larger are not merged any more
+const maxMergedSegmentSize = 256 << 20
+
+// sizeTier groups segments whose sizes differ by less than a factor of four,
+// so that every entry is only merged again once its segment has grown
+func sizeTier(size int64) int {
+	return bits.Len64(uint64(size)) / 2
+}
+
+// Compact merges segments of similar size once there are CompactionThreshold of them and removes
+// segments without entries, it returns the number of removed segments. Like a migration it writes
+// the merged segment without holding the lock, entries deleted meanwhile stay out of it. The
+// tombstone log is replaced before and after the segments are removed, so that in the end it
+// holds only the tombstones which are still needed
+func (t *TieredDatastore) Compact() (int, error) {
+	t.migrationMutex.Lock()
+	defer t.migrationMutex.Unlock()
+
+	t.mutex.Lock()
+	if t.failure != nil {
+		t.mutex.Unlock()
+		return 0, t.failure
+	}
+
+	for _, s := range t.segments {
+		if s.live == 0 {
+			t.dropSegment(s)
+		}
+	}
+
+	merging := t.mergeCandidates()
+	t.mutex.Unlock()
+
+	if len(merging) > 0 {
+		if err := t.mergeSegments(merging); err != nil {
+			return 0, err
+		}
+	}
+
+	removed := len(t.obsolete)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// removing a segment brings back older copies of its entries, which have no tombstone as
+	// long as it hides them, so the new log has to be in place before the segments are removed
+	t.mutex.Lock()
+	err := t.replaceTombstoneLog()
+	t.mutex.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	// segments which could not be removed before are removed now
+	for _, s := range t.obsolete {
+		if err := removeSegmentFiles(t.config.FS, s.path); err != nil {
+			return 0, fmt.Errorf("could not remove segment %d: %w", s.id, err)
+		}
+	}
+
+	if err := t.config.FS.SyncDir(t.config.Dir); err != nil {
+		return 0, fmt.Errorf("could not remove segments: %w", err)
+	}
+	t.obsolete = make(map[uint64]*segment)
+
+	// the tombstones of the removed segments are not needed any more
+	t.mutex.Lock()
+	err = t.replaceTombstoneLog()
+	t.mutex.Unlock()
+
+	if err != nil {
+		return removed, err
+	}
+
+	if t.config.Debug {
+		log.Printf("tiered - compaction removed %d segments\n", removed)
+	}
+
+	return removed, nil
+}
+
+// dropSegment takes s out of the cold tier, its files are removed by Compact afterwards
+func (t *TieredDatastore) dropSegment(s *segment) {
+	delete(t.segments, s.id)
+	t.cache.remove(s.id)
+	t.obsolete[s.id] = s
+}
+
+// mergeCandidates returns the segments of the smallest size tier which has at least CompactionThreshold
+// segments, ordered by id, or nil if there is no such tier. It is called with the lock held
+func (t *TieredDatastore) mergeCandidates() []*segment {
+	tiers := make(map[int][]*segment)
+	for _, s := range t.segments {
+		if s.size < maxMergedSegmentSize {
+			tiers[sizeTier(s.size)] = append(tiers[sizeTier(s.size)], s)
+		}
+	}
+
+	var candidates []*segment
+	smallest := -1
+	for tier, segments := range tiers {
+		if len(segments) >= t.config.CompactionThreshold && (smallest < 0 || tier < smallest) {
+			smallest = tier
+			candidates = segments
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+
+	return candidates
+}
+
+// mergeSegments writes the entries of the cold tier held by merging to a new segment and swaps it in
+func (t *TieredDatastore) mergeSegments(merging []*segment) error {
+	t.mutex.Lock()
+	id := t.nextSegmentID
+	t.nextSegmentID = id + 1
+
+	sources := make(map[string]uint64) // key -> id of the merged segment holding its entry
+	t.writing = &pendingSegment{id: id, keys: make(map[string]bool)}
+	for _, s := range merging {
+		for _, key := range s.keys {
+			if t.coldIndex[key] == s.id {
+				sources[key] = s.id
+				t.writing.keys[key] = true
+			}
+		}
+	}
+	t.mutex.Unlock()
+
+	records, err := t.readMergedEntries(merging, sources)
+
+	var written *segment
+	var cleanupErr error
+	if err == nil {
+		written, cleanupErr, err = writeSegment(t.config.FS, t.config.Dir, id, records)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.writing = nil
+
+	if err != nil {
+		if cleanupErr != nil {
+			// the segment may turn up after a crash, and with it entries deleted from now on
+			t.failure = fmt.Errorf("segment %d could not be removed after a failed compaction: %w", id, cleanupErr)
+		}
+		return err
+	}
+
+	// entries deleted while the segment was written have a tombstone for it already
+	t.segments[id] = written
+	for key, source := range sources {
+		if t.coldIndex[key] == source {
+			t.coldIndex[key] = id
+			written.live++
+		}
+	}
+
+	for _, s := range merging {
+		t.dropSegment(s)
+	}
+
+	if t.config.Debug {
+		log.Printf("tiered - merged %d segments into segment %d\n", len(merging), id)
+	}
+
+	return nil
+}
+
+// readMergedEntries reads the entries of merging which sources points to
+func (t *TieredDatastore) readMergedEntries(merging []*segment, sources map[string]uint64) ([]segmentRecord, error) {
+	entries := make(map[string]*model.MachineMetrics, len(sources))
+
+	for _, s := range merging {
+		records, err := readSegment(t.config.FS, s.path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if sources[record.Key] == s.id {
+				entries[record.Key] = record.Entry
+			}
+		}
+	}
+
+	records := make([]segmentRecord, 0, len(entries))
+	for key, entry := range entries {
+		records = append(records, segmentRecord{Key: key, Entry: entry})
+	}
+
+	return records, nil
+}
+
+// replaceTombstoneLog replaces the tombstone log with one holding a tombstone for every deleted or replaced entry
+// of the segments on disk which is not hidden by a later segment. It is called and returns with the lock held, but writes the new log without it,
+// tombstones added meanwhile are appended to both logs. If it fails, the old log may or may not have been replaced
+func (t *TieredDatastore) replaceTombstoneLog() error {
+	segments := make([]*segment, 0, len(t.segments)+len(t.obsolete))
+	for _, s := range t.segments {
+		segments = append(segments, s)
+	}
+	for _, s := range t.obsolete {
+		segments = append(segments, s)
+	}
+
+	records := []interface{}{}
+	for _, s := range segments {
+		for _, key := range s.keys {
+			// the entry is still there or it is replaced by one of a later segment
+			if id, found := t.coldIndex[key]; found && id >= s.id {
+				continue
+			}
+			records = append(records, &tombstone{Key: key, SegmentID: s.id})
+		}
+	}
+
+	t.tombstones.startRotation()
+	t.mutex.Unlock()
+
+	next, err := writeTempRecordLog(t.config.FS, filepath.Join(t.config.Dir, tombstoneFileName), records)
+
+	t.mutex.Lock()
+	if err != nil {
+		t.tombstones.abortRotation()
+		return err
+	}
+
+	if err := t.tombstones.finishRotation(t.config.FS, next); err != nil {
+		t.tombstones.abortRotation()
+		next.discard(t.config.FS)
+		t.failure = fmt.Errorf("tombstone log could not be replaced after a compaction: %w", err)
+		return t.failure
+	}
+	t.tombstones = &tombstoneLog{recordLog: next}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package tiered
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/datastore/datastoretest"
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+// coldOnlyDatastore migrates every entry to the cold tier as soon as it is added,
+// so that the conformance suite exercises the cold tier as well
+type coldOnlyDatastore struct {
+	*TieredDatastore
+	clock *fakeClock
+}
+
+func (c *coldOnlyDatastore) AddEntry(key string, entry *model.MachineMetrics) ds.DatastoreReturnCode {
+	rc := c.TieredDatastore.AddEntry(key, entry)
+
+	if rc == ds.Success {
+		c.clock.Advance(hotThreshold + time.Second)
+		if _, err := c.Migrate(); err != nil {
+			return ds.ErrorNotAvailable
+		}
+	}
+
+	return rc
+}
+
+func openForConformance(t *testing.T, clock *fakeClock) *TieredDatastore {
+	opened, err := Open(Config{
+		Dir:               t.TempDir(),
+		HotThreshold:      hotThreshold,
+		MigrationInterval: time.Hour,
+		now:               clock.Now,
+	})
+	require.Nil(t, err, "Problem opening datastore")
+	t.Cleanup(func() { opened.Close() })
+
+	return opened
+}
+
+func TestTieredDatastore_HotTier_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) ds.DatastoreInterface {
+		return openForConformance(t, &fakeClock{now: time.Now()})
+	})
+}
+
+func TestTieredDatastore_ColdTier_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) ds.DatastoreInterface {
+		clock := &fakeClock{now: time.Now()}
+		return &coldOnlyDatastore{TieredDatastore: openForConformance(t, clock), clock: clock}
+	})
+}
@@ -0,0 +1,41 @@
+package tiered
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore/crashtest"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+const crashTestSeeds = 20
+
+func TestTieredDatastore_CrashConsistency(t *testing.T) {
+	for seed := int64(1); seed <= crashTestSeeds; seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			crashtest.Run(t, crashtest.Config{
+				Open: func(fs vfs.FS) (crashtest.Store, error) {
+					return Open(Config{
+						Dir:                 "/data",
+						FS:                  fs,
+						HotThreshold:        time.Nanosecond, // every migration moves all entries
+						MigrationInterval:   time.Hour,       // migrations are triggered by the test
+						CompactionThreshold: 2,
+					})
+				},
+				Maintain: func(store crashtest.Store) error {
+					if _, err := store.(*TieredDatastore).Migrate(); err != nil {
+						return err
+					}
+					_, err := store.(*TieredDatastore).Compact()
+					return err
+				},
+				Seed:       seed,
+				Rounds:     20,
+				Operations: 50,
+				FaultRate:  0.02,
+			})
+		})
+	}
+}
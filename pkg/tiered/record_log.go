@@ -0,0 +1,242 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+// recordLog is an append-only file with one JSON record per line
+type recordLog struct {
+	file   vfs.File
+	path   string
+	offset int64 // end of the last complete line
+
+	// err is set when a failed append could not be undone,
+	// no more appends are accepted as the end of the file is unknown
+	err error
+
+	// pending holds the records appended since startRotation, nil if the log is not being rotated
+	pending []interface{}
+}
+
+// openRecordLog opens the log at path, creating it if needed, and passes every
+// complete line to decode. A last line without a newline is the result of an
+// interrupted append and is dropped
+func openRecordLog(fs vfs.FS, path string, decode func(line []byte)) (*recordLog, error) {
+	contents, err := vfs.ReadFile(fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	complete := 0 // length of contents up to and including the last complete line
+
+	for {
+		newline := bytes.IndexByte(contents[complete:], '\n')
+		if newline < 0 {
+			break
+		}
+
+		decode(contents[complete : complete+newline])
+		complete += newline + 1
+	}
+
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recordLog{file: file, path: path, offset: int64(complete)}
+
+	if err := r.open(fs, len(contents)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// open drops an interrupted append and makes sure that the log itself is durable
+func (r *recordLog) open(fs vfs.FS, size int) error {
+	if int64(size) != r.offset {
+		if err := r.file.Truncate(r.offset); err != nil {
+			return err
+		}
+
+		if err := r.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.file.Seek(r.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// the log may have just been created
+	return fs.SyncDir(filepath.Dir(r.path))
+}
+
+// encodeRecords encodes records as JSON lines
+func encodeRecords(records []interface{}) ([]byte, error) {
+	contents := []byte{}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(append(contents, line...), '\n')
+	}
+
+	return contents, nil
+}
+
+// writeTempRecordLog durably writes a log holding records to a temporary
+// file next to path, which install then moves into place
+func writeTempRecordLog(fs vfs.FS, path string, records []interface{}) (*recordLog, error) {
+	tempPath := path + tempSuffix
+
+	file, err := fs.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not write %s: %w", path, err)
+	}
+
+	r := &recordLog{file: file, path: path}
+
+	err = func() error {
+		contents, err := encodeRecords(records)
+		if err != nil {
+			return err
+		}
+
+		if _, err := file.Write(contents); err != nil {
+			return err
+		}
+		r.offset = int64(len(contents))
+
+		return file.Sync()
+	}()
+
+	if err != nil {
+		r.discard(fs)
+		return nil, fmt.Errorf("could not write %s: %w", path, err)
+	}
+
+	return r, nil
+}
+
+// install atomically replaces the log at path with r, which was written by writeTempRecordLog
+func (r *recordLog) install(fs vfs.FS) error {
+	if err := fs.Rename(r.path+tempSuffix, r.path); err != nil {
+		return fmt.Errorf("could not write %s: %w", r.path, err)
+	}
+
+	if err := fs.SyncDir(filepath.Dir(r.path)); err != nil {
+		return fmt.Errorf("could not write %s: %w", r.path, err)
+	}
+
+	return nil
+}
+
+// discard closes and removes r if it was not installed. The temporary file
+// is removed on the next start as well if that fails
+func (r *recordLog) discard(fs vfs.FS) {
+	r.file.Close()
+	fs.Remove(r.path + tempSuffix)
+}
+
+// writeRecordLog atomically replaces the log at path with one holding records
+func writeRecordLog(fs vfs.FS, path string, records []interface{}) (*recordLog, error) {
+	r, err := writeTempRecordLog(fs, path, records)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.install(fs); err != nil {
+		r.file.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// startRotation collects the records appended from now on, so that the
+// log replacing r can be written without holding up the appends
+func (r *recordLog) startRotation() {
+	r.pending = []interface{}{}
+}
+
+// finishRotation appends the records collected since startRotation to next, which
+// was written by writeTempRecordLog, moves it into place and closes r. If it fails,
+// next may or may not have replaced r on disk
+func (r *recordLog) finishRotation(fs vfs.FS, next *recordLog) error {
+	pending := r.pending
+	r.pending = nil
+
+	if len(pending) > 0 {
+		if err := next.append(pending...); err != nil {
+			return fmt.Errorf("could not write %s: %w", next.path, err)
+		}
+	}
+
+	if err := next.install(fs); err != nil {
+		return err
+	}
+
+	return r.close()
+}
+
+// rotating tells if the log is being rotated
+func (r *recordLog) rotating() bool {
+	return r.pending != nil
+}
+
+// abortRotation stops collecting records, r stays the log
+func (r *recordLog) abortRotation() {
+	r.pending = nil
+}
+
+// append durably writes records to the end of the log with a single sync
+func (r *recordLog) append(records ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	lines, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	if _, err = r.file.Write(lines); err == nil {
+		err = r.file.Sync()
+	}
+
+	if err != nil {
+		// drop whatever part of the lines was written, so that the next append starts on a clean line
+		if truncateErr := r.file.Truncate(r.offset); truncateErr != nil {
+			r.err = fmt.Errorf("%s is unusable after a failed append: %w", r.path, truncateErr)
+		} else if _, seekErr := r.file.Seek(r.offset, io.SeekStart); seekErr != nil {
+			r.err = fmt.Errorf("%s is unusable after a failed append: %w", r.path, seekErr)
+		}
+
+		return err
+	}
+
+	r.offset += int64(len(lines))
+
+	if r.pending != nil {
+		r.pending = append(r.pending, records...)
+	}
+
+	return nil
+}
+
+func (r *recordLog) close() error {
+	return r.file.Close()
+}
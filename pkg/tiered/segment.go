@@ -0,0 +1,289 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".seg"
+	keysSuffix    = ".keys"
+	tempSuffix    = ".tmp"
+)
+
+// segmentRecord is one line of a segment
+type segmentRecord struct {
+	Key   string                `json:"key"`
+	Entry *model.MachineMetrics `json:"entry"`
+}
+
+// segment is an immutable gzip compressed file with one JSON record per line
+type segment struct {
+	id   uint64
+	path string
+	size int64 // size on disk in bytes
+	keys []string
+	live int // number of keys of the cold tier which are held by the segment
+
+	maxSequence uint64 // highest sequence number of the entries in the segment
+}
+
+func (s *segment) addRecord(record *segmentRecord) {
+	s.keys = append(s.keys, record.Key)
+
+	if record.Entry != nil && record.Entry.Meta != nil && record.Entry.Meta.Sequence > s.maxSequence {
+		s.maxSequence = record.Entry.Meta.Sequence
+	}
+}
+
+// segmentKeys is written next to a segment, so that opening the segment does not need to decompress it
+type segmentKeys struct {
+	Keys        []string `json:"keys"`
+	MaxSequence uint64   `json:"maxSequence"`
+}
+
+func segmentFileName(id uint64) string {
+	return fmt.Sprintf("%s%016d%s", segmentPrefix, id, segmentSuffix)
+}
+
+// parseSegmentFileName returns the id of a segment or false if name is not a segment
+func parseSegmentFileName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// writeSegment writes records to a temporary file, syncs it and only then renames it into place,
+// so a segment is either complete or not there at all. Its keys file is put in place before it.
+// If it fails, cleanupErr tells if the segment could not be removed again,
+// in which case it may still turn up after a crash
+func writeSegment(fs vfs.FS, dir string, id uint64, records []segmentRecord) (written *segment, cleanupErr error, err error) {
+	path := filepath.Join(dir, segmentFileName(id))
+	tempPath := path + tempSuffix
+
+	file, err := fs.OpenFile(tempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not write segment %d: %w", id, err)
+	}
+
+	written = &segment{id: id, path: path}
+
+	err = func() error {
+		gzipWriter := gzip.NewWriter(file)
+		encoder := json.NewEncoder(gzipWriter)
+
+		for _, record := range records {
+			if err := encoder.Encode(&record); err != nil {
+				return err
+			}
+			written.addRecord(&record)
+		}
+
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+
+		return file.Sync()
+	}()
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = writeSegmentKeys(fs, written)
+	}
+
+	renamed := false
+	if err == nil {
+		// a failed rename may still have taken effect
+		renamed = true
+		err = fs.Rename(tempPath, path)
+	}
+
+	if err == nil {
+		err = fs.SyncDir(dir)
+	}
+
+	if err == nil {
+		var info os.FileInfo
+		if info, err = fs.Stat(path); err == nil {
+			written.size = info.Size()
+			return written, nil, nil
+		}
+	}
+
+	return nil, removeSegment(fs, dir, path, renamed), fmt.Errorf("could not write segment %d: %w", id, err)
+}
+
+// writeSegmentKeys writes the keys file of s, which is not synced to the directory, as
+// the segment is read instead if it is missing. It is only written in full
+func writeSegmentKeys(fs vfs.FS, s *segment) error {
+	contents, err := json.Marshal(&segmentKeys{Keys: s.keys, MaxSequence: s.maxSequence})
+	if err != nil {
+		return err
+	}
+
+	path := s.path + keysSuffix
+	tempPath := path + tempSuffix
+
+	file, err := fs.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(contents); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		fs.Remove(tempPath)
+		return err
+	}
+
+	return fs.Rename(tempPath, path)
+}
+
+// readSegmentKeys reads the keys file of the segment at path
+func readSegmentKeys(fs vfs.FS, path string) (*segmentKeys, error) {
+	contents, err := vfs.ReadFile(fs, path+keysSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &segmentKeys{}
+	if err := json.Unmarshal(contents, keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// removeSegment durably removes what a failed writeSegment left behind
+func removeSegment(fs vfs.FS, dir string, path string, renamed bool) error {
+	for _, leftover := range []string{path + tempSuffix, path + keysSuffix + tempSuffix, path + keysSuffix} {
+		if err := fs.Remove(leftover); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if !renamed {
+		return nil
+	}
+
+	if err := removeSegmentFiles(fs, path); err != nil {
+		return err
+	}
+
+	return fs.SyncDir(dir)
+}
+
+// removeSegmentFiles removes the segment at path and its keys file, the directory is not synced
+func removeSegmentFiles(fs vfs.FS, path string) error {
+	for _, name := range []string{path, path + keysSuffix} {
+		if err := fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSegment reads all records of a segment
+func readSegment(fs vfs.FS, path string) ([]segmentRecord, error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("could not read segment %s: %w", path, err)
+	}
+	defer gzipReader.Close()
+
+	records := []segmentRecord{}
+
+	decoder := json.NewDecoder(gzipReader)
+	for {
+		var record segmentRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read segment %s: %w", path, err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// openSegment learns which keys a segment contains from its keys file. The segment is
+// only read if the keys file is missing or damaged, in which case it is written again
+func openSegment(fs vfs.FS, dir string, id uint64) (*segment, error) {
+	path := filepath.Join(dir, segmentFileName(id))
+
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opened := &segment{id: id, path: path, size: info.Size()}
+
+	if keys, err := readSegmentKeys(fs, path); err == nil {
+		opened.keys = keys.Keys
+		opened.maxSequence = keys.MaxSequence
+		return opened, nil
+	}
+
+	records, err := readSegment(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range records {
+		opened.addRecord(&records[i])
+	}
+
+	if err := writeSegmentKeys(fs, opened); err != nil {
+		log.Printf("ERROR: tiered - could not write the keys of segment %d: %s\n", id, err.Error())
+	}
+
+	return opened, nil
+}
+
+// pendingSegment is a segment being written. A crash may leave it in place
+// with all of its keys, so deletions of them are recorded against it as well
+type pendingSegment struct {
+	id   uint64
+	keys map[string]bool
+}
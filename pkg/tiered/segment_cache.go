@@ -0,0 +1,98 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+const defaultSegmentCacheSize = 16
+
+// decodedSegment holds the entries of a segment by key, later records of a key win
+type decodedSegment struct {
+	id      uint64
+	entries map[string]*model.MachineMetrics
+}
+
+func newDecodedSegment(id uint64, records []segmentRecord) *decodedSegment {
+	decoded := &decodedSegment{id: id, entries: make(map[string]*model.MachineMetrics, len(records))}
+	for _, record := range records {
+		decoded.entries[record.Key] = record.Entry
+	}
+
+	return decoded
+}
+
+// segmentCache keeps the most recently read segments decoded, so that reads do not decompress
+// them every time. Segments are immutable, so a decoded segment never goes stale. It has a lock
+// of its own, as it is used under the read lock of the datastore
+type segmentCache struct {
+	mutex    sync.Mutex // protects all fields below
+	capacity int
+	order    *list.List // of *decodedSegment, most recently used first
+	elements map[uint64]*list.Element
+}
+
+func newSegmentCache(capacity int) *segmentCache {
+	return &segmentCache{
+		capacity: capacity,
+		order:    list.New(),
+		elements: make(map[uint64]*list.Element),
+	}
+}
+
+// get returns the decoded segment, reading it if it is not cached.
+// The cache is not locked while the segment is read
+func (c *segmentCache) get(fs vfs.FS, s *segment) (*decodedSegment, error) {
+	c.mutex.Lock()
+	if element, found := c.elements[s.id]; found {
+		c.order.MoveToFront(element)
+		c.mutex.Unlock()
+		return element.Value.(*decodedSegment), nil
+	}
+	c.mutex.Unlock()
+
+	records, err := readSegment(fs, s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := newDecodedSegment(s.id, records)
+	c.put(decoded)
+
+	return decoded, nil
+}
+
+// put caches decoded, evicting the least recently used segments beyond the capacity
+func (c *segmentCache) put(decoded *decodedSegment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, found := c.elements[decoded.id]; found {
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.elements[decoded.id] = c.order.PushFront(decoded)
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(*decodedSegment).id)
+	}
+}
+
+// remove drops the segment, which was replaced by a compaction
+func (c *segmentCache) remove(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, found := c.elements[id]; found {
+		c.order.Remove(element)
+		delete(c.elements, id)
+	}
+}
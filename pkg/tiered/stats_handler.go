@@ -0,0 +1,46 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// StatsPath is the route on which size metrics of both tiers are exposed
+const StatsPath = "/datastore/tiers"
+
+// an HTTP handler which returns TierStats as JSON
+type statsHandler struct {
+	Datastore *TieredDatastore
+}
+
+func NewStatsHandler(tieredDatastore *TieredDatastore) *statsHandler {
+	return &statsHandler{
+		Datastore: tieredDatastore,
+	}
+}
+
+// implementing http.Handler interface
+func (s *statsHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		responseWriter.Header().Set("Allow", "GET")
+		responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := s.Datastore.Stats()
+
+	statsAsBytes, err := json.MarshalIndent(&stats, "", "  ") // for readability
+	if err != nil {
+		log.Printf("ERROR: tiered - could not marshal stats: %s\n", err.Error())
+		http.Error(responseWriter, "Error marshalling stats", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	if _, err = responseWriter.Write(statsAsBytes); err != nil {
+		log.Printf("ERROR: tiered - could not write response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,689 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+const (
+	defaultHotThreshold        = time.Hour
+	defaultMigrationInterval   = time.Minute
+	defaultCompactionThreshold = 4
+)
+
+// Config holds the settings of a tiered datastore
+type Config struct {
+	Dir               string        // directory for the cold tier segments and the write-ahead log
+	HotThreshold      time.Duration // entries older than this are migrated to the cold tier
+	MigrationInterval time.Duration // how often to look for entries to migrate
+	SegmentCacheSize  int           // number of decoded segments kept in memory, defaultSegmentCacheSize if not set
+	Debug             bool
+	FS                vfs.FS // filesystem holding Dir, vfs.OS if not set
+
+	// number of segments of similar size which are merged into one, defaultCompactionThreshold if not set
+	CompactionThreshold int
+
+	// now returns the current time, it is only replaced in tests
+	now func() time.Time
+}
+
+// hotEntry is an entry in the in-memory tier together with the time it was added
+type hotEntry struct {
+	entry   *model.MachineMetrics
+	addedAt time.Time
+	size    int64 // length of the entry encoded as JSON
+}
+
+// entrySize returns the length of entry encoded as JSON
+func entrySize(entry *model.MachineMetrics) int64 {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return 0
+	}
+
+	return int64(len(encoded))
+}
+
+// TierStats contains size metrics of both tiers
+type TierStats struct {
+	HotEntries   int   `json:"hotEntries"`
+	HotBytes     int64 `json:"hotBytes"` // size of the hot entries encoded as JSON
+	ColdEntries  int   `json:"coldEntries"`
+	ColdSegments int   `json:"coldSegments"`
+	ColdBytes    int64 `json:"coldBytes"`
+}
+
+// TieredDatastore implements DatastoreInterface. New entries live in memory
+// and in a write-ahead log, entries older than HotThreshold are migrated in
+// the background to compressed immutable segments on disk. Reads span both tiers
+type TieredDatastore struct {
+	config Config
+
+	// only one migration or compaction runs at a time, it is taken before mutex
+	migrationMutex sync.Mutex
+
+	// obsolete holds the segments replaced by a compaction whose files may still be there,
+	// it is protected by migrationMutex
+	obsolete map[uint64]*segment
+
+	mutex sync.RWMutex // protects all fields below
+
+	hot          map[string]*hotEntry
+	hotBytes     int64 // sum of the sizes of the hot entries
+	wal          *writeAheadLog
+	nextSequence uint64 // sequence number of the next entry with ingestion metadata
+	changes      *datastore.ChangeCounter
+
+	segments      map[uint64]*segment
+	coldIndex     map[string]uint64 // key -> id of the segment holding it
+	tombstones    *tombstoneLog
+	nextSegmentID uint64
+	cache         *segmentCache
+
+	// writing is the segment being written without the lock, nil if there is none
+	writing *pendingSegment
+
+	// failure is set when the files could not be brought back to a known state
+	// after an error, changes are refused until the datastore is opened again
+	failure error
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// Open loads both tiers from config.Dir, creating the directory if needed,
+// and starts the background migration and compaction
+func Open(config Config) (*TieredDatastore, error) {
+	if config.Dir == "" {
+		return nil, errors.New("directory is not specified")
+	}
+
+	if config.HotThreshold <= 0 {
+		config.HotThreshold = defaultHotThreshold
+	}
+
+	if config.MigrationInterval <= 0 {
+		config.MigrationInterval = defaultMigrationInterval
+	}
+
+	if config.now == nil {
+		config.now = time.Now
+	}
+
+	if config.FS == nil {
+		config.FS = vfs.OS
+	}
+
+	if config.SegmentCacheSize <= 0 {
+		config.SegmentCacheSize = defaultSegmentCacheSize
+	}
+
+	if config.CompactionThreshold <= 0 {
+		config.CompactionThreshold = defaultCompactionThreshold
+	}
+
+	if err := config.FS.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	t := &TieredDatastore{
+		config:        config,
+		obsolete:      make(map[uint64]*segment),
+		hot:           make(map[string]*hotEntry),
+		nextSequence:  1,
+		changes:       datastore.NewChangeCounter(),
+		segments:      make(map[uint64]*segment),
+		coldIndex:     make(map[string]uint64),
+		nextSegmentID: 1,
+		cache:         newSegmentCache(config.SegmentCacheSize),
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+	}
+
+	if err := t.loadColdTier(); err != nil {
+		return nil, err
+	}
+
+	if err := t.loadHotTier(); err != nil {
+		t.tombstones.close()
+		return nil, err
+	}
+
+	go t.migrateInBackground()
+
+	return t, nil
+}
+
+// loadColdTier builds the index of the cold tier from segments and tombstones
+func (t *TieredDatastore) loadColdTier() error {
+	names, err := t.config.FS.ReadDir(t.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	keyFiles := []string{}
+	for _, name := range names {
+		// leftovers of a migration which did not finish
+		if strings.HasSuffix(name, tempSuffix) {
+			if err := t.config.FS.Remove(filepath.Join(t.config.Dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if strings.HasSuffix(name, keysSuffix) {
+			keyFiles = append(keyFiles, name)
+		}
+
+		if id, ok := parseSegmentFileName(name); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	// keys files of segments which were removed or never put in place
+	for _, name := range keyFiles {
+		if _, err := t.config.FS.Stat(filepath.Join(t.config.Dir, strings.TrimSuffix(name, keysSuffix))); os.IsNotExist(err) {
+			if err := t.config.FS.Remove(filepath.Join(t.config.Dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// later segments win, so that a key which was deleted and then
+	// added again points to the latest segment
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		opened, err := openSegment(t.config.FS, t.config.Dir, id)
+		if err != nil {
+			return err
+		}
+
+		t.segments[id] = opened
+		for _, key := range opened.keys {
+			t.coldIndex[key] = id
+		}
+
+		if id >= t.nextSegmentID {
+			t.nextSegmentID = id + 1
+		}
+
+		if opened.maxSequence >= t.nextSequence {
+			t.nextSequence = opened.maxSequence + 1
+		}
+	}
+
+	tombstoneLog, tombstones, err := openTombstoneLog(t.config.FS, t.config.Dir)
+	if err != nil {
+		return err
+	}
+	t.tombstones = tombstoneLog
+
+	for _, deleted := range tombstones {
+		if id, found := t.coldIndex[deleted.Key]; found && id == deleted.SegmentID {
+			delete(t.coldIndex, deleted.Key)
+		}
+
+		// the segment of a migration which did not finish may have tombstones, its id must not be used again
+		if deleted.SegmentID >= t.nextSegmentID {
+			t.nextSegmentID = deleted.SegmentID + 1
+		}
+	}
+
+	for _, id := range t.coldIndex {
+		t.segments[id].live++
+	}
+
+	if t.config.Debug {
+		log.Printf("tiered - loaded %d segments with %d entries from %s\n", len(t.segments), len(t.coldIndex), t.config.Dir)
+	}
+
+	return nil
+}
+
+// loadHotTier replays the write-ahead log and then rewrites it, so that it
+// does not hold entries which made it to the cold tier before a crash
+func (t *TieredDatastore) loadHotTier() error {
+	wal, hot, err := openWriteAheadLog(t.config.FS, t.config.Dir)
+	if err != nil {
+		return err
+	}
+	wal.close()
+
+	for key, v := range hot {
+		// the crash happened after the migration of the entry but before the log was rewritten
+		if _, found := t.coldIndex[key]; found {
+			delete(hot, key)
+			continue
+		}
+
+		if v.entry.Meta != nil && v.entry.Meta.Sequence >= t.nextSequence {
+			t.nextSequence = v.entry.Meta.Sequence + 1
+		}
+
+		v.size = entrySize(v.entry)
+		t.hotBytes += v.size
+	}
+
+	if t.wal, err = rewriteWriteAheadLog(t.config.FS, t.config.Dir, hot); err != nil {
+		return err
+	}
+	t.hot = hot
+
+	if t.config.Debug {
+		log.Printf("tiered - loaded %d hot entries from %s\n", len(t.hot), t.config.Dir)
+	}
+
+	return nil
+}
+
+// GetAllEntries returns entries from both tiers or nil if the cold tier could not be read,
+// only segments which are not cached are read
+func (t *TieredDatastore) GetAllEntries() []*model.MachineMetrics {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	allEntries := []*model.MachineMetrics{}
+	for _, v := range t.hot {
+		allEntries = append(allEntries, v.entry)
+	}
+
+	for id, s := range t.segments {
+		decoded, err := t.cache.get(t.config.FS, s)
+		if err != nil {
+			log.Printf("ERROR: tiered - %s\n", err.Error())
+			return nil
+		}
+
+		for key, entry := range decoded.entries {
+			// skip deleted entries and older copies of entries which were added again
+			if t.coldIndex[key] == id {
+				allEntries = append(allEntries, entry)
+			}
+		}
+	}
+
+	return allEntries
+}
+
+// GetEntry returns the entry stored under key from whichever tier holds it,
+// only the segment holding the entry is read, unless it is cached
+func (t *TieredDatastore) GetEntry(key string) (*model.MachineMetrics, datastore.DatastoreReturnCode) {
+	if key == "" {
+		return nil, datastore.ErrorKeyNotSpecified
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if v, found := t.hot[key]; found {
+		return v.entry, datastore.Success
+	}
+
+	id, found := t.coldIndex[key]
+	if !found {
+		return nil, datastore.ErrorKeyNotFound
+	}
+
+	decoded, err := t.cache.get(t.config.FS, t.segments[id])
+	if err != nil {
+		log.Printf("ERROR: tiered - %s\n", err.Error())
+		return nil, datastore.ErrorNotAvailable
+	}
+
+	if entry, found := decoded.entries[key]; found {
+		return entry, datastore.Success
+	}
+
+	log.Printf("ERROR: tiered - entry %s is not in segment %d\n", key, id)
+	return nil, datastore.ErrorNotAvailable
+}
+
+// AddEntry durably adds entry to the hot tier,
+// a sequence number is assigned to the entry if it has ingestion metadata
+func (t *TieredDatastore) AddEntry(key string, entry *model.MachineMetrics) datastore.DatastoreReturnCode {
+	if key == "" {
+		return datastore.ErrorKeyNotSpecified
+	}
+
+	if entry == nil {
+		return datastore.ErrorValueNotSpecified
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.failure != nil {
+		log.Printf("ERROR: tiered - could not add entry %s: %s\n", key, t.failure.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	if t.containsKey(key) {
+		return datastore.ErrorKeyExists
+	}
+
+	added := &hotEntry{entry: datastore.AssignSequence(entry, &t.nextSequence), addedAt: t.config.now()}
+	added.size = entrySize(added.entry)
+
+	if err := t.wal.appendAdd(key, added); err != nil {
+		log.Printf("ERROR: tiered - could not add entry %s: %s\n", key, err.Error())
+		return datastore.ErrorNotAvailable
+	}
+	t.hot[key] = added
+	t.hotBytes += added.size
+	t.changes.Changed()
+
+	return datastore.Success
+}
+
+// AddBatch durably adds all entries to the hot tier under their IDs with a single
+// record of the write-ahead log, so that none of them is kept if any could not be
+func (t *TieredDatastore) AddBatch(entries []*model.MachineMetrics) datastore.DatastoreReturnCode {
+	if rc := datastore.CheckBatch(entries); rc != datastore.Success {
+		return rc
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.failure != nil {
+		log.Printf("ERROR: tiered - could not add batch of %d entries: %s\n", len(entries), t.failure.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		if t.containsKey(entry.ID) {
+			return datastore.ErrorKeyExists
+		}
+		keys[i] = entry.ID
+	}
+
+	addedAt := t.config.now()
+	added := make([]*hotEntry, len(entries))
+	for i, entry := range entries {
+		added[i] = &hotEntry{entry: datastore.AssignSequence(entry, &t.nextSequence), addedAt: addedAt}
+		added[i].size = entrySize(added[i].entry)
+	}
+
+	if err := t.wal.appendBatch(keys, added); err != nil {
+		log.Printf("ERROR: tiered - could not add batch of %d entries: %s\n", len(entries), err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	for i, key := range keys {
+		t.hot[key] = added[i]
+		t.hotBytes += added[i].size
+	}
+	t.changes.Changed()
+
+	return datastore.Success
+}
+
+// DeleteEntry deletes entry from whichever tier holds it
+func (t *TieredDatastore) DeleteEntry(key string) datastore.DatastoreReturnCode {
+	if key == "" {
+		return datastore.ErrorKeyNotSpecified
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.failure != nil {
+		log.Printf("ERROR: tiered - could not delete entry %s: %s\n", key, t.failure.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	if !t.containsKey(key) {
+		return datastore.ErrorKeyNotFound
+	}
+
+	if err := t.deleteFromPendingSegment(key); err != nil {
+		log.Printf("ERROR: tiered - could not delete entry %s: %s\n", key, err.Error())
+		return datastore.ErrorNotAvailable
+	}
+
+	if v, found := t.hot[key]; found {
+		if err := t.wal.appendDelete(key); err != nil {
+			log.Printf("ERROR: tiered - could not delete entry %s: %s\n", key, err.Error())
+			return datastore.ErrorNotAvailable
+		}
+
+		delete(t.hot, key)
+		t.hotBytes -= v.size
+		t.changes.Changed()
+		return datastore.Success
+	}
+
+	// the log being replaced may still hold the entry, which would come back from it after a crash
+	if t.wal.rotating() {
+		if err := t.wal.appendDelete(key); err != nil {
+			log.Printf("ERROR: tiered - could not delete entry %s: %s\n", key, err.Error())
+			return datastore.ErrorNotAvailable
+		}
+	}
+
+	id := t.coldIndex[key]
+	if err := t.tombstones.appendTombstone(key, id); err != nil {
+		log.Printf("ERROR: tiered - could not delete entry %s: %s\n", key, err.Error())
+		return datastore.ErrorNotAvailable
+	}
+	delete(t.coldIndex, key)
+	t.segments[id].live--
+	t.changes.Changed()
+
+	return datastore.Success
+}
+
+// deleteFromPendingSegment records the deletion of key against the segment being written if it holds key,
+// as a crash may leave that segment in place before the migration learns about the deletion
+func (t *TieredDatastore) deleteFromPendingSegment(key string) error {
+	if t.writing == nil || !t.writing.keys[key] {
+		return nil
+	}
+
+	return t.tombstones.appendTombstone(key, t.writing.id)
+}
+
+func (t *TieredDatastore) containsKey(key string) bool {
+	if _, found := t.hot[key]; found {
+		return true
+	}
+
+	_, found := t.coldIndex[key]
+	return found
+}
+
+// Version returns the version of the entries of both tiers, migrations do not change it
+func (t *TieredDatastore) Version() datastore.Version {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.changes.Version()
+}
+
+// Stats returns size metrics of both tiers
+func (t *TieredDatastore) Stats() TierStats {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	stats := TierStats{
+		HotEntries:   len(t.hot),
+		HotBytes:     t.hotBytes,
+		ColdEntries:  len(t.coldIndex),
+		ColdSegments: len(t.segments),
+	}
+
+	for _, s := range t.segments {
+		stats.ColdBytes += s.size
+	}
+
+	return stats
+}
+
+// Migrate moves all entries older than HotThreshold to a new segment, it returns the number
+// of migrated entries. The segment is written without holding the lock and swapped in afterwards,
+// entries which are deleted or replaced meanwhile stay out of the cold tier. Their deletion is recorded
+// against the segment before it is acknowledged, so they stay out even if the migration is cut short by a crash
+func (t *TieredDatastore) Migrate() (int, error) {
+	t.migrationMutex.Lock()
+	defer t.migrationMutex.Unlock()
+
+	// nothing but a migration changes the segments
+	t.mutex.Lock()
+	if t.failure != nil {
+		t.mutex.Unlock()
+		return 0, t.failure
+	}
+
+	id := t.nextSegmentID
+	cutoff := t.config.now().Add(-t.config.HotThreshold)
+
+	records := []segmentRecord{}
+	migrating := make(map[string]*hotEntry)
+	for key, v := range t.hot {
+		if v.addedAt.Before(cutoff) {
+			records = append(records, segmentRecord{Key: key, Entry: v.entry})
+			migrating[key] = v
+		}
+	}
+
+	if len(records) == 0 {
+		t.mutex.Unlock()
+		return 0, nil
+	}
+
+	// the id is not used again even if the migration fails, as tombstones may already refer to it
+	t.nextSegmentID = id + 1
+	t.writing = &pendingSegment{id: id, keys: make(map[string]bool, len(records))}
+	for key := range migrating {
+		t.writing.keys[key] = true
+	}
+	t.mutex.Unlock()
+
+	written, cleanupErr, err := writeSegment(t.config.FS, t.config.Dir, id, records)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.writing = nil
+
+	if err != nil {
+		if cleanupErr != nil {
+			// the segment may turn up after a crash, and with it entries deleted from now on
+			t.failure = fmt.Errorf("segment %d could not be removed after a failed migration: %w", id, cleanupErr)
+		}
+		return 0, err
+	}
+
+	t.segments[id] = written
+	t.cache.put(newDecodedSegment(id, records))
+
+	// entries deleted while the segment was written have a tombstone for it already
+	migrated := 0
+	for _, record := range records {
+		if v, found := t.hot[record.Key]; found && v == migrating[record.Key] {
+			delete(t.hot, record.Key)
+			t.hotBytes -= v.size
+			t.coldIndex[record.Key] = id
+			written.live++
+			migrated++
+		}
+	}
+
+	if t.config.Debug {
+		log.Printf("tiered - migrated %d entries to segment %d\n", migrated, id)
+	}
+
+	// the old log still holds the migrated entries, which would come back
+	// after a crash if they were deleted from the cold tier
+	if err := t.replaceWriteAheadLog(); err != nil {
+		t.failure = fmt.Errorf("write-ahead log could not be replaced after a migration: %w", err)
+		return 0, t.failure
+	}
+
+	return migrated, nil
+}
+
+// replaceWriteAheadLog replaces the log with one holding only the hot tier. It is called and
+// returns with the lock held, but writes the new log without it, changes made meanwhile are
+// appended to both logs. If it fails, the old log may or may not have been replaced
+func (t *TieredDatastore) replaceWriteAheadLog() error {
+	records := walRecords(t.hot)
+	t.wal.startRotation()
+	t.mutex.Unlock()
+
+	next, err := writeTempRecordLog(t.config.FS, filepath.Join(t.config.Dir, walFileName), records)
+
+	t.mutex.Lock()
+	if err != nil {
+		t.wal.abortRotation()
+		return err
+	}
+
+	if err := t.wal.finishRotation(t.config.FS, next); err != nil {
+		t.wal.abortRotation()
+		next.discard(t.config.FS)
+		return err
+	}
+	t.wal = &writeAheadLog{recordLog: next}
+
+	return nil
+}
+
+func (t *TieredDatastore) migrateInBackground() {
+	defer close(t.doneCh)
+
+	ticker := time.NewTicker(t.config.MigrationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+			if _, err := t.Migrate(); err != nil {
+				log.Printf("ERROR: tiered - migration failed: %s\n", err.Error())
+			}
+
+			if _, err := t.Compact(); err != nil {
+				log.Printf("ERROR: tiered - compaction failed: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// Close stops the background migration and compaction, entries in the hot tier stay in the write-ahead log
+func (t *TieredDatastore) Close() error {
+	close(t.stopCh)
+	<-t.doneCh
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var walErr error
+	if t.wal != nil {
+		walErr = t.wal.close()
+	}
+
+	if err := t.tombstones.close(); err != nil {
+		return err
+	}
+
+	return walErr
+}
@@ -0,0 +1,677 @@
+package tiered
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/kostik-b/metrics-store/pkg/datastore"
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+	"github.com/kostik-b/metrics-store/pkg/vfs/faultfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const hotThreshold = time.Hour
+
+// fakeClock is a clock which only moves when told to
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func newEntry(id string) *model.MachineMetrics {
+	return &model.MachineMetrics{
+		ID:        id,
+		MachineID: 123,
+		Stats: model.MetricsStats{
+			CPUTemp:  456,
+			FanSpeed: 789,
+			HDDSpace: 987,
+		},
+		LastLoggedIn: "userA",
+		SysTime:      model.NewSysTime(time.Date(2021, 7, 28, 14, 16, 27, 0, time.UTC)),
+	}
+}
+
+// pausingFS pauses the rename of a segment into place until it is resumed
+type pausingFS struct {
+	vfs.FS
+	paused  chan struct{}
+	resumed chan struct{}
+}
+
+func (p *pausingFS) Rename(oldpath, newpath string) error {
+	if _, isSegment := parseSegmentFileName(filepath.Base(newpath)); isSegment {
+		close(p.paused)
+		<-p.resumed
+	}
+
+	return p.FS.Rename(oldpath, newpath)
+}
+
+// crashingFS pauses when the file called name is created or renamed into place until it is
+// resumed and then crashes. A rename is made durable before the crash, the creation fails
+type crashingFS struct {
+	*faultfs.FS
+	name    string // nothing is paused if it is empty
+	paused  chan struct{}
+	resumed chan struct{}
+}
+
+func (c *crashingFS) pause(path string) bool {
+	if c.name == "" || filepath.Base(path) != c.name {
+		return false
+	}
+
+	close(c.paused)
+	<-c.resumed
+
+	return true
+}
+
+func (c *crashingFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	if c.pause(name) {
+		c.FS.Crash()
+	}
+
+	return c.FS.OpenFile(name, flag, perm)
+}
+
+func (c *crashingFS) Rename(oldpath, newpath string) error {
+	if !c.pause(newpath) {
+		return c.FS.Rename(oldpath, newpath)
+	}
+
+	err := c.FS.Rename(oldpath, newpath)
+	c.FS.SyncDir(filepath.Dir(newpath))
+	c.FS.Crash()
+
+	return err
+}
+
+type TieredDatastoreTestSuite struct {
+	suite.Suite
+	dir       string
+	clock     *fakeClock
+	datastore *TieredDatastore
+}
+
+func (s *TieredDatastoreTestSuite) open() *TieredDatastore {
+	opened, err := Open(Config{
+		Dir:               s.dir,
+		HotThreshold:      hotThreshold,
+		MigrationInterval: time.Hour, // migrations are triggered by the tests
+		now:               s.clock.Now,
+	})
+	require.Nil(s.T(), err, "Problem opening datastore")
+
+	return opened
+}
+
+func (s *TieredDatastoreTestSuite) reopen() {
+	require.Nil(s.T(), s.datastore.Close(), "Problem closing datastore")
+	s.datastore = s.open()
+}
+
+func (s *TieredDatastoreTestSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+	s.clock = &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.datastore = s.open()
+}
+
+func (s *TieredDatastoreTestSuite) TearDownTest() {
+	s.datastore.Close()
+}
+
+func (s *TieredDatastoreTestSuite) Test_AddEntry_StoredInHotTier() {
+	rc := s.datastore.AddEntry("key1", newEntry("key1"))
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	assert.Equal(s.T(), TierStats{HotEntries: 1, HotBytes: entrySize(newEntry("key1"))}, s.datastore.Stats(), "Entry should be in the hot tier")
+	assert.Equal(s.T(), []*model.MachineMetrics{newEntry("key1")}, s.datastore.GetAllEntries(), "Entry should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_AddEntryWithEmptyKeyOrNilValue_ReturnsErrors() {
+	assert.Equal(s.T(), ds.ErrorKeyNotSpecified, s.datastore.AddEntry("", newEntry("key1")), "Key should be required")
+	assert.Equal(s.T(), ds.ErrorValueNotSpecified, s.datastore.AddEntry("key1", nil), "Value should be required")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Migrate_OnlyOldEntriesMovedToColdTier() {
+	s.datastore.AddEntry("old", newEntry("old"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.AddEntry("new", newEntry("new"))
+
+	migrated, err := s.datastore.Migrate()
+	assert.Nil(s.T(), err, "Problem migrating")
+	assert.Equal(s.T(), 1, migrated, "Only the old entry should be migrated")
+
+	stats := s.datastore.Stats()
+	assert.Equal(s.T(), 1, stats.HotEntries, "New entry should stay in the hot tier")
+	assert.Equal(s.T(), entrySize(newEntry("new")), stats.HotBytes, "Only the new entry should count towards the hot tier")
+	assert.Equal(s.T(), 1, stats.ColdEntries, "Old entry should be in the cold tier")
+	assert.Equal(s.T(), 1, stats.ColdSegments, "One segment should have been written")
+	assert.Greater(s.T(), stats.ColdBytes, int64(0), "Segment should not be empty")
+
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("old"), newEntry("new")},
+		s.datastore.GetAllEntries(), "Entries from both tiers should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Migrate_NothingToMigrate_NoSegmentWritten() {
+	s.datastore.AddEntry("new", newEntry("new"))
+
+	migrated, err := s.datastore.Migrate()
+	assert.Nil(s.T(), err, "Problem migrating")
+	assert.Equal(s.T(), 0, migrated, "Nothing should be migrated")
+	assert.Equal(s.T(), 0, s.datastore.Stats().ColdSegments, "No segment should have been written")
+}
+
+func (s *TieredDatastoreTestSuite) Test_AddEntryWithKeyInColdTier_ReturnsKeyExistsError() {
+	s.datastore.AddEntry("key1", newEntry("key1"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	rc := s.datastore.AddEntry("key1", newEntry("key1"))
+	assert.Equal(s.T(), ds.ErrorKeyExists, rc, "ReturnCode should be "+ds.ErrorKeyExists.String())
+}
+
+func (s *TieredDatastoreTestSuite) Test_Reopen_ColdTierLoadedFromDisk() {
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.datastore.AddEntry(key, newEntry(key))
+	}
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	s.datastore.AddEntry("key10", newEntry("key10"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	before := s.datastore.GetAllEntries()
+	stats := s.datastore.Stats()
+
+	s.reopen()
+
+	assert.ElementsMatch(s.T(), before, s.datastore.GetAllEntries(), "Entries should survive reopening")
+	assert.Equal(s.T(), stats, s.datastore.Stats(), "Stats should survive reopening")
+
+	// new segments should not overwrite the existing ones
+	s.datastore.AddEntry("key11", newEntry("key11"))
+	s.clock.Advance(hotThreshold + time.Second)
+	_, err := s.datastore.Migrate()
+	assert.Nil(s.T(), err, "Problem migrating")
+	assert.Equal(s.T(), 12, len(s.datastore.GetAllEntries()), "All entries should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Reopen_SequenceContinuesAfterColdTier() {
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key%d", i)
+		entry := newEntry(key)
+		entry.Meta = &model.IngestionMeta{}
+		s.datastore.AddEntry(key, entry)
+	}
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	s.reopen()
+
+	entry := newEntry("key3")
+	entry.Meta = &model.IngestionMeta{}
+	s.datastore.AddEntry("key3", entry)
+
+	sequences := map[string]uint64{}
+	for _, stored := range s.datastore.GetAllEntries() {
+		sequences[stored.ID] = stored.Meta.Sequence
+	}
+
+	assert.Equal(s.T(), map[string]uint64{"key0": 1, "key1": 2, "key2": 3, "key3": 4}, sequences,
+		"Sequence numbers should keep increasing after reopening")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Version_KeptByMigrationNotByReopening() {
+	s.datastore.AddEntry("cold", newEntry("cold"))
+	version := s.datastore.Version()
+
+	s.clock.Advance(hotThreshold + time.Second)
+	migrated, err := s.datastore.Migrate()
+	require.Nil(s.T(), err, "Problem migrating")
+	require.Equal(s.T(), 1, migrated, "Entry should be migrated")
+
+	assert.Equal(s.T(), version, s.datastore.Version(), "Migration should not change the version")
+
+	s.reopen()
+
+	assert.NotEqual(s.T(), version.Tag, s.datastore.Version().Tag,
+		"Version should change on reopening, as the files may have changed in between")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Reopen_HotTierLoadedFromWriteAheadLog() {
+	s.datastore.AddEntry("cold", newEntry("cold"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	s.datastore.AddEntry("hot", newEntry("hot"))
+	s.datastore.AddEntry("deleted", newEntry("deleted"))
+	s.datastore.DeleteEntry("deleted")
+
+	s.reopen()
+
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("cold"), newEntry("hot")}, s.datastore.GetAllEntries(),
+		"Hot entries should survive reopening")
+	assert.Equal(s.T(), TierStats{HotEntries: 1, HotBytes: entrySize(newEntry("hot")), ColdEntries: 1, ColdSegments: 1, ColdBytes: s.datastore.Stats().ColdBytes},
+		s.datastore.Stats(), "Entries should stay in their tiers")
+
+	// the time an entry was added survives as well
+	s.clock.Advance(hotThreshold + time.Second)
+	migrated, err := s.datastore.Migrate()
+	assert.Nil(s.T(), err, "Problem migrating")
+	assert.Equal(s.T(), 1, migrated, "Hot entry should be migrated")
+}
+
+func (s *TieredDatastoreTestSuite) Test_AddBatch_KeptOrDroppedAsAWhole() {
+	s.datastore.AddEntry("single", newEntry("single"))
+	rc := s.datastore.AddBatch([]*model.MachineMetrics{newEntry("batch1"), newEntry("batch2")})
+	require.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+
+	s.reopen()
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("single"), newEntry("batch1"), newEntry("batch2")},
+		s.datastore.GetAllEntries(), "Batch should survive reopening")
+
+	rc = s.datastore.AddBatch([]*model.MachineMetrics{newEntry("torn1"), newEntry("torn2")})
+	require.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	require.Nil(s.T(), s.datastore.Close(), "Problem closing datastore")
+
+	// as if the process crashed while the record of the batch was written
+	walPath := filepath.Join(s.dir, walFileName)
+	info, err := os.Stat(walPath)
+	require.Nil(s.T(), err, "Problem reading write-ahead log")
+	require.Nil(s.T(), os.Truncate(walPath, info.Size()-10), "Problem truncating write-ahead log")
+
+	s.datastore = s.open()
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("single"), newEntry("batch1"), newEntry("batch2")},
+		s.datastore.GetAllEntries(), "No entry of a batch which was not written in full should be kept")
+}
+
+func (s *TieredDatastoreTestSuite) Test_DeleteEntry_FromBothTiers() {
+	s.datastore.AddEntry("cold", newEntry("cold"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+	s.datastore.AddEntry("hot", newEntry("hot"))
+
+	assert.Equal(s.T(), ds.Success, s.datastore.DeleteEntry("hot"), "Problem deleting hot entry")
+	assert.Equal(s.T(), ds.Success, s.datastore.DeleteEntry("cold"), "Problem deleting cold entry")
+	assert.Equal(s.T(), ds.ErrorKeyNotFound, s.datastore.DeleteEntry("cold"), "Entry should already be deleted")
+	assert.Equal(s.T(), ds.ErrorKeyNotSpecified, s.datastore.DeleteEntry(""), "Key should be required")
+
+	assert.Empty(s.T(), s.datastore.GetAllEntries(), "No entries should be returned")
+
+	s.reopen()
+
+	assert.Empty(s.T(), s.datastore.GetAllEntries(), "Deletion should survive reopening")
+}
+
+func (s *TieredDatastoreTestSuite) Test_DeleteAndAddAgain_LatestEntryReturned() {
+	s.datastore.AddEntry("key1", newEntry("key1"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	s.datastore.DeleteEntry("key1")
+
+	replacement := newEntry("key1")
+	replacement.MachineID = 999
+	assert.Equal(s.T(), ds.Success, s.datastore.AddEntry("key1", replacement), "Key should be free again")
+
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+	s.reopen()
+
+	assert.Equal(s.T(), []*model.MachineMetrics{replacement}, s.datastore.GetAllEntries(), "Only the replacement should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Open_LeftoverTempFileRemoved() {
+	tempPath := filepath.Join(s.dir, segmentFileName(42)+tempSuffix)
+	require.Nil(s.T(), os.WriteFile(tempPath, []byte("garbage"), 0644), "Problem writing temp file")
+
+	s.reopen()
+
+	_, err := os.Stat(tempPath)
+	assert.True(s.T(), os.IsNotExist(err), "Temp file should have been removed")
+	assert.Empty(s.T(), s.datastore.GetAllEntries(), "No entries should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_BackgroundMigration_MovesOldEntries() {
+	s.datastore.Close()
+
+	var err error
+	s.datastore, err = Open(Config{
+		Dir:               s.dir,
+		HotThreshold:      hotThreshold,
+		MigrationInterval: 10 * time.Millisecond,
+		now:               s.clock.Now,
+	})
+	require.Nil(s.T(), err, "Problem opening datastore")
+
+	s.datastore.AddEntry("key1", newEntry("key1"))
+	s.clock.Advance(hotThreshold + time.Second)
+
+	assert.Eventually(s.T(), func() bool {
+		return s.datastore.Stats().ColdEntries == 1
+	}, 5*time.Second, 10*time.Millisecond, "Entry should have been migrated in the background")
+}
+
+func (s *TieredDatastoreTestSuite) Test_StatsHandler_ReturnsStatsAsJSON() {
+	s.datastore.AddEntry("key1", newEntry("key1"))
+
+	recorder := httptest.NewRecorder()
+	NewStatsHandler(s.datastore).ServeHTTP(recorder, httptest.NewRequest("GET", StatsPath, nil))
+
+	assert.Equal(s.T(), http.StatusOK, recorder.Code, "Status code is incorrect")
+	assert.Equal(s.T(), "application/json", recorder.Header().Get("Content-Type"), "Content type is incorrect")
+	assert.JSONEq(s.T(), fmt.Sprintf(`{"hotEntries": 1, "hotBytes": %d, "coldEntries": 0, "coldSegments": 0, "coldBytes": 0}`, entrySize(newEntry("key1"))),
+		recorder.Body.String(), "Response body is incorrect")
+}
+
+func (s *TieredDatastoreTestSuite) Test_HotBytes_KeptAcrossDeletesAndReopening() {
+	s.datastore.AddEntry("key1", newEntry("key1"))
+	s.datastore.AddBatch([]*model.MachineMetrics{newEntry("batch1"), newEntry("batch2")})
+	s.datastore.DeleteEntry("batch1")
+
+	expected := entrySize(newEntry("key1")) + entrySize(newEntry("batch2"))
+	assert.Equal(s.T(), expected, s.datastore.Stats().HotBytes, "Size of the hot tier is incorrect")
+
+	s.reopen()
+	assert.Equal(s.T(), expected, s.datastore.Stats().HotBytes, "Size of the hot tier should survive reopening")
+}
+
+func (s *TieredDatastoreTestSuite) Test_ColdEntries_ReadFromCacheAfterMigration() {
+	s.datastore.AddEntry("key1", newEntry("key1"))
+	s.clock.Advance(hotThreshold + time.Second)
+	s.datastore.Migrate()
+
+	// the segment written by the migration is cached, so it is not read again
+	require.Nil(s.T(), os.Remove(filepath.Join(s.dir, segmentFileName(1))), "Problem removing segment")
+
+	entry, rc := s.datastore.GetEntry("key1")
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	assert.Equal(s.T(), newEntry("key1"), entry, "Cold entry should be returned")
+	assert.Equal(s.T(), []*model.MachineMetrics{newEntry("key1")}, s.datastore.GetAllEntries(), "Cold entry should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_ColdEntries_SegmentsBeyondCacheSizeReadAgain() {
+	s.datastore.Close()
+
+	var err error
+	s.datastore, err = Open(Config{
+		Dir:               s.dir,
+		HotThreshold:      hotThreshold,
+		MigrationInterval: time.Hour,
+		SegmentCacheSize:  1,
+		now:               s.clock.Now,
+	})
+	require.Nil(s.T(), err, "Problem opening datastore")
+
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.datastore.AddEntry(key, newEntry(key))
+		s.clock.Advance(hotThreshold + time.Second)
+		s.datastore.Migrate()
+	}
+
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("key0"), newEntry("key1"), newEntry("key2")},
+		s.datastore.GetAllEntries(), "Entries of every segment should be returned")
+
+	entry, rc := s.datastore.GetEntry("key0")
+	assert.Equal(s.T(), ds.Success, rc, "ReturnCode should be "+ds.Success.String())
+	assert.Equal(s.T(), newEntry("key0"), entry, "Entry of an evicted segment should be returned")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Migrate_ChangesAcceptedWhileSegmentIsWritten() {
+	s.datastore.Close()
+
+	fs := &pausingFS{FS: vfs.OS, paused: make(chan struct{}), resumed: make(chan struct{})}
+
+	var err error
+	s.datastore, err = Open(Config{
+		Dir:               s.dir,
+		HotThreshold:      hotThreshold,
+		MigrationInterval: time.Hour,
+		FS:                fs,
+		now:               s.clock.Now,
+	})
+	require.Nil(s.T(), err, "Problem opening datastore")
+
+	s.datastore.AddEntry("kept", newEntry("kept"))
+	s.datastore.AddEntry("deleted", newEntry("deleted"))
+	s.datastore.AddEntry("replaced", newEntry("replaced"))
+	s.clock.Advance(hotThreshold + time.Second)
+
+	type result struct {
+		migrated int
+		err      error
+	}
+	done := make(chan result)
+	go func() {
+		migrated, err := s.datastore.Migrate()
+		done <- result{migrated, err}
+	}()
+
+	<-fs.paused
+
+	replacement := newEntry("replaced")
+	replacement.MachineID = 999
+
+	assert.Equal(s.T(), ds.Success, s.datastore.AddEntry("new", newEntry("new")), "Problem adding entry during migration")
+	assert.Equal(s.T(), ds.Success, s.datastore.DeleteEntry("deleted"), "Problem deleting entry during migration")
+	assert.Equal(s.T(), ds.Success, s.datastore.DeleteEntry("replaced"), "Problem deleting entry during migration")
+	assert.Equal(s.T(), ds.Success, s.datastore.AddEntry("replaced", replacement), "Problem adding entry during migration")
+	_, rc := s.datastore.GetEntry("kept")
+	assert.Equal(s.T(), ds.Success, rc, "Entry should be readable during migration")
+
+	close(fs.resumed)
+	migration := <-done
+	require.Nil(s.T(), migration.err, "Problem migrating")
+	assert.Equal(s.T(), 1, migration.migrated, "Only the unchanged entry should be migrated")
+
+	expected := []*model.MachineMetrics{newEntry("kept"), newEntry("new"), replacement}
+	assert.ElementsMatch(s.T(), expected, s.datastore.GetAllEntries(), "Changes made during migration should be kept")
+
+	s.datastore.config.FS = vfs.OS
+	s.reopen()
+	assert.ElementsMatch(s.T(), expected, s.datastore.GetAllEntries(), "Changes made during migration should survive reopening")
+	assert.Equal(s.T(), 1, s.datastore.Stats().ColdEntries, "Only the unchanged entry should be in the cold tier")
+}
+
+// crashDuring runs maintain once the entries are old enough to be migrated, runs change while maintain is paused
+// at the file called name and returns the datastore opened again after the crash which ends maintain
+func (s *TieredDatastoreTestSuite) crashDuring(name string, maintain func(*TieredDatastore) error, change func(*TieredDatastore)) *TieredDatastore {
+	fs := &crashingFS{FS: faultfs.New(1), paused: make(chan struct{}), resumed: make(chan struct{})}
+	config := Config{
+		Dir:                 "/data",
+		HotThreshold:        hotThreshold,
+		MigrationInterval:   time.Hour,
+		CompactionThreshold: 1,
+		FS:                  fs,
+		now:                 s.clock.Now,
+	}
+
+	crashed, err := Open(config)
+	require.Nil(s.T(), err, "Problem opening datastore")
+
+	crashed.AddEntry("kept", newEntry("kept"))
+	crashed.AddEntry("deleted", newEntry("deleted"))
+	s.clock.Advance(hotThreshold + time.Second)
+
+	fs.name = name
+	done := make(chan error)
+	go func() {
+		done <- maintain(crashed)
+	}()
+
+	<-fs.paused
+	change(crashed)
+
+	close(fs.resumed)
+	require.NotNil(s.T(), <-done, "Maintenance should be cut short by the crash")
+	crashed.Close()
+
+	fs.Restart()
+	config.FS = fs.FS
+	reopened, err := Open(config)
+	require.Nil(s.T(), err, "Problem opening datastore after the crash")
+
+	return reopened
+}
+
+func migrate(t *TieredDatastore) error {
+	_, err := t.Migrate()
+	return err
+}
+
+func (s *TieredDatastoreTestSuite) Test_Migrate_EntryDeletedWhileSegmentIsWrittenStaysDeletedAfterCrash() {
+	reopened := s.crashDuring(segmentFileName(1), migrate, func(crashed *TieredDatastore) {
+		require.Equal(s.T(), ds.Success, crashed.DeleteEntry("deleted"), "Problem deleting entry during migration")
+	})
+	defer reopened.Close()
+
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("kept")}, reopened.GetAllEntries(),
+		"Entry deleted during the migration should not come back with the segment")
+	assert.Equal(s.T(), 1, reopened.Stats().ColdSegments, "Segment should survive the crash")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Migrate_EntryDeletedWhileWriteAheadLogIsReplacedStaysDeletedAfterCrash() {
+	reopened := s.crashDuring(walFileName+tempSuffix, migrate, func(crashed *TieredDatastore) {
+		require.Equal(s.T(), 2, crashed.Stats().ColdEntries, "Entries should be in the cold tier")
+		require.Equal(s.T(), ds.Success, crashed.DeleteEntry("deleted"), "Problem deleting entry during migration")
+		require.Equal(s.T(), ds.Success, crashed.AddEntry("new", newEntry("new")), "Problem adding entry during migration")
+	})
+	defer reopened.Close()
+
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("kept"), newEntry("new")}, reopened.GetAllEntries(),
+		"Entry deleted while the log was replaced should not come back from the old log")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Compact_EntryDeletedWhileSegmentsAreMergedStaysDeletedAfterCrash() {
+	compact := func(t *TieredDatastore) error {
+		if err := migrate(t); err != nil {
+			return err
+		}
+		_, err := t.Compact()
+		return err
+	}
+
+	reopened := s.crashDuring(segmentFileName(2), compact, func(crashed *TieredDatastore) {
+		require.Equal(s.T(), ds.Success, crashed.DeleteEntry("deleted"), "Problem deleting entry during compaction")
+	})
+	defer reopened.Close()
+
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("kept")}, reopened.GetAllEntries(),
+		"Entry deleted during the compaction should not come back with the merged segment")
+}
+
+// migrateEntries adds entries and migrates them to a segment of their own
+func (s *TieredDatastoreTestSuite) migrateEntries(keys ...string) {
+	for _, key := range keys {
+		require.Equal(s.T(), ds.Success, s.datastore.AddEntry(key, newEntry(key)), "Problem adding entry")
+	}
+	s.clock.Advance(hotThreshold + time.Second)
+
+	migrated, err := s.datastore.Migrate()
+	require.Nil(s.T(), err, "Problem migrating")
+	require.Equal(s.T(), len(keys), migrated, "Entries should be migrated")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Compact_SegmentsMergedWithoutDeletedEntries() {
+	s.datastore.config.CompactionThreshold = 3
+	s.migrateEntries("key1")
+	s.migrateEntries("key2", "key4")
+
+	removed, err := s.datastore.Compact()
+	require.Nil(s.T(), err, "Problem compacting")
+	assert.Zero(s.T(), removed, "Segments should not be merged below the threshold")
+
+	s.migrateEntries("key3")
+	assert.Equal(s.T(), ds.Success, s.datastore.DeleteEntry("key2"), "Problem deleting entry")
+
+	removed, err = s.datastore.Compact()
+	require.Nil(s.T(), err, "Problem compacting")
+	assert.Equal(s.T(), 3, removed, "Segments should be merged")
+
+	expected := []*model.MachineMetrics{newEntry("key1"), newEntry("key3"), newEntry("key4")}
+	assert.ElementsMatch(s.T(), expected, s.datastore.GetAllEntries(), "Entries should be kept by the compaction")
+	assert.Equal(s.T(), TierStats{ColdEntries: 3, ColdSegments: 1, ColdBytes: s.datastore.Stats().ColdBytes}, s.datastore.Stats(),
+		"Entries should be in the merged segment")
+
+	names, err := vfs.OS.ReadDir(s.dir)
+	require.Nil(s.T(), err, "Problem reading directory")
+	assert.ElementsMatch(s.T(), []string{segmentFileName(4), segmentFileName(4) + keysSuffix, walFileName, tombstoneFileName}, names,
+		"Merged segments should be removed")
+
+	tombstones, err := os.ReadFile(filepath.Join(s.dir, tombstoneFileName))
+	require.Nil(s.T(), err, "Problem reading tombstones")
+	assert.Empty(s.T(), tombstones, "Tombstones of merged segments should be removed")
+
+	s.reopen()
+	assert.ElementsMatch(s.T(), expected, s.datastore.GetAllEntries(), "Merged segment should survive reopening")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Compact_SegmentWithoutEntriesRemoved() {
+	s.migrateEntries("key1")
+	assert.Equal(s.T(), ds.Success, s.datastore.DeleteEntry("key1"), "Problem deleting entry")
+
+	removed, err := s.datastore.Compact()
+	require.Nil(s.T(), err, "Problem compacting")
+	assert.Equal(s.T(), 1, removed, "Empty segment should be removed")
+	assert.Zero(s.T(), s.datastore.Stats().ColdSegments, "Empty segment should be removed")
+
+	_, err = os.Stat(filepath.Join(s.dir, segmentFileName(1)))
+	assert.True(s.T(), os.IsNotExist(err), "Empty segment should be removed from disk")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Open_SegmentNotReadWhenKeysFileIsThere() {
+	s.migrateEntries("key1")
+	s.datastore.Close()
+
+	// a damaged segment would fail to open if it was read
+	require.Nil(s.T(), os.WriteFile(filepath.Join(s.dir, segmentFileName(1)), []byte("damaged"), 0644), "Problem damaging segment")
+
+	s.datastore = s.open()
+	assert.Equal(s.T(), 1, s.datastore.Stats().ColdEntries, "Keys should be read from the keys file")
+}
+
+func (s *TieredDatastoreTestSuite) Test_Open_SegmentReadWhenKeysFileIsMissing() {
+	s.migrateEntries("key1")
+	s.datastore.Close()
+
+	keysPath := filepath.Join(s.dir, segmentFileName(1)+keysSuffix)
+	require.Nil(s.T(), os.Remove(keysPath), "Problem removing keys file")
+
+	s.datastore = s.open()
+	assert.ElementsMatch(s.T(), []*model.MachineMetrics{newEntry("key1")}, s.datastore.GetAllEntries(), "Keys should be read from the segment")
+
+	_, err := os.Stat(keysPath)
+	assert.Nil(s.T(), err, "Keys file should be written again")
+}
+
+func TestTieredDatastoreTestSuite(t *testing.T) {
+	suite.Run(t, new(TieredDatastoreTestSuite))
+}
@@ -0,0 +1,46 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+const tombstoneFileName = "tombstones.log"
+
+// tombstone marks an entry of a segment as deleted,
+// as segments themselves are never modified
+type tombstone struct {
+	Key       string `json:"key"`
+	SegmentID uint64 `json:"segmentId"`
+}
+
+// tombstoneLog is an append-only file with one JSON tombstone per line
+type tombstoneLog struct {
+	*recordLog
+}
+
+// openTombstoneLog opens the log and returns all tombstones in it
+func openTombstoneLog(fs vfs.FS, dir string) (*tombstoneLog, []tombstone, error) {
+	tombstones := []tombstone{}
+
+	opened, err := openRecordLog(fs, filepath.Join(dir, tombstoneFileName), func(line []byte) {
+		var t tombstone
+		if err := json.Unmarshal(line, &t); err == nil {
+			tombstones = append(tombstones, t)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &tombstoneLog{recordLog: opened}, tombstones, nil
+}
+
+// appendTombstone durably records a tombstone
+func (t *tombstoneLog) appendTombstone(key string, segmentID uint64) error {
+	return t.append(&tombstone{Key: key, SegmentID: segmentID})
+}
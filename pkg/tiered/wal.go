@@ -0,0 +1,104 @@
+// Copyright Konstantin Bakanov 2023
+
+package tiered
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+const walFileName = "hot.wal"
+
+const (
+	walAdd    = "add"
+	walDelete = "delete"
+	walBatch  = "batch" // adds all of its records, as one line is either written in full or dropped
+)
+
+// walRecord is one change of the hot tier
+type walRecord struct {
+	Op      string                `json:"op"`
+	Key     string                `json:"key"`
+	Entry   *model.MachineMetrics `json:"entry,omitempty"`
+	AddedAt time.Time             `json:"addedAt"`
+	Batch   []*walRecord          `json:"batch,omitempty"`
+}
+
+// writeAheadLog makes the hot tier durable, every change of the hot tier
+// is appended to it before it is acknowledged. It is replaced after
+// every migration, so that it only holds entries which are still hot
+type writeAheadLog struct {
+	*recordLog
+}
+
+// openWriteAheadLog opens the log and returns the hot tier recorded in it
+func openWriteAheadLog(fs vfs.FS, dir string) (*writeAheadLog, map[string]*hotEntry, error) {
+	hot := make(map[string]*hotEntry)
+
+	opened, err := openRecordLog(fs, filepath.Join(dir, walFileName), func(line []byte) {
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return
+		}
+
+		switch {
+		case record.Op == walAdd && record.Entry != nil:
+			hot[record.Key] = &hotEntry{entry: record.Entry, addedAt: record.AddedAt}
+		case record.Op == walDelete:
+			delete(hot, record.Key)
+		case record.Op == walBatch:
+			for _, added := range record.Batch {
+				if added != nil && added.Entry != nil {
+					hot[added.Key] = &hotEntry{entry: added.Entry, addedAt: added.AddedAt}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &writeAheadLog{recordLog: opened}, hot, nil
+}
+
+// walRecords returns the records of a log holding only hot
+func walRecords(hot map[string]*hotEntry) []interface{} {
+	records := make([]interface{}, 0, len(hot))
+	for key, v := range hot {
+		records = append(records, &walRecord{Op: walAdd, Key: key, Entry: v.entry, AddedAt: v.addedAt})
+	}
+
+	return records
+}
+
+// rewriteWriteAheadLog atomically replaces the log with one holding only hot
+func rewriteWriteAheadLog(fs vfs.FS, dir string, hot map[string]*hotEntry) (*writeAheadLog, error) {
+	written, err := writeRecordLog(fs, filepath.Join(dir, walFileName), walRecords(hot))
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeAheadLog{recordLog: written}, nil
+}
+
+func (w *writeAheadLog) appendAdd(key string, v *hotEntry) error {
+	return w.append(&walRecord{Op: walAdd, Key: key, Entry: v.entry, AddedAt: v.addedAt})
+}
+
+// appendBatch adds all entries of added with a single record
+func (w *writeAheadLog) appendBatch(keys []string, added []*hotEntry) error {
+	batch := make([]*walRecord, len(keys))
+	for i, key := range keys {
+		batch[i] = &walRecord{Op: walAdd, Key: key, Entry: added[i].entry, AddedAt: added[i].addedAt}
+	}
+
+	return w.append(&walRecord{Op: walBatch, Batch: batch})
+}
+
+func (w *writeAheadLog) appendDelete(key string) error {
+	return w.append(&walRecord{Op: walDelete, Key: key})
+}
@@ -0,0 +1,282 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package validation checks incoming reports against declarative rules
+package validation
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Violation is a broken rule
+type Violation struct {
+	Field   string `json:"field"` // e.g. "stats.cpuTemp" or "labels.dc"
+	Message string `json:"message"`
+}
+
+// Rules declares constraints on the fields of a report. A rules file is YAML or JSON:
+//
+//	machineId:
+//	  ranges:
+//	    - {min: 1, max: 99999}
+//	lastLoggedIn:
+//	  required: true
+//	  pattern: "^(admin|user)/[A-Za-z]+$"
+//	metrics:
+//	  cpuTemp: {min: -50, max: 150}
+//	  gpuTemp: {required: true, max: 120}
+//	labels:
+//	  dc: {required: true, pattern: "^[a-z]+-[a-z]+-[0-9]+$"}
+type Rules struct {
+	MachineID    *MachineIDRule         `yaml:"machineId"`
+	LastLoggedIn *StringRule            `yaml:"lastLoggedIn"`
+	Metrics      map[string]*NumberRule `yaml:"metrics"` // by metric name, typed or custom
+	Labels       map[string]*StringRule `yaml:"labels"`  // by label key
+}
+
+// MachineIDRule allows only machine ids within one of the ranges
+type MachineIDRule struct {
+	Ranges []IntRange `yaml:"ranges"`
+}
+
+// IntRange includes both Min and Max
+type IntRange struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+// NumberRule constrains a metric. Typed metrics other than
+// internalTemp are always present, so Required only matters for the others
+type NumberRule struct {
+	Required bool     `yaml:"required"`
+	Min      *float64 `yaml:"min"`
+	Max      *float64 `yaml:"max"`
+}
+
+// StringRule constrains a string, an empty string counts as missing
+type StringRule struct {
+	Required  bool   `yaml:"required"`
+	Pattern   string `yaml:"pattern"`   // regular expression the whole value has to match
+	MaxLength int    `yaml:"maxLength"` // in characters, 0 means no limit
+
+	pattern *regexp.Regexp
+}
+
+// Parse reads rules from YAML or JSON, unknown keys are rejected to catch typos
+func Parse(data []byte) (*Rules, error) {
+	rules := &Rules{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(rules); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// Load reads rules from a file
+func Load(path string) (*Rules, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := Parse(contents)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+// compile checks the rules and compiles their patterns
+func (r *Rules) compile() error {
+	if r.MachineID != nil {
+		for _, idRange := range r.MachineID.Ranges {
+			if idRange.Min > idRange.Max {
+				return fmt.Errorf("machineId range has min %d greater than max %d", idRange.Min, idRange.Max)
+			}
+		}
+	}
+
+	if err := r.LastLoggedIn.compile("lastLoggedIn"); err != nil {
+		return err
+	}
+
+	for name, rule := range r.Metrics {
+		if rule == nil {
+			return fmt.Errorf("metrics.%s has no rule", name)
+		}
+
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("metrics.%s has min %v greater than max %v", name, *rule.Min, *rule.Max)
+		}
+	}
+
+	for key, rule := range r.Labels {
+		if rule == nil {
+			return fmt.Errorf("labels.%s has no rule", key)
+		}
+
+		if err := rule.compile("labels." + key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StringRule) compile(field string) error {
+	if s == nil || s.Pattern == "" {
+		return nil
+	}
+
+	pattern, err := regexp.Compile("^(?:" + s.Pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("%s has an invalid pattern: %w", field, err)
+	}
+	s.pattern = pattern
+
+	return nil
+}
+
+// Validate returns every rule entry breaks, in the order of the fields
+func (r *Rules) Validate(entry *model.MachineMetrics) []Violation {
+	violations := []Violation{}
+
+	if r.MachineID != nil && len(r.MachineID.Ranges) > 0 && !r.MachineID.allows(entry.MachineID) {
+		violations = append(violations, Violation{
+			Field:   "machineId",
+			Message: fmt.Sprintf("machineId %d is not in any of the allowed ranges", entry.MachineID),
+		})
+	}
+
+	violations = r.LastLoggedIn.validate("lastLoggedIn", entry.LastLoggedIn, violations)
+
+	for _, name := range sortedKeys(r.Metrics) {
+		rule := r.Metrics[name]
+		field := MetricField(name)
+
+		value, found := entry.Stats.Metric(name)
+		switch {
+		case !found && rule.Required:
+			violations = append(violations, Violation{Field: field, Message: field + " is required"})
+		case found && rule.Min != nil && value < *rule.Min:
+			violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("%s is %v, it has to be at least %v", field, value, *rule.Min)})
+		case found && rule.Max != nil && value > *rule.Max:
+			violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("%s is %v, it has to be at most %v", field, value, *rule.Max)})
+		}
+	}
+
+	for _, key := range sortedKeys(r.Labels) {
+		violations = r.Labels[key].validate("labels."+key, entry.Labels[key], violations)
+	}
+
+	return violations
+}
+
+// MetricField returns the path of a metric in a report, e.g. "stats.cpuTemp", "stats.custom.gpuTemp" or "stats.disks.sda.free"
+func MetricField(name string) string {
+	if model.IsTypedMetric(name) || model.IsDiskMetric(name) {
+		return "stats." + name
+	}
+
+	return "stats.custom." + name
+}
+
+func (m *MachineIDRule) allows(machineID int) bool {
+	for _, idRange := range m.Ranges {
+		if machineID >= idRange.Min && machineID <= idRange.Max {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *StringRule) validate(field string, value string, violations []Violation) []Violation {
+	if s == nil {
+		return violations
+	}
+
+	if value == "" {
+		if s.Required {
+			violations = append(violations, Violation{Field: field, Message: field + " is required"})
+		}
+		return violations
+	}
+
+	if s.MaxLength > 0 && utf8.RuneCountInString(value) > s.MaxLength {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("%s is longer than %d characters", field, s.MaxLength)})
+	}
+
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("%s %q does not match %s", field, value, s.Pattern)})
+	}
+
+	return violations
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// RulesFile holds the rules loaded from a file, which can be reloaded while they are in use
+type RulesFile struct {
+	path  string
+	rules atomic.Pointer[Rules]
+}
+
+// LoadRulesFile loads the rules from path
+func LoadRulesFile(path string) (*RulesFile, error) {
+	f := &RulesFile{path: path}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload loads the file again, the current rules stay in use if it cannot be loaded
+func (f *RulesFile) Reload() error {
+	rules, err := Load(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.rules.Store(rules)
+
+	return nil
+}
+
+// Rules returns the rules currently in use
+func (f *RulesFile) Rules() *Rules {
+	return f.rules.Load()
+}
+
+// Path returns the path of the file
+func (f *RulesFile) Path() string {
+	return f.path
+}
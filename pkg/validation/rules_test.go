@@ -0,0 +1,145 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kostik-b/metrics-store/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const yamlRules = `
+machineId:
+  ranges:
+    - {min: 1, max: 999}
+    - {min: 5000, max: 5999}
+lastLoggedIn:
+  required: true
+  pattern: "(admin|user)/[A-Za-z]+"
+metrics:
+  cpuTemp: {min: 0, max: 100}
+  gpuTemp: {required: true, max: 120}
+labels:
+  dc: {required: true, pattern: "[a-z]+-[a-z]+-[0-9]+"}
+  os: {maxLength: 5}
+`
+
+type RulesTestSuite struct {
+	suite.Suite
+	rules *Rules
+	entry *model.MachineMetrics
+}
+
+func (s *RulesTestSuite) SetupTest() {
+	var err error
+	s.rules, err = Parse([]byte(yamlRules))
+	require.Nil(s.T(), err, "Problem parsing rules")
+
+	s.entry = &model.MachineMetrics{
+		MachineID: 5123,
+		Stats: model.MetricsStats{
+			CPUTemp:  55,
+			FanSpeed: 400,
+			HDDSpace: 800,
+			Custom:   map[string]float64{"gpuTemp": 71.5},
+		},
+		LastLoggedIn: "admin/Paul",
+		Labels:       map[string]string{"dc": "eu-west-1", "os": "linux"},
+	}
+}
+
+func (s *RulesTestSuite) Test_Validate_ValidEntry_NoViolations() {
+	assert.Empty(s.T(), s.rules.Validate(s.entry), "Entry should not break any rule")
+}
+
+func (s *RulesTestSuite) Test_Validate_SeveralRulesBroken_AllReported() {
+	s.entry.MachineID = 1000
+	s.entry.LastLoggedIn = "Paul"
+	s.entry.Stats.CPUTemp = 101
+	s.entry.Stats.Custom = nil
+	s.entry.Labels = map[string]string{"os": "windows"}
+
+	assert.Equal(s.T(), []Violation{
+		{Field: "machineId", Message: "machineId 1000 is not in any of the allowed ranges"},
+		{Field: "lastLoggedIn", Message: `lastLoggedIn "Paul" does not match (admin|user)/[A-Za-z]+`},
+		{Field: "stats.cpuTemp", Message: "stats.cpuTemp is 101, it has to be at most 100"},
+		{Field: "stats.custom.gpuTemp", Message: "stats.custom.gpuTemp is required"},
+		{Field: "labels.dc", Message: "labels.dc is required"},
+		{Field: "labels.os", Message: "labels.os is longer than 5 characters"},
+	}, s.rules.Validate(s.entry), "All violations should be reported in the order of the fields")
+}
+
+func (s *RulesTestSuite) Test_Validate_PatternMatchesWholeValue() {
+	s.entry.LastLoggedIn = "admin/Paul; drop"
+
+	violations := s.rules.Validate(s.entry)
+
+	require.Len(s.T(), violations, 1, "Partial match should not be accepted")
+	assert.Equal(s.T(), "lastLoggedIn", violations[0].Field, "Field is incorrect")
+}
+
+func (s *RulesTestSuite) Test_Parse_JSON() {
+	rules, err := Parse([]byte(`{"metrics": {"fanSpeed": {"min": 100}}}`))
+	require.Nil(s.T(), err, "JSON rules should be parsed")
+
+	assert.Equal(s.T(), []Violation{
+		{Field: "stats.fanSpeed", Message: "stats.fanSpeed is 50, it has to be at least 100"},
+	}, rules.Validate(&model.MachineMetrics{Stats: model.MetricsStats{FanSpeed: 50}}), "Rule from JSON should be applied")
+}
+
+func (s *RulesTestSuite) Test_Validate_DiskMetric() {
+	rules, err := Parse([]byte(`{"metrics": {"disks.sdb.free": {"required": true, "min": 10}}}`))
+	require.Nil(s.T(), err, "Problem parsing rules")
+
+	s.entry.Stats.Disks = []model.Disk{{Device: "sda", Total: 500, Free: 5}, {Device: "sdb", Total: 4000, Free: 3}}
+
+	assert.Equal(s.T(), []Violation{
+		{Field: "stats.disks.sdb.free", Message: "stats.disks.sdb.free is 3, it has to be at least 10"},
+	}, rules.Validate(s.entry), "Rule should be applied to the named disk only")
+}
+
+func (s *RulesTestSuite) Test_Parse_EmptyRules_NothingChecked() {
+	rules, err := Parse([]byte{})
+	require.Nil(s.T(), err, "Empty rules should be parsed")
+
+	assert.Empty(s.T(), rules.Validate(&model.MachineMetrics{}), "Empty rules should not be broken")
+}
+
+func (s *RulesTestSuite) Test_Parse_InvalidRulesRejected() {
+	_, err := Parse([]byte("metrics:\n  cpuTemp: {minimum: 0}\n"))
+	assert.NotNil(s.T(), err, "Unknown key should be rejected")
+
+	_, err = Parse([]byte("lastLoggedIn: {pattern: \"(admin\"}\n"))
+	assert.NotNil(s.T(), err, "Invalid pattern should be rejected")
+
+	_, err = Parse([]byte("metrics:\n  cpuTemp: {min: 10, max: 0}\n"))
+	assert.NotNil(s.T(), err, "Min greater than max should be rejected")
+
+	_, err = Parse([]byte("machineId:\n  ranges: [{min: 10, max: 0}]\n"))
+	assert.NotNil(s.T(), err, "Empty machineId range should be rejected")
+}
+
+func (s *RulesTestSuite) Test_Reload_InvalidFile_PreviousRulesKept() {
+	path := filepath.Join(s.T().TempDir(), "rules.yaml")
+	require.Nil(s.T(), os.WriteFile(path, []byte(yamlRules), 0644), "Problem writing rules")
+
+	rulesFile, err := LoadRulesFile(path)
+	require.Nil(s.T(), err, "Problem loading rules")
+	loaded := rulesFile.Rules()
+
+	require.Nil(s.T(), os.WriteFile(path, []byte("metrics: [\n"), 0644), "Problem writing rules")
+	assert.NotNil(s.T(), rulesFile.Reload(), "Invalid file should not be loaded")
+	assert.Same(s.T(), loaded, rulesFile.Rules(), "Previous rules should be kept")
+
+	require.Nil(s.T(), os.WriteFile(path, []byte("metrics:\n  cpuTemp: {max: 10}\n"), 0644), "Problem writing rules")
+	assert.Nil(s.T(), rulesFile.Reload(), "Valid file should be loaded")
+	assert.Len(s.T(), rulesFile.Rules().Validate(s.entry), 1, "New rules should be used")
+}
+
+func TestRulesTestSuite(t *testing.T) {
+	suite.Run(t, new(RulesTestSuite))
+}
@@ -0,0 +1,607 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package faultfs provides an in-memory vfs.FS which injects I/O faults
+// and simulates crashes, only data which was made durable survives a crash
+package faultfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+)
+
+// ErrCrashed is returned by every operation after the simulated crash
+var ErrCrashed = errors.New("faultfs: crashed")
+
+// Fault is a kind of I/O fault which can be injected
+type Fault int
+
+const (
+	TornWrite     Fault = iota // a write stores only a part of the data and fails with EIO
+	NoSpace                    // a write stores only a part of the data and fails with ENOSPC
+	FailedSync                 // a sync fails with EIO, the data stays not durable
+	PartialRename              // a rename takes effect but fails with EIO
+)
+
+// AllFaults lists every kind of fault
+var AllFaults = []Fault{TornWrite, NoSpace, FailedSync, PartialRename}
+
+// inode holds the contents of a file, which may be linked under several names
+type inode struct {
+	data   []byte // what the running process sees
+	synced []byte // what was made durable by Sync
+}
+
+// dirOp links node under name or, if node is nil, unlinks name
+type dirOp struct {
+	name string
+	node *inode
+}
+
+type directory struct {
+	files   map[string]*inode // what the running process sees
+	durable map[string]*inode // what survives a crash
+	pending []dirOp           // changes since the last SyncDir, in order
+}
+
+func (d *directory) apply(op dirOp, files map[string]*inode) {
+	if op.node == nil {
+		delete(files, op.name)
+	} else {
+		files[op.name] = op.node
+	}
+}
+
+// FS is an in-memory filesystem. On a crash, the unsynced tail of every file may be
+// partially lost (torn), and every directory keeps only a random prefix of the
+// changes made since it was last synced. Directories themselves are always durable
+type FS struct {
+	mutex  sync.Mutex
+	random *rand.Rand
+
+	dirs       map[string]*directory
+	generation int // incremented by Restart, files opened before a restart are closed
+
+	operations int // number of operations since the crash point was set
+	crashAt    int // 0 means no crash point is set
+	crashed    bool
+
+	faultRate float64
+	faults    []Fault
+}
+
+// New creates an empty filesystem, seed makes the choice of faults and of the
+// data surviving a crash reproducible
+func New(seed int64) *FS {
+	return &FS{
+		random: rand.New(rand.NewSource(seed)),
+		dirs:   map[string]*directory{"/": newDirectory()},
+	}
+}
+
+func newDirectory() *directory {
+	return &directory{files: make(map[string]*inode), durable: make(map[string]*inode)}
+}
+
+// CrashAfter makes the filesystem crash on the given operation counted from now,
+// the operation and all operations after it fail with ErrCrashed
+func (f *FS) CrashAfter(operations int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.operations = 0
+	f.crashAt = operations
+}
+
+// Crash makes the filesystem crash immediately
+func (f *FS) Crash() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.crashed = true
+}
+
+// Crashed tells if the filesystem has crashed
+func (f *FS) Crashed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.crashed
+}
+
+// InjectFaults makes every operation which is subject to one of the given
+// faults fail with probability rate. A rate of 0 disables the injection
+func (f *FS) InjectFaults(rate float64, faults ...Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.faultRate = rate
+	f.faults = faults
+}
+
+// Restart simulates a reboot: only the durable state survives, open files are
+// closed, and the crash point and the fault injection are cleared
+func (f *FS) Restart() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	survived := map[*inode][]byte{}
+
+	for _, dir := range f.dirs {
+		persisted := f.random.Intn(len(dir.pending) + 1)
+		for _, op := range dir.pending[:persisted] {
+			dir.apply(op, dir.durable)
+		}
+		dir.pending = nil
+
+		dir.files = make(map[string]*inode, len(dir.durable))
+		for name, node := range dir.durable {
+			dir.files[name] = node
+
+			if _, done := survived[node]; !done {
+				survived[node] = f.survivingData(node)
+			}
+		}
+	}
+
+	for node, data := range survived {
+		node.data = data
+		node.synced = append([]byte{}, data...)
+	}
+
+	f.generation++
+	f.operations = 0
+	f.crashAt = 0
+	f.crashed = false
+	f.faultRate = 0
+	f.faults = nil
+}
+
+// survivingData returns the contents of node after a crash. Data appended
+// after the last sync survives partially, other unsynced changes survive or not
+func (f *FS) survivingData(node *inode) []byte {
+	if bytes.HasPrefix(node.data, node.synced) {
+		unsynced := len(node.data) - len(node.synced)
+		return append([]byte{}, node.data[:len(node.synced)+f.random.Intn(unsynced+1)]...)
+	}
+
+	if f.random.Intn(2) == 0 {
+		return append([]byte{}, node.synced...)
+	}
+
+	return append([]byte{}, node.data...)
+}
+
+// step counts an operation and tells if it has to fail because of a crash
+func (f *FS) step() error {
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	f.operations++
+	if f.crashAt > 0 && f.operations >= f.crashAt {
+		f.crashed = true
+		return ErrCrashed
+	}
+
+	return nil
+}
+
+// inject tells which of the candidate faults, if any, the current operation suffers
+func (f *FS) inject(candidates ...Fault) (Fault, bool) {
+	if f.faultRate <= 0 || f.random.Float64() >= f.faultRate {
+		return 0, false
+	}
+
+	enabled := []Fault{}
+	for _, candidate := range candidates {
+		for _, fault := range f.faults {
+			if candidate == fault {
+				enabled = append(enabled, candidate)
+			}
+		}
+	}
+
+	if len(enabled) == 0 {
+		return 0, false
+	}
+
+	return enabled[f.random.Intn(len(enabled))], true
+}
+
+// lookup returns the directory of path and the name of path in it
+func (f *FS) lookup(op string, path string) (*directory, string, error) {
+	path = filepath.Clean(path)
+
+	dir, found := f.dirs[filepath.Dir(path)]
+	if !found {
+		return nil, "", &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+
+	return dir, filepath.Base(path), nil
+}
+
+func (f *FS) link(dir *directory, name string, node *inode) {
+	op := dirOp{name: name, node: node}
+	dir.apply(op, dir.files)
+	dir.pending = append(dir.pending, op)
+}
+
+// OpenFile supports the O_RDONLY, O_WRONLY, O_RDWR, O_APPEND, O_CREATE, O_EXCL and O_TRUNC flags
+func (f *FS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	dir, base, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	node, exists := dir.files[base]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !exists:
+		node = &inode{}
+		f.link(dir, base, node)
+	}
+
+	accessMode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+
+	opened := &file{
+		fs:         f,
+		name:       name,
+		node:       node,
+		generation: f.generation,
+		readable:   accessMode != os.O_WRONLY,
+		writable:   accessMode != os.O_RDONLY,
+		appendMode: flag&os.O_APPEND != 0,
+	}
+
+	if opened.writable && flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+
+	return opened, nil
+}
+
+// Rename moves oldpath to newpath, replacing newpath if it exists
+func (f *FS) Rename(oldpath, newpath string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	oldDir, oldBase, err := f.lookup("rename", oldpath)
+	if err != nil {
+		return err
+	}
+
+	newDir, newBase, err := f.lookup("rename", newpath)
+	if err != nil {
+		return err
+	}
+
+	node, exists := oldDir.files[oldBase]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+
+	// a crash can persist the link without the unlink, leaving the file under both names
+	f.link(newDir, newBase, node)
+	f.link(oldDir, oldBase, nil)
+
+	if _, faulty := f.inject(PartialRename); faulty {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EIO}
+	}
+
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	dir, base, err := f.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+
+	if _, exists := dir.files[base]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+
+	f.link(dir, base, nil)
+
+	return nil
+}
+
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	if _, isDir := f.dirs[filepath.Clean(name)]; isDir {
+		return &fileInfo{name: filepath.Base(name), isDir: true}, nil
+	}
+
+	dir, base, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	node, exists := dir.files[base]
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return &fileInfo{name: base, size: int64(len(node.data))}, nil
+}
+
+// MkdirAll creates path and its parents, directories are durable right away
+func (f *FS) MkdirAll(path string, perm os.FileMode) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	for path = filepath.Clean(path); ; path = filepath.Dir(path) {
+		if _, exists := f.dirs[path]; !exists {
+			f.dirs[path] = newDirectory()
+		}
+
+		if path == filepath.Dir(path) {
+			return nil
+		}
+	}
+}
+
+// ReadDir returns the sorted names of the files in dirname, subdirectories are not listed
+func (f *FS) ReadDir(dirname string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: err}
+	}
+
+	dir, found := f.dirs[filepath.Clean(dirname)]
+	if !found {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: os.ErrNotExist}
+	}
+
+	names := make([]string, 0, len(dir.files))
+	for name := range dir.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// SyncDir makes all creations, renames and removals of files in dirname durable
+func (f *FS) SyncDir(dirname string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.step(); err != nil {
+		return &os.PathError{Op: "sync", Path: dirname, Err: err}
+	}
+
+	dir, found := f.dirs[filepath.Clean(dirname)]
+	if !found {
+		return &os.PathError{Op: "sync", Path: dirname, Err: os.ErrNotExist}
+	}
+
+	if _, faulty := f.inject(FailedSync); faulty {
+		return &os.PathError{Op: "sync", Path: dirname, Err: syscall.EIO}
+	}
+
+	for _, op := range dir.pending {
+		dir.apply(op, dir.durable)
+	}
+	dir.pending = nil
+
+	return nil
+}
+
+// file is an open file of FS
+type file struct {
+	fs         *FS
+	name       string
+	node       *inode
+	generation int
+	offset     int64
+
+	readable   bool
+	writable   bool
+	appendMode bool
+	closed     bool
+}
+
+// begin locks the filesystem and checks that the file can still be used
+func (f *file) begin(op string) error {
+	f.fs.mutex.Lock()
+
+	if f.closed || f.generation != f.fs.generation {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+
+	if err := f.fs.step(); err != nil {
+		return &os.PathError{Op: op, Path: f.name, Err: err}
+	}
+
+	return nil
+}
+
+func (f *file) end() {
+	f.fs.mutex.Unlock()
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	defer f.end()
+	if err := f.begin("read"); err != nil {
+		return 0, err
+	}
+
+	if !f.readable {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	defer f.end()
+	if err := f.begin("write"); err != nil {
+		return 0, err
+	}
+
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+
+	if f.appendMode {
+		f.offset = int64(len(f.node.data))
+	}
+
+	var err error
+	if fault, faulty := f.fs.inject(TornWrite, NoSpace); faulty {
+		p = p[:f.fs.random.Intn(len(p)+1)]
+
+		err = &os.PathError{Op: "write", Path: f.name, Err: syscall.EIO}
+		if fault == NoSpace {
+			err = &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		}
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+
+	return len(p), err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	defer f.end()
+	if err := f.begin("seek"); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Sync() error {
+	defer f.end()
+	if err := f.begin("sync"); err != nil {
+		return err
+	}
+
+	if _, faulty := f.fs.inject(FailedSync); faulty {
+		return &os.PathError{Op: "sync", Path: f.name, Err: syscall.EIO}
+	}
+
+	f.node.synced = append([]byte{}, f.node.data...)
+
+	return nil
+}
+
+func (f *file) Truncate(size int64) error {
+	defer f.end()
+	if err := f.begin("truncate"); err != nil {
+		return err
+	}
+
+	if !f.writable || size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+
+	return nil
+}
+
+// Close always succeeds, so that files can be closed after a crash
+func (f *file) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+
+	return nil
+}
+
+// fileInfo implements os.FileInfo
+type fileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return time.Time{} }
+func (i *fileInfo) IsDir() bool        { return i.isDir }
+func (i *fileInfo) Sys() interface{}   { return nil }
+
+func (i *fileInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
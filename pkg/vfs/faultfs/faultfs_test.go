@@ -0,0 +1,192 @@
+package faultfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/kostik-b/metrics-store/pkg/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFS(t *testing.T) *FS {
+	fs := New(1)
+	require.Nil(t, fs.MkdirAll("/data", 0755), "Problem creating directory")
+	return fs
+}
+
+// writeFile writes contents to name, syncing the file if sync is set
+func writeFile(t *testing.T, fs *FS, name string, contents string, sync bool) {
+	file, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err, "Problem opening file")
+	defer file.Close()
+
+	_, err = file.Write([]byte(contents))
+	require.Nil(t, err, "Problem writing file")
+
+	if sync {
+		require.Nil(t, file.Sync(), "Problem syncing file")
+	}
+}
+
+func Test_OpenFile_Flags(t *testing.T) {
+	fs := newFS(t)
+
+	_, err := fs.OpenFile("/data/file", os.O_RDONLY, 0)
+	assert.True(t, os.IsNotExist(err), "File should not exist")
+
+	_, err = fs.OpenFile("/missing/file", os.O_CREATE|os.O_WRONLY, 0644)
+	assert.True(t, os.IsNotExist(err), "Directory should not exist")
+
+	writeFile(t, fs, "/data/file", "hello", false)
+
+	_, err = fs.OpenFile("/data/file", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	assert.True(t, os.IsExist(err), "File should exist")
+
+	contents, err := vfs.ReadFile(fs, "/data/file")
+	assert.Nil(t, err, "Problem reading file")
+	assert.Equal(t, "hello", string(contents), "Unexpected contents")
+
+	file, err := fs.OpenFile("/data/file", os.O_WRONLY|os.O_TRUNC, 0)
+	require.Nil(t, err, "Problem opening file")
+	file.Close()
+
+	info, err := fs.Stat("/data/file")
+	assert.Nil(t, err, "Problem getting file info")
+	assert.Equal(t, int64(0), info.Size(), "File should be truncated")
+}
+
+func Test_Restart_SyncedDataSurvives(t *testing.T) {
+	fs := newFS(t)
+	writeFile(t, fs, "/data/file", "synced", true)
+	require.Nil(t, fs.SyncDir("/data"), "Problem syncing directory")
+
+	fs.Crash()
+	fs.Restart()
+
+	contents, err := vfs.ReadFile(fs, "/data/file")
+	assert.Nil(t, err, "Problem reading file")
+	assert.Equal(t, "synced", string(contents), "Synced data should survive")
+}
+
+func Test_Restart_UnsyncedAppendIsTorn(t *testing.T) {
+	lengths := map[int]bool{}
+
+	for seed := int64(0); seed < 50; seed++ {
+		fs := New(seed)
+		require.Nil(t, fs.MkdirAll("/data", 0755), "Problem creating directory")
+		writeFile(t, fs, "/data/file", "synced", true)
+		require.Nil(t, fs.SyncDir("/data"), "Problem syncing directory")
+		writeFile(t, fs, "/data/file", "-unsynced", false)
+
+		fs.Restart()
+
+		contents, err := vfs.ReadFile(fs, "/data/file")
+		require.Nil(t, err, "Problem reading file")
+		assert.Equal(t, "synced-unsynced"[:len(contents)], string(contents), "Only a prefix should survive")
+		assert.GreaterOrEqual(t, len(contents), len("synced"), "Synced data should survive")
+
+		lengths[len(contents)] = true
+	}
+
+	assert.Greater(t, len(lengths), 2, "Different parts of the unsynced data should survive")
+}
+
+func Test_Restart_UnsyncedRenameMayBeLost(t *testing.T) {
+	outcomes := map[string]bool{}
+
+	for seed := int64(0); seed < 50; seed++ {
+		fs := New(seed)
+		require.Nil(t, fs.MkdirAll("/data", 0755), "Problem creating directory")
+		writeFile(t, fs, "/data/file.tmp", "contents", true)
+		require.Nil(t, fs.SyncDir("/data"), "Problem syncing directory")
+		require.Nil(t, fs.Rename("/data/file.tmp", "/data/file"), "Problem renaming")
+
+		fs.Restart()
+
+		names, err := fs.ReadDir("/data")
+		require.Nil(t, err, "Problem reading directory")
+		outcomes[strings.Join(names, ",")] = true
+	}
+
+	// the rename is lost, persisted only partially or persisted completely
+	assert.Equal(t, map[string]bool{"file.tmp": true, "file,file.tmp": true, "file": true}, outcomes,
+		"Unexpected outcomes of a rename without a directory sync")
+}
+
+func Test_Restart_SyncedRenameSurvives(t *testing.T) {
+	fs := newFS(t)
+	writeFile(t, fs, "/data/file.tmp", "contents", true)
+	require.Nil(t, fs.Rename("/data/file.tmp", "/data/file"), "Problem renaming")
+	require.Nil(t, fs.SyncDir("/data"), "Problem syncing directory")
+
+	fs.Restart()
+
+	names, err := fs.ReadDir("/data")
+	assert.Nil(t, err, "Problem reading directory")
+	assert.Equal(t, []string{"file"}, names, "Rename should survive")
+}
+
+func Test_CrashAfter_OperationsFailFromCrashPoint(t *testing.T) {
+	fs := newFS(t)
+	file, err := fs.OpenFile("/data/file", os.O_CREATE|os.O_WRONLY, 0644)
+	require.Nil(t, err, "Problem opening file")
+
+	fs.CrashAfter(2)
+
+	_, err = file.Write([]byte("a"))
+	assert.Nil(t, err, "First write should succeed")
+	assert.False(t, fs.Crashed(), "Filesystem should not have crashed yet")
+
+	_, err = file.Write([]byte("b"))
+	assert.True(t, errors.Is(err, ErrCrashed), "Second write should crash")
+	assert.True(t, fs.Crashed(), "Filesystem should have crashed")
+
+	_, err = fs.ReadDir("/data")
+	assert.True(t, errors.Is(err, ErrCrashed), "Operations after the crash should fail")
+
+	fs.Restart()
+
+	_, err = file.Write([]byte("c"))
+	assert.True(t, errors.Is(err, os.ErrClosed), "Files opened before the restart should be closed")
+
+	_, err = fs.ReadDir("/data")
+	assert.Nil(t, err, "Operations after the restart should succeed")
+}
+
+func Test_InjectFaults_WritesAndSyncsFail(t *testing.T) {
+	fs := newFS(t)
+	file, err := fs.OpenFile("/data/file", os.O_CREATE|os.O_WRONLY, 0644)
+	require.Nil(t, err, "Problem opening file")
+
+	fs.InjectFaults(1, NoSpace, FailedSync)
+
+	n, err := file.Write([]byte("contents"))
+	assert.True(t, errors.Is(err, syscall.ENOSPC), "Write should fail with ENOSPC")
+	assert.Less(t, n, len("contents"), "Only a part should be written")
+
+	assert.True(t, errors.Is(file.Sync(), syscall.EIO), "Sync should fail")
+
+	fs.InjectFaults(0)
+
+	_, err = file.Write([]byte("contents"))
+	assert.Nil(t, err, "Write should succeed without fault injection")
+}
+
+func Test_InjectFaults_PartialRenameTakesEffect(t *testing.T) {
+	fs := newFS(t)
+	writeFile(t, fs, "/data/file.tmp", "contents", true)
+
+	fs.InjectFaults(1, PartialRename)
+
+	err := fs.Rename("/data/file.tmp", "/data/file")
+	assert.True(t, errors.Is(err, syscall.EIO), "Rename should fail")
+
+	names, err := fs.ReadDir("/data")
+	assert.Nil(t, err, "Problem reading directory")
+	assert.Equal(t, []string{"file"}, names, "Rename should have taken effect")
+}
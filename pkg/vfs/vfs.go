@@ -0,0 +1,101 @@
+// Copyright Konstantin Bakanov 2023
+
+// Package vfs abstracts the filesystem calls used by persisted datastores,
+// so that they can be run against a fault-injecting filesystem in tests
+package vfs
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// File is the subset of *os.File used by datastores
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Seek(offset int64, whence int) (int64, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is the subset of the os package used by datastores.
+// Creating, renaming or removing a file is only durable once SyncDir
+// is called for the directory the file is in
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(dirname string) ([]string, error) // sorted names of the directory entries
+	SyncDir(dirname string) error
+}
+
+// OS is the FS backed by the real filesystem
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoid returning a non-nil interface holding a nil *os.File
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(dirname string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		names = append(names, dirEntry.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (osFS) SyncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// ReadFile reads the whole file, like os.ReadFile
+func ReadFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
@@ -0,0 +1 @@
+curl -i http://localhost:4000/metrics/$1